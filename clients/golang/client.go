@@ -1,7 +1,10 @@
 package hypercache
 
 import (
+	"context"
 	"encoding/binary"
+	"io"
+	"math"
 	"net"
 	"sync"
 	"sync/atomic"
@@ -18,19 +21,32 @@ type hnpConn struct {
 	replies   map[uint32]func(error)
 	repliesMu sync.Mutex
 
-	events   []chan []byte
-	eventsMu sync.RWMutex
+	// Defines the handlers for each subscription and keyspace prefix. subscribeMu is held whilst subscriptions are
+	// changed on the server, and subsMu whilst the maps are used.
+	subs         map[subscription][]chan Event
+	keyspaceSubs map[string]*keyspaceSubscription
+	subsMu       sync.RWMutex
+	subscribeMu  sync.Mutex
+
+	// Defines the handlers for events sent with the deprecated SendEvent. These are also guarded by subsMu.
+	events []chan []byte
 
 	lastErr   error
 	lastErrMu sync.RWMutex
-}
 
-// AddEventHandler is used to add a handler for custom events.
-// Note that the bytes should not be mutated.
-func (h *hnpConn) AddEventHandler(ch chan []byte) {
-	h.eventsMu.Lock()
-	h.events = append(h.events, ch)
-	h.eventsMu.Unlock()
+	// Defines how to reconnect. This is nil if the connection does not reconnect.
+	reconnect *reconnector
+
+	// Defines the number of mutexes the connection holds, including the global mutex.
+	mutexesHeld int32
+
+	// Defines the name the connection was given with SetClientName. This is a string, and is not set if it was not
+	// given one.
+	clientName atomic.Value
+
+	// Closed when the connection is closed with Close.
+	closeCh   chan struct{}
+	closeOnce sync.Once
 }
 
 func (h *hnpConn) getConnectionError() error {
@@ -40,8 +56,24 @@ func (h *hnpConn) getConnectionError() error {
 	return err
 }
 
-// Ping is used to ping the server.
-func (h *hnpConn) Ping() error {
+// reply is the result of a request along with any error.
+type reply[T any] struct {
+	value T
+	err   error
+}
+
+// request is used to send a packet with the opcode and body specified and wait for the reply. If the server does not
+// raise an exception, read is called from the read loop to consume the result. It can be nil if there is no result.
+// If the context is done before the reply, the reply is left to a handler which drains it so the connection stays
+// in sync, and the context error is returned.
+func request[T any](
+	ctx context.Context, h *hnpConn, op byte, body []byte, read func() (T, error),
+) (value T, err error) {
+	// Check if the context is already done.
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
 	// Get the reply ID.
 	replyId := h.replyId()
 
@@ -49,186 +81,796 @@ func (h *hnpConn) Ping() error {
 	h.repliesMu.Lock()
 
 	// Check if there was a connection error.
-	err := h.getConnectionError()
+	err = h.getConnectionError()
 	if err != nil {
 		h.repliesMu.Unlock()
-		return err
+		return
 	}
 
-	// Defines the error channel.
-	errorCh := make(chan error, 1)
+	// Defines the reply channel.
+	replyCh := make(chan reply[T], 1)
 	b := packetmaker.New().
 		Uint32(replyId, true).
-		Uint32(1, true).
-		Byte(0).
+		Uint32(uint32(len(body)+1), true).
+		Byte(op).
+		Bytes(body).
 		Make()
-	h.replies[replyId] = func(err error) { errorCh <- err }
+	h.replies[replyId] = func(err error) {
+		// Read the result if the error is nil.
+		res := reply[T]{err: err}
+		if err == nil && read != nil {
+			res.value, res.err = read()
+		}
+		replyCh <- res
+	}
+	c := h.c
 	h.repliesMu.Unlock()
-	_, err = h.c.Write(b)
+	_, err = c.Write(b)
 	if err != nil {
-		return err
+		h.repliesMu.Lock()
+		delete(h.replies, replyId)
+		h.repliesMu.Unlock()
+		return
 	}
 
-	// Return any errors.
-	return <-errorCh
+	// Wait for the reply or the context.
+	select {
+	case res := <-replyCh:
+		return res.value, res.err
+	case <-ctx.Done():
+	}
+
+	// Swap our handler for one which drains the reply. If it is gone, the reply is already being read, so wait for it.
+	h.repliesMu.Lock()
+	_, pending := h.replies[replyId]
+	if pending {
+		body = append([]byte(nil), body...)
+		h.replies[replyId] = func(err error) {
+			var value T
+			if err == nil && read != nil {
+				value, err = read()
+			}
+			if err == nil {
+				h.abandoned(op, body, value)
+			}
+		}
+	}
+	h.repliesMu.Unlock()
+	if !pending {
+		res := <-replyCh
+		return res.value, res.err
+	}
+	return value, ctx.Err()
+}
+
+// abandoned is used to unlock a lock which the server gave out after the request for it was given up on.
+func (h *hnpConn) abandoned(op byte, body []byte, value any) {
+	switch op {
+	case 7:
+		go func() { _, _ = request[struct{}](context.Background(), h, 8, nil, nil) }()
+	case 21:
+		go func() { _, _ = request[struct{}](context.Background(), h, 22, body[8:], nil) }()
+	case 23:
+		if token, _ := value.(uint64); token != 0 {
+			go func() { _, _ = request[struct{}](context.Background(), h, 22, body[8:], nil) }()
+		}
+	case 24:
+		if token, _ := value.(uint64); token != 0 {
+			go func() { _, _ = request[struct{}](context.Background(), h, 22, body[16:], nil) }()
+		}
+	case 26:
+		if token, _ := value.(uint64); token != 0 {
+			go func() { _, _ = request[struct{}](context.Background(), h, 27, body[17:], nil) }()
+		}
+	case 28:
+		if token, _ := value.(uint64); token != 0 {
+			go func() { _, _ = request[struct{}](context.Background(), h, 29, body[20:], nil) }()
+		}
+	}
+}
+
+// Ping is used to ping the server.
+func (h *hnpConn) Ping() error {
+	return h.PingContext(context.Background())
+}
+
+// PingContext is used to ping the server.
+func (h *hnpConn) PingContext(ctx context.Context) error {
+	_, err := request[struct{}](ctx, h, 0, nil, nil)
+	return err
 }
 
 // Get is used to get a record.
 func (h *hnpConn) Get(key []byte) ([]byte, error) {
-	// Get the reply ID.
-	replyId := h.replyId()
+	return h.GetContext(context.Background(), key)
+}
 
-	// Lock the replies map.
-	h.repliesMu.Lock()
+// GetContext is used to get a record.
+func (h *hnpConn) GetContext(ctx context.Context, key []byte) ([]byte, error) {
+	return request(ctx, h, 1, key, h.readBytes)
+}
 
-	// Check if there was a connection error.
-	err := h.getConnectionError()
+// readUint32 is used to read a little endian uint32 from the connection.
+func (h *hnpConn) readUint32() (uint32, error) {
+	b := make([]byte, 4)
+	_, err := io.ReadFull(h.c, b)
+	return binary.LittleEndian.Uint32(b), err
+}
+
+// readUint64 is used to read a little endian uint64 from the connection.
+func (h *hnpConn) readUint64() (uint64, error) {
+	b := make([]byte, 8)
+	_, err := io.ReadFull(h.c, b)
+	return binary.LittleEndian.Uint64(b), err
+}
+
+// readBytes is used to read a length prefixed byte slice from the connection.
+func (h *hnpConn) readBytes() ([]byte, error) {
+	l, err := h.readUint32()
 	if err != nil {
-		h.repliesMu.Unlock()
 		return nil, err
 	}
+	b := make([]byte, l)
+	_, err = io.ReadFull(h.c, b)
+	return b, err
+}
 
-	// Defines the error channel.
-	errorCh := make(chan error, 1)
-	b := packetmaker.New().
-		Uint32(replyId, true).
-		Uint32(uint32(len(key)+1), true).
-		Byte(1).
-		Bytes(key).
-		Make()
-	var value []byte
-	h.replies[replyId] = func(err error) {
-		// Handle if the error isn't nil.
-		if err != nil {
-			errorCh <- err
-			return
+// readBool is used to read a length prefixed boolean from the connection.
+func (h *hnpConn) readBool() (bool, error) {
+	b, err := h.readBytes()
+	if err != nil {
+		return false, err
+	}
+	return len(b) == 1 && b[0] == 1, nil
+}
+
+// readRecords is used to read a count followed by that many records from the connection.
+func (h *hnpConn) readRecords() ([]Record, error) {
+	count, err := h.readUint32()
+	if err != nil {
+		return nil, err
+	}
+	var records []Record
+	for i := uint32(0); i < count; i++ {
+		var r Record
+		if r.Key, err = h.readBytes(); err != nil {
+			return nil, err
 		}
+		if r.Value, err = h.readBytes(); err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	return records, nil
+}
 
-		// Use the first 4 bytes of the old packet.
-		fb := b[:4]
-		_, err = h.c.Read(fb)
+// readLocks is used to read the locks from a lock list.
+func (h *hnpConn) readLocks() ([]Lock, error) {
+	count, err := h.readUint32()
+	if err != nil {
+		return nil, err
+	}
+	locks := make([]Lock, count)
+	for i := range locks {
+		l := &locks[i]
+		kind := []byte{0}
+		if _, err = io.ReadFull(h.c, kind); err != nil {
+			return nil, err
+		}
+		l.Kind = LockKind(kind[0])
+		if l.Name, err = h.readBytes(); err != nil {
+			return nil, err
+		}
+		if l.Waiters, err = h.readUint32(); err != nil {
+			return nil, err
+		}
+		holders, err := h.readUint32()
 		if err != nil {
-			errorCh <- err
-			return
+			return nil, err
 		}
+		l.Holders = make([]LockHolder, holders)
+		for j := range l.Holders {
+			holder := &l.Holders[j]
+			b := make([]byte, 17)
+			if _, err = io.ReadFull(h.c, b); err != nil {
+				return nil, err
+			}
+			holder.Token = binary.LittleEndian.Uint64(b)
+			holder.Shared = b[8] == 1
+			holder.Acquired = time.UnixMilli(int64(binary.LittleEndian.Uint64(b[9:])))
+			addr, err := h.readBytes()
+			if err != nil {
+				return nil, err
+			}
+			holder.Addr = string(addr)
+			clientName, err := h.readBytes()
+			if err != nil {
+				return nil, err
+			}
+			holder.ClientName = string(clientName)
+		}
+	}
+	return locks, nil
+}
+
+// Set is used to set a record. Returns true if it overwrote a record.
+func (h *hnpConn) Set(key, value []byte) (overwrote bool, err error) {
+	return h.SetContext(context.Background(), key, value)
+}
+
+// SetContext is used to set a record. Returns true if it overwrote a record.
+func (h *hnpConn) SetContext(ctx context.Context, key, value []byte) (overwrote bool, err error) {
+	body := packetmaker.New().
+		Uint32(uint32(len(key)), true).
+		Bytes(key).
+		Bytes(value).
+		Make()
+	return request(ctx, h, 3, body, h.readBool)
+}
+
+// SetFenced is used to set a record if the fencing token is at least the highest token the record was set with.
+// Returns false if the token is stale.
+func (h *hnpConn) SetFenced(key, value []byte, token uint64) (written bool, err error) {
+	return h.SetFencedContext(context.Background(), key, value, token)
+}
+
+// SetFencedContext is used to set a record if the fencing token is at least the highest token the record was set
+// with. Returns false if the token is stale.
+func (h *hnpConn) SetFencedContext(ctx context.Context, key, value []byte, token uint64) (written bool, err error) {
+	body := packetmaker.New().
+		Byte(5).
+		Uint32(uint32(len(key)), true).
+		Bytes(key).
+		Uint64(0, true).
+		Uint64(token, true).
+		Uint32(0, true).
+		Bytes(value).
+		Make()
+	version, err := request(ctx, h, 16, body, h.readUint64)
+	return version != 0, err
+}
 
-		// Get it as an uint32.
-		packetLen := binary.LittleEndian.Uint32(fb)
+// Delete is used to delete a record. Returns true if the record existed.
+func (h *hnpConn) Delete(key []byte) (deleted bool, err error) {
+	return h.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext is used to delete a record. Returns true if the record existed.
+func (h *hnpConn) DeleteContext(ctx context.Context, key []byte) (deleted bool, err error) {
+	return request(ctx, h, 2, key, h.readBool)
+}
 
-		// Consume these bytes.
-		value = make([]byte, packetLen)
-		_, err = h.c.Read(value)
-		errorCh <- err
+// DeletePrefix is used to delete every record starting with the prefix. Returns the number of nodes removed from
+// the tree.
+func (h *hnpConn) DeletePrefix(prefix []byte) (removed uint64, err error) {
+	return h.DeletePrefixContext(context.Background(), prefix)
+}
+
+// DeletePrefixContext is used to delete every record starting with the prefix. Returns the number of nodes removed
+// from the tree.
+func (h *hnpConn) DeletePrefixContext(ctx context.Context, prefix []byte) (removed uint64, err error) {
+	return request(ctx, h, 5, prefix, h.readUint64)
+}
+
+// page is a page of records from a walk along with the cursor for the next page.
+type page struct {
+	records []Record
+	next    []byte
+}
+
+// readPage is used to read if there is another page, the cursor for it and the records in this page.
+func (h *hnpConn) readPage() (p page, err error) {
+	more := []byte{0}
+	if _, err = io.ReadFull(h.c, more); err != nil {
+		return
 	}
-	h.repliesMu.Unlock()
-	_, err = h.c.Write(b)
+	cursor, err := h.readBytes()
 	if err != nil {
-		return nil, err
+		return
 	}
+	if more[0] == 1 {
+		p.next = cursor
+	}
+	p.records, err = h.readRecords()
+	return
+}
 
-	// Return any errors.
-	err = <-errorCh
-	return value, err
+// walkPages is used to get the records from every page of a walk, starting with no cursor.
+func walkPages(page func(cursor []byte) (records []Record, next []byte, err error)) ([]Record, error) {
+	var records []Record
+	var cursor []byte
+	for {
+		p, next, err := page(cursor)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, p...)
+		if next == nil {
+			return records, nil
+		}
+		cursor = next
+	}
 }
 
-// MutexLock is used to lock a global mutex.
-func (h *hnpConn) MutexLock() error {
-	// Get the reply ID.
-	replyId := h.replyId()
+// WalkPrefix is used to get every record starting with the prefix in byte order. The records are fetched a page at a
+// time.
+func (h *hnpConn) WalkPrefix(prefix []byte) ([]Record, error) {
+	return h.WalkPrefixContext(context.Background(), prefix)
+}
 
-	// Lock the replies map.
-	h.repliesMu.Lock()
+// WalkPrefixContext is used to get every record starting with the prefix in byte order. The records are fetched a
+// page at a time.
+func (h *hnpConn) WalkPrefixContext(ctx context.Context, prefix []byte) ([]Record, error) {
+	return walkPages(func(cursor []byte) ([]Record, []byte, error) {
+		return h.WalkPrefixPageContext(ctx, prefix, cursor, 0)
+	})
+}
 
-	// Check if there was a connection error.
-	err := h.getConnectionError()
-	if err != nil {
-		h.repliesMu.Unlock()
-		return err
+// WalkPrefixPage is used to get up to limit records starting with the prefix in byte order. The server caps the limit
+// to 10000, which is also used if it is 0. If the cursor is not nil, the walk resumes after it. The cursor for the next
+// page is returned, or nil if there are no more records.
+func (h *hnpConn) WalkPrefixPage(prefix, cursor []byte, limit int) (records []Record, next []byte, err error) {
+	return h.WalkPrefixPageContext(context.Background(), prefix, cursor, limit)
+}
+
+// WalkPrefixPageContext is used to get up to limit records starting with the prefix in byte order. The server caps
+// the limit to 10000, which is also used if it is 0. If the cursor is not nil, the walk resumes after it. The cursor
+// for the next page is returned, or nil if there are no more records.
+func (h *hnpConn) WalkPrefixPageContext(
+	ctx context.Context, prefix, cursor []byte, limit int,
+) (records []Record, next []byte, err error) {
+	if limit < 0 {
+		limit = 0
+	}
+	m := packetmaker.New().
+		Uint32(uint32(limit), true).
+		Uint32(uint32(len(prefix)), true).
+		Bytes(prefix)
+	if cursor != nil {
+		m.Byte(1).Uint32(uint32(len(cursor)), true).Bytes(cursor)
 	}
+	p, err := request(ctx, h, 15, m.Make(), h.readPage)
+	return p.records, p.next, err
+}
 
-	// Defines the error channel.
-	errorCh := make(chan error, 1)
-	b := packetmaker.New().
-		Uint32(replyId, true).
-		Uint32(1, true).
-		Byte(7).
+// WalkRange is used to get every record from start (inclusive) to end (exclusive) in byte order, or in descending byte
+// order if reverse is true. An empty end means there is no end. The records are fetched a page at a time.
+func (h *hnpConn) WalkRange(start, end []byte, reverse bool) ([]Record, error) {
+	return h.WalkRangeContext(context.Background(), start, end, reverse)
+}
+
+// WalkRangeContext is used to get every record from start (inclusive) to end (exclusive) in byte order, or in
+// descending byte order if reverse is true. An empty end means there is no end. The records are fetched a page at a
+// time.
+func (h *hnpConn) WalkRangeContext(ctx context.Context, start, end []byte, reverse bool) ([]Record, error) {
+	return walkPages(func(cursor []byte) ([]Record, []byte, error) {
+		return h.WalkRangePageContext(ctx, start, end, reverse, cursor, 0)
+	})
+}
+
+// WalkRangePage is used to get up to limit records from start (inclusive) to end (exclusive), in descending byte order
+// if reverse is true. The server caps the limit to 10000, which is also used if it is 0. If the cursor is not nil, the
+// walk resumes after it. The cursor for the next page is returned, or nil if there are no more records.
+func (h *hnpConn) WalkRangePage(
+	start, end []byte, reverse bool, cursor []byte, limit int,
+) (records []Record, next []byte, err error) {
+	return h.WalkRangePageContext(context.Background(), start, end, reverse, cursor, limit)
+}
+
+// WalkRangePageContext is used to get up to limit records from start (inclusive) to end (exclusive), in descending
+// byte order if reverse is true. The server caps the limit to 10000, which is also used if it is 0. If the cursor is
+// not nil, the walk resumes after it. The cursor for the next page is returned, or nil if there are no more records.
+func (h *hnpConn) WalkRangePageContext(
+	ctx context.Context, start, end []byte, reverse bool, cursor []byte, limit int,
+) (records []Record, next []byte, err error) {
+	if limit < 0 {
+		limit = 0
+	}
+	reverseByte := byte(0)
+	if reverse {
+		reverseByte = 1
+	}
+	m := packetmaker.New().
+		Uint32(uint32(limit), true).
+		Byte(reverseByte).
+		Uint32(uint32(len(start)), true).
+		Bytes(start).
+		Uint32(uint32(len(end)), true).
+		Bytes(end)
+	if cursor != nil {
+		m.Byte(1).Bytes(cursor)
+	}
+	p, err := request(ctx, h, 14, m.Make(), h.readPage)
+	return p.records, p.next, err
+}
+
+// FreeTree is used to delete every record in the database.
+func (h *hnpConn) FreeTree() error {
+	return h.FreeTreeContext(context.Background())
+}
+
+// FreeTreeContext is used to delete every record in the database.
+func (h *hnpConn) FreeTreeContext(ctx context.Context) error {
+	_, err := request[struct{}](ctx, h, 4, nil, nil)
+	return err
+}
+
+func (h *hnpConn) increment(ctx context.Context, op byte, key []byte, delta uint64) (uint64, error) {
+	body := packetmaker.New().
+		Uint64(delta, true).
+		Bytes(key).
 		Make()
-	h.replies[replyId] = func(err error) { errorCh <- err }
-	h.repliesMu.Unlock()
-	_, err = h.c.Write(b)
-	if err != nil {
-		return err
+	return request(ctx, h, op, body, h.readUint64)
+}
+
+// Increment is used to atomically add to a record as a 64-bit integer. Records which do not exist count as 0.
+func (h *hnpConn) Increment(key []byte, delta int64) (int64, error) {
+	return h.IncrementContext(context.Background(), key, delta)
+}
+
+// IncrementContext is used to atomically add to a record as a 64-bit integer. Records which do not exist count as 0.
+func (h *hnpConn) IncrementContext(ctx context.Context, key []byte, delta int64) (int64, error) {
+	res, err := h.increment(ctx, 18, key, uint64(delta))
+	return int64(res), err
+}
+
+// Decrement is used to atomically subtract from a record as a 64-bit integer. Records which do not exist count as 0.
+// The delta cannot be math.MinInt64, since it cannot be negated.
+func (h *hnpConn) Decrement(key []byte, delta int64) (int64, error) {
+	return h.DecrementContext(context.Background(), key, delta)
+}
+
+// DecrementContext is used to atomically subtract from a record as a 64-bit integer. Records which do not exist
+// count as 0. The delta cannot be math.MinInt64, since it cannot be negated.
+func (h *hnpConn) DecrementContext(ctx context.Context, key []byte, delta int64) (int64, error) {
+	if delta == math.MinInt64 {
+		return 0, errDecrementOverflow
+	}
+	return h.IncrementContext(ctx, key, -delta)
+}
+
+// IncrementFloat is used to atomically add to a record as a float. Records which do not exist count as 0.
+func (h *hnpConn) IncrementFloat(key []byte, delta float64) (float64, error) {
+	return h.IncrementFloatContext(context.Background(), key, delta)
+}
+
+// IncrementFloatContext is used to atomically add to a record as a float. Records which do not exist count as 0.
+func (h *hnpConn) IncrementFloatContext(ctx context.Context, key []byte, delta float64) (float64, error) {
+	res, err := h.increment(ctx, 19, key, math.Float64bits(delta))
+	return math.Float64frombits(res), err
+}
+
+// MutexLock is used to lock a global mutex. Use MutexLockWithLease to get the fencing token.
+func (h *hnpConn) MutexLock() error {
+	return h.MutexLockContext(context.Background())
+}
+
+// MutexLockContext is used to lock a global mutex. If the context is done before the mutex is locked, it is unlocked
+// as soon as the server locks it.
+func (h *hnpConn) MutexLockContext(ctx context.Context) error {
+	_, err := request[struct{}](ctx, h, 7, nil, nil)
+	if err == nil {
+		atomic.AddInt32(&h.mutexesHeld, 1)
 	}
+	return err
+}
 
-	// Return any errors.
-	return <-errorCh
+// MutexLockWithLease is used to lock a global mutex which the server unlocks when the lease expires. If the lease is
+// 0, it has no lease. Returns the fencing token.
+func (h *hnpConn) MutexLockWithLease(lease time.Duration) (token uint64, err error) {
+	return h.MutexLockWithLeaseContext(context.Background(), lease)
+}
+
+// MutexLockWithLeaseContext is used to lock a global mutex which the server unlocks when the lease expires. If the
+// lease is 0, it has no lease. Returns the fencing token. If the context is done before the mutex is locked, it is
+// unlocked as soon as the server locks it.
+func (h *hnpConn) MutexLockWithLeaseContext(ctx context.Context, lease time.Duration) (token uint64, err error) {
+	// The global mutex is the named mutex with an empty name. This is locked with the named mutex opcode, since the
+	// mutex lock opcode replies with nothing.
+	return h.NamedMutexLockContext(ctx, nil, lease)
 }
 
 // MutexUnlock is used to unlock a globally locked mutex.
 func (h *hnpConn) MutexUnlock() error {
-	// Get the reply ID.
-	replyId := h.replyId()
+	return h.MutexUnlockContext(context.Background())
+}
 
-	// Lock the replies map.
-	h.repliesMu.Lock()
+// MutexUnlockContext is used to unlock a globally locked mutex.
+func (h *hnpConn) MutexUnlockContext(ctx context.Context) error {
+	return h.unlock(ctx, 8, nil)
+}
 
-	// Check if there was a connection error.
-	err := h.getConnectionError()
-	if err != nil {
-		h.repliesMu.Unlock()
-		return err
+// unlock is used to unlock a mutex with the opcode specified and count it as released.
+func (h *hnpConn) unlock(ctx context.Context, op byte, name []byte) error {
+	_, err := request[struct{}](ctx, h, op, name, nil)
+	if err == nil {
+		atomic.AddInt32(&h.mutexesHeld, -1)
 	}
+	return err
+}
 
-	// Defines the error channel.
-	errorCh := make(chan error, 1)
-	b := packetmaker.New().
-		Uint32(replyId, true).
-		Uint32(1, true).
-		Byte(8).
-		Make()
-	h.replies[replyId] = func(err error) { errorCh <- err }
-	h.repliesMu.Unlock()
-	_, err = h.c.Write(b)
-	if err != nil {
-		return err
+// timeoutMillis is used to get a lock timeout in milliseconds. Any timeout below 0 is -1, so that it is not rounded
+// to 0 and taken as not waiting at all.
+func timeoutMillis(timeout time.Duration) int64 {
+	if timeout < 0 {
+		return -1
 	}
+	return timeout.Milliseconds()
+}
 
-	// Return any errors.
-	return <-errorCh
+// lockBody is used to make the body of a named mutex lock. This is the lease in milliseconds followed by the name.
+func lockBody(name []byte, lease time.Duration) []byte {
+	if lease < 0 {
+		lease = 0
+	}
+	return packetmaker.New().Uint64(uint64(lease.Milliseconds()), true).Bytes(name).Make()
 }
 
-// SendEvent is used to send an event to the HyperCache server.
-func (h *hnpConn) SendEvent(b []byte) error {
-	// Get the reply ID.
-	replyId := h.replyId()
+// timedLockBody is used to make the body of a lock with a timeout. This is the lease in milliseconds, then the timeout
+// in milliseconds, followed by the name. If the timeout is below 0, it waits until it gets the lock.
+func timedLockBody(name []byte, lease, timeout time.Duration) []byte {
+	return lockBody(packetmaker.New().Uint64(uint64(timeoutMillis(timeout)), true).Bytes(name).Make(), lease)
+}
 
-	// Lock the replies map.
-	h.repliesMu.Lock()
+// NamedMutexLock is used to lock the mutex with the name specified. If the lease is above 0, the server unlocks it
+// when the lease expires. Returns the fencing token.
+func (h *hnpConn) NamedMutexLock(name []byte, lease time.Duration) (token uint64, err error) {
+	return h.NamedMutexLockContext(context.Background(), name, lease)
+}
 
-	// Check if there was a connection error.
-	err := h.getConnectionError()
-	if err != nil {
-		h.repliesMu.Unlock()
-		return err
+// NamedMutexLockContext is used to lock the mutex with the name specified. If the lease is above 0, the server unlocks
+// it when the lease expires. Returns the fencing token. If the context is done before the mutex is locked, it is
+// unlocked as soon as the server locks it.
+func (h *hnpConn) NamedMutexLockContext(
+	ctx context.Context, name []byte, lease time.Duration,
+) (token uint64, err error) {
+	token, err = request(ctx, h, 21, lockBody(name, lease), h.readUint64)
+	if err == nil {
+		atomic.AddInt32(&h.mutexesHeld, 1)
 	}
+	return token, err
+}
 
-	// Defines the error channel.
-	errorCh := make(chan error, 1)
-	b = packetmaker.New().
-		Uint32(replyId, true).
-		Uint32(uint32(len(b)+1), true).
-		Byte(9).
-		Bytes(b).
-		Make()
-	h.replies[replyId] = func(err error) { errorCh <- err }
-	h.repliesMu.Unlock()
-	_, err = h.c.Write(b)
-	if err != nil {
-		return err
+// NamedMutexTryLock is used to lock the mutex with the name specified if it is not held. Returns the fencing token,
+// or 0 if it is held. If the lease is above 0, the server unlocks it when the lease expires.
+func (h *hnpConn) NamedMutexTryLock(name []byte, lease time.Duration) (token uint64, err error) {
+	return h.NamedMutexTryLockContext(context.Background(), name, lease)
+}
+
+// NamedMutexTryLockContext is used to lock the mutex with the name specified if it is not held. Returns the fencing
+// token, or 0 if it is held. If the lease is above 0, the server unlocks it when the lease expires.
+func (h *hnpConn) NamedMutexTryLockContext(
+	ctx context.Context, name []byte, lease time.Duration,
+) (token uint64, err error) {
+	token, err = request(ctx, h, 23, lockBody(name, lease), h.readUint64)
+	if token != 0 {
+		atomic.AddInt32(&h.mutexesHeld, 1)
 	}
+	return token, err
+}
+
+// NamedMutexLockWithTimeout is used to lock the mutex with the name specified, waiting in line for up to the timeout.
+// If the timeout is below 0, it waits until it is locked. If the lease is above 0, the server unlocks it when the
+// lease expires. Returns the fencing token, or 0 if the timeout passed.
+func (h *hnpConn) NamedMutexLockWithTimeout(
+	name []byte, lease, timeout time.Duration,
+) (token uint64, err error) {
+	return h.NamedMutexLockWithTimeoutContext(context.Background(), name, lease, timeout)
+}
+
+// NamedMutexLockWithTimeoutContext is used to lock the mutex with the name specified, waiting in line for up to the
+// timeout. If the timeout is below 0, it waits until it is locked. If the lease is above 0, the server unlocks it
+// when the lease expires. Returns the fencing token, or 0 if the timeout passed.
+func (h *hnpConn) NamedMutexLockWithTimeoutContext(
+	ctx context.Context, name []byte, lease, timeout time.Duration,
+) (token uint64, err error) {
+	token, err = request(ctx, h, 24, timedLockBody(name, lease, timeout), h.readUint64)
+	if token != 0 {
+		atomic.AddInt32(&h.mutexesHeld, 1)
+	}
+	return token, err
+}
+
+// NamedMutexQueue is used to get if the mutex with the name specified is held and how many connections are waiting
+// for it.
+func (h *hnpConn) NamedMutexQueue(name []byte) (held bool, waiters uint32, err error) {
+	return h.NamedMutexQueueContext(context.Background(), name)
+}
+
+// NamedMutexQueueContext is used to get if the mutex with the name specified is held and how many connections are
+// waiting for it.
+func (h *hnpConn) NamedMutexQueueContext(ctx context.Context, name []byte) (held bool, waiters uint32, err error) {
+	holds, waiters, err := h.lockQueue(ctx, 0, name)
+	return holds != 0, waiters, err
+}
+
+// NamedMutexUnlock is used to unlock the mutex with the name specified.
+func (h *hnpConn) NamedMutexUnlock(name []byte) error {
+	return h.NamedMutexUnlockContext(context.Background(), name)
+}
+
+// NamedMutexUnlockContext is used to unlock the mutex with the name specified.
+func (h *hnpConn) NamedMutexUnlockContext(ctx context.Context, name []byte) error {
+	return h.unlock(ctx, 22, name)
+}
+
+// lockQueue is used to get how many holds there are on a lock of the kind specified and how many connections are
+// waiting for it.
+func (h *hnpConn) lockQueue(ctx context.Context, kind byte, name []byte) (holds, waiters uint32, err error) {
+	type queue struct {
+		holds   uint32
+		waiters uint32
+	}
+	body := packetmaker.New().Byte(kind).Bytes(name).Make()
+	q, err := request(ctx, h, 30, body, func() (queue, error) {
+		b := make([]byte, 8)
+		_, err := io.ReadFull(h.c, b)
+		return queue{holds: binary.LittleEndian.Uint32(b), waiters: binary.LittleEndian.Uint32(b[4:])}, err
+	})
+	return q.holds, q.waiters, err
+}
+
+// rwLock is used to take a hold on a read-write lock and count it as held.
+func (h *hnpConn) rwLock(
+	ctx context.Context, name []byte, shared bool, lease, timeout time.Duration,
+) (token uint64, err error) {
+	var b byte
+	if shared {
+		b = 1
+	}
+	body := packetmaker.New().Byte(b).Bytes(timedLockBody(name, lease, timeout)).Make()
+	token, err = request(ctx, h, 26, body, h.readUint64)
+	if token != 0 {
+		atomic.AddInt32(&h.mutexesHeld, 1)
+	}
+	return token, err
+}
+
+// RWMutexLock is used to take an exclusive (write) hold on the read-write lock with the name specified, waiting in
+// line for up to the timeout, or until it is taken if the timeout is below 0. If the lease is above 0, the server
+// releases it when the lease expires. Returns the fencing token, or 0 if the timeout passed.
+func (h *hnpConn) RWMutexLock(name []byte, lease, timeout time.Duration) (token uint64, err error) {
+	return h.RWMutexLockContext(context.Background(), name, lease, timeout)
+}
 
-	// Return any errors.
-	return <-errorCh
+// RWMutexLockContext is used to take an exclusive (write) hold on the read-write lock with the name specified, waiting
+// in line for up to the timeout, or until it is taken if the timeout is below 0. If the lease is above 0, the server
+// releases it when the lease expires. Returns the fencing token, or 0 if the timeout passed. If the context is done
+// before the hold is taken, it is released as soon as the server gives it.
+func (h *hnpConn) RWMutexLockContext(
+	ctx context.Context, name []byte, lease, timeout time.Duration,
+) (token uint64, err error) {
+	return h.rwLock(ctx, name, false, lease, timeout)
+}
+
+// RWMutexRLock is used to take a shared (read) hold on the read-write lock with the name specified, waiting in line
+// for up to the timeout, or until it is taken if the timeout is below 0. If the lease is above 0, the server releases
+// it when the lease expires. Returns the fencing token, or 0 if the timeout passed.
+func (h *hnpConn) RWMutexRLock(name []byte, lease, timeout time.Duration) (token uint64, err error) {
+	return h.RWMutexRLockContext(context.Background(), name, lease, timeout)
+}
+
+// RWMutexRLockContext is used to take a shared (read) hold on the read-write lock with the name specified, waiting in
+// line for up to the timeout, or until it is taken if the timeout is below 0. If the lease is above 0, the server
+// releases it when the lease expires. Returns the fencing token, or 0 if the timeout passed. If the context is done
+// before the hold is taken, it is released as soon as the server gives it.
+func (h *hnpConn) RWMutexRLockContext(
+	ctx context.Context, name []byte, lease, timeout time.Duration,
+) (token uint64, err error) {
+	return h.rwLock(ctx, name, true, lease, timeout)
+}
+
+// RWMutexUnlock is used to release the oldest hold this connection has on the read-write lock with the name specified.
+func (h *hnpConn) RWMutexUnlock(name []byte) error {
+	return h.RWMutexUnlockContext(context.Background(), name)
+}
+
+// RWMutexUnlockContext is used to release the oldest hold this connection has on the read-write lock with the name
+// specified.
+func (h *hnpConn) RWMutexUnlockContext(ctx context.Context, name []byte) error {
+	return h.unlock(ctx, 27, name)
+}
+
+// RWMutexQueue is used to get how many holds there are on the read-write lock with the name specified and how many
+// connections are waiting for it.
+func (h *hnpConn) RWMutexQueue(name []byte) (holds, waiters uint32, err error) {
+	return h.RWMutexQueueContext(context.Background(), name)
+}
+
+// RWMutexQueueContext is used to get how many holds there are on the read-write lock with the name specified and how
+// many connections are waiting for it.
+func (h *hnpConn) RWMutexQueueContext(ctx context.Context, name []byte) (holds, waiters uint32, err error) {
+	return h.lockQueue(ctx, 1, name)
+}
+
+// SemaphoreAcquire is used to take a hold on the semaphore with the name specified, waiting in line for up to the
+// timeout, or until it is taken if the timeout is below 0. If the lease is above 0, the server releases it when the
+// lease expires. Returns the fencing token, or 0 if the timeout passed.
+func (h *hnpConn) SemaphoreAcquire(name []byte, limit uint32, lease, timeout time.Duration) (token uint64, err error) {
+	return h.SemaphoreAcquireContext(context.Background(), name, limit, lease, timeout)
+}
+
+// SemaphoreAcquireContext is used to take a hold on the semaphore with the name specified, waiting in line for up to
+// the timeout, or until it is taken if the timeout is below 0. If the lease is above 0, the server releases it when
+// the lease expires. Returns the fencing token, or 0 if the timeout passed. If the context is done before the hold is
+// taken, it is released as soon as the server gives it.
+func (h *hnpConn) SemaphoreAcquireContext(
+	ctx context.Context, name []byte, limit uint32, lease, timeout time.Duration,
+) (token uint64, err error) {
+	body := packetmaker.New().Uint32(limit, true).Bytes(timedLockBody(name, lease, timeout)).Make()
+	token, err = request(ctx, h, 28, body, h.readUint64)
+	if token != 0 {
+		atomic.AddInt32(&h.mutexesHeld, 1)
+	}
+	return token, err
+}
+
+// SemaphoreRelease is used to release the oldest hold this connection has on the semaphore with the name specified.
+func (h *hnpConn) SemaphoreRelease(name []byte) error {
+	return h.SemaphoreReleaseContext(context.Background(), name)
+}
+
+// SemaphoreReleaseContext is used to release the oldest hold this connection has on the semaphore with the name
+// specified.
+func (h *hnpConn) SemaphoreReleaseContext(ctx context.Context, name []byte) error {
+	return h.unlock(ctx, 29, name)
+}
+
+// SemaphoreQueue is used to get how many holds there are on the semaphore with the name specified and how many
+// connections are waiting for it.
+func (h *hnpConn) SemaphoreQueue(name []byte) (holds, waiters uint32, err error) {
+	return h.SemaphoreQueueContext(context.Background(), name)
+}
+
+// SemaphoreQueueContext is used to get how many holds there are on the semaphore with the name specified and how many
+// connections are waiting for it.
+func (h *hnpConn) SemaphoreQueueContext(ctx context.Context, name []byte) (holds, waiters uint32, err error) {
+	return h.lockQueue(ctx, 2, name)
+}
+
+// Locks is used to list every lock in the database along with who holds it and how many connections are waiting for
+// it.
+func (h *hnpConn) Locks() ([]Lock, error) {
+	return h.LocksContext(context.Background())
+}
+
+// LocksContext is used to list every lock in the database along with who holds it and how many connections are
+// waiting for it.
+func (h *hnpConn) LocksContext(ctx context.Context) ([]Lock, error) {
+	return request(ctx, h, 32, nil, h.readLocks)
+}
+
+// ForceRelease is used to release every hold on a lock, whoever has it. This needs the admin password the server was
+// started with. Returns the number of holds released.
+func (h *hnpConn) ForceRelease(kind LockKind, name []byte, adminPassword string) (released uint32, err error) {
+	return h.ForceReleaseContext(context.Background(), kind, name, adminPassword)
+}
+
+// ForceReleaseContext is used to release every hold on a lock, whoever has it. This needs the admin password the
+// server was started with. Returns the number of holds released.
+func (h *hnpConn) ForceReleaseContext(
+	ctx context.Context, kind LockKind, name []byte, adminPassword string,
+) (released uint32, err error) {
+	body := packetmaker.New().
+		Byte(byte(kind)).
+		Uint16(uint16(len(adminPassword)), true).
+		String(adminPassword).
+		Bytes(name).
+		Make()
+	return request(ctx, h, 33, body, h.readUint32)
+}
+
+// SetClientName is used to name the connection. The name is shown as the holder of any locks the connection has.
+func (h *hnpConn) SetClientName(name string) error {
+	return h.SetClientNameContext(context.Background(), name)
+}
+
+// SetClientNameContext is used to name the connection. The name is shown as the holder of any locks the connection
+// has.
+func (h *hnpConn) SetClientNameContext(ctx context.Context, name string) error {
+	h.clientName.Store(name)
+	_, err := request[struct{}](ctx, h, 31, []byte(name), nil)
+	return err
 }
 
 func (h *hnpConn) throwError(err error) {
@@ -250,27 +892,31 @@ func (h *hnpConn) replyId() uint32 {
 }
 
 func (h *hnpConn) getException() error {
+	return readException(h.c)
+}
+
+func readException(c net.Conn) error {
 	b := make([]byte, 512)
 	ob := b[:1]
-	_ = h.c.SetWriteDeadline(time.Now().Add(time.Second * 2))
-	_, err := h.c.Read(ob)
+	_ = c.SetWriteDeadline(time.Now().Add(time.Second * 2))
+	_, err := c.Read(ob)
 	if err != nil {
 		return err
 	}
-	_ = h.c.SetWriteDeadline(time.Now().Add(time.Second * 2))
+	_ = c.SetWriteDeadline(time.Now().Add(time.Second * 2))
 	exceptionNameB := b[:ob[0]]
-	_, err = h.c.Read(exceptionNameB)
+	_, err = c.Read(exceptionNameB)
 	if err != nil {
 		return err
 	}
 	exceptionName := string(exceptionNameB)
-	_ = h.c.SetWriteDeadline(time.Now().Add(time.Second * 2))
-	_, err = h.c.Read(ob)
+	_ = c.SetWriteDeadline(time.Now().Add(time.Second * 2))
+	_, err = c.Read(ob)
 	if err != nil {
 		return err
 	}
 	exceptionDescriptionB := b[:ob[0]]
-	_, err = h.c.Read(exceptionDescriptionB)
+	_, err = c.Read(exceptionDescriptionB)
 	if err != nil {
 		return err
 	}
@@ -279,48 +925,41 @@ func (h *hnpConn) getException() error {
 }
 
 func (h *hnpConn) readLoop() {
+	for {
+		// Read packets until the connection errors.
+		err := h.readPackets()
+		if h.isClosed() {
+			err = ErrClosed
+		}
+		h.throwError(err)
+		if h.reconnect == nil || !h.redial(err) {
+			return
+		}
+	}
+}
+
+func (h *hnpConn) readPackets() error {
 	fb := make([]byte, 5)
 	for {
 		// Read the contents.
 		_, err := h.c.Read(fb)
 		if err != nil {
-			h.throwError(err)
-			return
+			return err
 		}
 
 		// Get the reply ID.
 		replyId := binary.LittleEndian.Uint32(fb)
 		if replyId == 0 {
-			// Check the next byte is 0. If not, this is a unsupported packet.
-			if fb[4] == 0 {
-				// Get the length of the event.
-				four := fb[:4]
-
-				// Read the length.
-				_, err = h.c.Read(four)
-				if err != nil {
-					h.throwError(err)
-					return
+			// Check what kind of event this is. Events from the deprecated event send are length prefixed.
+			switch fb[4] {
+			case 0:
+				if err = h.readSentEvent(); err != nil {
+					return err
 				}
-
-				// Allocate and read the number of bytes specified.
-				eventLen := binary.LittleEndian.Uint32(four)
-				event := make([]byte, eventLen)
-				_, err = h.c.Read(event)
-				if err != nil {
-					h.throwError(err)
-					return
+			case 2:
+				if err = h.readEvent(); err != nil {
+					return err
 				}
-
-				// Send it to each channel.
-				h.eventsMu.RLock()
-				for _, v := range h.events {
-					select {
-					case v <- event:
-					default:
-					}
-				}
-				h.eventsMu.RUnlock()
 			}
 		} else {
 			// Check if this is an exception.
@@ -340,14 +979,8 @@ func (h *hnpConn) readLoop() {
 	}
 }
 
-// NewConnectionWithHNPSocket is used to connect with a newly made HNP socket.
-func NewConnectionWithHNPSocket(c net.Conn, password string, db uint16) (HNPImplementation, error) {
-	h := &hnpConn{
-		c:       c,
-		replies: map[uint32]func(error){},
-	}
-
-	// Do the initial handshake.
+// handshake is used to do the HNP handshake on a newly made socket.
+func handshake(c net.Conn, password string, db uint16) error {
 	_ = c.SetWriteDeadline(time.Now().Add(time.Second * 2))
 	b := packetmaker.New().
 		String("HNP1").
@@ -357,19 +990,39 @@ func NewConnectionWithHNPSocket(c net.Conn, password string, db uint16) (HNPImpl
 		Make()
 	_, err := c.Write(b)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	_ = c.SetReadDeadline(time.Now().Add(time.Minute))
 	ob := []byte{0}
 	_, err = c.Read(ob)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	// Check if the byte is 1.
 	if ob[0] == 1 {
-		err = h.getException()
+		err = readException(c)
 		_ = c.Close()
+		return err
+	}
+
+	// Clear the deadlines so they do not apply to the rest of the connection.
+	_ = c.SetDeadline(time.Time{})
+	return nil
+}
+
+// NewConnectionWithHNPSocket is used to connect with a newly made HNP socket.
+func NewConnectionWithHNPSocket(c net.Conn, password string, db uint16) (HNPImplementation, error) {
+	h := &hnpConn{
+		c:            c,
+		replies:      map[uint32]func(error){},
+		subs:         map[subscription][]chan Event{},
+		keyspaceSubs: map[string]*keyspaceSubscription{},
+		closeCh:      make(chan struct{}),
+	}
+
+	// Do the initial handshake.
+	if err := handshake(c, password, db); err != nil {
 		return nil, err
 	}
 
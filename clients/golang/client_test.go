@@ -0,0 +1,350 @@
+package hypercache
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"math"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jakemakesstuff/packetmaker"
+)
+
+// fakeServer is the server side of a piped HNP connection.
+type fakeServer struct {
+	t *testing.T
+	c net.Conn
+}
+
+// newFakeServer is used to make a client connected to a fake server. The handshake is accepted.
+func newFakeServer(t *testing.T) (HNPImplementation, *fakeServer) {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+	s := &fakeServer{t: t, c: server}
+	go func() {
+		// HNP1, the database and an empty password.
+		if _, err := io.ReadFull(server, make([]byte, 8)); err != nil {
+			return
+		}
+		_, _ = server.Write([]byte{0})
+	}()
+	h, err := NewConnectionWithHNPSocket(client, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h, s
+}
+
+// read is used to read a packet from the client. Returns the reply ID, opcode and body.
+func (s *fakeServer) read() (replyId uint32, op byte, body []byte) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(s.c, header); err != nil {
+		s.t.Error(err)
+		return
+	}
+	b := make([]byte, binary.LittleEndian.Uint32(header[4:]))
+	if _, err := io.ReadFull(s.c, b); err != nil {
+		s.t.Error(err)
+		return
+	}
+	return binary.LittleEndian.Uint32(header), b[0], b[1:]
+}
+
+// reply is used to write a successful reply with the result specified.
+func (s *fakeServer) reply(replyId uint32, result []byte) {
+	b := packetmaker.New().Uint32(replyId, true).Byte(0).Bytes(result).Make()
+	if _, err := s.c.Write(b); err != nil {
+		s.t.Error(err)
+	}
+}
+
+// pageResult is used to make the result of a walk page.
+func pageResult(next []byte, records ...Record) []byte {
+	more := byte(0)
+	if next != nil {
+		more = 1
+	}
+	m := packetmaker.New().Byte(more).Uint32(uint32(len(next)), true).Bytes(next).Uint32(uint32(len(records)), true)
+	for _, r := range records {
+		m.Uint32(uint32(len(r.Key)), true).Bytes(r.Key).Uint32(uint32(len(r.Value)), true).Bytes(r.Value)
+	}
+	return m.Make()
+}
+
+func TestWalkPrefixPages(t *testing.T) {
+	h, s := newFakeServer(t)
+	a := Record{Key: []byte("pa"), Value: []byte("1")}
+	b := Record{Key: []byte("pb"), Value: []byte("2")}
+	go func() {
+		// The first page has no cursor.
+		replyId, op, body := s.read()
+		want := packetmaker.New().Uint32(0, true).Uint32(1, true).String("p").Make()
+		if op != 15 || !bytes.Equal(body, want) {
+			t.Errorf("got op %d with %v for the first page, want op 15 with %v", op, body, want)
+		}
+		s.reply(replyId, pageResult([]byte("pa"), a))
+
+		// The second page resumes after the cursor.
+		replyId, op, body = s.read()
+		want = packetmaker.New().Uint32(0, true).Uint32(1, true).String("p").
+			Byte(1).Uint32(2, true).String("pa").Make()
+		if op != 15 || !bytes.Equal(body, want) {
+			t.Errorf("got op %d with %v for the second page, want op 15 with %v", op, body, want)
+		}
+		s.reply(replyId, pageResult(nil, b))
+	}()
+
+	records, err := h.WalkPrefix([]byte("p"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || !bytes.Equal(records[0].Key, a.Key) || !bytes.Equal(records[1].Value, b.Value) {
+		t.Errorf("got %q, want %q", records, []Record{a, b})
+	}
+}
+
+func TestWalkPageException(t *testing.T) {
+	h, s := newFakeServer(t)
+	go func() {
+		replyId, _, _ := s.read()
+		b := packetmaker.New().Uint32(replyId, true).Byte(1).
+			Byte(13).String("InvalidCursor").Byte(3).String("bad").Make()
+		_, _ = s.c.Write(b)
+	}()
+
+	_, _, err := h.WalkRangePage([]byte("a"), nil, false, []byte("x"), 10)
+	if _, ok := err.(InvalidCursor); !ok {
+		t.Fatalf("got %v, want InvalidCursor", err)
+	}
+}
+
+func TestCanceledRequestIsDrained(t *testing.T) {
+	h, s := newFakeServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	givenUp, served := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(served)
+
+		// Hold the reply to the first get until it has been given up on.
+		replyId, _, _ := s.read()
+		cancel()
+		<-givenUp
+		s.reply(replyId, packetmaker.New().Uint32(5, true).String("stale").Make())
+
+		// The next get should not see the stale result.
+		replyId, _, key := s.read()
+		s.reply(replyId, packetmaker.New().Uint32(uint32(len(key)), true).Bytes(key).Make())
+	}()
+
+	if _, err := h.GetContext(ctx, []byte("first")); err != context.Canceled {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+	close(givenUp)
+	value, err := h.Get([]byte("second"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "second" {
+		t.Errorf("got %q, want %q", value, "second")
+	}
+	<-served
+}
+
+func TestDoneContextIsNotSent(t *testing.T) {
+	h, _ := newFakeServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// Nothing reads from the server side of the pipe, so a write would block.
+	if _, err := h.GetContext(ctx, []byte("key")); err != context.Canceled {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+}
+
+func TestMutexLockWithLease(t *testing.T) {
+	h, s := newFakeServer(t)
+	go func() {
+		// The plain lock gets an empty reply.
+		replyId, op, body := s.read()
+		if op != 7 || len(body) != 0 {
+			t.Errorf("got op %d with %v, want op 7 with nothing", op, body)
+		}
+		s.reply(replyId, nil)
+
+		// The leased lock is the named lock with an empty name.
+		replyId, op, body = s.read()
+		want := packetmaker.New().Uint64(1500, true).Make()
+		if op != 21 || !bytes.Equal(body, want) {
+			t.Errorf("got op %d with %v, want op 21 with %v", op, body, want)
+		}
+		s.reply(replyId, packetmaker.New().Uint64(42, true).Make())
+	}()
+
+	if err := h.MutexLock(); err != nil {
+		t.Fatal(err)
+	}
+	token, err := h.MutexLockWithLease(1500 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != 42 {
+		t.Errorf("got token %d, want 42", token)
+	}
+}
+
+func TestNamedMutexLockWithTimeout(t *testing.T) {
+	h, s := newFakeServer(t)
+	go func() {
+		// A negative timeout is sent as -1 so that the server waits forever, even if it is under a millisecond.
+		replyId, op, body := s.read()
+		want := packetmaker.New().Uint64(0, true).Uint64(uint64(math.MaxUint64), true).String("lock").Make()
+		if op != 24 || !bytes.Equal(body, want) {
+			t.Errorf("got op %d with %v, want op 24 with %v", op, body, want)
+		}
+		s.reply(replyId, packetmaker.New().Uint64(7, true).Make())
+	}()
+
+	token, err := h.NamedMutexLockWithTimeout([]byte("lock"), 0, -time.Microsecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != 7 {
+		t.Errorf("got token %d, want 7", token)
+	}
+}
+
+func TestNamedMutexQueue(t *testing.T) {
+	h, s := newFakeServer(t)
+	go func() {
+		// Mutexes are queried like every other lock, with the kind before the name.
+		replyId, op, body := s.read()
+		if want := []byte("\x00lock"); op != 30 || !bytes.Equal(body, want) {
+			t.Errorf("got op %d with %v, want op 30 with %v", op, body, want)
+		}
+		s.reply(replyId, packetmaker.New().Uint32(1, true).Uint32(3, true).Make())
+	}()
+
+	held, waiters, err := h.NamedMutexQueue([]byte("lock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !held || waiters != 3 {
+		t.Errorf("got held %v with %d waiters, want held with 3", held, waiters)
+	}
+}
+
+func TestForceRelease(t *testing.T) {
+	h, s := newFakeServer(t)
+	go func() {
+		// The admin password goes between the kind and the name.
+		replyId, op, body := s.read()
+		want := packetmaker.New().Byte(2).Uint16(6, true).String("secret").String("sem").Make()
+		if op != 33 || !bytes.Equal(body, want) {
+			t.Errorf("got op %d with %v, want op 33 with %v", op, body, want)
+		}
+		s.reply(replyId, packetmaker.New().Uint32(2, true).Make())
+	}()
+
+	released, err := h.ForceRelease(LockKindSemaphore, []byte("sem"), "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if released != 2 {
+		t.Errorf("got %d holds released, want 2", released)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	h, s := newFakeServer(t)
+	go func() {
+		replyId, op, body := s.read()
+		if want := []byte("\x01orders.*"); op != 34 || !bytes.Equal(body, want) {
+			t.Errorf("got op %d with %v, want op 34 with %v", op, body, want)
+		}
+		s.reply(replyId, []byte{1, 0, 0, 0, 1})
+
+		// A subscription event followed by one from the deprecated event send.
+		_, _ = s.c.Write(packetmaker.New().Uint32(0, true).Byte(2).Byte(1).
+			Uint32(8, true).String("orders.*").Uint32(10, true).String("orders.new").
+			Uint32(4, true).String("data").Make())
+		_, _ = s.c.Write(packetmaker.New().Uint32(0, true).Byte(0).Uint32(5, true).String("hello").Make())
+	}()
+
+	events, sent := make(chan Event, 1), make(chan []byte, 1)
+	h.AddEventHandler(sent)
+	if err := h.PSubscribe([]byte("orders.*"), events); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e := <-events:
+		if string(e.Pattern) != "orders.*" || string(e.Channel) != "orders.new" || string(e.Data) != "data" {
+			t.Errorf("got event %q on %q from %q, want data on orders.new from orders.*", e.Data, e.Channel, e.Pattern)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the event was not delivered")
+	}
+	select {
+	case b := <-sent:
+		if string(b) != "hello" {
+			t.Errorf("got %q, want hello", b)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the sent event was not delivered")
+	}
+}
+
+func TestSubscribeKeyspace(t *testing.T) {
+	h, s := newFakeServer(t)
+	go func() {
+		replyId, op, body := s.read()
+		if want := []byte("\x01user:"); op != 37 || !bytes.Equal(body, want) {
+			t.Errorf("got op %d with %v, want op 37 with %v", op, body, want)
+		}
+		s.reply(replyId, []byte{1, 0, 0, 0, 1})
+
+		// A set of a key under the prefix, with the value.
+		_, _ = s.c.Write(packetmaker.New().Uint32(0, true).Byte(2).Byte(2).
+			Uint32(5, true).String("user:").Byte(byte(KeyspaceSet)).Uint32(6, true).String("user:1").
+			Uint64(0, true).Uint32(5, true).String("value").Make())
+	}()
+
+	notifications := make(chan KeyspaceNotification, 1)
+	if err := h.SubscribeKeyspace([]byte("user:"), true, notifications); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case n := <-notifications:
+		if string(n.Prefix) != "user:" || n.Op != KeyspaceSet || string(n.Key) != "user:1" ||
+			string(n.Value) != "value" {
+			t.Errorf("got %+v, want a set of user:1 to value under user:", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the notification was not delivered")
+	}
+}
+
+func TestEventStats(t *testing.T) {
+	h, s := newFakeServer(t)
+	go func() {
+		replyId, op, _ := s.read()
+		if op != 36 {
+			t.Errorf("got op %d, want 36", op)
+		}
+		s.reply(replyId, packetmaker.New().Uint64(5, true).Uint32(2, true).Make())
+	}()
+
+	dropped, queued, err := h.EventStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dropped != 5 || queued != 2 {
+		t.Errorf("got %d dropped and %d queued, want 5 and 2", dropped, queued)
+	}
+}
@@ -0,0 +1,413 @@
+package hypercache
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+
+	"github.com/jakemakesstuff/packetmaker"
+)
+
+// subscription is a channel or glob pattern subscribed to.
+type subscription struct {
+	pattern bool
+	name    string
+}
+
+// body is used to make the body of a subscribe or unsubscribe packet.
+func (s subscription) body() []byte {
+	var b byte
+	if s.pattern {
+		b = 1
+	}
+	return packetmaker.New().Byte(b).String(s.name).Make()
+}
+
+// keyspaceSubscription is a key prefix subscribed to.
+type keyspaceSubscription struct {
+	// Defines if the server was asked to include values. This is never turned off whilst there are handlers, since
+	// another handler might want them.
+	values bool
+
+	handlers []chan KeyspaceNotification
+}
+
+// keyspaceBody is used to make the body of a keyspace subscribe packet.
+func keyspaceBody(prefix []byte, values bool) []byte {
+	var b byte
+	if values {
+		b = 1
+	}
+	return packetmaker.New().Byte(b).Bytes(prefix).Make()
+}
+
+// readEvent is used to read an event from the connection and send it to the handlers for the subscription it matched.
+func (h *hnpConn) readEvent() error {
+	kind := []byte{0}
+	if _, err := io.ReadFull(h.c, kind); err != nil {
+		return err
+	}
+	if kind[0] == 2 {
+		return h.readKeyspaceNotification()
+	}
+	name, err := h.readBytes()
+	if err != nil {
+		return err
+	}
+	var e Event
+	if e.Channel, err = h.readBytes(); err != nil {
+		return err
+	}
+	if e.Data, err = h.readBytes(); err != nil {
+		return err
+	}
+	sub := subscription{pattern: kind[0] == 1, name: string(name)}
+	if sub.pattern {
+		e.Pattern = name
+	}
+
+	// Send it to each handler.
+	h.subsMu.RLock()
+	for _, v := range h.subs[sub] {
+		select {
+		case v <- e:
+		default:
+		}
+	}
+	h.subsMu.RUnlock()
+	return nil
+}
+
+// readSentEvent is used to read an event sent with SendEvent from the connection and send it to each event handler.
+func (h *hnpConn) readSentEvent() error {
+	event, err := h.readBytes()
+	if err != nil {
+		return err
+	}
+	h.subsMu.RLock()
+	for _, v := range h.events {
+		select {
+		case v <- event:
+		default:
+		}
+	}
+	h.subsMu.RUnlock()
+	return nil
+}
+
+// readKeyspaceNotification is used to read a keyspace notification from the connection and send it to the handlers
+// for the prefix.
+func (h *hnpConn) readKeyspaceNotification() error {
+	var n KeyspaceNotification
+	var err error
+	if n.Prefix, err = h.readBytes(); err != nil {
+		return err
+	}
+	op := []byte{0}
+	if _, err = io.ReadFull(h.c, op); err != nil {
+		return err
+	}
+	n.Op = KeyspaceOp(op[0])
+	if n.Key, err = h.readBytes(); err != nil {
+		return err
+	}
+	if n.Removed, err = h.readUint64(); err != nil {
+		return err
+	}
+	value, err := h.readBytes()
+	if err != nil {
+		return err
+	}
+
+	// Send it to each handler.
+	h.subsMu.RLock()
+	if sub, ok := h.keyspaceSubs[string(n.Prefix)]; ok {
+		if sub.values && n.Op == KeyspaceSet {
+			n.Value = value
+		}
+		for _, v := range sub.handlers {
+			select {
+			case v <- n:
+			default:
+			}
+		}
+	}
+	h.subsMu.RUnlock()
+	return nil
+}
+
+// AddEventHandler is used to add a handler for events sent with SendEvent. The server sends these to every
+// connection, so nothing needs subscribing. Note that the bytes should not be mutated.
+//
+// Deprecated: Use Subscribe or PSubscribe, which only get the events published on the channels asked for.
+func (h *hnpConn) AddEventHandler(ch chan []byte) {
+	h.subsMu.Lock()
+	h.events = append(h.events, ch)
+	h.subsMu.Unlock()
+}
+
+// SendEvent is used to send an event to every other connection on the database.
+//
+// Deprecated: Use Publish, which only sends the event to the connections subscribed to the channel.
+func (h *hnpConn) SendEvent(b []byte) error {
+	return h.SendEventContext(context.Background(), b)
+}
+
+// SendEventContext is used to send an event to every other connection on the database.
+//
+// Deprecated: Use PublishContext, which only sends the event to the connections subscribed to the channel.
+func (h *hnpConn) SendEventContext(ctx context.Context, b []byte) error {
+	_, err := request[struct{}](ctx, h, 9, b, nil)
+	return err
+}
+
+// subscribe is used to add a handler for a subscription, subscribing on the server if it is the first one.
+func (h *hnpConn) subscribe(ctx context.Context, sub subscription, ch chan Event) error {
+	h.subscribeMu.Lock()
+	defer h.subscribeMu.Unlock()
+
+	// Add the handler first so no events are missed once the server subscribes.
+	h.subsMu.Lock()
+	first := len(h.subs[sub]) == 0
+	h.subs[sub] = append(h.subs[sub], ch)
+	h.subsMu.Unlock()
+	if !first {
+		return nil
+	}
+
+	_, err := request(ctx, h, 34, sub.body(), h.readBool)
+	if err != nil {
+		// Remove the handler again.
+		h.subsMu.Lock()
+		delete(h.subs, sub)
+		h.subsMu.Unlock()
+	}
+	return err
+}
+
+// unsubscribe is used to remove a handler for a subscription, unsubscribing on the server if it is the last one.
+func (h *hnpConn) unsubscribe(ctx context.Context, sub subscription, ch chan Event) error {
+	h.subscribeMu.Lock()
+	defer h.subscribeMu.Unlock()
+
+	h.subsMu.Lock()
+	handlers := h.subs[sub]
+	for i, v := range handlers {
+		if v == ch {
+			handlers = append(handlers[:i], handlers[i+1:]...)
+			break
+		}
+	}
+	if len(handlers) != 0 {
+		h.subs[sub] = handlers
+		h.subsMu.Unlock()
+		return nil
+	}
+	_, ok := h.subs[sub]
+	delete(h.subs, sub)
+	h.subsMu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	_, err := request(ctx, h, 35, sub.body(), h.readBool)
+	return err
+}
+
+// resubscribe is used to subscribe a new connection to everything the old one was subscribed to.
+func (h *hnpConn) resubscribe() {
+	h.subscribeMu.Lock()
+	defer h.subscribeMu.Unlock()
+	h.subsMu.RLock()
+	subs := make([]subscription, 0, len(h.subs))
+	for sub := range h.subs {
+		subs = append(subs, sub)
+	}
+	keyspace := map[string]bool{}
+	for prefix, sub := range h.keyspaceSubs {
+		keyspace[prefix] = sub.values
+	}
+	h.subsMu.RUnlock()
+	for _, sub := range subs {
+		_, _ = request(context.Background(), h, 34, sub.body(), h.readBool)
+	}
+	for prefix, values := range keyspace {
+		_, _ = request(context.Background(), h, 37, keyspaceBody([]byte(prefix), values), h.readBool)
+	}
+}
+
+// takeSubscriptions is used to move every subscription and event handler from a connection which failed to this one.
+// This does not subscribe on the server, so resubscribe must be called after.
+func (h *hnpConn) takeSubscriptions(old *hnpConn) {
+	old.subscribeMu.Lock()
+	old.subsMu.Lock()
+	subs, keyspaceSubs, events := old.subs, old.keyspaceSubs, old.events
+	old.subs, old.keyspaceSubs, old.events = map[subscription][]chan Event{}, map[string]*keyspaceSubscription{}, nil
+	old.subsMu.Unlock()
+	old.subscribeMu.Unlock()
+
+	h.subsMu.Lock()
+	h.subs, h.keyspaceSubs = subs, keyspaceSubs
+	h.events = append(h.events, events...)
+	h.subsMu.Unlock()
+}
+
+// Subscribe is used to send events published on the channel specified to the Go channel. Events are dropped if the Go
+// channel is full.
+func (h *hnpConn) Subscribe(channel []byte, ch chan Event) error {
+	return h.SubscribeContext(context.Background(), channel, ch)
+}
+
+// SubscribeContext is used to send events published on the channel specified to the Go channel. Events are dropped if
+// the Go channel is full.
+func (h *hnpConn) SubscribeContext(ctx context.Context, channel []byte, ch chan Event) error {
+	return h.subscribe(ctx, subscription{name: string(channel)}, ch)
+}
+
+// PSubscribe is used to send events published on any channel matching the glob pattern specified to the Go channel.
+// Events are dropped if the Go channel is full.
+func (h *hnpConn) PSubscribe(pattern []byte, ch chan Event) error {
+	return h.PSubscribeContext(context.Background(), pattern, ch)
+}
+
+// PSubscribeContext is used to send events published on any channel matching the glob pattern specified to the Go
+// channel. Events are dropped if the Go channel is full.
+func (h *hnpConn) PSubscribeContext(ctx context.Context, pattern []byte, ch chan Event) error {
+	return h.subscribe(ctx, subscription{pattern: true, name: string(pattern)}, ch)
+}
+
+// Unsubscribe is used to stop sending events published on the channel specified to the Go channel.
+func (h *hnpConn) Unsubscribe(channel []byte, ch chan Event) error {
+	return h.UnsubscribeContext(context.Background(), channel, ch)
+}
+
+// UnsubscribeContext is used to stop sending events published on the channel specified to the Go channel.
+func (h *hnpConn) UnsubscribeContext(ctx context.Context, channel []byte, ch chan Event) error {
+	return h.unsubscribe(ctx, subscription{name: string(channel)}, ch)
+}
+
+// PUnsubscribe is used to stop sending events published on channels matching the glob pattern specified to the Go
+// channel.
+func (h *hnpConn) PUnsubscribe(pattern []byte, ch chan Event) error {
+	return h.PUnsubscribeContext(context.Background(), pattern, ch)
+}
+
+// PUnsubscribeContext is used to stop sending events published on channels matching the glob pattern specified to the
+// Go channel.
+func (h *hnpConn) PUnsubscribeContext(ctx context.Context, pattern []byte, ch chan Event) error {
+	return h.unsubscribe(ctx, subscription{pattern: true, name: string(pattern)}, ch)
+}
+
+// Publish is used to publish an event on a channel. Returns the number of events the server sent.
+func (h *hnpConn) Publish(channel, data []byte) (sent uint32, err error) {
+	return h.PublishContext(context.Background(), channel, data)
+}
+
+// PublishContext is used to publish an event on a channel. Returns the number of events the server sent.
+func (h *hnpConn) PublishContext(ctx context.Context, channel, data []byte) (sent uint32, err error) {
+	body := packetmaker.New().Uint32(uint32(len(channel)), true).Bytes(channel).Bytes(data).Make()
+	return request(ctx, h, 39, body, h.readUint32)
+}
+
+// SubscribeKeyspace is used to send a notification to the Go channel whenever a key starting with the prefix changes.
+// If values is true, notifications for sets include the new value. Notifications are dropped if the Go channel is full.
+func (h *hnpConn) SubscribeKeyspace(prefix []byte, values bool, ch chan KeyspaceNotification) error {
+	return h.SubscribeKeyspaceContext(context.Background(), prefix, values, ch)
+}
+
+// SubscribeKeyspaceContext is used to send a notification to the Go channel whenever a key starting with the prefix
+// changes. If values is true, notifications for sets include the new value. Notifications are dropped if the Go
+// channel is full.
+func (h *hnpConn) SubscribeKeyspaceContext(
+	ctx context.Context, prefix []byte, values bool, ch chan KeyspaceNotification,
+) error {
+	h.subscribeMu.Lock()
+	defer h.subscribeMu.Unlock()
+
+	// Add the handler first so no notifications are missed once the server subscribes.
+	h.subsMu.Lock()
+	sub, ok := h.keyspaceSubs[string(prefix)]
+	if !ok {
+		sub = &keyspaceSubscription{}
+		h.keyspaceSubs[string(prefix)] = sub
+	}
+	sub.handlers = append(sub.handlers, ch)
+	oldValues := sub.values
+	if ok && (oldValues || !values) {
+		// The server already sends what this handler needs.
+		h.subsMu.Unlock()
+		return nil
+	}
+	sub.values = values
+	h.subsMu.Unlock()
+
+	_, err := request(ctx, h, 37, keyspaceBody(prefix, values), h.readBool)
+	if err != nil {
+		// Remove the handler again.
+		h.subsMu.Lock()
+		if ok {
+			sub.handlers = sub.handlers[:len(sub.handlers)-1]
+			sub.values = oldValues
+		} else {
+			delete(h.keyspaceSubs, string(prefix))
+		}
+		h.subsMu.Unlock()
+	}
+	return err
+}
+
+// UnsubscribeKeyspace is used to stop sending notifications for changes to keys starting with the prefix to the Go
+// channel.
+func (h *hnpConn) UnsubscribeKeyspace(prefix []byte, ch chan KeyspaceNotification) error {
+	return h.UnsubscribeKeyspaceContext(context.Background(), prefix, ch)
+}
+
+// UnsubscribeKeyspaceContext is used to stop sending notifications for changes to keys starting with the prefix to the
+// Go channel.
+func (h *hnpConn) UnsubscribeKeyspaceContext(ctx context.Context, prefix []byte, ch chan KeyspaceNotification) error {
+	h.subscribeMu.Lock()
+	defer h.subscribeMu.Unlock()
+
+	h.subsMu.Lock()
+	sub, ok := h.keyspaceSubs[string(prefix)]
+	if !ok {
+		h.subsMu.Unlock()
+		return nil
+	}
+	for i, v := range sub.handlers {
+		if v == ch {
+			sub.handlers = append(sub.handlers[:i], sub.handlers[i+1:]...)
+			break
+		}
+	}
+	if len(sub.handlers) != 0 {
+		h.subsMu.Unlock()
+		return nil
+	}
+	delete(h.keyspaceSubs, string(prefix))
+	h.subsMu.Unlock()
+
+	_, err := request(ctx, h, 38, prefix, h.readBool)
+	return err
+}
+
+// EventStats is used to get the number of events the server dropped for this connection because it could not keep up,
+// and the number waiting to be written to it.
+func (h *hnpConn) EventStats() (dropped uint64, queued uint32, err error) {
+	return h.EventStatsContext(context.Background())
+}
+
+// EventStatsContext is used to get the number of events the server dropped for this connection because it could not
+// keep up, and the number waiting to be written to it.
+func (h *hnpConn) EventStatsContext(ctx context.Context) (dropped uint64, queued uint32, err error) {
+	type stats struct {
+		dropped uint64
+		queued  uint32
+	}
+	st, err := request(ctx, h, 36, nil, func() (stats, error) {
+		b := make([]byte, 12)
+		_, err := io.ReadFull(h.c, b)
+		return stats{dropped: binary.LittleEndian.Uint64(b), queued: binary.LittleEndian.Uint32(b[8:])}, err
+	})
+	return st.dropped, st.queued, err
+}
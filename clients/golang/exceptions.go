@@ -10,6 +10,9 @@ func (e ClientError) Error() string {
 	return string(e.description)
 }
 
+// Defines the error returned when decrementing by math.MinInt64, since it cannot be negated into an increment.
+var errDecrementOverflow = ClientError{description: []byte("the delta cannot be math.MinInt64")}
+
 type clientErrorWrapper struct {
 	description []byte
 }
@@ -37,6 +40,26 @@ type UnlockError struct {
 	clientErrorWrapper
 }
 
+// NotLockOwner is returned when a mutex is unlocked by a connection which does not hold it.
+type NotLockOwner struct {
+	clientErrorWrapper
+}
+
+// LockHeld is returned by the HTTP API when a mutex is held by another connection.
+type LockHeld struct {
+	clientErrorWrapper
+}
+
+// LimitMismatch is returned when a semaphore is acquired with a different limit to the one it is in use with.
+type LimitMismatch struct {
+	clientErrorWrapper
+}
+
+// PreconditionFailed is returned by the HTTP API when a conditional write does not meet its condition.
+type PreconditionFailed struct {
+	clientErrorWrapper
+}
+
 // InvalidCredentials is returned when the users credentials are invalid.
 type InvalidCredentials struct {
 	clientErrorWrapper
@@ -47,6 +70,26 @@ type DatabaseNotFound struct {
 	clientErrorWrapper
 }
 
+// OutOfMemory is returned when the database does not have enough memory for a write.
+type OutOfMemory struct {
+	clientErrorWrapper
+}
+
+// InvalidCursor is returned when a cursor is not from a walk of the same prefix.
+type InvalidCursor struct {
+	clientErrorWrapper
+}
+
+// NotANumber is returned when a record being incremented is not a number.
+type NotANumber struct {
+	clientErrorWrapper
+}
+
+// NumberOverflow is returned when an increment would overflow.
+type NumberOverflow struct {
+	clientErrorWrapper
+}
+
 var errFactories = map[string]func([]byte) error{
 	"InvalidPacket": func(b []byte) error {
 		return InvalidPacket{clientErrorWrapper{b}}
@@ -57,12 +100,36 @@ var errFactories = map[string]func([]byte) error{
 	"UnlockError": func(b []byte) error {
 		return UnlockError{clientErrorWrapper{b}}
 	},
+	"NotLockOwner": func(b []byte) error {
+		return NotLockOwner{clientErrorWrapper{b}}
+	},
+	"LockHeld": func(b []byte) error {
+		return LockHeld{clientErrorWrapper{b}}
+	},
+	"LimitMismatch": func(b []byte) error {
+		return LimitMismatch{clientErrorWrapper{b}}
+	},
+	"PreconditionFailed": func(b []byte) error {
+		return PreconditionFailed{clientErrorWrapper{b}}
+	},
 	"InvalidCredentials": func(b []byte) error {
 		return InvalidCredentials{clientErrorWrapper{b}}
 	},
 	"DatabaseNotFound": func(b []byte) error {
 		return DatabaseNotFound{clientErrorWrapper{b}}
 	},
+	"OutOfMemory": func(b []byte) error {
+		return OutOfMemory{clientErrorWrapper{b}}
+	},
+	"InvalidCursor": func(b []byte) error {
+		return InvalidCursor{clientErrorWrapper{b}}
+	},
+	"NotANumber": func(b []byte) error {
+		return NotANumber{clientErrorWrapper{b}}
+	},
+	"NumberOverflow": func(b []byte) error {
+		return NumberOverflow{clientErrorWrapper{b}}
+	},
 }
 
 func toException(exceptionName string, exceptionDescriptionB []byte) error {
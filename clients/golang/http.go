@@ -0,0 +1,630 @@
+package hypercache
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type httpConn struct {
+	c        *http.Client
+	base     string
+	password string
+
+	// Defines the name set with SetClientName. This is a string, and is not set if it was not given one.
+	clientName atomic.Value
+}
+
+// do is used to make a request to the path specified with any extra headers. If the server returns an exception, it is
+// returned as an error.
+func (h *httpConn) do(
+	ctx context.Context, method, path string, query url.Values, body []byte, header http.Header,
+) ([]byte, error) {
+	b, _, err := h.doWithHeader(ctx, method, path, query, body, header)
+	return b, err
+}
+
+// doWithHeader is used to make a request to the path specified with any extra headers and also return the response
+// headers. If the server returns an exception, it is returned as an error.
+func (h *httpConn) doWithHeader(
+	ctx context.Context, method, path string, query url.Values, body []byte, header http.Header,
+) ([]byte, http.Header, error) {
+	// Make the request.
+	u := h.base + path
+	if query != nil {
+		u += "?" + query.Encode()
+	}
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, r)
+	if err != nil {
+		return nil, nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Authorization", "Password "+h.password)
+
+	// Send it and read the response.
+	res, err := h.c.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Handle any exceptions.
+	if exceptionName := res.Header.Get("X-Exception"); exceptionName != "" {
+		return nil, nil, toException(exceptionName, b)
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return nil, nil, ClientError{description: []byte("unexpected HTTP status: " + res.Status)}
+	}
+	return b, res.Header, nil
+}
+
+// recordPath is used to get the path for a record. Note that the server routes on the unescaped path, so keys with a
+// slash in them cannot be used over HTTP.
+func recordPath(key []byte) string {
+	return "/record/" + url.PathEscape(string(key))
+}
+
+// Ping is used to ping the server.
+func (h *httpConn) Ping() error {
+	return h.PingContext(context.Background())
+}
+
+// PingContext is used to ping the server.
+func (h *httpConn) PingContext(ctx context.Context) error {
+	_, err := h.do(ctx, "GET", "/ping", nil, nil, nil)
+	return err
+}
+
+// Get is used to get a record.
+func (h *httpConn) Get(key []byte) ([]byte, error) {
+	return h.GetContext(context.Background(), key)
+}
+
+// GetContext is used to get a record.
+func (h *httpConn) GetContext(ctx context.Context, key []byte) ([]byte, error) {
+	return h.do(ctx, "GET", recordPath(key), nil, nil, nil)
+}
+
+// Set is used to set a record. Returns true if it overwrote a record.
+func (h *httpConn) Set(key, value []byte) (overwrote bool, err error) {
+	return h.SetContext(context.Background(), key, value)
+}
+
+// SetContext is used to set a record. Returns true if it overwrote a record.
+func (h *httpConn) SetContext(ctx context.Context, key, value []byte) (overwrote bool, err error) {
+	b, err := h.do(ctx, "PUT", recordPath(key), nil, value, nil)
+	return string(b) == "true", err
+}
+
+// SetFenced is used to set a record if the fencing token is at least the highest token the record was set with.
+// Returns false if the token is stale.
+func (h *httpConn) SetFenced(key, value []byte, token uint64) (written bool, err error) {
+	return h.SetFencedContext(context.Background(), key, value, token)
+}
+
+// SetFencedContext is used to set a record if the fencing token is at least the highest token the record was set
+// with. Returns false if the token is stale.
+func (h *httpConn) SetFencedContext(ctx context.Context, key, value []byte, token uint64) (written bool, err error) {
+	b, err := h.do(ctx, "PUT", recordPath(key), nil, value, http.Header{
+		"X-Fencing-Token": {strconv.FormatUint(token, 10)},
+	})
+	if errors.As(err, &PreconditionFailed{}) {
+		return false, nil
+	}
+	return string(b) == "true", err
+}
+
+// Delete is used to delete a record. Returns true if the record existed.
+func (h *httpConn) Delete(key []byte) (deleted bool, err error) {
+	return h.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext is used to delete a record. Returns true if the record existed.
+func (h *httpConn) DeleteContext(ctx context.Context, key []byte) (deleted bool, err error) {
+	b, err := h.do(ctx, "DELETE", recordPath(key), nil, nil, nil)
+	return string(b) == "true", err
+}
+
+// DeletePrefix is used to delete every record starting with the prefix. Returns the number of nodes removed from
+// the tree.
+func (h *httpConn) DeletePrefix(prefix []byte) (removed uint64, err error) {
+	return h.DeletePrefixContext(context.Background(), prefix)
+}
+
+// DeletePrefixContext is used to delete every record starting with the prefix. Returns the number of nodes removed from
+// the tree.
+func (h *httpConn) DeletePrefixContext(ctx context.Context, prefix []byte) (removed uint64, err error) {
+	b, err := h.do(ctx, "DELETE", "/prefix/"+url.PathEscape(string(prefix)), nil, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(string(b), 10, 64)
+}
+
+// prefixEnd is used to get the first key after every key starting with the prefix. Returns nil if there is no such key.
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] != 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// WalkPrefix is used to get every record starting with the prefix in byte order. The records are fetched a page at a
+// time. Note that over HTTP, records are sent as JSON strings, so they should be valid UTF-8.
+func (h *httpConn) WalkPrefix(prefix []byte) ([]Record, error) {
+	return h.WalkPrefixContext(context.Background(), prefix)
+}
+
+// WalkPrefixContext is used to get every record starting with the prefix in byte order. The records are fetched a
+// page at a time. Note that over HTTP, records are sent as JSON strings, so they should be valid UTF-8.
+func (h *httpConn) WalkPrefixContext(ctx context.Context, prefix []byte) ([]Record, error) {
+	return walkPages(func(cursor []byte) ([]Record, []byte, error) {
+		return h.WalkPrefixPageContext(ctx, prefix, cursor, 0)
+	})
+}
+
+// WalkPrefixPage is used to get up to limit records starting with the prefix in byte order. This is done with a range
+// walk since it keeps the order, and the cursor is the last key in both. The server caps the limit to 10000, which is
+// also used if it is 0. If the cursor is not nil, the walk resumes after it. The cursor for the next page is returned,
+// or nil if there are no more records.
+func (h *httpConn) WalkPrefixPage(prefix, cursor []byte, limit int) (records []Record, next []byte, err error) {
+	return h.WalkPrefixPageContext(context.Background(), prefix, cursor, limit)
+}
+
+// WalkPrefixPageContext is used to get up to limit records starting with the prefix in byte order. This is done with
+// a range walk since it keeps the order, and the cursor is the last key in both. The server caps the limit to 10000,
+// which is also used if it is 0. If the cursor is not nil, the walk resumes after it. The cursor for the next page is
+// returned, or nil if there are no more records.
+func (h *httpConn) WalkPrefixPageContext(
+	ctx context.Context, prefix, cursor []byte, limit int,
+) (records []Record, next []byte, err error) {
+	return h.WalkRangePageContext(ctx, prefix, prefixEnd(prefix), false, cursor, limit)
+}
+
+// WalkRange is used to get every record from start (inclusive) to end (exclusive) in byte order, or in descending byte
+// order if reverse is true. An empty end means there is no end. The records are fetched a page at a time.
+func (h *httpConn) WalkRange(start, end []byte, reverse bool) ([]Record, error) {
+	return h.WalkRangeContext(context.Background(), start, end, reverse)
+}
+
+// WalkRangeContext is used to get every record from start (inclusive) to end (exclusive) in byte order, or in
+// descending byte order if reverse is true. An empty end means there is no end. The records are fetched a page at a
+// time.
+func (h *httpConn) WalkRangeContext(ctx context.Context, start, end []byte, reverse bool) ([]Record, error) {
+	return walkPages(func(cursor []byte) ([]Record, []byte, error) {
+		return h.WalkRangePageContext(ctx, start, end, reverse, cursor, 0)
+	})
+}
+
+// WalkRangePage is used to get up to limit records from start (inclusive) to end (exclusive), in descending byte order
+// if reverse is true. The server caps the limit to 10000, which is also used if it is 0. If the cursor is not nil, the
+// walk resumes after it. The cursor for the next page is returned, or nil if there are no more records.
+func (h *httpConn) WalkRangePage(
+	start, end []byte, reverse bool, cursor []byte, limit int,
+) (records []Record, next []byte, err error) {
+	return h.WalkRangePageContext(context.Background(), start, end, reverse, cursor, limit)
+}
+
+// WalkRangePageContext is used to get up to limit records from start (inclusive) to end (exclusive), in descending
+// byte order if reverse is true. The server caps the limit to 10000, which is also used if it is 0. If the cursor is
+// not nil, the walk resumes after it. The cursor for the next page is returned, or nil if there are no more records.
+func (h *httpConn) WalkRangePageContext(
+	ctx context.Context, start, end []byte, reverse bool, cursor []byte, limit int,
+) (records []Record, next []byte, err error) {
+	query := url.Values{
+		"start":   {string(start)},
+		"end":     {string(end)},
+		"reverse": {strconv.FormatBool(reverse)},
+	}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	if cursor != nil {
+		query.Set("cursor", base64.RawURLEncoding.EncodeToString(cursor))
+	}
+	b, header, err := h.doWithHeader(ctx, "GET", "/range", query, nil, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if c := header.Get("X-Cursor"); c != "" {
+		if next, err = base64.RawURLEncoding.DecodeString(c); err != nil {
+			return nil, nil, err
+		}
+	}
+	var res []struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+	}
+	if err = json.Unmarshal(b, &res); err != nil {
+		return nil, nil, err
+	}
+	records = make([]Record, len(res))
+	for i, r := range res {
+		records[i] = Record{Key: []byte(r.Key), Value: []byte(r.Value)}
+	}
+	return records, next, nil
+}
+
+// FreeTree is used to delete every record in the database.
+func (h *httpConn) FreeTree() error {
+	return h.FreeTreeContext(context.Background())
+}
+
+// FreeTreeContext is used to delete every record in the database.
+func (h *httpConn) FreeTreeContext(ctx context.Context) error {
+	_, err := h.do(ctx, "DELETE", "/", nil, nil, nil)
+	return err
+}
+
+// Increment is used to atomically add to a record as a 64-bit integer. Records which do not exist count as 0.
+func (h *httpConn) Increment(key []byte, delta int64) (int64, error) {
+	return h.IncrementContext(context.Background(), key, delta)
+}
+
+// IncrementContext is used to atomically add to a record as a 64-bit integer. Records which do not exist count as 0.
+func (h *httpConn) IncrementContext(ctx context.Context, key []byte, delta int64) (int64, error) {
+	b, err := h.do(ctx, "POST", recordPath(key)+"/incr", url.Values{
+		"by": {strconv.FormatInt(delta, 10)},
+	}, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(string(b), 10, 64)
+}
+
+// Decrement is used to atomically subtract from a record as a 64-bit integer. Records which do not exist count as 0.
+// The delta cannot be math.MinInt64, since it cannot be negated.
+func (h *httpConn) Decrement(key []byte, delta int64) (int64, error) {
+	return h.DecrementContext(context.Background(), key, delta)
+}
+
+// DecrementContext is used to atomically subtract from a record as a 64-bit integer. Records which do not exist
+// count as 0. The delta cannot be math.MinInt64, since it cannot be negated.
+func (h *httpConn) DecrementContext(ctx context.Context, key []byte, delta int64) (int64, error) {
+	if delta == math.MinInt64 {
+		return 0, errDecrementOverflow
+	}
+	return h.IncrementContext(ctx, key, -delta)
+}
+
+// IncrementFloat is used to atomically add to a record as a float. Records which do not exist count as 0.
+func (h *httpConn) IncrementFloat(key []byte, delta float64) (float64, error) {
+	return h.IncrementFloatContext(context.Background(), key, delta)
+}
+
+// IncrementFloatContext is used to atomically add to a record as a float. Records which do not exist count as 0.
+func (h *httpConn) IncrementFloatContext(ctx context.Context, key []byte, delta float64) (float64, error) {
+	b, err := h.do(ctx, "POST", recordPath(key)+"/incr", url.Values{
+		"by":    {strconv.FormatFloat(delta, 'g', -1, 64)},
+		"float": {"true"},
+	}, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(string(b), 64)
+}
+
+// lock is used to take a hold on the lock at the path and name specified, waiting in line for up to the timeout, or
+// until it is taken if the timeout is below 0. Returns the fencing token, or 0 if the timeout passed.
+func (h *httpConn) lock(
+	ctx context.Context, path string, name []byte, query url.Values, lease, timeout time.Duration,
+) (token uint64, err error) {
+	query.Set("lease", strconv.FormatInt(lease.Milliseconds(), 10))
+	query.Set("timeout", strconv.FormatInt(timeoutMillis(timeout), 10))
+	var header http.Header
+	if clientName, ok := h.clientName.Load().(string); ok {
+		header = http.Header{"X-Client-Name": {clientName}}
+	}
+	b, err := h.do(ctx, "POST", path+url.PathEscape(string(name)), query, nil, header)
+	if err != nil {
+		if errors.As(err, &LockHeld{}) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return strconv.ParseUint(string(b), 10, 64)
+}
+
+// lockQueue is used to get how many holds there are on the lock at the path and name specified and how many
+// connections are waiting for it.
+func (h *httpConn) lockQueue(ctx context.Context, path string, name []byte) (holds, waiters uint32, err error) {
+	b, err := h.do(ctx, "GET", path+url.PathEscape(string(name)), nil, nil, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	var res struct {
+		Holds   uint32 `json:"holds"`
+		Waiters uint32 `json:"waiters"`
+	}
+	err = json.Unmarshal(b, &res)
+	return res.Holds, res.Waiters, err
+}
+
+// unlock is used to release the hold with the token specified on the lock at the path and name specified.
+func (h *httpConn) unlock(ctx context.Context, path string, name []byte, token uint64) error {
+	_, err := h.do(ctx, "DELETE", path+url.PathEscape(string(name)), url.Values{
+		"token": {strconv.FormatUint(token, 10)},
+	}, nil, nil)
+	return err
+}
+
+// NamedMutexTryLock is used to lock the mutex with the name specified if it is not held. The server unlocks it when
+// the lease expires. Returns the fencing token, or 0 if it is held.
+func (h *httpConn) NamedMutexTryLock(name []byte, lease time.Duration) (token uint64, err error) {
+	return h.NamedMutexTryLockContext(context.Background(), name, lease)
+}
+
+// NamedMutexTryLockContext is used to lock the mutex with the name specified if it is not held. The server unlocks it
+// when the lease expires. Returns the fencing token, or 0 if it is held.
+func (h *httpConn) NamedMutexTryLockContext(
+	ctx context.Context, name []byte, lease time.Duration,
+) (token uint64, err error) {
+	return h.NamedMutexLockWithTimeoutContext(ctx, name, lease, 0)
+}
+
+// NamedMutexLockWithTimeout is used to lock the mutex with the name specified, waiting in line for up to the timeout.
+// If the timeout is below 0, it waits until it is locked. The server unlocks it when the lease expires. Returns the
+// fencing token, or 0 if the timeout passed.
+func (h *httpConn) NamedMutexLockWithTimeout(name []byte, lease, timeout time.Duration) (token uint64, err error) {
+	return h.NamedMutexLockWithTimeoutContext(context.Background(), name, lease, timeout)
+}
+
+// NamedMutexLockWithTimeoutContext is used to lock the mutex with the name specified, waiting in line for up to the
+// timeout. If the timeout is below 0, it waits until it is locked. The server unlocks it when the lease expires.
+// Returns the fencing token, or 0 if the timeout passed.
+func (h *httpConn) NamedMutexLockWithTimeoutContext(
+	ctx context.Context, name []byte, lease, timeout time.Duration,
+) (token uint64, err error) {
+	return h.lock(ctx, "/lock/", name, url.Values{}, lease, timeout)
+}
+
+// NamedMutexQueue is used to get if the mutex with the name specified is held and how many connections are waiting
+// for it.
+func (h *httpConn) NamedMutexQueue(name []byte) (held bool, waiters uint32, err error) {
+	return h.NamedMutexQueueContext(context.Background(), name)
+}
+
+// NamedMutexQueueContext is used to get if the mutex with the name specified is held and how many connections are
+// waiting for it.
+func (h *httpConn) NamedMutexQueueContext(ctx context.Context, name []byte) (held bool, waiters uint32, err error) {
+	b, err := h.do(ctx, "GET", "/lock/"+url.PathEscape(string(name)), nil, nil, nil)
+	if err != nil {
+		return false, 0, err
+	}
+	var res struct {
+		Held    bool   `json:"held"`
+		Waiters uint32 `json:"waiters"`
+	}
+	err = json.Unmarshal(b, &res)
+	return res.Held, res.Waiters, err
+}
+
+// NamedMutexUnlock is used to unlock the mutex with the name specified. The token is the one it was locked with.
+func (h *httpConn) NamedMutexUnlock(name []byte, token uint64) error {
+	return h.NamedMutexUnlockContext(context.Background(), name, token)
+}
+
+// NamedMutexUnlockContext is used to unlock the mutex with the name specified. The token is the one it was locked
+// with.
+func (h *httpConn) NamedMutexUnlockContext(ctx context.Context, name []byte, token uint64) error {
+	return h.unlock(ctx, "/lock/", name, token)
+}
+
+// RWMutexLock is used to take an exclusive (write) hold on the read-write lock with the name specified, waiting in
+// line for up to the timeout, or until it is taken if the timeout is below 0. The server releases it when the lease
+// expires. Returns the fencing token, or 0 if the timeout passed.
+func (h *httpConn) RWMutexLock(name []byte, lease, timeout time.Duration) (token uint64, err error) {
+	return h.RWMutexLockContext(context.Background(), name, lease, timeout)
+}
+
+// RWMutexLockContext is used to take an exclusive (write) hold on the read-write lock with the name specified, waiting
+// in line for up to the timeout, or until it is taken if the timeout is below 0. The server releases it when the
+// lease expires. Returns the fencing token, or 0 if the timeout passed.
+func (h *httpConn) RWMutexLockContext(
+	ctx context.Context, name []byte, lease, timeout time.Duration,
+) (token uint64, err error) {
+	return h.lock(ctx, "/rwlock/", name, url.Values{"mode": {"exclusive"}}, lease, timeout)
+}
+
+// RWMutexRLock is used to take a shared (read) hold on the read-write lock with the name specified, waiting in line
+// for up to the timeout, or until it is taken if the timeout is below 0. The server releases it when the lease
+// expires. Returns the fencing token, or 0 if the timeout passed.
+func (h *httpConn) RWMutexRLock(name []byte, lease, timeout time.Duration) (token uint64, err error) {
+	return h.RWMutexRLockContext(context.Background(), name, lease, timeout)
+}
+
+// RWMutexRLockContext is used to take a shared (read) hold on the read-write lock with the name specified, waiting in
+// line for up to the timeout, or until it is taken if the timeout is below 0. The server releases it when the lease
+// expires. Returns the fencing token, or 0 if the timeout passed.
+func (h *httpConn) RWMutexRLockContext(
+	ctx context.Context, name []byte, lease, timeout time.Duration,
+) (token uint64, err error) {
+	return h.lock(ctx, "/rwlock/", name, url.Values{"mode": {"shared"}}, lease, timeout)
+}
+
+// RWMutexUnlock is used to release the hold on the read-write lock with the name specified. The token is the one the
+// hold was taken with.
+func (h *httpConn) RWMutexUnlock(name []byte, token uint64) error {
+	return h.RWMutexUnlockContext(context.Background(), name, token)
+}
+
+// RWMutexUnlockContext is used to release the hold on the read-write lock with the name specified. The token is the
+// one the hold was taken with.
+func (h *httpConn) RWMutexUnlockContext(ctx context.Context, name []byte, token uint64) error {
+	return h.unlock(ctx, "/rwlock/", name, token)
+}
+
+// RWMutexQueue is used to get how many holds there are on the read-write lock with the name specified and how many
+// connections are waiting for it.
+func (h *httpConn) RWMutexQueue(name []byte) (holds, waiters uint32, err error) {
+	return h.RWMutexQueueContext(context.Background(), name)
+}
+
+// RWMutexQueueContext is used to get how many holds there are on the read-write lock with the name specified and how
+// many connections are waiting for it.
+func (h *httpConn) RWMutexQueueContext(ctx context.Context, name []byte) (holds, waiters uint32, err error) {
+	return h.lockQueue(ctx, "/rwlock/", name)
+}
+
+// SemaphoreAcquire is used to take a hold on the semaphore with the name specified, waiting in line for up to the
+// timeout, or until it is taken if the timeout is below 0. The server releases it when the lease expires. Returns the
+// fencing token, or 0 if the timeout passed.
+func (h *httpConn) SemaphoreAcquire(
+	name []byte, limit uint32, lease, timeout time.Duration,
+) (token uint64, err error) {
+	return h.SemaphoreAcquireContext(context.Background(), name, limit, lease, timeout)
+}
+
+// SemaphoreAcquireContext is used to take a hold on the semaphore with the name specified, waiting in line for up to
+// the timeout, or until it is taken if the timeout is below 0. The server releases it when the lease expires. Returns
+// the fencing token, or 0 if the timeout passed.
+func (h *httpConn) SemaphoreAcquireContext(
+	ctx context.Context, name []byte, limit uint32, lease, timeout time.Duration,
+) (token uint64, err error) {
+	query := url.Values{"limit": {strconv.FormatUint(uint64(limit), 10)}}
+	return h.lock(ctx, "/semaphore/", name, query, lease, timeout)
+}
+
+// SemaphoreRelease is used to release the hold on the semaphore with the name specified. The token is the one the
+// hold was taken with.
+func (h *httpConn) SemaphoreRelease(name []byte, token uint64) error {
+	return h.SemaphoreReleaseContext(context.Background(), name, token)
+}
+
+// SemaphoreReleaseContext is used to release the hold on the semaphore with the name specified. The token is the one
+// the hold was taken with.
+func (h *httpConn) SemaphoreReleaseContext(ctx context.Context, name []byte, token uint64) error {
+	return h.unlock(ctx, "/semaphore/", name, token)
+}
+
+// SemaphoreQueue is used to get how many holds there are on the semaphore with the name specified and how many
+// connections are waiting for it.
+func (h *httpConn) SemaphoreQueue(name []byte) (holds, waiters uint32, err error) {
+	return h.SemaphoreQueueContext(context.Background(), name)
+}
+
+// SemaphoreQueueContext is used to get how many holds there are on the semaphore with the name specified and how many
+// connections are waiting for it.
+func (h *httpConn) SemaphoreQueueContext(ctx context.Context, name []byte) (holds, waiters uint32, err error) {
+	return h.lockQueue(ctx, "/semaphore/", name)
+}
+
+// lockKinds is the name of each kind of lock in the HTTP API.
+var lockKinds = []string{LockKindMutex: "mutex", LockKindRWMutex: "rwlock", LockKindSemaphore: "semaphore"}
+
+// Locks is used to list every lock in the database along with who holds it and how many connections are waiting for
+// it.
+func (h *httpConn) Locks() ([]Lock, error) {
+	return h.LocksContext(context.Background())
+}
+
+// LocksContext is used to list every lock in the database along with who holds it and how many connections are
+// waiting for it.
+func (h *httpConn) LocksContext(ctx context.Context) ([]Lock, error) {
+	b, err := h.do(ctx, "GET", "/locks", nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var res []struct {
+		Kind    string `json:"kind"`
+		Name    string `json:"name"`
+		Holders []struct {
+			Addr       string    `json:"addr"`
+			ClientName string    `json:"client_name"`
+			Acquired   time.Time `json:"acquired"`
+			Token      uint64    `json:"token"`
+			Shared     bool      `json:"shared"`
+		} `json:"holders"`
+		Waiters uint32 `json:"waiters"`
+	}
+	if err = json.Unmarshal(b, &res); err != nil {
+		return nil, err
+	}
+	locks := make([]Lock, len(res))
+	for i, l := range res {
+		for kind, v := range lockKinds {
+			if v == l.Kind {
+				locks[i].Kind = LockKind(kind)
+			}
+		}
+		locks[i].Name = []byte(l.Name)
+		locks[i].Waiters = l.Waiters
+		locks[i].Holders = make([]LockHolder, len(l.Holders))
+		for j, holder := range l.Holders {
+			locks[i].Holders[j] = LockHolder(holder)
+		}
+	}
+	return locks, nil
+}
+
+// ForceRelease is used to release every hold on a lock, whoever has it. This needs the admin password the server was
+// started with. Returns the number of holds released.
+func (h *httpConn) ForceRelease(kind LockKind, name []byte, adminPassword string) (released uint32, err error) {
+	return h.ForceReleaseContext(context.Background(), kind, name, adminPassword)
+}
+
+// ForceReleaseContext is used to release every hold on a lock, whoever has it. This needs the admin password the
+// server was started with. Returns the number of holds released.
+func (h *httpConn) ForceReleaseContext(
+	ctx context.Context, kind LockKind, name []byte, adminPassword string,
+) (released uint32, err error) {
+	if int(kind) >= len(lockKinds) {
+		return 0, ClientError{description: []byte("unknown lock kind")}
+	}
+	header := http.Header{"X-Admin-Password": {adminPassword}}
+	if clientName, ok := h.clientName.Load().(string); ok {
+		header.Set("X-Client-Name", clientName)
+	}
+	b, err := h.do(ctx, "DELETE", "/locks/"+lockKinds[kind]+"/"+url.PathEscape(string(name)), nil, nil, header)
+	if err != nil {
+		return 0, err
+	}
+	var res struct {
+		Released uint32 `json:"released"`
+	}
+	err = json.Unmarshal(b, &res)
+	return res.Released, err
+}
+
+// SetClientName is used to set the name sent with lock requests. The name is shown as the holder of the locks.
+func (h *httpConn) SetClientName(name string) {
+	h.clientName.Store(name)
+}
+
+// NewConnectionWithHTTP is used to connect to the HTTP API at the base URL specified (for example,
+// "http://localhost:8080"). The connection is pinged to check the password and database.
+func NewConnectionWithHTTP(baseURL, password string, db uint16) (HTTPImplementation, error) {
+	h := &httpConn{
+		c:        &http.Client{},
+		base:     strings.TrimSuffix(baseURL, "/") + "/api/v1/" + strconv.Itoa(int(db)),
+		password: password,
+	}
+	if err := h.Ping(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
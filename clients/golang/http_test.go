@@ -0,0 +1,101 @@
+package hypercache
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// newHTTPTestConn is used to make a HTTP connection to a test server with the handler specified. Pings always succeed.
+func newHTTPTestConn(t *testing.T, hn http.HandlerFunc) BaseImplementation {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/0/ping" {
+			return
+		}
+		hn(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	h, err := NewConnectionWithHTTP(srv.URL, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestHTTPExceptions(t *testing.T) {
+	var exceptionName string
+	h := newHTTPTestConn(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Exception", exceptionName)
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("description"))
+	})
+
+	for name, want := range map[string]any{
+		"NotFound":       NotFound{},
+		"OutOfMemory":    OutOfMemory{},
+		"InvalidCursor":  InvalidCursor{},
+		"NotANumber":     NotANumber{},
+		"NumberOverflow": NumberOverflow{},
+		"SomethingNew":   ClientError{},
+	} {
+		exceptionName = name
+		_, err := h.Get([]byte("key"))
+		if reflect.TypeOf(err) != reflect.TypeOf(want) {
+			t.Errorf("%s: got %T, want %T", name, err, want)
+			continue
+		}
+		var base ClientError
+		if !errors.As(err, &base) || base.Error() != "description" {
+			t.Errorf("%s: got %v, want a ClientError with the description", name, err)
+		}
+	}
+}
+
+func TestHTTPUnexpectedStatus(t *testing.T) {
+	h := newHTTPTestConn(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	})
+	if _, err := h.Get([]byte("key")); !errors.As(err, &ClientError{}) {
+		t.Fatalf("got %v, want a ClientError", err)
+	}
+}
+
+func TestHTTPWalkPages(t *testing.T) {
+	h := newHTTPTestConn(t, func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("start") != "p" || query.Get("end") != "q" {
+			t.Errorf("got range %q to %q, want p to q", query.Get("start"), query.Get("end"))
+		}
+		switch query.Get("cursor") {
+		case "":
+			w.Header().Set("X-Cursor", "cGE") // pa
+			_, _ = w.Write([]byte(`[{"key":"pa","value":"1"}]`))
+		case "cGE":
+			_, _ = w.Write([]byte(`[{"key":"pb","value":"2"}]`))
+		default:
+			t.Errorf("got unexpected cursor %q", query.Get("cursor"))
+		}
+	})
+
+	records, err := h.WalkPrefix([]byte("p"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Record{{Key: []byte("pa"), Value: []byte("1")}, {Key: []byte("pb"), Value: []byte("2")}}
+	if !reflect.DeepEqual(records, want) {
+		t.Errorf("got %q, want %q", records, want)
+	}
+}
+
+func TestHTTPDecrementOverflow(t *testing.T) {
+	h := newHTTPTestConn(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Error("the request should not be sent")
+	})
+	if _, err := h.Decrement([]byte("key"), math.MinInt64); !reflect.DeepEqual(err, errDecrementOverflow) {
+		t.Fatalf("got %v, want errDecrementOverflow", err)
+	}
+}
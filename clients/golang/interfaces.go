@@ -1,28 +1,400 @@
 package hypercache
 
-// BaseImplementation is implementation functionality used by both HTTP and HNP.
+import (
+	"context"
+	"time"
+)
+
+// Record is a record returned from a walk.
+type Record struct {
+	Key   []byte
+	Value []byte
+}
+
+// Event is an event published on a channel.
+type Event struct {
+	// Channel is the channel the event was published on.
+	Channel []byte
+
+	// Pattern is the glob pattern the channel matched, or nil if the channel was subscribed to directly.
+	Pattern []byte
+
+	// Data is the event. Note that the bytes should not be mutated, since they are shared between handlers.
+	Data []byte
+}
+
+// KeyspaceOp is the kind of change in a keyspace notification.
+type KeyspaceOp byte
+
+const (
+	// KeyspaceSet is a key being set, including by an increment.
+	KeyspaceSet KeyspaceOp = iota
+
+	// KeyspaceDelete is a key being deleted.
+	KeyspaceDelete
+
+	// KeyspaceDeletePrefix is every key starting with a prefix being deleted.
+	KeyspaceDeletePrefix
+
+	// KeyspaceFreeTree is every key in the database being deleted.
+	KeyspaceFreeTree
+
+	// KeyspaceExpireAt is the time a key expires at being changed.
+	KeyspaceExpireAt
+
+	// KeyspaceEvict is a key being evicted to make room for a write.
+	KeyspaceEvict
+)
+
+// KeyspaceNotification is a change to keys starting with a prefix which was subscribed to.
+type KeyspaceNotification struct {
+	// Prefix is the prefix which was subscribed to.
+	Prefix []byte
+
+	// Op is the kind of change.
+	Op KeyspaceOp
+
+	// Key is the key which changed. For KeyspaceDeletePrefix, this is the prefix which was deleted, which can be
+	// shorter than the prefix subscribed to. For KeyspaceFreeTree, this is empty.
+	Key []byte
+
+	// Removed is the number of nodes removed from the tree for KeyspaceDeletePrefix.
+	Removed uint64
+
+	// Value is the new value for KeyspaceSet if the prefix was subscribed to with values, or nil otherwise.
+	Value []byte
+}
+
+// LockKind is the kind of a lock.
+type LockKind byte
+
+const (
+	// LockKindMutex is a mutex. The global mutex is the mutex with an empty name.
+	LockKindMutex LockKind = iota
+
+	// LockKindRWMutex is a read-write lock.
+	LockKindRWMutex
+
+	// LockKindSemaphore is a semaphore.
+	LockKindSemaphore
+)
+
+// LockHolder is a hold on a lock.
+type LockHolder struct {
+	// Addr is the remote address of the connection with the hold, as the server sees it.
+	Addr string
+
+	// ClientName is the name the client gave itself, or a blank string if it did not give one.
+	ClientName string
+
+	// Acquired is when the hold was given out.
+	Acquired time.Time
+
+	// Token is the fencing token of the hold.
+	Token uint64
+
+	// Shared is true if the hold is shared.
+	Shared bool
+}
+
+// Lock is a lock returned from a lock list.
+type Lock struct {
+	Kind    LockKind
+	Name    []byte
+	Holders []LockHolder
+	Waiters uint32
+}
+
+// BaseImplementation is implementation functionality used by both HTTP and HNP. Each method has a variant which
+// takes a context. If the context is done before the server replies, the context error is returned.
 type BaseImplementation interface {
 	// Ping is used to ping the server.
 	Ping() error
+	PingContext(ctx context.Context) error
 
 	// Get is used to get a record.
 	Get(key []byte) ([]byte, error)
+	GetContext(ctx context.Context, key []byte) ([]byte, error)
+
+	// Set is used to set a record. Returns true if it overwrote a record.
+	Set(key, value []byte) (overwrote bool, err error)
+	SetContext(ctx context.Context, key, value []byte) (overwrote bool, err error)
+
+	// SetFenced is used to set a record if the fencing token from a lock is at least the highest token the record was
+	// set with. Returns false if the token is stale, meaning the lock was taken by someone else since. Deleting the
+	// record also removes its highest token.
+	SetFenced(key, value []byte, token uint64) (written bool, err error)
+	SetFencedContext(ctx context.Context, key, value []byte, token uint64) (written bool, err error)
+
+	// Delete is used to delete a record. Returns true if the record existed.
+	Delete(key []byte) (deleted bool, err error)
+	DeleteContext(ctx context.Context, key []byte) (deleted bool, err error)
+
+	// DeletePrefix is used to delete every record starting with the prefix. Returns the number of nodes removed from
+	// the tree.
+	DeletePrefix(prefix []byte) (removed uint64, err error)
+	DeletePrefixContext(ctx context.Context, prefix []byte) (removed uint64, err error)
+
+	// WalkPrefix is used to get every record starting with the prefix in byte order. The records are fetched a page at
+	// a time.
+	WalkPrefix(prefix []byte) ([]Record, error)
+	WalkPrefixContext(ctx context.Context, prefix []byte) ([]Record, error)
+
+	// WalkPrefixPage is used to get up to limit records starting with the prefix in byte order. The server caps the
+	// limit to 10000, which is also used if it is 0. If the cursor is not nil, the walk resumes after it. The cursor
+	// for the next page is returned, or nil if there are no more records.
+	WalkPrefixPage(prefix, cursor []byte, limit int) (records []Record, next []byte, err error)
+	WalkPrefixPageContext(
+		ctx context.Context, prefix, cursor []byte, limit int,
+	) (records []Record, next []byte, err error)
+
+	// WalkRange is used to get every record from start (inclusive) to end (exclusive) in byte order, or in descending
+	// byte order if reverse is true. An empty end means there is no end. The records are fetched a page at a time.
+	WalkRange(start, end []byte, reverse bool) ([]Record, error)
+	WalkRangeContext(ctx context.Context, start, end []byte, reverse bool) ([]Record, error)
+
+	// WalkRangePage is used to get up to limit records from start (inclusive) to end (exclusive), in descending byte
+	// order if reverse is true. The server caps the limit to 10000, which is also used if it is 0. If the cursor is not
+	// nil, the walk resumes after it. The cursor for the next page is returned, or nil if there are no more records.
+	WalkRangePage(start, end []byte, reverse bool, cursor []byte, limit int) (records []Record, next []byte, err error)
+	WalkRangePageContext(
+		ctx context.Context, start, end []byte, reverse bool, cursor []byte, limit int,
+	) (records []Record, next []byte, err error)
+
+	// FreeTree is used to delete every record in the database.
+	FreeTree() error
+	FreeTreeContext(ctx context.Context) error
+
+	// Increment is used to atomically add to a record as a 64-bit integer. Records which do not exist count as 0.
+	Increment(key []byte, delta int64) (int64, error)
+	IncrementContext(ctx context.Context, key []byte, delta int64) (int64, error)
+
+	// Decrement is used to atomically subtract from a record as a 64-bit integer. Records which do not exist count as
+	// 0. The delta cannot be math.MinInt64, since it cannot be negated.
+	Decrement(key []byte, delta int64) (int64, error)
+	DecrementContext(ctx context.Context, key []byte, delta int64) (int64, error)
+
+	// IncrementFloat is used to atomically add to a record as a float. Records which do not exist count as 0.
+	IncrementFloat(key []byte, delta float64) (float64, error)
+	IncrementFloatContext(ctx context.Context, key []byte, delta float64) (float64, error)
+
+	// NamedMutexQueue is used to get if the mutex with the name specified is held and how many connections are
+	// waiting for it.
+	NamedMutexQueue(name []byte) (held bool, waiters uint32, err error)
+	NamedMutexQueueContext(ctx context.Context, name []byte) (held bool, waiters uint32, err error)
+
+	// RWMutexQueue is used to get how many holds there are on the read-write lock with the name specified and how many
+	// connections are waiting for it.
+	RWMutexQueue(name []byte) (holds, waiters uint32, err error)
+	RWMutexQueueContext(ctx context.Context, name []byte) (holds, waiters uint32, err error)
+
+	// SemaphoreQueue is used to get how many holds there are on the semaphore with the name specified and how many
+	// connections are waiting for it.
+	SemaphoreQueue(name []byte) (holds, waiters uint32, err error)
+	SemaphoreQueueContext(ctx context.Context, name []byte) (holds, waiters uint32, err error)
+
+	// Locks is used to list every lock in the database along with who holds it and how many connections are waiting
+	// for it. This is used to find what holds a lock when something is stuck.
+	Locks() ([]Lock, error)
+	LocksContext(ctx context.Context) ([]Lock, error)
+
+	// ForceRelease is used to release every hold on a lock, whoever has it. The lock is then given to anything
+	// waiting for it. This is meant for operators freeing a lock which is stuck, so it needs the admin password the
+	// server was started with and the server logs who asked for it. Returns the number of holds released.
+	ForceRelease(kind LockKind, name []byte, adminPassword string) (released uint32, err error)
+	ForceReleaseContext(
+		ctx context.Context, kind LockKind, name []byte, adminPassword string,
+	) (released uint32, err error)
 }
 
 // HNPImplementation includes HNP exclusive functionality.
 type HNPImplementation interface {
 	BaseImplementation
 
-	// AddEventHandler is used to add a handler for custom events.
+	// AddEventHandler is used to add a handler for events sent with SendEvent.
 	// Note that the bytes should not be mutated.
+	//
+	// Deprecated: Use Subscribe or PSubscribe, which only get the events published on the channels asked for.
 	AddEventHandler(ch chan []byte)
 
-	// MutexLock is used to lock a global mutex.
+	// Subscribe is used to send events published on the channel specified to the Go channel. Events are dropped if the
+	// Go channel is full. Connections which reconnect subscribe again on the new connection.
+	Subscribe(channel []byte, ch chan Event) error
+	SubscribeContext(ctx context.Context, channel []byte, ch chan Event) error
+
+	// PSubscribe is used to send events published on any channel matching the glob pattern specified to the Go
+	// channel. A "*" matches any number of bytes and a "?" matches one byte. Otherwise, this is the same as Subscribe.
+	PSubscribe(pattern []byte, ch chan Event) error
+	PSubscribeContext(ctx context.Context, pattern []byte, ch chan Event) error
+
+	// Unsubscribe is used to stop sending events published on the channel specified to the Go channel.
+	Unsubscribe(channel []byte, ch chan Event) error
+	UnsubscribeContext(ctx context.Context, channel []byte, ch chan Event) error
+
+	// PUnsubscribe is used to stop sending events published on channels matching the glob pattern specified to the
+	// Go channel.
+	PUnsubscribe(pattern []byte, ch chan Event) error
+	PUnsubscribeContext(ctx context.Context, pattern []byte, ch chan Event) error
+
+	// SubscribeKeyspace is used to send a notification to the Go channel whenever a key starting with the prefix
+	// changes. If values is true, notifications for sets include the new value. Keys removed because they expired are
+	// not notified. Notifications are dropped if the Go channel is full. Connections which reconnect subscribe again
+	// on the new connection.
+	SubscribeKeyspace(prefix []byte, values bool, ch chan KeyspaceNotification) error
+	SubscribeKeyspaceContext(ctx context.Context, prefix []byte, values bool, ch chan KeyspaceNotification) error
+
+	// UnsubscribeKeyspace is used to stop sending notifications for changes to keys starting with the prefix to the Go
+	// channel.
+	UnsubscribeKeyspace(prefix []byte, ch chan KeyspaceNotification) error
+	UnsubscribeKeyspaceContext(ctx context.Context, prefix []byte, ch chan KeyspaceNotification) error
+
+	// EventStats is used to get the number of events the server dropped for this connection because it could not
+	// keep up, and the number waiting to be written to it. The server drops events when too many are waiting, or
+	// closes the connection, depending on how it is configured.
+	EventStats() (dropped uint64, queued uint32, err error)
+	EventStatsContext(ctx context.Context) (dropped uint64, queued uint32, err error)
+
+	// Publish is used to publish an event on a channel. Returns the number of events the server sent, which is one
+	// for each connection subscribed to the channel and one for each pattern matching it.
+	Publish(channel, data []byte) (sent uint32, err error)
+	PublishContext(ctx context.Context, channel, data []byte) (sent uint32, err error)
+
+	// MutexLock is used to lock a global mutex. The server unlocks it if the connection closes. If the context is done
+	// before the mutex is locked, it is unlocked as soon as the server locks it.
 	MutexLock() error
+	MutexLockContext(ctx context.Context) error
+
+	// MutexLockWithLease is used to lock a global mutex which the server unlocks when the lease expires. If the lease
+	// is 0, it has no lease. Returns the fencing token.
+	MutexLockWithLease(lease time.Duration) (token uint64, err error)
+	MutexLockWithLeaseContext(ctx context.Context, lease time.Duration) (token uint64, err error)
 
-	// MutexUnlock is used to unlock a globally locked mutex.
+	// MutexUnlock is used to unlock a globally locked mutex. Returns NotLockOwner if another connection holds it.
 	MutexUnlock() error
+	MutexUnlockContext(ctx context.Context) error
+
+	// NamedMutexLock is used to lock the mutex with the name specified. Named mutexes are made by the server when they
+	// are first used, so unrelated work does not wait on one lock. The server unlocks it if the connection closes, or
+	// when the lease expires if it is above 0. If the context is done before the mutex is locked, it is unlocked as
+	// soon as the server locks it. Returns the fencing token, which increases every time the mutex is locked.
+	NamedMutexLock(name []byte, lease time.Duration) (token uint64, err error)
+	NamedMutexLockContext(ctx context.Context, name []byte, lease time.Duration) (token uint64, err error)
+
+	// NamedMutexTryLock is used to lock the mutex with the name specified if it is not held. Returns the fencing token,
+	// or 0 if it is held.
+	NamedMutexTryLock(name []byte, lease time.Duration) (token uint64, err error)
+	NamedMutexTryLockContext(ctx context.Context, name []byte, lease time.Duration) (token uint64, err error)
+
+	// NamedMutexLockWithTimeout is used to lock the mutex with the name specified, waiting in line for up to the
+	// timeout, or forever if it is below 0. Connections waiting for a mutex get it in the order they asked for it.
+	// Returns the fencing token, or 0 if the timeout passed.
+	NamedMutexLockWithTimeout(name []byte, lease, timeout time.Duration) (token uint64, err error)
+	NamedMutexLockWithTimeoutContext(
+		ctx context.Context, name []byte, lease, timeout time.Duration,
+	) (token uint64, err error)
 
-	// SendEvent is used to send an event to the HyperCache server.
+	// NamedMutexUnlock is used to unlock the mutex with the name specified. Returns NotLockOwner if another connection
+	// holds it.
+	NamedMutexUnlock(name []byte) error
+	NamedMutexUnlockContext(ctx context.Context, name []byte) error
+
+	// RWMutexLock is used to take an exclusive (write) hold on the read-write lock with the name specified, waiting in
+	// line for up to the timeout, or until it is taken if the timeout is below 0. Read-write locks are made by the
+	// server when they are first used. The server releases the hold if the connection closes, or when the lease
+	// expires if it is above 0. Returns the fencing token, or 0 if the timeout passed.
+	RWMutexLock(name []byte, lease, timeout time.Duration) (token uint64, err error)
+	RWMutexLockContext(ctx context.Context, name []byte, lease, timeout time.Duration) (token uint64, err error)
+
+	// RWMutexRLock is used to take a shared (read) hold on the read-write lock with the name specified. Any number of
+	// connections can have a shared hold at once, but not whilst there is an exclusive hold. Shared holds wait behind
+	// exclusive holds which asked first. Otherwise, this is the same as RWMutexLock.
+	RWMutexRLock(name []byte, lease, timeout time.Duration) (token uint64, err error)
+	RWMutexRLockContext(ctx context.Context, name []byte, lease, timeout time.Duration) (token uint64, err error)
+
+	// RWMutexUnlock is used to release the oldest hold this connection has on the read-write lock with the name
+	// specified. Returns NotLockOwner if only other connections hold it.
+	RWMutexUnlock(name []byte) error
+	RWMutexUnlockContext(ctx context.Context, name []byte) error
+
+	// SemaphoreAcquire is used to take a hold on the semaphore with the name specified, which up to the limit
+	// connections can hold at once. The limit must be the same for everything using the semaphore, or LimitMismatch
+	// is returned. Otherwise, this is the same as RWMutexLock.
+	SemaphoreAcquire(name []byte, limit uint32, lease, timeout time.Duration) (token uint64, err error)
+	SemaphoreAcquireContext(
+		ctx context.Context, name []byte, limit uint32, lease, timeout time.Duration,
+	) (token uint64, err error)
+
+	// SemaphoreRelease is used to release the oldest hold this connection has on the semaphore with the name
+	// specified. Returns NotLockOwner if only other connections hold it.
+	SemaphoreRelease(name []byte) error
+	SemaphoreReleaseContext(ctx context.Context, name []byte) error
+
+	// SetClientName is used to name the connection. The name is shown as the holder of any locks the connection has.
+	// Connections which reconnect set it again on the new connection.
+	SetClientName(name string) error
+	SetClientNameContext(ctx context.Context, name string) error
+
+	// SendEvent is used to send an event to every other connection on the database.
+	//
+	// Deprecated: Use Publish, which only sends the event to the connections subscribed to the channel.
 	SendEvent(b []byte) error
+	SendEventContext(ctx context.Context, b []byte) error
+
+	// Close is used to close the connection. Connections which reconnect stop doing so.
+	Close() error
+}
+
+// HTTPImplementation includes HTTP exclusive functionality.
+type HTTPImplementation interface {
+	BaseImplementation
+
+	// SetClientName is used to set the name sent with lock requests. The name is shown as the holder of the locks.
+	SetClientName(name string)
+
+	// NamedMutexTryLock is used to lock the mutex with the name specified if it is not held. Since there is no
+	// connection to release it, the server unlocks it when the lease expires. Returns the fencing token, or 0 if it is
+	// held.
+	NamedMutexTryLock(name []byte, lease time.Duration) (token uint64, err error)
+	NamedMutexTryLockContext(ctx context.Context, name []byte, lease time.Duration) (token uint64, err error)
+
+	// NamedMutexLockWithTimeout is used to lock the mutex with the name specified, waiting in line for up to the
+	// timeout, or forever if it is below 0. The server unlocks it when the lease expires. Returns the fencing token,
+	// or 0 if the timeout passed.
+	NamedMutexLockWithTimeout(name []byte, lease, timeout time.Duration) (token uint64, err error)
+	NamedMutexLockWithTimeoutContext(
+		ctx context.Context, name []byte, lease, timeout time.Duration,
+	) (token uint64, err error)
+
+	// NamedMutexUnlock is used to unlock the mutex with the name specified. The token is the one it was locked with.
+	// Returns NotLockOwner if it was locked again since.
+	NamedMutexUnlock(name []byte, token uint64) error
+	NamedMutexUnlockContext(ctx context.Context, name []byte, token uint64) error
+
+	// RWMutexLock is used to take an exclusive (write) hold on the read-write lock with the name specified, waiting in
+	// line for up to the timeout, or until it is taken if the timeout is below 0. The server releases it when the
+	// lease expires. Returns the fencing token, or 0 if the timeout passed.
+	RWMutexLock(name []byte, lease, timeout time.Duration) (token uint64, err error)
+	RWMutexLockContext(ctx context.Context, name []byte, lease, timeout time.Duration) (token uint64, err error)
+
+	// RWMutexRLock is used to take a shared (read) hold on the read-write lock with the name specified. Otherwise,
+	// this is the same as RWMutexLock.
+	RWMutexRLock(name []byte, lease, timeout time.Duration) (token uint64, err error)
+	RWMutexRLockContext(ctx context.Context, name []byte, lease, timeout time.Duration) (token uint64, err error)
+
+	// RWMutexUnlock is used to release the hold on the read-write lock with the name specified. The token is the one
+	// the hold was taken with.
+	RWMutexUnlock(name []byte, token uint64) error
+	RWMutexUnlockContext(ctx context.Context, name []byte, token uint64) error
+
+	// SemaphoreAcquire is used to take a hold on the semaphore with the name specified, which up to the limit holds
+	// can be on at once. Otherwise, this is the same as RWMutexLock.
+	SemaphoreAcquire(name []byte, limit uint32, lease, timeout time.Duration) (token uint64, err error)
+	SemaphoreAcquireContext(
+		ctx context.Context, name []byte, limit uint32, lease, timeout time.Duration,
+	) (token uint64, err error)
+
+	// SemaphoreRelease is used to release the hold on the semaphore with the name specified. The token is the one the
+	// hold was taken with.
+	SemaphoreRelease(name []byte, token uint64) error
+	SemaphoreReleaseContext(ctx context.Context, name []byte, token uint64) error
 }
@@ -0,0 +1,1040 @@
+package hypercache
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PoolOptions defines how a pool manages its connections.
+type PoolOptions struct {
+	// MinConnections is the number of connections which are kept open. Defaults to 1.
+	MinConnections int
+
+	// MaxConnections is the most connections which are opened for requests. Defaults to 10.
+	MaxConnections int
+
+	// HealthCheckInterval is how often connections are pinged. Connections which fail are replaced, and connections
+	// above the minimum which were not used since the last check are closed. This includes the connections events and
+	// the mutex are pinned to. Subscriptions and event handlers are moved to the new connection, but the mutex is lost
+	// if it was held on the old one, which is reported to OnMutexLost. Defaults to 30s.
+	HealthCheckInterval time.Duration
+
+	// HealthCheckTimeout is how long a ping can take before the connection is deemed unhealthy. Defaults to 5s.
+	HealthCheckTimeout time.Duration
+
+	// OnMutexLost is called when the connection mutexes are pinned to is replaced whilst it holds the global mutex or a
+	// named mutex, since the new connection does not hold them.
+	OnMutexLost func()
+}
+
+type pooledConn struct {
+	conn    HNPImplementation
+	pending int32
+	used    uint32
+}
+
+func (c *pooledConn) release() {
+	atomic.AddInt32(&c.pending, -1)
+}
+
+type pool struct {
+	dial func() (HNPImplementation, error)
+	opts PoolOptions
+
+	conns   []*pooledConn
+	connsMu sync.RWMutex
+
+	// Defines if a connection is being opened in the background.
+	growing uint32
+
+	// Defines the connections which subscriptions and the mutex are pinned to. These are opened when they are first
+	// used.
+	eventConn HNPImplementation
+	mutexConn HNPImplementation
+	pinnedMu  sync.Mutex
+
+	// Defines the number of mutexes held on the mutex connection, including the global mutex.
+	mutexesHeld int32
+
+	closeCh   chan struct{}
+	closeOnce sync.Once
+}
+
+// acquire is used to get the connection with the least pending requests. If every connection is busy, another
+// is opened in the background.
+func (p *pool) acquire() (*pooledConn, error) {
+	p.connsMu.RLock()
+	var best *pooledConn
+	for _, c := range p.conns {
+		if best == nil || atomic.LoadInt32(&c.pending) < atomic.LoadInt32(&best.pending) {
+			best = c
+		}
+	}
+	count := len(p.conns)
+	p.connsMu.RUnlock()
+
+	if best == nil {
+		// Every connection failed, so open one now.
+		c, err := p.open()
+		if err != nil {
+			return nil, err
+		}
+		best = c
+	} else if atomic.LoadInt32(&best.pending) != 0 && count < p.opts.MaxConnections &&
+		atomic.CompareAndSwapUint32(&p.growing, 0, 1) {
+		go func() {
+			_, _ = p.open()
+			atomic.StoreUint32(&p.growing, 0)
+		}()
+	}
+	atomic.AddInt32(&best.pending, 1)
+	atomic.StoreUint32(&best.used, 1)
+	return best, nil
+}
+
+// open is used to open a connection and add it to the pool.
+func (p *pool) open() (*pooledConn, error) {
+	conn, err := p.dial()
+	if err != nil {
+		return nil, err
+	}
+	c := &pooledConn{conn: conn}
+	p.connsMu.Lock()
+	p.conns = append(p.conns, c)
+	p.connsMu.Unlock()
+	return c, nil
+}
+
+// healthCheck is used to ping every connection, replacing any which fail and closing any above the minimum which
+// were not used since the last check.
+func (p *pool) healthCheck() {
+	p.connsMu.RLock()
+	conns := append([]*pooledConn(nil), p.conns...)
+	p.connsMu.RUnlock()
+
+	// Find the connections to remove.
+	remove := map[*pooledConn]bool{}
+	failed := map[*pooledConn]bool{}
+	idle := 0
+	for _, c := range conns {
+		ctx, cancel := context.WithTimeout(context.Background(), p.opts.HealthCheckTimeout)
+		err := c.conn.PingContext(ctx)
+		cancel()
+		if err != nil {
+			remove[c] = true
+			failed[c] = true
+		} else if atomic.SwapUint32(&c.used, 0) == 0 && atomic.LoadInt32(&c.pending) == 0 &&
+			len(conns)-len(remove)-idle > p.opts.MinConnections {
+			remove[c] = true
+			idle++
+		}
+	}
+
+	// Remove them from the pool and close them. Idle connections are checked again whilst the pool is locked, since
+	// a request could have acquired them after they were pinged.
+	if len(remove) != 0 {
+		p.connsMu.Lock()
+		kept := p.conns[:0]
+		for _, c := range p.conns {
+			if remove[c] && !failed[c] && atomic.LoadInt32(&c.pending) != 0 {
+				delete(remove, c)
+			}
+			if !remove[c] {
+				kept = append(kept, c)
+			}
+		}
+		p.conns = kept
+		p.connsMu.Unlock()
+		for c := range remove {
+			_ = c.conn.Close()
+		}
+	}
+
+	// Top the pool back up to the minimum.
+	p.fill()
+
+	// Check the pinned connections.
+	p.checkPinned(&p.eventConn)
+	p.checkPinned(&p.mutexConn)
+}
+
+// checkPinned is used to ping a pinned connection if it is open, replacing it if it fails. The old connection is kept
+// if a new one cannot be opened, so it is tried again on the next check.
+func (p *pool) checkPinned(conn *HNPImplementation) {
+	p.pinnedMu.Lock()
+	c := *conn
+	p.pinnedMu.Unlock()
+	if c == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), p.opts.HealthCheckTimeout)
+	err := c.PingContext(ctx)
+	cancel()
+	if err == nil {
+		return
+	}
+
+	// Open the new connection and move any subscriptions over to it.
+	p.pinnedMu.Lock()
+	if *conn != c || p.isClosed() {
+		// This was replaced or the pool was closed whilst we were pinging it.
+		p.pinnedMu.Unlock()
+		return
+	}
+	replacement, err := p.dial()
+	if err != nil {
+		p.pinnedMu.Unlock()
+		return
+	}
+	h, ok := replacement.(*hnpConn)
+	old, oldOk := c.(*hnpConn)
+	ok = ok && oldOk
+	if ok {
+		h.takeSubscriptions(old)
+	}
+	*conn = replacement
+	p.pinnedMu.Unlock()
+	_ = c.Close()
+
+	// Name the new connection and subscribe it on the server, since the server does not carry either over. These wait
+	// for replies, so they are done after unlocking.
+	if ok {
+		if name, named := old.clientName.Load().(string); named {
+			ctx, cancel := context.WithTimeout(context.Background(), p.opts.HealthCheckTimeout)
+			_ = h.SetClientNameContext(ctx, name)
+			cancel()
+		}
+		h.resubscribe()
+	}
+
+	// The server does not carry mutexes over to a new connection, so report them as lost.
+	if conn == &p.mutexConn && atomic.SwapInt32(&p.mutexesHeld, 0) > 0 && p.opts.OnMutexLost != nil {
+		p.opts.OnMutexLost()
+	}
+}
+
+func (p *pool) isClosed() bool {
+	select {
+	case <-p.closeCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// fill is used to open connections until there are the minimum number of them.
+func (p *pool) fill() error {
+	for {
+		p.connsMu.RLock()
+		count := len(p.conns)
+		p.connsMu.RUnlock()
+		if count >= p.opts.MinConnections {
+			return nil
+		}
+		if _, err := p.open(); err != nil {
+			return err
+		}
+	}
+}
+
+func (p *pool) healthCheckLoop() {
+	t := time.NewTicker(p.opts.HealthCheckInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			p.healthCheck()
+		case <-p.closeCh:
+			return
+		}
+	}
+}
+
+// pinned is used to get a connection which is pinned to one purpose, opening it if it isn't open.
+func (p *pool) pinned(conn *HNPImplementation) (HNPImplementation, error) {
+	p.pinnedMu.Lock()
+	defer p.pinnedMu.Unlock()
+	if *conn == nil {
+		c, err := p.dial()
+		if err != nil {
+			return nil, err
+		}
+		*conn = c
+	}
+	return *conn, nil
+}
+
+// Ping is used to ping the server.
+func (p *pool) Ping() error {
+	return p.PingContext(context.Background())
+}
+
+// PingContext is used to ping the server.
+func (p *pool) PingContext(ctx context.Context) error {
+	c, err := p.acquire()
+	if err != nil {
+		return err
+	}
+	defer c.release()
+	return c.conn.PingContext(ctx)
+}
+
+// Get is used to get a record.
+func (p *pool) Get(key []byte) ([]byte, error) {
+	return p.GetContext(context.Background(), key)
+}
+
+// GetContext is used to get a record.
+func (p *pool) GetContext(ctx context.Context, key []byte) ([]byte, error) {
+	c, err := p.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer c.release()
+	return c.conn.GetContext(ctx, key)
+}
+
+// Set is used to set a record. Returns true if it overwrote a record.
+func (p *pool) Set(key, value []byte) (overwrote bool, err error) {
+	return p.SetContext(context.Background(), key, value)
+}
+
+// SetContext is used to set a record. Returns true if it overwrote a record.
+func (p *pool) SetContext(ctx context.Context, key, value []byte) (overwrote bool, err error) {
+	c, err := p.acquire()
+	if err != nil {
+		return false, err
+	}
+	defer c.release()
+	return c.conn.SetContext(ctx, key, value)
+}
+
+// SetFenced is used to set a record if the fencing token is at least the highest token the record was set with.
+// Returns false if the token is stale.
+func (p *pool) SetFenced(key, value []byte, token uint64) (written bool, err error) {
+	return p.SetFencedContext(context.Background(), key, value, token)
+}
+
+// SetFencedContext is used to set a record if the fencing token is at least the highest token the record was set
+// with. Returns false if the token is stale.
+func (p *pool) SetFencedContext(ctx context.Context, key, value []byte, token uint64) (written bool, err error) {
+	c, err := p.acquire()
+	if err != nil {
+		return false, err
+	}
+	defer c.release()
+	return c.conn.SetFencedContext(ctx, key, value, token)
+}
+
+// Delete is used to delete a record. Returns true if the record existed.
+func (p *pool) Delete(key []byte) (deleted bool, err error) {
+	return p.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext is used to delete a record. Returns true if the record existed.
+func (p *pool) DeleteContext(ctx context.Context, key []byte) (deleted bool, err error) {
+	c, err := p.acquire()
+	if err != nil {
+		return false, err
+	}
+	defer c.release()
+	return c.conn.DeleteContext(ctx, key)
+}
+
+// DeletePrefix is used to delete every record starting with the prefix. Returns the number of nodes removed from
+// the tree.
+func (p *pool) DeletePrefix(prefix []byte) (removed uint64, err error) {
+	return p.DeletePrefixContext(context.Background(), prefix)
+}
+
+// DeletePrefixContext is used to delete every record starting with the prefix. Returns the number of nodes removed
+// from the tree.
+func (p *pool) DeletePrefixContext(ctx context.Context, prefix []byte) (removed uint64, err error) {
+	c, err := p.acquire()
+	if err != nil {
+		return 0, err
+	}
+	defer c.release()
+	return c.conn.DeletePrefixContext(ctx, prefix)
+}
+
+// WalkPrefix is used to get every record starting with the prefix in byte order. The records are fetched a page at a
+// time.
+func (p *pool) WalkPrefix(prefix []byte) ([]Record, error) {
+	return p.WalkPrefixContext(context.Background(), prefix)
+}
+
+// WalkPrefixContext is used to get every record starting with the prefix in byte order. The records are fetched a
+// page at a time.
+func (p *pool) WalkPrefixContext(ctx context.Context, prefix []byte) ([]Record, error) {
+	return walkPages(func(cursor []byte) ([]Record, []byte, error) {
+		return p.WalkPrefixPageContext(ctx, prefix, cursor, 0)
+	})
+}
+
+// WalkPrefixPage is used to get up to limit records starting with the prefix in byte order. The server caps the limit
+// to 10000, which is also used if it is 0. If the cursor is not nil, the walk resumes after it. The cursor for the next
+// page is returned, or nil if there are no more records.
+func (p *pool) WalkPrefixPage(prefix, cursor []byte, limit int) (records []Record, next []byte, err error) {
+	return p.WalkPrefixPageContext(context.Background(), prefix, cursor, limit)
+}
+
+// WalkPrefixPageContext is used to get up to limit records starting with the prefix in byte order. The server caps
+// the limit to 10000, which is also used if it is 0. If the cursor is not nil, the walk resumes after it. The cursor
+// for the next page is returned, or nil if there are no more records.
+func (p *pool) WalkPrefixPageContext(
+	ctx context.Context, prefix, cursor []byte, limit int,
+) (records []Record, next []byte, err error) {
+	c, err := p.acquire()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer c.release()
+	return c.conn.WalkPrefixPageContext(ctx, prefix, cursor, limit)
+}
+
+// WalkRange is used to get every record from start (inclusive) to end (exclusive) in byte order, or in descending byte
+// order if reverse is true. An empty end means there is no end. The records are fetched a page at a time.
+func (p *pool) WalkRange(start, end []byte, reverse bool) ([]Record, error) {
+	return p.WalkRangeContext(context.Background(), start, end, reverse)
+}
+
+// WalkRangeContext is used to get every record from start (inclusive) to end (exclusive) in byte order, or in
+// descending byte order if reverse is true. An empty end means there is no end. The records are fetched a page at a
+// time.
+func (p *pool) WalkRangeContext(ctx context.Context, start, end []byte, reverse bool) ([]Record, error) {
+	return walkPages(func(cursor []byte) ([]Record, []byte, error) {
+		return p.WalkRangePageContext(ctx, start, end, reverse, cursor, 0)
+	})
+}
+
+// WalkRangePage is used to get up to limit records from start (inclusive) to end (exclusive), in descending byte order
+// if reverse is true. The server caps the limit to 10000, which is also used if it is 0. If the cursor is not nil, the
+// walk resumes after it. The cursor for the next page is returned, or nil if there are no more records.
+func (p *pool) WalkRangePage(
+	start, end []byte, reverse bool, cursor []byte, limit int,
+) (records []Record, next []byte, err error) {
+	return p.WalkRangePageContext(context.Background(), start, end, reverse, cursor, limit)
+}
+
+// WalkRangePageContext is used to get up to limit records from start (inclusive) to end (exclusive), in descending
+// byte order if reverse is true. The server caps the limit to 10000, which is also used if it is 0. If the cursor is
+// not nil, the walk resumes after it. The cursor for the next page is returned, or nil if there are no more records.
+func (p *pool) WalkRangePageContext(
+	ctx context.Context, start, end []byte, reverse bool, cursor []byte, limit int,
+) (records []Record, next []byte, err error) {
+	c, err := p.acquire()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer c.release()
+	return c.conn.WalkRangePageContext(ctx, start, end, reverse, cursor, limit)
+}
+
+// FreeTree is used to delete every record in the database.
+func (p *pool) FreeTree() error {
+	return p.FreeTreeContext(context.Background())
+}
+
+// FreeTreeContext is used to delete every record in the database.
+func (p *pool) FreeTreeContext(ctx context.Context) error {
+	c, err := p.acquire()
+	if err != nil {
+		return err
+	}
+	defer c.release()
+	return c.conn.FreeTreeContext(ctx)
+}
+
+// Increment is used to atomically add to a record as a 64-bit integer. Records which do not exist count as 0.
+func (p *pool) Increment(key []byte, delta int64) (int64, error) {
+	return p.IncrementContext(context.Background(), key, delta)
+}
+
+// IncrementContext is used to atomically add to a record as a 64-bit integer. Records which do not exist count as 0.
+func (p *pool) IncrementContext(ctx context.Context, key []byte, delta int64) (int64, error) {
+	c, err := p.acquire()
+	if err != nil {
+		return 0, err
+	}
+	defer c.release()
+	return c.conn.IncrementContext(ctx, key, delta)
+}
+
+// Decrement is used to atomically subtract from a record as a 64-bit integer. Records which do not exist count as 0.
+// The delta cannot be math.MinInt64, since it cannot be negated.
+func (p *pool) Decrement(key []byte, delta int64) (int64, error) {
+	return p.DecrementContext(context.Background(), key, delta)
+}
+
+// DecrementContext is used to atomically subtract from a record as a 64-bit integer. Records which do not exist
+// count as 0. The delta cannot be math.MinInt64, since it cannot be negated.
+func (p *pool) DecrementContext(ctx context.Context, key []byte, delta int64) (int64, error) {
+	c, err := p.acquire()
+	if err != nil {
+		return 0, err
+	}
+	defer c.release()
+	return c.conn.DecrementContext(ctx, key, delta)
+}
+
+// IncrementFloat is used to atomically add to a record as a float. Records which do not exist count as 0.
+func (p *pool) IncrementFloat(key []byte, delta float64) (float64, error) {
+	return p.IncrementFloatContext(context.Background(), key, delta)
+}
+
+// IncrementFloatContext is used to atomically add to a record as a float. Records which do not exist count as 0.
+func (p *pool) IncrementFloatContext(ctx context.Context, key []byte, delta float64) (float64, error) {
+	c, err := p.acquire()
+	if err != nil {
+		return 0, err
+	}
+	defer c.release()
+	return c.conn.IncrementFloatContext(ctx, key, delta)
+}
+
+// AddEventHandler is used to add a handler for events sent with SendEvent. Events are only received on one
+// connection, so each is only delivered once. Note that the bytes should not be mutated.
+//
+// Deprecated: Use Subscribe or PSubscribe, which only get the events published on the channels asked for.
+func (p *pool) AddEventHandler(ch chan []byte) {
+	// If the connection can't be opened, there is nowhere to get events from, and there is no error to return.
+	c, err := p.pinned(&p.eventConn)
+	if err == nil {
+		c.AddEventHandler(ch)
+	}
+}
+
+// MutexLock is used to lock a global mutex. The mutex is locked and unlocked on one connection. See MutexLockContext
+// for how waiting for it affects the other mutex calls.
+func (p *pool) MutexLock() error {
+	return p.MutexLockContext(context.Background())
+}
+
+// MutexLockContext is used to lock a global mutex. The mutex is locked and unlocked on one connection. The server
+// waits for mutexes without holding up the other requests from that connection, so the other mutex calls from this
+// pool, including unlocks, are not stuck behind it whilst it waits.
+func (p *pool) MutexLockContext(ctx context.Context) error {
+	c, err := p.pinned(&p.mutexConn)
+	if err != nil {
+		return err
+	}
+	if err = c.MutexLockContext(ctx); err != nil {
+		return err
+	}
+	atomic.AddInt32(&p.mutexesHeld, 1)
+	return nil
+}
+
+// MutexLockWithLease is used to lock a global mutex which the server unlocks when the lease expires.
+func (p *pool) MutexLockWithLease(lease time.Duration) (token uint64, err error) {
+	return p.MutexLockWithLeaseContext(context.Background(), lease)
+}
+
+// MutexLockWithLeaseContext is used to lock a global mutex which the server unlocks when the lease expires.
+func (p *pool) MutexLockWithLeaseContext(ctx context.Context, lease time.Duration) (token uint64, err error) {
+	c, err := p.pinned(&p.mutexConn)
+	if err != nil {
+		return 0, err
+	}
+	if token, err = c.MutexLockWithLeaseContext(ctx, lease); err != nil {
+		return 0, err
+	}
+	atomic.AddInt32(&p.mutexesHeld, 1)
+	return token, nil
+}
+
+// MutexUnlock is used to unlock a globally locked mutex.
+func (p *pool) MutexUnlock() error {
+	return p.MutexUnlockContext(context.Background())
+}
+
+// MutexUnlockContext is used to unlock a globally locked mutex.
+func (p *pool) MutexUnlockContext(ctx context.Context) error {
+	c, err := p.pinned(&p.mutexConn)
+	if err != nil {
+		return err
+	}
+	if err = c.MutexUnlockContext(ctx); err != nil {
+		return err
+	}
+	atomic.AddInt32(&p.mutexesHeld, -1)
+	return nil
+}
+
+// NamedMutexLock is used to lock the mutex with the name specified. Mutexes are locked and unlocked on one connection.
+// See MutexLockContext for how waiting for it affects the other mutex calls.
+func (p *pool) NamedMutexLock(name []byte, lease time.Duration) (token uint64, err error) {
+	return p.NamedMutexLockContext(context.Background(), name, lease)
+}
+
+// NamedMutexLockContext is used to lock the mutex with the name specified. Mutexes are locked and unlocked on one
+// connection. See MutexLockContext for how waiting for it affects the other mutex calls.
+func (p *pool) NamedMutexLockContext(
+	ctx context.Context, name []byte, lease time.Duration,
+) (token uint64, err error) {
+	c, err := p.pinned(&p.mutexConn)
+	if err != nil {
+		return 0, err
+	}
+	if token, err = c.NamedMutexLockContext(ctx, name, lease); err != nil {
+		return 0, err
+	}
+	atomic.AddInt32(&p.mutexesHeld, 1)
+	return token, nil
+}
+
+// NamedMutexTryLock is used to lock the mutex with the name specified if it is not held. Returns the fencing token,
+// or 0 if it is held.
+func (p *pool) NamedMutexTryLock(name []byte, lease time.Duration) (token uint64, err error) {
+	return p.NamedMutexTryLockContext(context.Background(), name, lease)
+}
+
+// NamedMutexTryLockContext is used to lock the mutex with the name specified if it is not held. Returns the fencing
+// token, or 0 if it is held.
+func (p *pool) NamedMutexTryLockContext(
+	ctx context.Context, name []byte, lease time.Duration,
+) (token uint64, err error) {
+	c, err := p.pinned(&p.mutexConn)
+	if err != nil {
+		return 0, err
+	}
+	token, err = c.NamedMutexTryLockContext(ctx, name, lease)
+	if token != 0 {
+		atomic.AddInt32(&p.mutexesHeld, 1)
+	}
+	return token, err
+}
+
+// NamedMutexLockWithTimeout is used to lock the mutex with the name specified, waiting in line for up to the timeout,
+// or forever if it is below 0. Mutexes are locked and unlocked on one connection.
+func (p *pool) NamedMutexLockWithTimeout(name []byte, lease, timeout time.Duration) (token uint64, err error) {
+	return p.NamedMutexLockWithTimeoutContext(context.Background(), name, lease, timeout)
+}
+
+// NamedMutexLockWithTimeoutContext is used to lock the mutex with the name specified, waiting in line for up to the
+// timeout, or forever if it is below 0. Mutexes are locked and unlocked on one connection.
+func (p *pool) NamedMutexLockWithTimeoutContext(
+	ctx context.Context, name []byte, lease, timeout time.Duration,
+) (token uint64, err error) {
+	c, err := p.pinned(&p.mutexConn)
+	if err != nil {
+		return 0, err
+	}
+	return c.NamedMutexLockWithTimeoutContext(ctx, name, lease, timeout)
+}
+
+// NamedMutexQueue is used to get if the mutex with the name specified is held and how many connections are waiting
+// for it.
+func (p *pool) NamedMutexQueue(name []byte) (held bool, waiters uint32, err error) {
+	return p.NamedMutexQueueContext(context.Background(), name)
+}
+
+// NamedMutexQueueContext is used to get if the mutex with the name specified is held and how many connections are
+// waiting for it.
+func (p *pool) NamedMutexQueueContext(ctx context.Context, name []byte) (held bool, waiters uint32, err error) {
+	c, err := p.acquire()
+	if err != nil {
+		return false, 0, err
+	}
+	defer c.release()
+	return c.conn.NamedMutexQueueContext(ctx, name)
+}
+
+// NamedMutexUnlock is used to unlock the mutex with the name specified.
+func (p *pool) NamedMutexUnlock(name []byte) error {
+	return p.NamedMutexUnlockContext(context.Background(), name)
+}
+
+// NamedMutexUnlockContext is used to unlock the mutex with the name specified.
+func (p *pool) NamedMutexUnlockContext(ctx context.Context, name []byte) error {
+	c, err := p.pinned(&p.mutexConn)
+	if err != nil {
+		return err
+	}
+	if err = c.NamedMutexUnlockContext(ctx, name); err != nil {
+		return err
+	}
+	atomic.AddInt32(&p.mutexesHeld, -1)
+	return nil
+}
+
+// RWMutexLock is used to take an exclusive (write) hold on the read-write lock with the name specified. Locks are
+// taken and released on one connection.
+func (p *pool) RWMutexLock(name []byte, lease, timeout time.Duration) (token uint64, err error) {
+	return p.RWMutexLockContext(context.Background(), name, lease, timeout)
+}
+
+// RWMutexLockContext is used to take an exclusive (write) hold on the read-write lock with the name specified. Locks
+// are taken and released on one connection.
+func (p *pool) RWMutexLockContext(
+	ctx context.Context, name []byte, lease, timeout time.Duration,
+) (token uint64, err error) {
+	c, err := p.pinned(&p.mutexConn)
+	if err != nil {
+		return 0, err
+	}
+	return c.RWMutexLockContext(ctx, name, lease, timeout)
+}
+
+// RWMutexRLock is used to take a shared (read) hold on the read-write lock with the name specified. Locks are taken
+// and released on one connection.
+func (p *pool) RWMutexRLock(name []byte, lease, timeout time.Duration) (token uint64, err error) {
+	return p.RWMutexRLockContext(context.Background(), name, lease, timeout)
+}
+
+// RWMutexRLockContext is used to take a shared (read) hold on the read-write lock with the name specified. Locks are
+// taken and released on one connection.
+func (p *pool) RWMutexRLockContext(
+	ctx context.Context, name []byte, lease, timeout time.Duration,
+) (token uint64, err error) {
+	c, err := p.pinned(&p.mutexConn)
+	if err != nil {
+		return 0, err
+	}
+	return c.RWMutexRLockContext(ctx, name, lease, timeout)
+}
+
+// RWMutexUnlock is used to release the oldest hold the pool has on the read-write lock with the name specified.
+func (p *pool) RWMutexUnlock(name []byte) error {
+	return p.RWMutexUnlockContext(context.Background(), name)
+}
+
+// RWMutexUnlockContext is used to release the oldest hold the pool has on the read-write lock with the name
+// specified.
+func (p *pool) RWMutexUnlockContext(ctx context.Context, name []byte) error {
+	c, err := p.pinned(&p.mutexConn)
+	if err != nil {
+		return err
+	}
+	return c.RWMutexUnlockContext(ctx, name)
+}
+
+// RWMutexQueue is used to get how many holds there are on the read-write lock with the name specified and how many
+// connections are waiting for it.
+func (p *pool) RWMutexQueue(name []byte) (holds, waiters uint32, err error) {
+	return p.RWMutexQueueContext(context.Background(), name)
+}
+
+// RWMutexQueueContext is used to get how many holds there are on the read-write lock with the name specified and how
+// many connections are waiting for it.
+func (p *pool) RWMutexQueueContext(ctx context.Context, name []byte) (holds, waiters uint32, err error) {
+	c, err := p.acquire()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer c.release()
+	return c.conn.RWMutexQueueContext(ctx, name)
+}
+
+// SemaphoreAcquire is used to take a hold on the semaphore with the name specified. Semaphores are acquired and
+// released on one connection.
+func (p *pool) SemaphoreAcquire(name []byte, limit uint32, lease, timeout time.Duration) (token uint64, err error) {
+	return p.SemaphoreAcquireContext(context.Background(), name, limit, lease, timeout)
+}
+
+// SemaphoreAcquireContext is used to take a hold on the semaphore with the name specified. Semaphores are acquired
+// and released on one connection.
+func (p *pool) SemaphoreAcquireContext(
+	ctx context.Context, name []byte, limit uint32, lease, timeout time.Duration,
+) (token uint64, err error) {
+	c, err := p.pinned(&p.mutexConn)
+	if err != nil {
+		return 0, err
+	}
+	return c.SemaphoreAcquireContext(ctx, name, limit, lease, timeout)
+}
+
+// SemaphoreRelease is used to release the oldest hold the pool has on the semaphore with the name specified.
+func (p *pool) SemaphoreRelease(name []byte) error {
+	return p.SemaphoreReleaseContext(context.Background(), name)
+}
+
+// SemaphoreReleaseContext is used to release the oldest hold the pool has on the semaphore with the name specified.
+func (p *pool) SemaphoreReleaseContext(ctx context.Context, name []byte) error {
+	c, err := p.pinned(&p.mutexConn)
+	if err != nil {
+		return err
+	}
+	return c.SemaphoreReleaseContext(ctx, name)
+}
+
+// SemaphoreQueue is used to get how many holds there are on the semaphore with the name specified and how many
+// connections are waiting for it.
+func (p *pool) SemaphoreQueue(name []byte) (holds, waiters uint32, err error) {
+	return p.SemaphoreQueueContext(context.Background(), name)
+}
+
+// SemaphoreQueueContext is used to get how many holds there are on the semaphore with the name specified and how many
+// connections are waiting for it.
+func (p *pool) SemaphoreQueueContext(ctx context.Context, name []byte) (holds, waiters uint32, err error) {
+	c, err := p.acquire()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer c.release()
+	return c.conn.SemaphoreQueueContext(ctx, name)
+}
+
+// Locks is used to list every lock in the database along with who holds it and how many connections are waiting for
+// it.
+func (p *pool) Locks() ([]Lock, error) {
+	return p.LocksContext(context.Background())
+}
+
+// LocksContext is used to list every lock in the database along with who holds it and how many connections are
+// waiting for it.
+func (p *pool) LocksContext(ctx context.Context) ([]Lock, error) {
+	c, err := p.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer c.release()
+	return c.conn.LocksContext(ctx)
+}
+
+// ForceRelease is used to release every hold on a lock, whoever has it. This needs the admin password the server was
+// started with. Returns the number of holds released.
+func (p *pool) ForceRelease(kind LockKind, name []byte, adminPassword string) (released uint32, err error) {
+	return p.ForceReleaseContext(context.Background(), kind, name, adminPassword)
+}
+
+// ForceReleaseContext is used to release every hold on a lock, whoever has it. This needs the admin password the
+// server was started with. Returns the number of holds released.
+func (p *pool) ForceReleaseContext(
+	ctx context.Context, kind LockKind, name []byte, adminPassword string,
+) (released uint32, err error) {
+	c, err := p.acquire()
+	if err != nil {
+		return 0, err
+	}
+	defer c.release()
+	return c.conn.ForceReleaseContext(ctx, kind, name, adminPassword)
+}
+
+// SetClientName is used to name the connection locks are held on. The name is shown as the holder of the locks.
+func (p *pool) SetClientName(name string) error {
+	return p.SetClientNameContext(context.Background(), name)
+}
+
+// SetClientNameContext is used to name the connection locks are held on. The name is shown as the holder of the
+// locks.
+func (p *pool) SetClientNameContext(ctx context.Context, name string) error {
+	c, err := p.pinned(&p.mutexConn)
+	if err != nil {
+		return err
+	}
+	return c.SetClientNameContext(ctx, name)
+}
+
+// SendEvent is used to send an event to every other connection on the database. This is sent on the connection
+// events are received on, since the server does not send events back to the connection which sent them.
+//
+// Deprecated: Use Publish, which only sends the event to the connections subscribed to the channel.
+func (p *pool) SendEvent(b []byte) error {
+	return p.SendEventContext(context.Background(), b)
+}
+
+// SendEventContext is used to send an event to every other connection on the database. This is sent on the
+// connection events are received on, since the server does not send events back to the connection which sent them.
+//
+// Deprecated: Use PublishContext, which only sends the event to the connections subscribed to the channel.
+func (p *pool) SendEventContext(ctx context.Context, b []byte) error {
+	c, err := p.pinned(&p.eventConn)
+	if err != nil {
+		return err
+	}
+	return c.SendEventContext(ctx, b)
+}
+
+// Subscribe is used to send events published on the channel specified to the Go channel. Subscriptions are all on
+// one connection, so each event is only delivered once.
+func (p *pool) Subscribe(channel []byte, ch chan Event) error {
+	return p.SubscribeContext(context.Background(), channel, ch)
+}
+
+// SubscribeContext is used to send events published on the channel specified to the Go channel. Subscriptions are all
+// on one connection, so each event is only delivered once.
+func (p *pool) SubscribeContext(ctx context.Context, channel []byte, ch chan Event) error {
+	c, err := p.pinned(&p.eventConn)
+	if err != nil {
+		return err
+	}
+	return c.SubscribeContext(ctx, channel, ch)
+}
+
+// PSubscribe is used to send events published on any channel matching the glob pattern specified to the Go channel.
+// Subscriptions are all on one connection, so each event is only delivered once.
+func (p *pool) PSubscribe(pattern []byte, ch chan Event) error {
+	return p.PSubscribeContext(context.Background(), pattern, ch)
+}
+
+// PSubscribeContext is used to send events published on any channel matching the glob pattern specified to the Go
+// channel. Subscriptions are all on one connection, so each event is only delivered once.
+func (p *pool) PSubscribeContext(ctx context.Context, pattern []byte, ch chan Event) error {
+	c, err := p.pinned(&p.eventConn)
+	if err != nil {
+		return err
+	}
+	return c.PSubscribeContext(ctx, pattern, ch)
+}
+
+// Unsubscribe is used to stop sending events published on the channel specified to the Go channel.
+func (p *pool) Unsubscribe(channel []byte, ch chan Event) error {
+	return p.UnsubscribeContext(context.Background(), channel, ch)
+}
+
+// UnsubscribeContext is used to stop sending events published on the channel specified to the Go channel.
+func (p *pool) UnsubscribeContext(ctx context.Context, channel []byte, ch chan Event) error {
+	c, err := p.pinned(&p.eventConn)
+	if err != nil {
+		return err
+	}
+	return c.UnsubscribeContext(ctx, channel, ch)
+}
+
+// PUnsubscribe is used to stop sending events published on channels matching the glob pattern specified to the Go
+// channel.
+func (p *pool) PUnsubscribe(pattern []byte, ch chan Event) error {
+	return p.PUnsubscribeContext(context.Background(), pattern, ch)
+}
+
+// PUnsubscribeContext is used to stop sending events published on channels matching the glob pattern specified to the
+// Go channel.
+func (p *pool) PUnsubscribeContext(ctx context.Context, pattern []byte, ch chan Event) error {
+	c, err := p.pinned(&p.eventConn)
+	if err != nil {
+		return err
+	}
+	return c.PUnsubscribeContext(ctx, pattern, ch)
+}
+
+// SubscribeKeyspace is used to send a notification to the Go channel whenever a key starting with the prefix changes.
+// Subscriptions are all on one connection, so each notification is only delivered once.
+func (p *pool) SubscribeKeyspace(prefix []byte, values bool, ch chan KeyspaceNotification) error {
+	return p.SubscribeKeyspaceContext(context.Background(), prefix, values, ch)
+}
+
+// SubscribeKeyspaceContext is used to send a notification to the Go channel whenever a key starting with the prefix
+// changes. Subscriptions are all on one connection, so each notification is only delivered once.
+func (p *pool) SubscribeKeyspaceContext(
+	ctx context.Context, prefix []byte, values bool, ch chan KeyspaceNotification,
+) error {
+	c, err := p.pinned(&p.eventConn)
+	if err != nil {
+		return err
+	}
+	return c.SubscribeKeyspaceContext(ctx, prefix, values, ch)
+}
+
+// UnsubscribeKeyspace is used to stop sending notifications for changes to keys starting with the prefix to the Go
+// channel.
+func (p *pool) UnsubscribeKeyspace(prefix []byte, ch chan KeyspaceNotification) error {
+	return p.UnsubscribeKeyspaceContext(context.Background(), prefix, ch)
+}
+
+// UnsubscribeKeyspaceContext is used to stop sending notifications for changes to keys starting with the prefix to the
+// Go channel.
+func (p *pool) UnsubscribeKeyspaceContext(ctx context.Context, prefix []byte, ch chan KeyspaceNotification) error {
+	c, err := p.pinned(&p.eventConn)
+	if err != nil {
+		return err
+	}
+	return c.UnsubscribeKeyspaceContext(ctx, prefix, ch)
+}
+
+// EventStats is used to get the number of events the server dropped for the connection subscriptions are on because
+// it could not keep up, and the number waiting to be written to it.
+func (p *pool) EventStats() (dropped uint64, queued uint32, err error) {
+	return p.EventStatsContext(context.Background())
+}
+
+// EventStatsContext is used to get the number of events the server dropped for the connection subscriptions are on
+// because it could not keep up, and the number waiting to be written to it.
+func (p *pool) EventStatsContext(ctx context.Context) (dropped uint64, queued uint32, err error) {
+	c, err := p.pinned(&p.eventConn)
+	if err != nil {
+		return 0, 0, err
+	}
+	return c.EventStatsContext(ctx)
+}
+
+// Publish is used to publish an event on a channel. Returns the number of events the server sent.
+func (p *pool) Publish(channel, data []byte) (sent uint32, err error) {
+	return p.PublishContext(context.Background(), channel, data)
+}
+
+// PublishContext is used to publish an event on a channel. Returns the number of events the server sent.
+func (p *pool) PublishContext(ctx context.Context, channel, data []byte) (sent uint32, err error) {
+	c, err := p.acquire()
+	if err != nil {
+		return 0, err
+	}
+	defer c.release()
+	return c.conn.PublishContext(ctx, channel, data)
+}
+
+// Close is used to close every connection in the pool.
+func (p *pool) Close() error {
+	p.closeOnce.Do(func() { close(p.closeCh) })
+	p.connsMu.Lock()
+	conns := p.conns
+	p.conns = nil
+	p.connsMu.Unlock()
+	var err error
+	for _, c := range conns {
+		if closeErr := c.conn.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	p.pinnedMu.Lock()
+	defer p.pinnedMu.Unlock()
+	for _, c := range []HNPImplementation{p.eventConn, p.mutexConn} {
+		if c != nil {
+			if closeErr := c.Close(); closeErr != nil {
+				err = closeErr
+			}
+		}
+	}
+	return err
+}
+
+// NewPool is used to make a pool of connections opened with the dial function specified. The requests made with it
+// go to the connection with the least pending requests. Events and the mutex are pinned to their own connections.
+func NewPool(dial func() (HNPImplementation, error), opts PoolOptions) (HNPImplementation, error) {
+	if opts.MinConnections <= 0 {
+		opts.MinConnections = 1
+	}
+	if opts.MaxConnections <= 0 {
+		opts.MaxConnections = 10
+	}
+	if opts.MaxConnections < opts.MinConnections {
+		opts.MaxConnections = opts.MinConnections
+	}
+	if opts.HealthCheckInterval <= 0 {
+		opts.HealthCheckInterval = time.Second * 30
+	}
+	if opts.HealthCheckTimeout <= 0 {
+		opts.HealthCheckTimeout = time.Second * 5
+	}
+	p := &pool{
+		dial:    dial,
+		opts:    opts,
+		closeCh: make(chan struct{}),
+	}
+	if err := p.fill(); err != nil {
+		_ = p.Close()
+		return nil, err
+	}
+	go p.healthCheckLoop()
+	return p, nil
+}
+
+// NewPoolWithHNPAddr is used to make a pool of connections to a HNP address.
+func NewPoolWithHNPAddr(addr, password string, db uint16, opts PoolOptions) (HNPImplementation, error) {
+	return NewPool(func() (HNPImplementation, error) {
+		return NewConnectionWithHNPAddr(addr, password, db)
+	}, opts)
+}
@@ -0,0 +1,181 @@
+package hypercache
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stubConn is a connection for testing the pool. Only the methods the tests use are implemented.
+type stubConn struct {
+	HNPImplementation
+
+	id     int
+	ping   func(c *stubConn) error
+	closed uint32
+}
+
+func (c *stubConn) PingContext(context.Context) error {
+	if c.ping != nil {
+		return c.ping(c)
+	}
+	return nil
+}
+
+func (c *stubConn) MutexLockContext(context.Context) error { return nil }
+
+func (c *stubConn) MutexUnlockContext(context.Context) error { return nil }
+
+func (c *stubConn) Close() error {
+	atomic.StoreUint32(&c.closed, 1)
+	return nil
+}
+
+// newStubPool is used to make a pool of stub connections. The ping function is used by every connection.
+func newStubPool(t *testing.T, opts PoolOptions, ping func(c *stubConn) error) *pool {
+	t.Helper()
+	opts.HealthCheckInterval = time.Hour
+	var dialled int32
+	p, err := NewPool(func() (HNPImplementation, error) {
+		return &stubConn{id: int(atomic.AddInt32(&dialled, 1)), ping: ping}, nil
+	}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = p.Close() })
+	return p.(*pool)
+}
+
+func TestPoolLeastPending(t *testing.T) {
+	p := newStubPool(t, PoolOptions{MinConnections: 3, MaxConnections: 3}, nil)
+	acquire := func() *pooledConn {
+		c, err := p.acquire()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	// Each connection is used once before any is used twice.
+	first, second, third := acquire(), acquire(), acquire()
+	if first == second || second == third || first == third {
+		t.Fatal("a busy connection was used whilst another was idle")
+	}
+
+	// The connection with the least pending requests is used.
+	fourth := acquire()
+	second.release()
+	if c := acquire(); c != second {
+		t.Errorf("got connection %d, want %d", c.conn.(*stubConn).id, second.conn.(*stubConn).id)
+	}
+	fourth.release()
+	third.release()
+	if c := acquire(); c != third {
+		t.Errorf("got connection %d, want %d", c.conn.(*stubConn).id, third.conn.(*stubConn).id)
+	}
+}
+
+func TestPoolGrows(t *testing.T) {
+	p := newStubPool(t, PoolOptions{MinConnections: 1, MaxConnections: 2}, nil)
+	if _, err := p.acquire(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every connection is busy, so another is opened in the background.
+	if _, err := p.acquire(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; ; i++ {
+		p.connsMu.RLock()
+		count := len(p.conns)
+		p.connsMu.RUnlock()
+		if count == 2 {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("got %d connections, want 2", count)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPoolHealthCheck(t *testing.T) {
+	var p *pool
+	var acquired *pooledConn
+	p = newStubPool(t, PoolOptions{MinConnections: 1, MaxConnections: 3}, func(c *stubConn) error {
+		switch c.id {
+		case 2:
+			// Whilst the second connection is pinged, a request takes the first one, which was found idle.
+			var err error
+			acquired, err = p.acquire()
+			return err
+		case 3:
+			return errors.New("unhealthy")
+		}
+		return nil
+	})
+	for i := 0; i < 2; i++ {
+		if _, err := p.open(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p.healthCheck()
+
+	// The first connection is kept since it was in use, the failed one is closed, and the second is kept as the
+	// minimum.
+	p.connsMu.RLock()
+	defer p.connsMu.RUnlock()
+	if acquired == nil || acquired.conn.(*stubConn).id != 1 {
+		t.Fatal("the first connection was not acquired whilst the health check ran")
+	}
+	var ids []int
+	for _, c := range p.conns {
+		ids = append(ids, c.conn.(*stubConn).id)
+	}
+	if len(ids) != 2 || ids[0] != 1 || ids[1] != 2 {
+		t.Errorf("got connections %v, want [1 2]", ids)
+	}
+	if atomic.LoadUint32(&acquired.conn.(*stubConn).closed) == 1 {
+		t.Error("a connection in use was closed")
+	}
+}
+
+func TestPoolMutexLost(t *testing.T) {
+	var lost int32
+	var unhealthy uint32
+	p := newStubPool(t, PoolOptions{OnMutexLost: func() { atomic.AddInt32(&lost, 1) }}, func(c *stubConn) error {
+		if atomic.LoadUint32(&unhealthy) == 1 && c.id == 2 {
+			return errors.New("unhealthy")
+		}
+		return nil
+	})
+	if err := p.MutexLock(); err != nil {
+		t.Fatal(err)
+	}
+	old := p.mutexConn.(*stubConn)
+
+	// Replacing the connection loses the mutex.
+	atomic.StoreUint32(&unhealthy, 1)
+	p.healthCheck()
+	if p.mutexConn == HNPImplementation(old) || atomic.LoadUint32(&old.closed) != 1 {
+		t.Fatal("the unhealthy mutex connection was not replaced")
+	}
+	if atomic.LoadInt32(&lost) != 1 {
+		t.Fatalf("got %d lost mutex calls, want 1", lost)
+	}
+
+	// It is not reported again if it was unlocked.
+	if err := p.MutexLock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.MutexUnlock(); err != nil {
+		t.Fatal(err)
+	}
+	p.mutexConn.(*stubConn).ping = func(*stubConn) error { return errors.New("unhealthy") }
+	p.healthCheck()
+	if atomic.LoadInt32(&lost) != 1 {
+		t.Errorf("got %d lost mutex calls, want 1", lost)
+	}
+}
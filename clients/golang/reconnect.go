@@ -0,0 +1,189 @@
+package hypercache
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// ConnectionState is the state of a connection which reconnects.
+type ConnectionState int
+
+const (
+	// Connected means the connection is up.
+	Connected ConnectionState = iota
+
+	// Disconnected means the connection dropped and is being redialled.
+	Disconnected
+
+	// Closed means the connection was closed with Close and will not be redialled.
+	Closed
+)
+
+// ReconnectOptions defines how a connection reconnects.
+type ReconnectOptions struct {
+	// MinBackoff is the delay before the first redial. Defaults to 100ms.
+	MinBackoff time.Duration
+
+	// MaxBackoff is the most the delay doubles up to between redials. Defaults to 30s.
+	MaxBackoff time.Duration
+
+	// OnStateChange is called when the state of the connection changes, along with the error which caused it if
+	// there was one. It is called from the goroutine which reads from the connection, so it should not block.
+	OnStateChange func(state ConnectionState, err error)
+
+	// OnMutexLost is called when the connection drops whilst it holds the global mutex or a named mutex, since the new
+	// connection does not hold them. It is called before the connection is redialled.
+	OnMutexLost func()
+}
+
+// ErrClosed is returned when the connection was closed with Close.
+var ErrClosed = errors.New("the connection is closed")
+
+type reconnector struct {
+	dial     func() (net.Conn, error)
+	password string
+	db       uint16
+	opts     ReconnectOptions
+}
+
+func (h *hnpConn) stateChange(state ConnectionState, err error) {
+	if h.reconnect.opts.OnStateChange != nil {
+		h.reconnect.opts.OnStateChange(state, err)
+	}
+}
+
+// redial is used to redial the connection with exponential backoff and jitter until it is connected or closed.
+// Returns false if it was closed.
+func (h *hnpConn) redial(err error) bool {
+	// Check if this was closed.
+	if h.isClosed() {
+		h.stateChange(Closed, nil)
+		return false
+	}
+	h.stateChange(Disconnected, err)
+
+	// The server does not carry mutexes over to a new connection, so report them as lost.
+	if atomic.SwapInt32(&h.mutexesHeld, 0) > 0 && h.reconnect.opts.OnMutexLost != nil {
+		h.reconnect.opts.OnMutexLost()
+	}
+
+	backoff := h.reconnect.opts.MinBackoff
+	for {
+		// Wait a random amount of time between half the backoff and the backoff, so clients don't redial together.
+		delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		select {
+		case <-time.After(delay):
+		case <-h.closeCh:
+			h.stateChange(Closed, nil)
+			return false
+		}
+		if backoff *= 2; backoff > h.reconnect.opts.MaxBackoff {
+			backoff = h.reconnect.opts.MaxBackoff
+		}
+
+		// Dial and redo the handshake.
+		c, err := h.reconnect.dial()
+		if err != nil {
+			continue
+		}
+		if err = handshake(c, h.reconnect.password, h.reconnect.db); err != nil {
+			_ = c.Close()
+			continue
+		}
+
+		// Swap in the new connection. Event handlers stay registered, and are subscribed again below.
+		h.repliesMu.Lock()
+		h.c = c
+		h.repliesMu.Unlock()
+		if h.isClosed() {
+			// This was closed whilst we were dialling.
+			_ = c.Close()
+			h.stateChange(Closed, nil)
+			return false
+		}
+		h.lastErrMu.Lock()
+		h.lastErr = nil
+		h.lastErrMu.Unlock()
+		h.stateChange(Connected, nil)
+
+		// Name the new connection and subscribe it to the same channels. These wait for replies, so they can't be done
+		// on the goroutine which reads them.
+		go func() {
+			if name, ok := h.clientName.Load().(string); ok {
+				_ = h.SetClientName(name)
+			}
+			h.resubscribe()
+		}()
+		return true
+	}
+}
+
+func (h *hnpConn) isClosed() bool {
+	select {
+	case <-h.closeCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close is used to close the connection. Connections which reconnect stop doing so.
+func (h *hnpConn) Close() error {
+	h.closeOnce.Do(func() { close(h.closeCh) })
+	h.repliesMu.Lock()
+	c := h.c
+	h.repliesMu.Unlock()
+	return c.Close()
+}
+
+// NewResilientConnectionWithHNPAddr is used to connect with a HNP address. If the connection drops, it is redialled
+// with exponential backoff and the handshake is redone. Calls made whilst it is disconnected return the error which
+// dropped it. The first dial is not retried, so an error is returned if it fails.
+func NewResilientConnectionWithHNPAddr(
+	addr, password string, db uint16, opts ReconnectOptions,
+) (HNPImplementation, error) {
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = time.Millisecond * 100
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = time.Second * 30
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = opts.MinBackoff
+	}
+	dial := func() (net.Conn, error) {
+		return net.Dial("tcp", addr)
+	}
+
+	// Do the first dial.
+	c, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	if err = handshake(c, password, db); err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+	h := &hnpConn{
+		c:            c,
+		replies:      map[uint32]func(error){},
+		subs:         map[subscription][]chan Event{},
+		keyspaceSubs: map[string]*keyspaceSubscription{},
+		closeCh:      make(chan struct{}),
+		reconnect: &reconnector{
+			dial:     dial,
+			password: password,
+			db:       db,
+			opts:     opts,
+		},
+	}
+
+	// Start the read loop.
+	go h.readLoop()
+
+	// Return the HNP handler.
+	return h, nil
+}
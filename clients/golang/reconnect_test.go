@@ -0,0 +1,178 @@
+package hypercache
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jakemakesstuff/packetmaker"
+)
+
+// accept is used to accept a connection on the listener and do the server side of the handshake.
+func accept(t *testing.T, ln net.Listener) *fakeServer {
+	t.Helper()
+	c, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	if _, err = io.ReadFull(c, make([]byte, 8)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Write([]byte{0}); err != nil {
+		t.Fatal(err)
+	}
+	return &fakeServer{t: t, c: c}
+}
+
+func TestReconnect(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	states := make(chan ConnectionState, 10)
+	mutexLost := make(chan struct{}, 1)
+	opts := ReconnectOptions{
+		MinBackoff:    50 * time.Millisecond,
+		MaxBackoff:    time.Second,
+		OnStateChange: func(state ConnectionState, err error) { states <- state },
+		OnMutexLost:   func() { mutexLost <- struct{}{} },
+	}
+	connected := make(chan HNPImplementation, 1)
+	go func() {
+		h, err := NewResilientConnectionWithHNPAddr(ln.Addr().String(), "", 0, opts)
+		if err != nil {
+			t.Error(err)
+		}
+		connected <- h
+	}()
+	s := accept(t, ln)
+	h := <-connected
+	if h == nil {
+		t.FailNow()
+	}
+	defer h.Close()
+
+	// Lock the mutex and then drop the connection.
+	go func() {
+		replyId, _, _ := s.read()
+		s.reply(replyId, nil)
+	}()
+	if err = h.MutexLock(); err != nil {
+		t.Fatal(err)
+	}
+	dropped := time.Now()
+	_ = s.c.Close()
+	if state := <-states; state != Disconnected {
+		t.Fatalf("got state %d, want Disconnected", state)
+	}
+	select {
+	case <-mutexLost:
+	case <-time.After(time.Second):
+		t.Fatal("the lost mutex was not reported")
+	}
+
+	// The redial waits at least half the minimum backoff.
+	s = accept(t, ln)
+	if waited := time.Since(dropped); waited < opts.MinBackoff/2 {
+		t.Errorf("redialled after %s, want at least %s", waited, opts.MinBackoff/2)
+	}
+	if state := <-states; state != Connected {
+		t.Fatalf("got state %d, want Connected", state)
+	}
+
+	// Calls go over the new connection.
+	go func() {
+		replyId, _, key := s.read()
+		s.reply(replyId, packetmaker.New().Uint32(uint32(len(key)), true).Bytes(key).Make())
+	}()
+	value, err := h.Get([]byte("key"))
+	if err != nil || string(value) != "key" {
+		t.Fatalf("got %q and %v, want the key", value, err)
+	}
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+
+	connected := make(chan HNPImplementation, 1)
+	opts := ReconnectOptions{MinBackoff: 20 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+	go func() {
+		h, err := NewResilientConnectionWithHNPAddr(addr, "", 0, opts)
+		if err != nil {
+			t.Error(err)
+		}
+		connected <- h
+	}()
+	s := accept(t, ln)
+	h := <-connected
+	if h == nil {
+		t.FailNow()
+	}
+	defer h.Close()
+
+	// Refuse redials for a while so the backoff grows, then listen again on the same address.
+	_ = ln.Close()
+	_ = s.c.Close()
+	time.Sleep(500 * time.Millisecond)
+	if ln, err = net.Listen("tcp", addr); err != nil {
+		t.Skip("the address could not be listened on again:", err)
+	}
+	defer ln.Close()
+	listened := time.Now()
+	accept(t, ln)
+
+	// The backoff is capped, so the redial comes soon after. Without the cap, it would have grown past 300ms.
+	if waited := time.Since(listened); waited > opts.MaxBackoff+150*time.Millisecond {
+		t.Errorf("redialled after %s, want at most %s", waited, opts.MaxBackoff)
+	}
+}
+
+func TestReconnectResubscribes(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	connected := make(chan HNPImplementation, 1)
+	opts := ReconnectOptions{MinBackoff: 10 * time.Millisecond, MaxBackoff: 20 * time.Millisecond}
+	go func() {
+		h, err := NewResilientConnectionWithHNPAddr(ln.Addr().String(), "", 0, opts)
+		if err != nil {
+			t.Error(err)
+		}
+		connected <- h
+	}()
+	s := accept(t, ln)
+	h := <-connected
+	if h == nil {
+		t.FailNow()
+	}
+	defer h.Close()
+
+	go func() {
+		replyId, _, _ := s.read()
+		s.reply(replyId, []byte{1, 0, 0, 0, 1})
+	}()
+	if err = h.Subscribe([]byte("news"), make(chan Event, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The new connection is subscribed to the same channel.
+	_ = s.c.Close()
+	s = accept(t, ln)
+	replyId, op, body := s.read()
+	if want := []byte("\x00news"); op != 34 || !bytes.Equal(body, want) {
+		t.Fatalf("got op %d with %v, want op 34 with %v", op, body, want)
+	}
+	s.reply(replyId, []byte{1, 0, 0, 0, 1})
+}
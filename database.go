@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/webscalesoftwareltd/hypercache/radix"
+)
+
+// database is a radix tree which records its mutations in a write-ahead log and keeps to its memory limit. Every
+// mutation sends keyspace notifications through the event dispatcher. These are sent whilst the log is locked, so
+// they are in the same order as the log.
+type database struct {
+	radix.RadixTree
+
+	wal       *writeAheadLog
+	maxMemory uint64
+	eviction  evictionPolicy
+	events    *eventDispatcher
+
+	// memoryMu is held by writes from when they reserve memory until they are applied, if only this database has a
+	// limit.
+	memoryMu sync.Mutex
+}
+
+// Set is used to set a key in the tree. Returns true if it overwrote something, or errOutOfMemory if there
+// is not enough memory for it.
+func (d *database) Set(key, value []byte) (overwrote bool, err error) {
+	unlock := d.lockMemory()
+	defer unlock()
+	if !d.reserve(d.growth(key, len(value))) {
+		return false, errOutOfMemory
+	}
+	d.wal.apply(walSetEntry(key, value), func() bool {
+		overwrote = d.RadixTree.Set(key, value)
+		d.events.notifyKeyspace(keyspaceOpSet, key, 0, value)
+		return true
+	})
+	return
+}
+
+// SetWithExpiry is used to set a key which expires at the time specified. Returns true if it overwrote something,
+// or errOutOfMemory if there is not enough memory for it.
+func (d *database) SetWithExpiry(key, value []byte, expiresAt time.Time) (overwrote bool, err error) {
+	unlock := d.lockMemory()
+	defer unlock()
+	if !d.reserve(d.growth(key, len(value))) {
+		return false, errOutOfMemory
+	}
+	d.wal.apply(walSetExpiringEntry(key, value, expiresAt), func() bool {
+		overwrote = d.RadixTree.SetWithExpiry(key, value, expiresAt)
+		d.events.notifyKeyspace(keyspaceOpSet, key, 0, value)
+		return true
+	})
+	return
+}
+
+// SetIf is used to atomically set a key if it meets the condition. Returns the version of the new value, or 0 if the
+// condition was not met. Returns errOutOfMemory if there is not enough memory for it.
+func (d *database) SetIf(
+	key, value []byte, expiresAt time.Time, condition radix.SetCondition,
+	expectedValue []byte, expectedVersion uint64,
+) (version uint64, err error) {
+	unlock := d.lockMemory()
+	defer unlock()
+	if !d.reserve(d.growth(key, len(value))) {
+		return 0, errOutOfMemory
+	}
+
+	// Other than for fenced sets, whatever the condition was, replaying this is just a set. Fenced sets are replayed
+	// with their token so that the fence is raised again.
+	var entry []byte
+	switch {
+	case condition == radix.SetIfFence:
+		entry = walSetFencedEntry(key, value, expiresAt, expectedVersion)
+	case expiresAt.IsZero():
+		entry = walSetEntry(key, value)
+	default:
+		entry = walSetExpiringEntry(key, value, expiresAt)
+	}
+	d.wal.apply(entry, func() bool {
+		version = d.RadixTree.SetIf(key, value, expiresAt, condition, expectedValue, expectedVersion)
+		if version == 0 {
+			return false
+		}
+		d.events.notifyKeyspace(keyspaceOpSet, key, 0, value)
+		return true
+	})
+	return
+}
+
+// Defines the most bytes a number written by an increment can take up.
+const maxNumberLen = 24
+
+// Defines the function used to increment a key in the tree.
+type incrementer func(key []byte) (value []byte, expiresAt time.Time, err error)
+
+// increment is used to run an increment and log the new value as a set, so replaying it does not increment again.
+func (d *database) increment(key []byte, increment incrementer) (value []byte, err error) {
+	unlock := d.lockMemory()
+	defer unlock()
+	if !d.reserve(d.growth(key, maxNumberLen)) {
+		return nil, errOutOfMemory
+	}
+	d.wal.applyResult(func() []byte {
+		var expiresAt time.Time
+		value, expiresAt, err = increment(key)
+		if err != nil {
+			return nil
+		}
+		d.events.notifyKeyspace(keyspaceOpSet, key, 0, value)
+		if expiresAt.IsZero() {
+			return walSetEntry(key, value)
+		}
+		return walSetExpiringEntry(key, value, expiresAt)
+	})
+	return
+}
+
+// Increment is used to atomically add to a key as a 64-bit integer. Keys which do not exist count as 0. Returns the
+// new value, radix.ErrNotANumber or radix.ErrNumberOverflow if the increment failed, or errOutOfMemory.
+func (d *database) Increment(key []byte, delta int64) (int64, error) {
+	value, err := d.increment(key, func(key []byte) ([]byte, time.Time, error) {
+		return d.RadixTree.Increment(key, delta)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(string(value), 10, 64)
+}
+
+// IncrementFloat is used to atomically add to a key as a float. Keys which do not exist count as 0. Returns the
+// new value, radix.ErrNotANumber or radix.ErrNumberOverflow if the increment failed, or errOutOfMemory.
+func (d *database) IncrementFloat(key []byte, delta float64) (float64, error) {
+	value, err := d.increment(key, func(key []byte) ([]byte, time.Time, error) {
+		return d.RadixTree.IncrementFloat(key, delta)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(string(value), 64)
+}
+
+// incrementException is used to get the exception an increment error is raised as.
+func incrementException(err error) string {
+	switch err {
+	case errOutOfMemory:
+		return "OutOfMemory"
+	case radix.ErrNotANumber:
+		return "NotANumber"
+	default:
+		return "NumberOverflow"
+	}
+}
+
+// ExpireAt is used to set when a key expires. A zero time makes the key never expire. Returns true if the key exists.
+func (d *database) ExpireAt(key []byte, expiresAt time.Time) (exists bool) {
+	d.wal.apply(walExpireAtEntry(key, expiresAt), func() bool {
+		exists = d.RadixTree.ExpireAt(key, expiresAt)
+		if !exists {
+			return false
+		}
+		d.events.notifyKeyspace(keyspaceOpExpireAt, key, 0, nil)
+		return true
+	})
+	return
+}
+
+// Persist is used to make a key never expire. Returns true if the key exists.
+func (d *database) Persist(key []byte) bool {
+	return d.ExpireAt(key, time.Time{})
+}
+
+// DeleteKey is used to delete a key from the tree. Returns true if the key existed.
+func (d *database) DeleteKey(key []byte) bool {
+	return d.deleteKey(key, keyspaceOpDelete)
+}
+
+// deleteKey is used to delete a key from the tree, notifying subscribers with the kind of change specified if it
+// existed. Returns true if the key existed.
+func (d *database) deleteKey(key []byte, op byte) (deleted bool) {
+	d.wal.apply(walKeyEntry(walOpDeleteKey, key), func() bool {
+		deleted = d.RadixTree.DeleteKey(key)
+		if deleted {
+			d.events.notifyKeyspace(op, key, 0, nil)
+		}
+		return deleted
+	})
+	return
+}
+
+// DeletePrefix is used to delete everything starting with the prefix. Returns the number of nodes removed.
+func (d *database) DeletePrefix(prefix []byte) (removed uint64) {
+	d.wal.apply(walKeyEntry(walOpDeletePrefix, prefix), func() bool {
+		removed = d.RadixTree.DeletePrefix(prefix)
+		if removed != 0 {
+			d.events.notifyKeyspace(keyspaceOpDeletePrefix, prefix, removed, nil)
+		}
+		return true
+	})
+	return
+}
+
+// FreeTree is used to delete everything in the tree.
+func (d *database) FreeTree() {
+	d.wal.apply([]byte{walOpFreeTree}, func() bool {
+		d.RadixTree.FreeTree()
+		d.events.notifyKeyspace(keyspaceOpFreeTree, nil, 0, nil)
+		return true
+	})
+}
+
+// Defines how many expired keys are removed from a tree at a time. The tree is write locked whilst they are removed.
+const sweepBatchSize = 500
+
+// sweepExpired is used to remove expired keys from the tree in the background. Expired keys are already
+// invisible, so this only reclaims their memory. Removals are not logged since replaying the log expires them too.
+func (d *database) sweepExpired() {
+	for {
+		time.Sleep(time.Millisecond * 100)
+		for d.RadixTree.SweepExpired(sweepBatchSize) == sweepBatchSize {
+			// Let any waiting writers in before the next batch.
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+// Defines the most records which can be returned in a page of a walk.
+const maxPageLimit = 10000
+
+var (
+	errInvalidCursor      = errors.New("The cursor is not from a walk of this prefix.")
+	errInvalidRangeCursor = errors.New("The cursor is not from a walk of this range.")
+)
+
+// prefixEnd is used to get the first key after every key starting with the prefix. Returns nil if there is no such key.
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] != 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// walkPage is used to walk up to limit records from start (inclusive) to end (exclusive). A limit of 0 or above
+// maxPageLimit is capped to maxPageLimit. The cursor for the next page is the last key returned, or nil if there are no
+// more records. The records are freed by the destructor.
+func (d *database) walkPage(
+	start, end []byte, reverse bool, limit int, destructor radix.WalkerDestructor,
+) (records []record, next []byte) {
+	if limit <= 0 || limit > maxPageLimit {
+		limit = maxPageLimit
+	}
+
+	// Walk one more record than the limit so we know if there is another page.
+	d.WalkRange(start, end, reverse, func(key, value []byte) bool {
+		if len(records) == limit {
+			next = append([]byte{}, records[len(records)-1].key...)
+			return false
+		}
+		records = append(records, record{key: key, value: value})
+		return true
+	}, destructor)
+	return
+}
+
+// walkPrefixPage is used to walk up to limit records starting with the prefix in byte order. A limit of 0 or above
+// maxPageLimit is capped to maxPageLimit. If the cursor is set, the walk resumes after it. The cursor for the next
+// page is returned, or nil if there are no more records. The records are freed by the destructor.
+func (d *database) walkPrefixPage(
+	prefix, cursor []byte, limit int, destructor radix.WalkerDestructor,
+) (records []record, next []byte, err error) {
+	// The cursor is the last key returned, so start at the first key after it.
+	start := prefix
+	if cursor != nil {
+		if !bytes.HasPrefix(cursor, prefix) {
+			return nil, nil, errInvalidCursor
+		}
+		start = append(append([]byte(nil), cursor...), 0)
+	}
+	records, next = d.walkPage(start, prefixEnd(prefix), false, limit, destructor)
+	return records, next, nil
+}
+
+// walkRangePage is used to walk up to limit records from start (inclusive) to end (exclusive) in byte order, or in
+// descending byte order if reverse is true. An empty end means there is no end. A limit of 0 or above maxPageLimit is
+// capped to maxPageLimit. If the cursor is set, the walk resumes after it. The cursor for the next page is returned,
+// or nil if there are no more records. The records are freed by the destructor.
+func (d *database) walkRangePage(
+	start, end []byte, reverse bool, cursor []byte, limit int, destructor radix.WalkerDestructor,
+) (records []record, next []byte, err error) {
+	if cursor != nil {
+		if bytes.Compare(cursor, start) < 0 || (len(end) != 0 && bytes.Compare(cursor, end) >= 0) {
+			return nil, nil, errInvalidRangeCursor
+		}
+		if reverse {
+			// The cursor is the last key returned, so end at it. Nothing comes before an empty key.
+			if len(cursor) == 0 {
+				return nil, nil, nil
+			}
+			end = cursor
+		} else {
+			// The cursor is the last key returned, so start at the first key after it.
+			start = append(append([]byte(nil), cursor...), 0)
+		}
+	}
+	records, next = d.walkPage(start, end, reverse, limit, destructor)
+	return records, next, nil
+}
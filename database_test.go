@@ -0,0 +1,310 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/webscalesoftwareltd/hypercache/radix"
+)
+
+// newPagingDatabase is used to make a database with the keys specified, each set to "v" followed by the key.
+func newPagingDatabase(t *testing.T, keys []string) *database {
+	t.Helper()
+	d := &database{RadixTree: radix.NewRadixTree()}
+	t.Cleanup(d.RadixTree.FreeTree)
+	for _, k := range keys {
+		_, _ = d.Set([]byte(k), []byte("v"+k))
+	}
+	return d
+}
+
+// pageWalker is used to walk a page of records from the cursor.
+type pageWalker func(cursor []byte, destructor radix.WalkerDestructor) ([]record, []byte, error)
+
+// collectPages is used to walk every page with the function specified, checking no page is larger than the limit.
+// Returns the keys from each page.
+func collectPages(t *testing.T, limit int, page pageWalker) (pages [][]string) {
+	t.Helper()
+	var cursor []byte
+	for {
+		destructor := &radix.PendingFreer{}
+		records, next, err := page(cursor, destructor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) > limit {
+			t.Fatalf("got a page of %d records with a limit of %d", len(records), limit)
+		}
+		keys := make([]string, len(records))
+		for i, r := range records {
+			keys[i] = string(r.key)
+			if string(r.value) != "v"+keys[i] {
+				t.Errorf("key %q: got value %q", r.key, r.value)
+			}
+		}
+		destructor.FreeAll()
+		pages = append(pages, keys)
+		if next == nil {
+			return pages
+		}
+		if len(pages) > 100 {
+			t.Fatal("the walk did not end")
+		}
+		cursor = next
+	}
+}
+
+func TestWalkPrefixPage(t *testing.T) {
+	var keys []string
+	for i := 0; i < 7; i++ {
+		keys = append(keys, fmt.Sprintf("user:%d", i))
+	}
+	keys = append(keys, "user", "users", "post:1", "v")
+	tests := []struct {
+		name   string
+		prefix string
+		limit  int
+		want   [][]string
+	}{
+		{
+			name:   "one page",
+			prefix: "user:",
+			limit:  10,
+			want:   [][]string{{"user:0", "user:1", "user:2", "user:3", "user:4", "user:5", "user:6"}},
+		},
+		{
+			name:   "several pages",
+			prefix: "user:",
+			limit:  3,
+			want:   [][]string{{"user:0", "user:1", "user:2"}, {"user:3", "user:4", "user:5"}, {"user:6"}},
+		},
+		{
+			name:   "exact pages",
+			prefix: "user:",
+			limit:  7,
+			want:   [][]string{{"user:0", "user:1", "user:2", "user:3", "user:4", "user:5", "user:6"}},
+		},
+		{
+			name:   "prefix is a key",
+			prefix: "user",
+			limit:  4,
+			want: [][]string{
+				{"user", "user:0", "user:1", "user:2"}, {"user:3", "user:4", "user:5", "user:6"}, {"users"},
+			},
+		},
+		{name: "no matches", prefix: "missing", limit: 5, want: [][]string{{}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newPagingDatabase(t, keys)
+			var page pageWalker = func(cursor []byte, destructor radix.WalkerDestructor) ([]record, []byte, error) {
+				return d.walkPrefixPage([]byte(tt.prefix), cursor, tt.limit, destructor)
+			}
+			got := collectPages(t, tt.limit, page)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("cursor outside the prefix", func(t *testing.T) {
+		d := newPagingDatabase(t, keys)
+		_, _, err := d.walkPrefixPage([]byte("user:"), []byte("post:1"), 1, radix.ImmediateFreer{})
+		if err != errInvalidCursor {
+			t.Fatalf("got %v, want %v", err, errInvalidCursor)
+		}
+	})
+}
+
+func TestWalkRangePage(t *testing.T) {
+	keys := []string{"", "a", "ab", "abc", "b", "ba", "c", "d", "\xff"}
+	tests := []struct {
+		name       string
+		start, end string
+		reverse    bool
+		limit      int
+		want       [][]string
+	}{
+		{
+			name:  "everything",
+			limit: 4,
+			want:  [][]string{{"", "a", "ab", "abc"}, {"b", "ba", "c", "d"}, {"\xff"}},
+		},
+		{
+			name:    "everything reversed",
+			reverse: true,
+			limit:   4,
+			want:    [][]string{{"\xff", "d", "c", "ba"}, {"b", "abc", "ab", "a"}, {""}},
+		},
+		{
+			name:  "bounded",
+			start: "ab",
+			end:   "d",
+			limit: 2,
+			want:  [][]string{{"ab", "abc"}, {"b", "ba"}, {"c"}},
+		},
+		{
+			name:    "bounded reversed",
+			start:   "ab",
+			end:     "d",
+			reverse: true,
+			limit:   2,
+			want:    [][]string{{"c", "ba"}, {"b", "abc"}, {"ab"}},
+		},
+		{
+			name:  "limit of one",
+			start: "b",
+			end:   "c",
+			limit: 1,
+			want:  [][]string{{"b"}, {"ba"}},
+		},
+		{
+			name:    "limit of one reversed",
+			start:   "b",
+			end:     "c",
+			reverse: true,
+			limit:   1,
+			want:    [][]string{{"ba"}, {"b"}},
+		},
+		{
+			name:  "empty range",
+			start: "e",
+			end:   "f",
+			limit: 3,
+			want:  [][]string{{}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newPagingDatabase(t, keys)
+			var page pageWalker = func(cursor []byte, destructor radix.WalkerDestructor) ([]record, []byte, error) {
+				return d.walkRangePage([]byte(tt.start), []byte(tt.end), tt.reverse, cursor, tt.limit, destructor)
+			}
+			got := collectPages(t, tt.limit, page)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	cursorTests := []struct {
+		name       string
+		start, end string
+		reverse    bool
+		cursor     string
+		wantErr    error
+		want       []string
+	}{
+		{name: "cursor before the start", start: "b", end: "d", cursor: "a", wantErr: errInvalidRangeCursor},
+		{name: "cursor at the end", start: "b", end: "d", cursor: "d", wantErr: errInvalidRangeCursor},
+		{
+			name: "cursor after the end", start: "b", end: "d", reverse: true, cursor: "e",
+			wantErr: errInvalidRangeCursor,
+		},
+		{name: "cursor with no end", start: "b", cursor: "z", want: []string{"\xff"}},
+		{name: "cursor between keys", start: "a", end: "c", cursor: "aa", want: []string{"ab", "abc", "b", "ba"}},
+		{name: "empty cursor reversed", reverse: true, cursor: ""},
+	}
+	for _, tt := range cursorTests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newPagingDatabase(t, keys)
+			destructor := &radix.PendingFreer{}
+			defer destructor.FreeAll()
+			records, next, err := d.walkRangePage(
+				[]byte(tt.start), []byte(tt.end), tt.reverse, []byte(tt.cursor), 10, destructor)
+			if err != tt.wantErr {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			var got []string
+			for _, r := range records {
+				got = append(got, string(r.key))
+			}
+			if !reflect.DeepEqual(got, tt.want) || next != nil {
+				t.Fatalf("got %q (next %q), want %q", got, next, tt.want)
+			}
+		})
+	}
+}
+
+func TestExec(t *testing.T) {
+	tests := []struct {
+		name         string
+		watches      func(version uint64) []watchedKey
+		wantExecuted bool
+	}{
+		{name: "no watches", wantExecuted: true},
+		{
+			name: "watches match",
+			watches: func(version uint64) []watchedKey {
+				return []watchedKey{{key: []byte("counter"), version: version}, {key: []byte("new")}}
+			},
+			wantExecuted: true,
+		},
+		{
+			name: "watched key changed",
+			watches: func(version uint64) []watchedKey {
+				return []watchedKey{{key: []byte("counter"), version: version + 1}}
+			},
+		},
+		{
+			name: "watched key exists",
+			watches: func(uint64) []watchedKey {
+				return []watchedKey{{key: []byte("counter")}}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newPagingDatabase(t, nil)
+			version, _ := d.SetIf([]byte("counter"), []byte("1"), time.Time{}, radix.SetAlways, nil, 0)
+			_, _ = d.Set([]byte("old:1"), []byte("x"))
+			_, _ = d.Set([]byte("old:2"), []byte("y"))
+			var watches []watchedKey
+			if tt.watches != nil {
+				watches = tt.watches(version)
+			}
+
+			results, executed, err := d.Exec(watches, []transactionOp{
+				{kind: txOpGet, key: []byte("counter")},
+				{kind: txOpSet, key: []byte("counter"), value: []byte("2")},
+				{kind: txOpSet, key: []byte("new"), value: []byte("z")},
+				{kind: txOpDeleteKey, key: []byte("missing")},
+				{kind: txOpDeletePrefix, key: []byte("old:")},
+				{kind: txOpGet, key: []byte("new")},
+				{kind: txOpGet, key: []byte("missing")},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if executed != tt.wantExecuted {
+				t.Fatalf("got executed %v, want %v", executed, tt.wantExecuted)
+			}
+			want := map[string]string{"counter": "1", "old:1": "x", "old:2": "y"}
+			if !executed {
+				if results != nil {
+					t.Errorf("got results %v for a transaction which did not run", results)
+				}
+				got := lookup(d.RadixTree, "counter", "new", "missing", "old:1", "old:2")
+				if !reflect.DeepEqual(got, want) {
+					t.Fatalf("tree changed by a transaction which did not run: %q", got)
+				}
+				return
+			}
+
+			if string(results[0].value) != "1" || string(results[5].value) != "z" || results[6].value != nil {
+				t.Errorf("got values %q, %q and %q, want \"1\", \"z\" and nil",
+					results[0].value, results[5].value, results[6].value)
+			}
+			if results[1].n != 1 || results[2].n != 0 || results[3].n != 0 || results[4].n == 0 {
+				t.Errorf("got results %+v", results)
+			}
+			want = map[string]string{"counter": "2", "new": "z"}
+			got := lookup(d.RadixTree, "counter", "new", "missing", "old:1", "old:2")
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("got %q, want %q", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/jakemakesstuff/packetmaker"
+)
+
+// eventOverflowPolicy defines what happens when an event is sent to a subscriber whose queue is full.
+type eventOverflowPolicy int
+
+const (
+	// eventOverflowDropOldest drops the oldest event in the queue to make room.
+	eventOverflowDropOldest eventOverflowPolicy = iota
+
+	// eventOverflowDropNewest drops the event being sent.
+	eventOverflowDropNewest
+
+	// eventOverflowDisconnect drops the event and closes the connection, since it cannot keep up.
+	eventOverflowDisconnect
+)
+
+func parseEventOverflowPolicy(s string) (eventOverflowPolicy, error) {
+	switch s {
+	case "drop-oldest":
+		return eventOverflowDropOldest, nil
+	case "drop-newest":
+		return eventOverflowDropNewest, nil
+	case "disconnect":
+		return eventOverflowDisconnect, nil
+	default:
+		return 0, errors.New("unknown event overflow policy: " + s)
+	}
+}
+
+// eventSubscriber is a connection which can subscribe to event channels. Each connection has its own.
+type eventSubscriber struct {
+	conn net.Conn
+
+	// Defines the channels and glob patterns subscribed to, and the key prefixes subscribed to along with if their
+	// notifications include values. These are guarded by the dispatcher lock.
+	channels map[string]struct{}
+	patterns map[string]struct{}
+	keyspace map[string]bool
+
+	// Defines the events waiting to be written to the connection. Each subscriber has one goroutine writing them, so
+	// they are written in order and a slow connection only holds up itself.
+	queue   [][]byte
+	queueMu sync.Mutex
+	wake    chan struct{}
+	done    chan struct{}
+
+	// Defines the number of events dropped because the queue was full.
+	dropped uint64
+}
+
+// push is used to add an event packet to the queue, handling it with the policy specified if the queue is full.
+func (s *eventSubscriber) push(packet []byte, size int, overflow eventOverflowPolicy) {
+	s.queueMu.Lock()
+	if len(s.queue) >= size {
+		atomic.AddUint64(&s.dropped, 1)
+		switch overflow {
+		case eventOverflowDropOldest:
+			s.queue[0] = nil
+			s.queue = append(s.queue[1:], packet)
+		case eventOverflowDisconnect:
+			// Closing the connection makes the read loop return, which removes the subscriber.
+			_ = s.conn.Close()
+		}
+		s.queueMu.Unlock()
+	} else {
+		s.queue = append(s.queue, packet)
+		s.queueMu.Unlock()
+	}
+
+	// Wake the writer if it is not already awake.
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// writeLoop is used to write queued events to the connection until the subscriber is removed.
+func (s *eventSubscriber) writeLoop() {
+	for {
+		select {
+		case <-s.wake:
+		case <-s.done:
+			return
+		}
+
+		// Take everything in the queue and write it.
+		s.queueMu.Lock()
+		queue := s.queue
+		s.queue = nil
+		s.queueMu.Unlock()
+		for _, packet := range queue {
+			if !write(s.conn, packet) {
+				_ = s.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// stats is used to get the number of events waiting to be written and the number dropped.
+func (s *eventSubscriber) stats() (queued int, dropped uint64) {
+	s.queueMu.Lock()
+	queued = len(s.queue)
+	s.queueMu.Unlock()
+	return queued, atomic.LoadUint64(&s.dropped)
+}
+
+// eventDispatcher is used to send events published on a channel to the connections subscribed to it.
+type eventDispatcher struct {
+	mu          sync.RWMutex
+	subscribers []*eventSubscriber
+
+	// Defines the most events which can wait to be written to each subscriber, and what happens when there are more.
+	queueSize int
+	overflow  eventOverflowPolicy
+
+	// Defines the number of key prefixes subscribed to across every subscriber. Writes skip building notifications
+	// when this is 0.
+	keyspaceSubs int32
+}
+
+// addSubscriber is used to add a connection which can subscribe to channels, and start writing its events.
+func (e *eventDispatcher) addSubscriber(conn net.Conn) *eventSubscriber {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	s := &eventSubscriber{
+		conn:     conn,
+		channels: map[string]struct{}{},
+		patterns: map[string]struct{}{},
+		keyspace: map[string]bool{},
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	e.subscribers = append(e.subscribers, s)
+	go s.writeLoop()
+	return s
+}
+
+// removeSubscriber is used to remove a connection and all of its subscriptions, and stop writing its events.
+func (e *eventDispatcher) removeSubscriber(s *eventSubscriber) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	close(s.done)
+	atomic.AddInt32(&e.keyspaceSubs, -int32(len(s.keyspace)))
+
+	i := -1
+	for possibleIndex, possible := range e.subscribers {
+		if possible == s {
+			i = possibleIndex
+		}
+	}
+	if i == -1 {
+		return
+	}
+
+	e.subscribers[i] = e.subscribers[len(e.subscribers)-1]
+	e.subscribers[len(e.subscribers)-1] = nil
+	e.subscribers = e.subscribers[:len(e.subscribers)-1]
+}
+
+// subscribe is used to subscribe a connection to a channel, or to every channel matching a glob pattern if pattern is
+// true. Returns false if it was already subscribed.
+func (e *eventDispatcher) subscribe(s *eventSubscriber, channel []byte, pattern bool) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	m := s.channels
+	if pattern {
+		m = s.patterns
+	}
+	if _, ok := m[string(channel)]; ok {
+		return false
+	}
+	m[string(channel)] = struct{}{}
+	return true
+}
+
+// unsubscribe is used to unsubscribe a connection from a channel or glob pattern. Returns false if it was not
+// subscribed.
+func (e *eventDispatcher) unsubscribe(s *eventSubscriber, channel []byte, pattern bool) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	m := s.channels
+	if pattern {
+		m = s.patterns
+	}
+	if _, ok := m[string(channel)]; !ok {
+		return false
+	}
+	delete(m, string(channel))
+	return true
+}
+
+// Defines the byte after the reply ID of 0 which says what an event packet is. Events sent with the deprecated event
+// send use 0, which is what older clients read, and events from subscriptions use 2.
+const (
+	eventPacketLegacy       byte = 0
+	eventPacketSubscription byte = 2
+)
+
+// makeLegacyEventPacket is used to make the packet for an event sent with the deprecated event send. This is a reply
+// ID of 0 and a null byte, followed by the length prefixed event.
+func makeLegacyEventPacket(event []byte) []byte {
+	return packetmaker.New().
+		Uint32(0, true).
+		Byte(eventPacketLegacy).
+		Uint32(uint32(len(event)), true).
+		Bytes(event).
+		Make()
+}
+
+// broadcast is used to queue an event for every connection other than the one which sent it. This is only kept for
+// the deprecated event send, and publish should be used instead.
+func (e *eventDispatcher) broadcast(from *eventSubscriber, event []byte) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	packet := makeLegacyEventPacket(event)
+	for _, s := range e.subscribers {
+		if s != from {
+			s.push(packet, e.queueSize, e.overflow)
+		}
+	}
+}
+
+// makeEventPacket is used to make the packet for an event. This is a reply ID of 0 and a byte of 2, then a byte which
+// is 1 if it matched a pattern, the length prefixed channel or pattern it matched, the length prefixed channel it was
+// published on and the length prefixed event.
+func makeEventPacket(pattern bool, subscription, channel, event []byte) []byte {
+	var patternByte byte
+	if pattern {
+		patternByte = 1
+	}
+	return packetmaker.New().
+		Uint32(0, true).
+		Byte(eventPacketSubscription).
+		Byte(patternByte).
+		Uint32(uint32(len(subscription)), true).
+		Bytes(subscription).
+		Uint32(uint32(len(channel)), true).
+		Bytes(channel).
+		Uint32(uint32(len(event)), true).
+		Bytes(event).
+		Make()
+}
+
+// publish is used to queue an event for every connection subscribed to the channel. A connection gets it once for the
+// channel and once for each pattern it matches. Returns the number of events queued, including any which are then
+// dropped because a queue is full.
+func (e *eventDispatcher) publish(channel, event []byte) int {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	sent := 0
+	for _, s := range e.subscribers {
+		if _, ok := s.channels[string(channel)]; ok {
+			s.push(makeEventPacket(false, channel, channel, event), e.queueSize, e.overflow)
+			sent++
+		}
+		for pattern := range s.patterns {
+			if globMatch(pattern, channel) {
+				s.push(makeEventPacket(true, []byte(pattern), channel, event), e.queueSize, e.overflow)
+				sent++
+			}
+		}
+	}
+	return sent
+}
+
+// Defines the kinds of change in a keyspace notification.
+const (
+	// keyspaceOpSet is a key being set, including by an increment.
+	keyspaceOpSet byte = iota
+
+	// keyspaceOpDelete is a key being deleted.
+	keyspaceOpDelete
+
+	// keyspaceOpDeletePrefix is every key starting with a prefix being deleted.
+	keyspaceOpDeletePrefix
+
+	// keyspaceOpFreeTree is every key in the database being deleted.
+	keyspaceOpFreeTree
+
+	// keyspaceOpExpireAt is the time a key expires at being changed.
+	keyspaceOpExpireAt
+
+	// keyspaceOpEvict is a key being evicted to make room for a write.
+	keyspaceOpEvict
+)
+
+// subscribeKeyspace is used to subscribe a connection to changes to keys starting with the prefix. If values is true,
+// notifications for sets include the new value. Returns false if it was already subscribed, in which case values is
+// updated.
+func (e *eventDispatcher) subscribeKeyspace(s *eventSubscriber, prefix []byte, values bool) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, ok := s.keyspace[string(prefix)]
+	s.keyspace[string(prefix)] = values
+	if ok {
+		return false
+	}
+	atomic.AddInt32(&e.keyspaceSubs, 1)
+	return true
+}
+
+// unsubscribeKeyspace is used to unsubscribe a connection from changes to keys starting with the prefix. Returns
+// false if it was not subscribed.
+func (e *eventDispatcher) unsubscribeKeyspace(s *eventSubscriber, prefix []byte) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := s.keyspace[string(prefix)]; !ok {
+		return false
+	}
+	delete(s.keyspace, string(prefix))
+	atomic.AddInt32(&e.keyspaceSubs, -1)
+	return true
+}
+
+// makeKeyspacePacket is used to make the packet for a keyspace notification. This is the same as an event packet, but
+// the byte after the 2 is also 2, followed by the length prefixed prefix subscribed to, the kind of change, the length
+// prefixed key (or prefix for prefix deletes), the number of nodes removed for prefix deletes and the length prefixed
+// value.
+func makeKeyspacePacket(prefix []byte, op byte, key []byte, removed uint64, value []byte) []byte {
+	return packetmaker.New().
+		Uint32(0, true).
+		Byte(eventPacketSubscription).
+		Byte(2).
+		Uint32(uint32(len(prefix)), true).
+		Bytes(prefix).
+		Byte(op).
+		Uint32(uint32(len(key)), true).
+		Bytes(key).
+		Uint64(removed, true).
+		Uint32(uint32(len(value)), true).
+		Bytes(value).
+		Make()
+}
+
+// notifyKeyspace is used to queue a notification of a change for every connection subscribed to a prefix it touches.
+// The value is only sent for sets, and only to subscriptions which asked for it. The dispatcher can be nil, in which
+// case this does nothing.
+func (e *eventDispatcher) notifyKeyspace(op byte, key []byte, removed uint64, value []byte) {
+	if e == nil || atomic.LoadInt32(&e.keyspaceSubs) == 0 {
+		return
+	}
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	for _, s := range e.subscribers {
+		for prefix, values := range s.keyspace {
+			// Check if the change touches a key starting with the prefix.
+			p := []byte(prefix)
+			switch op {
+			case keyspaceOpFreeTree:
+			case keyspaceOpDeletePrefix:
+				if !bytes.HasPrefix(key, p) && !bytes.HasPrefix(p, key) {
+					continue
+				}
+			default:
+				if !bytes.HasPrefix(key, p) {
+					continue
+				}
+			}
+
+			var v []byte
+			if values && op == keyspaceOpSet {
+				v = value
+			}
+			s.push(makeKeyspacePacket(p, op, key, removed, v), e.queueSize, e.overflow)
+		}
+	}
+}
+
+// eventSubscriberInfo is a subscriber returned from an eventDispatcher list.
+type eventSubscriberInfo struct {
+	addr     string
+	channels []string
+	patterns []string
+	keyspace []string
+	queued   int
+	dropped  uint64
+}
+
+// list is used to get every subscriber along with its subscriptions and event counts.
+func (e *eventDispatcher) list() []eventSubscriberInfo {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	subscribers := make([]eventSubscriberInfo, len(e.subscribers))
+	for i, s := range e.subscribers {
+		info := eventSubscriberInfo{
+			addr:     s.conn.RemoteAddr().String(),
+			channels: []string{},
+			patterns: []string{},
+			keyspace: []string{},
+		}
+		for channel := range s.channels {
+			info.channels = append(info.channels, channel)
+		}
+		sort.Strings(info.channels)
+		for pattern := range s.patterns {
+			info.patterns = append(info.patterns, pattern)
+		}
+		sort.Strings(info.patterns)
+		for prefix := range s.keyspace {
+			info.keyspace = append(info.keyspace, prefix)
+		}
+		sort.Strings(info.keyspace)
+		info.queued, info.dropped = s.stats()
+		subscribers[i] = info
+	}
+	return subscribers
+}
+
+// globMatch is used to check if a channel matches a glob pattern. A "*" matches any number of bytes and a "?" matches
+// one byte. Everything else matches itself.
+func globMatch(pattern string, channel []byte) bool {
+	p, c := 0, 0
+
+	// Defines where to go back to if the rest after the last star does not match.
+	star, starC := -1, 0
+
+	for c < len(channel) {
+		switch {
+		case p < len(pattern) && pattern[p] == '*':
+			// Try matching nothing with the star first.
+			star, starC = p, c
+			p++
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == channel[c]):
+			p++
+			c++
+		case star != -1:
+			// Make the last star match one more byte.
+			starC++
+			p, c = star+1, starC
+		default:
+			return false
+		}
+	}
+
+	// Any stars left can match nothing.
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
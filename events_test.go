@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		channel string
+		want    bool
+	}{
+		{pattern: "orders", channel: "orders", want: true},
+		{pattern: "orders", channel: "orders.new"},
+		{pattern: "orders.*", channel: "orders.new", want: true},
+		{pattern: "orders.*", channel: "orders.", want: true},
+		{pattern: "orders.*", channel: "order"},
+		{pattern: "*.new", channel: "orders.new", want: true},
+		{pattern: "*.new", channel: "orders.old"},
+		{pattern: "o?ders", channel: "orders", want: true},
+		{pattern: "o?ders", channel: "oders"},
+		{pattern: "a*b*c", channel: "aXbYbZc", want: true},
+		{pattern: "a*b*c", channel: "aXbYbZ"},
+		{pattern: "*", channel: "", want: true},
+	}
+	for _, tt := range tests {
+		if got := globMatch(tt.pattern, []byte(tt.channel)); got != tt.want {
+			t.Errorf("%q matching %q: got %v, want %v", tt.pattern, tt.channel, got, tt.want)
+		}
+	}
+}
+
+// pipeSubscriber is used to add a subscriber to the dispatcher which writes to a pipe. Returns the subscriber and the
+// client side of the pipe.
+func pipeSubscriber(t *testing.T, e *eventDispatcher) (*eventSubscriber, net.Conn) {
+	t.Helper()
+	server, client := net.Pipe()
+	s := e.addSubscriber(server)
+	t.Cleanup(func() {
+		e.removeSubscriber(s)
+		_ = client.Close()
+		_ = server.Close()
+	})
+	return s, client
+}
+
+func TestPublish(t *testing.T) {
+	e := eventDispatcher{queueSize: 16}
+	sender, other := pipeSubscriber(t, &e)
+	direct, directConn := pipeSubscriber(t, &e)
+	patterns, matchedConn := pipeSubscriber(t, &e)
+	e.subscribe(direct, []byte("orders.new"), false)
+	e.subscribe(patterns, []byte("orders.*"), true)
+	if e.subscribe(patterns, []byte("orders.*"), true) {
+		t.Error("subscribing again was reported as a new subscription")
+	}
+
+	// Each subscription matching the channel gets the event.
+	if sent := e.publish([]byte("orders.new"), []byte("data")); sent != 2 {
+		t.Fatalf("got %d events sent, want 2", sent)
+	}
+	expect := func(conn net.Conn, want []byte) {
+		t.Helper()
+		got := make([]byte, len(want))
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := io.ReadFull(conn, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+	expect(directConn, makeEventPacket(false, []byte("orders.new"), []byte("orders.new"), []byte("data")))
+	expect(matchedConn, makeEventPacket(true, []byte("orders.*"), []byte("orders.new"), []byte("data")))
+
+	// Unsubscribed connections do not get it.
+	if !e.unsubscribe(patterns, []byte("orders.*"), true) {
+		t.Fatal("the pattern was not subscribed")
+	}
+	if sent := e.publish([]byte("orders.old"), []byte("data")); sent != 0 {
+		t.Fatalf("got %d events sent, want none", sent)
+	}
+
+	// The deprecated event send goes to every connection except the sender, whether or not it subscribed.
+	e.broadcast(sender, []byte("hello"))
+	expect(directConn, makeLegacyEventPacket([]byte("hello")))
+	expect(matchedConn, makeLegacyEventPacket([]byte("hello")))
+	_ = other.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err := other.Read(make([]byte, 1)); err == nil {
+		t.Error("the event was sent back to the sender")
+	}
+}
+
+func TestEventOverflowPolicy(t *testing.T) {
+	tests := []struct {
+		name        string
+		overflow    eventOverflowPolicy
+		size        int
+		pushes      []string
+		wantQueue   []string
+		wantDropped uint64
+		wantClosed  bool
+	}{
+		{
+			name:      "room in the queue",
+			overflow:  eventOverflowDisconnect,
+			size:      3,
+			pushes:    []string{"1", "2", "3"},
+			wantQueue: []string{"1", "2", "3"},
+		},
+		{
+			name:        "drop oldest",
+			overflow:    eventOverflowDropOldest,
+			size:        3,
+			pushes:      []string{"1", "2", "3", "4", "5"},
+			wantQueue:   []string{"3", "4", "5"},
+			wantDropped: 2,
+		},
+		{
+			name:        "drop newest",
+			overflow:    eventOverflowDropNewest,
+			size:        3,
+			pushes:      []string{"1", "2", "3", "4", "5"},
+			wantQueue:   []string{"1", "2", "3"},
+			wantDropped: 2,
+		},
+		{
+			name:        "disconnect",
+			overflow:    eventOverflowDisconnect,
+			size:        2,
+			pushes:      []string{"1", "2", "3"},
+			wantQueue:   []string{"1", "2"},
+			wantDropped: 1,
+			wantClosed:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer server.Close()
+			defer client.Close()
+
+			// Nothing writes the queue, so it fills up.
+			s := &eventSubscriber{conn: server, wake: make(chan struct{}, 1), done: make(chan struct{})}
+			for _, p := range tt.pushes {
+				s.push([]byte(p), tt.size, tt.overflow)
+			}
+
+			var queue []string
+			for _, p := range s.queue {
+				queue = append(queue, string(p))
+			}
+			if !reflect.DeepEqual(queue, tt.wantQueue) {
+				t.Errorf("got queue %q, want %q", queue, tt.wantQueue)
+			}
+			if queued, dropped := s.stats(); queued != len(tt.wantQueue) || dropped != tt.wantDropped {
+				t.Errorf("got %d queued and %d dropped, want %d and %d",
+					queued, dropped, len(tt.wantQueue), tt.wantDropped)
+			}
+
+			// The client sees the connection close if it was disconnected.
+			_ = client.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+			_, err := client.Read(make([]byte, 1))
+			if closed := err == io.EOF; closed != tt.wantClosed {
+				t.Errorf("got read error %v, want closed %v", err, tt.wantClosed)
+			}
+		})
+	}
+}
+
+func TestEventSubscriberWritesInOrder(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	var e eventDispatcher
+	e.queueSize = 16
+	s := e.addSubscriber(server)
+	defer e.removeSubscriber(s)
+	if !e.subscribe(s, []byte("news"), false) {
+		t.Fatal("subscribe failed")
+	}
+
+	tests := []struct {
+		channel   string
+		event     string
+		wantCount int
+	}{
+		{channel: "news", event: "first", wantCount: 1},
+		{channel: "other", event: "skipped"},
+		{channel: "news", event: "second", wantCount: 1},
+	}
+	var want []byte
+	for _, tt := range tests {
+		if n := e.publish([]byte(tt.channel), []byte(tt.event)); n != tt.wantCount {
+			t.Fatalf("publish to %q reached %d subscribers, want %d", tt.channel, n, tt.wantCount)
+		}
+		if tt.wantCount != 0 {
+			want = append(want, makeEventPacket(false, []byte(tt.channel), []byte(tt.channel), []byte(tt.event))...)
+		}
+	}
+
+	got := make([]byte, len(want))
+	_ = client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(client, got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestNotifyKeyspace(t *testing.T) {
+	e := eventDispatcher{queueSize: 16}
+	withValues, withValuesConn := pipeSubscriber(t, &e)
+	withoutValues, withoutValuesConn := pipeSubscriber(t, &e)
+	e.subscribeKeyspace(withValues, []byte("user:"), true)
+	e.subscribeKeyspace(withoutValues, []byte("user:1"), false)
+
+	tests := []struct {
+		op                        byte
+		key                       string
+		removed                   uint64
+		value                     string
+		withValues, withoutValues bool
+	}{
+		{op: keyspaceOpSet, key: "user:1", value: "a", withValues: true, withoutValues: true},
+		{op: keyspaceOpSet, key: "user:2", value: "b", withValues: true},
+		{op: keyspaceOpSet, key: "order:1", value: "c"},
+		{op: keyspaceOpDelete, key: "user:1", withValues: true, withoutValues: true},
+		{op: keyspaceOpDeletePrefix, key: "us", removed: 3, withValues: true, withoutValues: true},
+		{op: keyspaceOpDeletePrefix, key: "user:2", removed: 1, withValues: true},
+		{op: keyspaceOpFreeTree, withValues: true, withoutValues: true},
+	}
+	var wantWith, wantWithout []byte
+	for _, tt := range tests {
+		e.notifyKeyspace(tt.op, []byte(tt.key), tt.removed, []byte(tt.value))
+		if tt.withValues {
+			wantWith = append(wantWith,
+				makeKeyspacePacket([]byte("user:"), tt.op, []byte(tt.key), tt.removed, []byte(tt.value))...)
+		}
+		if tt.withoutValues {
+			// The value is only sent to subscriptions which asked for it.
+			wantWithout = append(wantWithout,
+				makeKeyspacePacket([]byte("user:1"), tt.op, []byte(tt.key), tt.removed, nil)...)
+		}
+	}
+
+	for _, c := range []struct {
+		conn net.Conn
+		want []byte
+	}{{conn: withValuesConn, want: wantWith}, {conn: withoutValuesConn, want: wantWithout}} {
+		got := make([]byte, len(c.want))
+		_ = c.conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := io.ReadFull(c.conn, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, c.want) {
+			t.Errorf("got %q, want %q", got, c.want)
+		}
+	}
+
+	// Nothing is sent once unsubscribed.
+	if !e.unsubscribeKeyspace(withValues, []byte("user:")) {
+		t.Fatal("the prefix was not subscribed")
+	}
+	e.notifyKeyspace(keyspaceOpSet, []byte("user:3"), 0, []byte("d"))
+	_ = withValuesConn.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err := withValuesConn.Read(make([]byte, 1)); err == nil {
+		t.Error("a notification was sent after unsubscribing")
+	}
+}
@@ -2,30 +2,45 @@ package main
 
 import (
 	"fmt"
-	hypercache "github.com/webscalesoftwareltd/hypercache/clients/golang"
+	"sync"
 	"time"
+
+	hypercache "github.com/webscalesoftwareltd/hypercache/clients/golang"
 )
 
 func main() {
-	impls := make([]hypercache.HNPImplementation, 150)
-	for i := 0; i < 150; i++ {
-		var err error
-		impls[i], err = hypercache.NewConnectionWithHNPAddr(
-			"127.0.0.1:6060", "", 0)
-		if err != nil {
-			panic(err)
-		}
+	impl, err := hypercache.NewPoolWithHNPAddr("127.0.0.1:6060", "", 0, hypercache.PoolOptions{
+		MinConnections: 10,
+		MaxConnections: 150,
+	})
+	if err != nil {
+		panic(err)
 	}
+	defer impl.Close()
 	fmt.Println("connected!")
 	count := 100000
+	workers := 150
 
 	var total time.Duration
-	for i := 0; i < count; i++ {
-		t1 := time.Now()
-		_, _ = impls[0].Get([]byte("hello"))
-		t2 := time.Now()
-		total += t2.Sub(t1)
+	var totalMu sync.Mutex
+	wg := sync.WaitGroup{}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var sum time.Duration
+			for i := 0; i < count/workers; i++ {
+				t1 := time.Now()
+				_, _ = impl.Get([]byte("hello"))
+				t2 := time.Now()
+				sum += t2.Sub(t1)
+			}
+			totalMu.Lock()
+			total += sum
+			totalMu.Unlock()
+		}()
 	}
-	average := total / time.Duration(count)
+	wg.Wait()
+	average := total / time.Duration(count/workers*workers)
 	fmt.Println("Average:", average)
 }
@@ -3,59 +3,14 @@ package main
 import (
 	"crypto/subtle"
 	"encoding/binary"
-	"io"
+	"math"
 	"net"
-	"sync"
 	"time"
 
 	"github.com/jakemakesstuff/packetmaker"
 	"github.com/webscalesoftwareltd/hypercache/radix"
 )
 
-type eventDispatcher struct {
-	mu      sync.RWMutex
-	writers []io.Writer
-}
-
-func (e *eventDispatcher) addWriter(w io.Writer) {
-	e.mu.Lock()
-	defer e.mu.Unlock()
-	e.writers = append(e.writers, w)
-}
-
-func (e *eventDispatcher) removeWriter(w io.Writer) {
-	e.mu.Lock()
-	defer e.mu.Unlock()
-
-	i := -1
-	for possibleIndex, possible := range e.writers {
-		if possible == w {
-			i = possibleIndex
-		}
-	}
-	if i == -1 {
-		return
-	}
-
-	e.writers[i] = e.writers[len(e.writers)-1]
-	e.writers = e.writers[:len(e.writers)-1]
-}
-
-var n5 = []byte{0, 0, 0, 0, 0}
-
-func (e *eventDispatcher) dispatch(event []byte, except io.Writer) {
-	event = packetmaker.New().Uint32(uint32(len(event)), true).Bytes(n5).Make()
-	e.mu.RLock()
-	defer e.mu.RUnlock()
-	for _, v := range e.writers {
-		v := v
-		if v == except {
-			continue
-		}
-		go v.Write(event)
-	}
-}
-
 func write(conn net.Conn, b []byte) bool {
 	_ = conn.SetWriteDeadline(time.Now().Add(time.Minute))
 	_, err := conn.Write(b)
@@ -101,23 +56,89 @@ var dbNotFoundPacket = packetmaker.New().
 	String(dbNotFoundMessage).
 	Make()
 
-func tryUnlock(mu *sync.Mutex) bool {
-	defer func() {
-		_ = recover()
-	}()
-	mu.Unlock()
-	return true
+// millis is used to turn a number of milliseconds from a packet into a duration, capping it so it cannot overflow.
+func millis(ms uint64) time.Duration {
+	if ms > math.MaxInt64/uint64(time.Millisecond) {
+		return math.MaxInt64
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// expiryFromTTL is used to turn a TTL in milliseconds into when a record expires. A TTL of 0 means the record does not
+// expire, so the time is zero. This is how every TTL is read, so that 0 means the same thing everywhere.
+func expiryFromTTL(ms uint64) time.Time {
+	if ms == 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(millis(ms))
 }
 
-type recordStack struct {
+type record struct {
 	key, value []byte
-	prev       *recordStack
+}
+
+// Makes the result for the records from a walk. This is the number of records followed by each length
+// prefixed key and value.
+func makeRecordsResult(records []record) []byte {
+	m := packetmaker.New().Uint32(uint32(len(records)), true)
+	for _, r := range records {
+		m.Uint32(uint32(len(r.key)), true).
+			Bytes(r.key).
+			Uint32(uint32(len(r.value)), true).
+			Bytes(r.value)
+	}
+	return m.Make()
+}
+
+// makeLocksResult is used to make the result of a lock list. This is the number of locks, then for each lock the
+// kind, name, number of waiters and holders, then for each holder the fencing token, if it is shared, when it was
+// acquired in Unix milliseconds, the remote address and the client name.
+func makeLocksResult(locks []lockInfo) []byte {
+	m := packetmaker.New().Uint32(uint32(len(locks)), true)
+	for _, l := range locks {
+		m.Byte(l.kind).
+			Uint32(uint32(len(l.name)), true).
+			Bytes(l.name).
+			Uint32(uint32(l.waiters), true).
+			Uint32(uint32(len(l.holders)), true)
+		for _, h := range l.holders {
+			var shared byte
+			if h.shared {
+				shared = 1
+			}
+			m.Uint64(h.token, true).
+				Byte(shared).
+				Uint64(uint64(h.acquired.UnixMilli()), true).
+				Uint32(uint32(len(h.addr)), true).
+				String(h.addr).
+				Uint32(uint32(len(h.clientName)), true).
+				String(h.clientName)
+		}
+	}
+	return m.Make()
+}
+
+// parseLock is used to parse a lock packet. This is the lease in milliseconds (0 for none) followed by the name.
+func parseLock(packet []byte) (name []byte, lease time.Duration, ok bool) {
+	if len(packet) < 8 {
+		return nil, 0, false
+	}
+	return packet[8:], millis(binary.LittleEndian.Uint64(packet)), true
+}
+
+// lockTimeout is used to turn a lock timeout in milliseconds into a duration. A timeout below 0 means waiting until
+// the lock is free, which is -1 for the lock table.
+func lockTimeout(ms int64) time.Duration {
+	if ms < 0 {
+		return -1
+	}
+	return millis(uint64(ms))
 }
 
 func processPacket(
 	conn net.Conn, packet []byte, replyId uint32,
-	db radix.RadixTree, mu *sync.Mutex,
-	dispatcher *eventDispatcher,
+	db *database, locks *lockTable, owner *lockOwner,
+	dispatcher *eventDispatcher, subscriber *eventSubscriber,
 ) {
 	raiseError := func(exception, message string) {
 		p := packetmaker.New().
@@ -142,6 +163,61 @@ func processPacket(
 		return write(conn, p.Make())
 	}
 
+	// Returns the fencing token of a lock which was just taken. If it cannot be sent, that hold is released.
+	returnToken := func(key string, token uint64) {
+		b := []byte{0, 0, 0, 0, 0, 0, 0, 0}
+		binary.LittleEndian.PutUint64(b, token)
+		if !returnResult(b, false) && token != 0 {
+			_ = locks.unlockToken(key, token)
+		}
+	}
+
+	// Takes a hold on a lock, waiting up to the timeout for it (forever if it is below 0). Any wait is done in another
+	// goroutine so that packets can still be read from the connection. The fencing token is returned, or 0 if it timed
+	// out.
+	lockMutex := func(key string, lease, timeout time.Duration, shared bool, limit int) {
+		w, err := locks.enqueue(key, owner, lease, shared, limit)
+		if err != nil {
+			raiseError("LimitMismatch", err.Error())
+			return
+		}
+		if timeout == 0 {
+			returnToken(key, locks.wait(w, 0, nil))
+			return
+		}
+		go func() { returnToken(key, locks.wait(w, timeout, nil)) }()
+	}
+
+	// Releases the oldest hold this connection has on a lock.
+	unlockMutex := func(key string) {
+		switch locks.unlock(key, owner) {
+		case nil:
+			returnResult([]byte{}, false)
+		case errNotLockOwner:
+			raiseError("NotLockOwner", errNotLockOwner.Error())
+		default:
+			raiseError("UnlockError", errNotLocked.Error())
+		}
+	}
+
+	// Returns the number of holds on a lock followed by the number of connections waiting for it.
+	returnQueue := func(key string) {
+		holds, waiters := locks.queue(key)
+		returnResult(packetmaker.New().Uint32(uint32(holds), true).Uint32(uint32(waiters), true).Make(), false)
+	}
+
+	// Parses the lease and timeout in milliseconds at the start of a packet, followed by the name. The timeout is
+	// signed, and waits forever if it is below 0.
+	parseTimedLock := func(packet []byte) (name []byte, lease, timeout time.Duration, ok bool) {
+		if len(packet) < 16 {
+			raiseError("InvalidPacket", "Lease and timeout not specified.")
+			return nil, 0, 0, false
+		}
+		lease = millis(binary.LittleEndian.Uint64(packet))
+		timeout = lockTimeout(int64(binary.LittleEndian.Uint64(packet[8:])))
+		return packet[16:], lease, timeout, true
+	}
+
 	packetLen := len(packet)
 	if packetLen == 0 {
 		raiseError("InvalidPacket", "No start byte found.")
@@ -195,8 +271,13 @@ func processPacket(
 		}
 		key := packet[:keyLen]
 		packet = packet[keyLen:]
+		overwrote, err := db.Set(key, packet)
+		if err != nil {
+			raiseError("OutOfMemory", outOfMemoryMessage)
+			return
+		}
 		var data []byte
-		if db.Set(key, packet) {
+		if overwrote {
 			data = []byte{1}
 		} else {
 			data = []byte{0}
@@ -216,52 +297,526 @@ func processPacket(
 	case 6:
 		// Walk prefix.
 		packet = packet[1:]
-		length := 0
-		var stack *recordStack
+		var records []record
 		freer := &radix.PendingFreer{}
 		db.WalkPrefix(packet, func(key, value []byte) bool {
-			stack = &recordStack{
-				key:   key,
-				value: value,
-				prev:  stack,
-			}
-			length++
+			records = append(records, record{key: key, value: value})
 			return true
 		}, freer)
-		m := packetmaker.New().Uint32(uint32(length), true)
-		for stack != nil {
-			m.Uint32(uint32(len(stack.key)), true).
-				Bytes(stack.key).
-				Uint32(uint32(len(stack.value)), true).
-				Bytes(stack.value)
-			stack = stack.prev
-		}
-		p := m.Make()
-		returnResult(p, false)
+		returnResult(makeRecordsResult(records), false)
 		freer.FreeAll()
 	case 7:
-		// Mutex lock.
-		mu.Lock()
-		sent := returnResult([]byte{}, false)
-		if !sent {
-			// Immediately unlock.
-			mu.Unlock()
+		// Mutex lock. This is the lock with an empty name, optionally followed by a lease in milliseconds.
+		packet = packet[1:]
+		var lease time.Duration
+		if len(packet) >= 8 {
+			lease = millis(binary.LittleEndian.Uint64(packet))
+		}
+		// This replies with nothing like it always has, so the fencing token is only returned by the named mutex
+		// opcodes. The wait is done in another goroutine like the other locks.
+		key := lockKey(lockKindMutex, nil)
+		w, err := locks.enqueue(key, owner, lease, false, 0)
+		if err != nil {
+			raiseError("LimitMismatch", err.Error())
+			return
 		}
+		go func() {
+			token := locks.wait(w, -1, nil)
+			if !returnResult([]byte{}, false) {
+				_ = locks.unlockToken(key, token)
+			}
+		}()
 	case 8:
 		// Mutex unlock.
-		unlocked := tryUnlock(mu)
-		if unlocked {
-			returnResult([]byte{}, false)
+		unlockMutex(lockKey(lockKindMutex, nil))
+	case 9:
+		// Event send. Deprecated: this is only kept for older clients, and new ones should publish on a channel
+		// instead. The event is sent to every other connection on the database, whether or not it subscribed.
+		dispatcher.broadcast(subscriber, packet[1:])
+		returnResult([]byte{}, false)
+	case 10:
+		// Record set with a TTL in milliseconds (0 for none).
+		packet = packet[1:]
+		if len(packet) < 4 {
+			raiseError(
+				"InvalidPacket",
+				"Key length not specified.")
 			return
 		}
-		raiseError(
-			"UnlockError",
-			"Mutex was already unlocked.")
-	case 9:
-		// Event send.
+		keyLen := int(binary.LittleEndian.Uint32(packet))
+		packet = packet[4:]
+		if len(packet) < keyLen+8 {
+			raiseError(
+				"InvalidPacket",
+				"Packet too short for key length and TTL.")
+			return
+		}
+		key := packet[:keyLen]
+		packet = packet[keyLen:]
+		expiresAt := expiryFromTTL(binary.LittleEndian.Uint64(packet))
+		packet = packet[8:]
+		overwrote, err := db.SetWithExpiry(key, packet, expiresAt)
+		if err != nil {
+			raiseError("OutOfMemory", outOfMemoryMessage)
+			return
+		}
+		var data []byte
+		if overwrote {
+			data = []byte{1}
+		} else {
+			data = []byte{0}
+		}
+		returnResult(data, true)
+	case 11:
+		// Record TTL get. This is -2 if the key does not exist and -1 if it does not expire.
+		packet = packet[1:]
+		b := []byte{0, 0, 0, 0, 0, 0, 0, 0}
+		expiresAt, ok := db.ExpiresAt(packet)
+		ttl := int64(-2)
+		if ok {
+			if expiresAt.IsZero() {
+				ttl = -1
+			} else if ttl = time.Until(expiresAt).Milliseconds(); ttl < 0 {
+				ttl = 0
+			}
+		}
+		binary.LittleEndian.PutUint64(b, uint64(ttl))
+		returnResult(b, false)
+	case 12:
+		// Record expire at a Unix timestamp in milliseconds.
+		packet = packet[1:]
+		if len(packet) < 8 {
+			raiseError(
+				"InvalidPacket",
+				"Timestamp not specified.")
+			return
+		}
+		ms := int64(binary.LittleEndian.Uint64(packet))
+		if ms <= 0 {
+			raiseError(
+				"InvalidPacket",
+				"Timestamp must be positive.")
+			return
+		}
+		var data []byte
+		if db.ExpireAt(packet[8:], time.UnixMilli(ms)) {
+			data = []byte{1}
+		} else {
+			data = []byte{0}
+		}
+		returnResult(data, true)
+	case 13:
+		// Record persist.
+		packet = packet[1:]
+		var data []byte
+		if db.Persist(packet) {
+			data = []byte{1}
+		} else {
+			data = []byte{0}
+		}
+		returnResult(data, true)
+	case 14:
+		// Walk range page. This is the limit, the reverse byte, the start and end, and then optionally a 1 followed by
+		// the cursor. The reply starts with if there is another page and the cursor for it.
+		packet = packet[1:]
+		if len(packet) < 5 {
+			raiseError(
+				"InvalidPacket",
+				"Limit and reverse byte not specified.")
+			return
+		}
+		limit := int(binary.LittleEndian.Uint32(packet))
+		reverse := packet[4] == 1
+		packet = packet[5:]
+		var bounds [2][]byte
+		for i := range bounds {
+			if len(packet) < 4 {
+				raiseError(
+					"InvalidPacket",
+					"Key length not specified.")
+				return
+			}
+			keyLen := int(binary.LittleEndian.Uint32(packet))
+			packet = packet[4:]
+			if len(packet) < keyLen {
+				raiseError(
+					"InvalidPacket",
+					"Packet too short for key length.")
+				return
+			}
+			bounds[i] = packet[:keyLen]
+			packet = packet[keyLen:]
+		}
+		var cursor []byte
+		if len(packet) != 0 {
+			if packet[0] != 1 {
+				raiseError(
+					"InvalidPacket",
+					"Invalid cursor byte.")
+				return
+			}
+			cursor = packet[1:]
+		}
+		freer := &radix.PendingFreer{}
+		records, next, err := db.walkRangePage(bounds[0], bounds[1], reverse, cursor, limit, freer)
+		if err != nil {
+			raiseError("InvalidCursor", err.Error())
+			return
+		}
+		more := byte(0)
+		if next != nil {
+			more = 1
+		}
+		p := packetmaker.New().
+			Byte(more).
+			Uint32(uint32(len(next)), true).
+			Bytes(next).
+			Bytes(makeRecordsResult(records)).
+			Make()
+		returnResult(p, false)
+		freer.FreeAll()
+	case 15:
+		// Walk prefix page. This is the limit and the prefix, and then optionally a 1 followed by the cursor. The reply
+		// starts with if there is another page and the cursor for it.
+		packet = packet[1:]
+		if len(packet) < 4 {
+			raiseError(
+				"InvalidPacket",
+				"Limit not specified.")
+			return
+		}
+		limit := int(binary.LittleEndian.Uint32(packet))
+		packet = packet[4:]
+		var chunks [2][]byte
+		for i := range chunks {
+			if i == 1 {
+				if len(packet) == 0 {
+					break
+				}
+				if packet[0] != 1 {
+					raiseError(
+						"InvalidPacket",
+						"Invalid cursor byte.")
+					return
+				}
+				packet = packet[1:]
+			}
+			if len(packet) < 4 {
+				raiseError(
+					"InvalidPacket",
+					"Key length not specified.")
+				return
+			}
+			keyLen := int(binary.LittleEndian.Uint32(packet))
+			packet = packet[4:]
+			if len(packet) < keyLen {
+				raiseError(
+					"InvalidPacket",
+					"Packet too short for key length.")
+				return
+			}
+			chunks[i] = packet[:keyLen]
+			packet = packet[keyLen:]
+		}
+		freer := &radix.PendingFreer{}
+		records, next, err := db.walkPrefixPage(chunks[0], chunks[1], limit, freer)
+		if err != nil {
+			raiseError("InvalidCursor", err.Error())
+			return
+		}
+		more := byte(0)
+		if next != nil {
+			more = 1
+		}
+		p := packetmaker.New().
+			Byte(more).
+			Uint32(uint32(len(next)), true).
+			Bytes(next).
+			Bytes(makeRecordsResult(records)).
+			Make()
+		returnResult(p, false)
+		freer.FreeAll()
+	case 16:
+		// Record conditional set. For fenced sets, the expected version is the fencing token.
+		packet = packet[1:]
+		if len(packet) < 5 {
+			raiseError(
+				"InvalidPacket",
+				"Condition and key length not specified.")
+			return
+		}
+		condition := radix.SetCondition(packet[0])
+		if condition > radix.SetIfFence {
+			raiseError(
+				"InvalidPacket",
+				"Unknown condition.")
+			return
+		}
+		keyLen := int(binary.LittleEndian.Uint32(packet[1:]))
+		packet = packet[5:]
+		if len(packet) < keyLen+20 {
+			raiseError(
+				"InvalidPacket",
+				"Packet too short for key length, TTL and expected version.")
+			return
+		}
+		key := packet[:keyLen]
+		packet = packet[keyLen:]
+		expiresAt := expiryFromTTL(binary.LittleEndian.Uint64(packet))
+		expectedVersion := binary.LittleEndian.Uint64(packet[8:])
+		expectedLen := int(binary.LittleEndian.Uint32(packet[16:]))
+		packet = packet[20:]
+		if len(packet) < expectedLen {
+			raiseError(
+				"InvalidPacket",
+				"Packet too short for expected value length.")
+			return
+		}
+		expected := packet[:expectedLen]
+		packet = packet[expectedLen:]
+		version, err := db.SetIf(key, packet, expiresAt, condition, expected, expectedVersion)
+		if err != nil {
+			raiseError("OutOfMemory", outOfMemoryMessage)
+			return
+		}
+		b := []byte{0, 0, 0, 0, 0, 0, 0, 0}
+		binary.LittleEndian.PutUint64(b, version)
+		returnResult(b, false)
+	case 17:
+		// Record get with version.
 		packet = packet[1:]
-		dispatcher.dispatch(packet, conn)
+		value, version, deallocator := db.GetVersioned(packet)
+		defer deallocator()
+		if value == nil {
+			raiseError("NotFound", "The key was not found in the database.")
+			return
+		}
+		p := packetmaker.New().
+			Uint64(version, true).
+			Uint32(uint32(len(value)), true).
+			Bytes(value).
+			Make()
+		returnResult(p, false)
+	case 18:
+		// Record increment.
+		packet = packet[1:]
+		if len(packet) < 8 {
+			raiseError(
+				"InvalidPacket",
+				"Delta not specified.")
+			return
+		}
+		res, err := db.Increment(packet[8:], int64(binary.LittleEndian.Uint64(packet)))
+		if err != nil {
+			raiseError(incrementException(err), err.Error())
+			return
+		}
+		b := []byte{0, 0, 0, 0, 0, 0, 0, 0}
+		binary.LittleEndian.PutUint64(b, uint64(res))
+		returnResult(b, false)
+	case 19:
+		// Record float increment.
+		packet = packet[1:]
+		if len(packet) < 8 {
+			raiseError(
+				"InvalidPacket",
+				"Delta not specified.")
+			return
+		}
+		delta := math.Float64frombits(binary.LittleEndian.Uint64(packet))
+		res, err := db.IncrementFloat(packet[8:], delta)
+		if err != nil {
+			raiseError(incrementException(err), err.Error())
+			return
+		}
+		b := []byte{0, 0, 0, 0, 0, 0, 0, 0}
+		binary.LittleEndian.PutUint64(b, math.Float64bits(res))
+		returnResult(b, false)
+	case 20:
+		// Transaction.
+		watches, ops, err := parseTransaction(packet[1:])
+		if err != nil {
+			raiseError("InvalidPacket", err.Error())
+			return
+		}
+		results, executed, err := db.Exec(watches, ops)
+		if err != nil {
+			raiseError("OutOfMemory", outOfMemoryMessage)
+			return
+		}
+		returnResult(makeTransactionResult(ops, results, executed), false)
+	case 21:
+		// Named mutex lock. This is the lease in milliseconds (0 for none) followed by the name.
+		name, lease, ok := parseLock(packet[1:])
+		if !ok {
+			raiseError("InvalidPacket", "Lease not specified.")
+			return
+		}
+		lockMutex(lockKey(lockKindMutex, name), lease, -1, false, 0)
+	case 22:
+		// Named mutex unlock.
+		unlockMutex(lockKey(lockKindMutex, packet[1:]))
+	case 23:
+		// Named mutex try lock. This is the same as a lock, but the token is 0 if it is held.
+		name, lease, ok := parseLock(packet[1:])
+		if !ok {
+			raiseError("InvalidPacket", "Lease not specified.")
+			return
+		}
+		lockMutex(lockKey(lockKindMutex, name), lease, 0, false, 0)
+	case 24:
+		// Named mutex lock with a timeout. This is the lease in milliseconds (0 for none), then the timeout in
+		// milliseconds as a signed number (below 0 to wait forever), followed by the name. The token is 0 if the
+		// timeout passed.
+		name, lease, timeout, ok := parseTimedLock(packet[1:])
+		if !ok {
+			return
+		}
+		lockMutex(lockKey(lockKindMutex, name), lease, timeout, false, 0)
+	case 25:
+		// Named mutex queue. This is the same as a lock queue for a mutex, so it returns the number of holds (0 or 1)
+		// followed by the number of connections waiting.
+		returnQueue(lockKey(lockKindMutex, packet[1:]))
+	case 26:
+		// Read-write lock. This is a byte which is 1 for a shared (read) hold and 0 for an exclusive (write) hold,
+		// followed by the same as a named mutex lock with a timeout.
+		if len(packet) < 2 {
+			raiseError("InvalidPacket", "Hold kind not specified.")
+			return
+		}
+		name, lease, timeout, ok := parseTimedLock(packet[2:])
+		if !ok {
+			return
+		}
+		lockMutex(lockKey(lockKindRW, name), lease, timeout, packet[1] == 1, 0)
+	case 27:
+		// Read-write unlock. This releases the oldest hold this connection has, shared or exclusive.
+		unlockMutex(lockKey(lockKindRW, packet[1:]))
+	case 28:
+		// Semaphore acquire. This is the most holds there can be at once as a u32, followed by the same as a named
+		// mutex lock with a timeout.
+		if len(packet) < 5 {
+			raiseError("InvalidPacket", "Limit not specified.")
+			return
+		}
+		limit := binary.LittleEndian.Uint32(packet[1:])
+		if limit == 0 {
+			raiseError("InvalidPacket", "The limit must be above 0.")
+			return
+		}
+		name, lease, timeout, ok := parseTimedLock(packet[5:])
+		if !ok {
+			return
+		}
+		lockMutex(lockKey(lockKindSemaphore, name), lease, timeout, true, int(limit))
+	case 29:
+		// Semaphore release.
+		unlockMutex(lockKey(lockKindSemaphore, packet[1:]))
+	case 30:
+		// Lock queue. This is the kind of lock (0 for mutexes, 1 for read-write locks and 2 for semaphores) followed
+		// by the name. Returns the number of holds followed by the number of connections waiting.
+		if len(packet) < 2 || packet[1] > lockKindSemaphore {
+			raiseError("InvalidPacket", "Unknown lock kind.")
+			return
+		}
+		returnQueue(lockKey(packet[1], packet[2:]))
+	case 31:
+		// Set the client name. This is shown as the holder of any locks the connection has.
+		owner.name.Store(string(packet[1:]))
 		returnResult([]byte{}, false)
+	case 32:
+		// List every lock along with who holds it.
+		returnResult(makeLocksResult(locks.list()), false)
+	case 33:
+		// Force release. This is the kind of lock, then the admin password prefixed with its length as a u16, followed
+		// by the name. Every hold on the lock is released, whoever has it. Returns the number of holds released. This
+		// is logged along with who asked for it.
+		if len(packet) < 2 || packet[1] > lockKindSemaphore {
+			raiseError("InvalidPacket", "Unknown lock kind.")
+			return
+		}
+		kind := packet[1]
+		packet = packet[2:]
+		if len(packet) < 2 || len(packet)-2 < int(binary.LittleEndian.Uint16(packet)) {
+			raiseError("InvalidPacket", "Admin password not specified.")
+			return
+		}
+		passwordLen := int(binary.LittleEndian.Uint16(packet)) + 2
+		name := packet[passwordLen:]
+		if !forceReleaseAllowed(packet[2:passwordLen]) {
+			logForceRelease(owner, kind, name, 0, false)
+			raiseError("InvalidCredentials", "The admin password is invalid or force release is turned off.")
+			return
+		}
+		released := locks.forceRelease(lockKey(kind, name))
+		logForceRelease(owner, kind, name, released, true)
+		returnResult(packetmaker.New().Uint32(uint32(released), true).Make(), false)
+	case 34:
+		// Subscribe. This is a byte which is 1 if it is a glob pattern, followed by the channel or pattern. Returns a
+		// byte which is 1 if it was not already subscribed.
+		if len(packet) < 2 {
+			raiseError("InvalidPacket", "Subscription kind not specified.")
+			return
+		}
+		var added byte
+		if dispatcher.subscribe(subscriber, packet[2:], packet[1] == 1) {
+			added = 1
+		}
+		returnResult([]byte{added}, true)
+	case 35:
+		// Unsubscribe. This is the same as a subscribe, and returns a byte which is 1 if it was subscribed.
+		if len(packet) < 2 {
+			raiseError("InvalidPacket", "Subscription kind not specified.")
+			return
+		}
+		var removed byte
+		if dispatcher.unsubscribe(subscriber, packet[2:], packet[1] == 1) {
+			removed = 1
+		}
+		returnResult([]byte{removed}, true)
+	case 36:
+		// Event stats. Returns the number of events dropped for this connection because its queue was full, followed by
+		// the number waiting to be written.
+		queued, dropped := subscriber.stats()
+		returnResult(packetmaker.New().Uint64(dropped, true).Uint32(uint32(queued), true).Make(), false)
+	case 37:
+		// Keyspace subscribe. This is a byte which is 1 if notifications for sets should include the value, followed by
+		// the key prefix. Returns a byte which is 1 if it was not already subscribed.
+		if len(packet) < 2 {
+			raiseError("InvalidPacket", "Value option not specified.")
+			return
+		}
+		var added byte
+		if dispatcher.subscribeKeyspace(subscriber, packet[2:], packet[1] == 1) {
+			added = 1
+		}
+		returnResult([]byte{added}, true)
+	case 38:
+		// Keyspace unsubscribe. This is the key prefix, and returns a byte which is 1 if it was subscribed.
+		var removed byte
+		if dispatcher.unsubscribeKeyspace(subscriber, packet[1:]) {
+			removed = 1
+		}
+		returnResult([]byte{removed}, true)
+	case 39:
+		// Event publish. This is the length prefixed channel followed by the event. Returns the number of events sent.
+		packet = packet[1:]
+		if len(packet) < 4 {
+			raiseError(
+				"InvalidPacket",
+				"Channel length not specified.")
+			return
+		}
+		channelLen := int(binary.LittleEndian.Uint32(packet))
+		packet = packet[4:]
+		if len(packet) < channelLen {
+			raiseError(
+				"InvalidPacket",
+				"Channel is too short.")
+			return
+		}
+		sent := dispatcher.publish(packet[:channelLen], packet[channelLen:])
+		returnResult(packetmaker.New().Uint32(uint32(sent), true).Make(), false)
 	default:
 		// Unknown byte.
 		raiseError("InvalidPacket", "Unknown start byte.")
@@ -313,20 +868,28 @@ func spawnHnpHandler(conn net.Conn) {
 		return
 	}
 	db := trees[dbIndex]
-	mu := &mutexes[dbIndex]
+	locks := &lockTables[dbIndex]
+	owner := &lockOwner{addr: conn.RemoteAddr().String()}
+	defer locks.releaseAll(owner)
 
 	// Send a null byte. Success!
 	write(conn, []byte{0})
 
 	// Add the connection to the event system.
 	dispatcher := &eventDispatchers[dbIndex]
-	dispatcher.addWriter(conn)
-	defer dispatcher.removeWriter(conn)
+	subscriber := dispatcher.addSubscriber(conn)
+	defer dispatcher.removeSubscriber(subscriber)
 
 	startHeader = make([]byte, 8)
 	for {
-		// Read the start header.
-		_ = conn.SetReadDeadline(time.Now().Add(time.Second * 2))
+		// Read the start header. Connections can sit idle between packets (for example, whilst holding a lock), so this
+		// only has a deadline if there is an idle timeout. Dead connections are also found by TCP keep-alives, which
+		// releases their locks.
+		var deadline time.Time
+		if idleTimeout > 0 {
+			deadline = time.Now().Add(idleTimeout)
+		}
+		_ = conn.SetReadDeadline(deadline)
 		n, err = conn.Read(startHeader)
 		if err != nil || n != 8 {
 			return
@@ -358,6 +921,6 @@ func spawnHnpHandler(conn net.Conn) {
 		}
 
 		// Process the packet.
-		processPacket(conn, packet, replyId, db, mu, dispatcher)
+		processPacket(conn, packet, replyId, db, locks, owner, dispatcher, subscriber)
 	}
 }
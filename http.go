@@ -3,11 +3,15 @@ package main
 import (
 	"bytes"
 	"crypto/subtle"
+	"encoding/base64"
 	"encoding/json"
 	"io"
+	"math"
 	"net/http"
 	"reflect"
 	"strconv"
+	"strings"
+	"time"
 	"unsafe"
 
 	"github.com/gorilla/mux"
@@ -19,12 +23,63 @@ var httpHn = mux.NewRouter()
 var bearer = []byte("Password ")
 
 func throwException(exceptionName, exceptionDescription string, w http.ResponseWriter) {
+	throwExceptionWithStatus(http.StatusBadRequest, exceptionName, exceptionDescription, w)
+}
+
+func throwExceptionWithStatus(status int, exceptionName, exceptionDescription string, w http.ResponseWriter) {
 	w.Header().Set("X-Exception", exceptionName)
-	w.WriteHeader(http.StatusBadRequest)
+	w.WriteHeader(status)
 	_, _ = w.Write([]byte(exceptionDescription))
 }
 
-func getDb(w http.ResponseWriter, r *http.Request) (*radix.RadixTree, bool) {
+// Makes the ETag for a version.
+func makeETag(version uint64) string {
+	return `"` + strconv.FormatUint(version, 10) + `"`
+}
+
+// Gets the condition for a write from the X-Fencing-Token, If-None-Match and If-Match headers. If-None-Match can only
+// be *. For fenced writes, the version is the fencing token. Returns false if the fencing token is not a number.
+func getSetCondition(r *http.Request) (condition radix.SetCondition, version uint64, ok bool) {
+	if token := r.Header.Get("X-Fencing-Token"); token != "" {
+		version, err := strconv.ParseUint(token, 10, 64)
+		return radix.SetIfFence, version, err == nil
+	}
+	if r.Header.Get("If-None-Match") == "*" {
+		return radix.SetIfAbsent, 0, true
+	}
+	match := r.Header.Get("If-Match")
+	if match == "" {
+		return radix.SetAlways, 0, true
+	}
+	if match == "*" {
+		return radix.SetIfExists, 0, true
+	}
+
+	// A version which is not one of ours will never match, and no value has the version 0.
+	match = strings.TrimPrefix(match, "W/")
+	if len(match) >= 2 && match[0] == '"' && match[len(match)-1] == '"' {
+		version, _ = strconv.ParseUint(match[1:len(match)-1], 10, 64)
+	}
+	return radix.SetIfVersion, version, true
+}
+
+func getDb(w http.ResponseWriter, r *http.Request) (*database, bool) {
+	i, ret := getDbIndex(w, r)
+	if ret {
+		return nil, true
+	}
+	return trees[i], false
+}
+
+func getLocks(w http.ResponseWriter, r *http.Request) (*lockTable, bool) {
+	i, ret := getDbIndex(w, r)
+	if ret {
+		return nil, true
+	}
+	return &lockTables[i], false
+}
+
+func getDbIndex(w http.ResponseWriter, r *http.Request) (int, bool) {
 	vars := mux.Vars(r)
 	value, ok := vars["db"]
 	if !ok {
@@ -32,7 +87,7 @@ func getDb(w http.ResponseWriter, r *http.Request) (*radix.RadixTree, bool) {
 			"DatabaseNotFound",
 			"The database value is not present.",
 			w)
-		return nil, true
+		return 0, true
 	}
 	i, err := strconv.Atoi(value)
 	if err != nil {
@@ -40,16 +95,16 @@ func getDb(w http.ResponseWriter, r *http.Request) (*radix.RadixTree, bool) {
 			"DatabaseNotFound",
 			"The database number is invalid.",
 			w)
-		return nil, true
+		return 0, true
 	}
 	if i >= len(trees) {
 		throwException(
 			"DatabaseNotFound",
 			"The database index is too large for the number of databases in this application.",
 			w)
-		return nil, true
+		return 0, true
 	}
-	return &trees[i], false
+	return i, false
 }
 
 func s2b(s string) (b []byte) {
@@ -70,6 +125,51 @@ func b2s(b []byte) string {
 	return *(*string)(unsafe.Pointer(&b))
 }
 
+// Gets when a record should expire from the X-TTL (in milliseconds, 0 for none) or Expires header. If neither is
+// set, the time is zero. If the header is invalid, an exception is thrown and ret is true.
+func getExpiry(w http.ResponseWriter, r *http.Request) (expiresAt time.Time, ret bool) {
+	if ttl := r.Header.Get("X-TTL"); ttl != "" {
+		ms, err := strconv.ParseUint(ttl, 10, 63)
+		if err != nil {
+			throwException(
+				"InvalidExpiry",
+				"The X-TTL header must be a number of milliseconds.",
+				w)
+			return time.Time{}, true
+		}
+		return expiryFromTTL(ms), false
+	}
+	if expires := r.Header.Get("Expires"); expires != "" {
+		t, err := http.ParseTime(expires)
+		if err != nil {
+			throwException(
+				"InvalidExpiry",
+				"The Expires header must be a HTTP date.",
+				w)
+			return time.Time{}, true
+		}
+		return t, false
+	}
+	return time.Time{}, false
+}
+
+func writeBool(w http.ResponseWriter, res bool) {
+	w.WriteHeader(http.StatusOK)
+	var b []byte
+	if res {
+		b = trueB
+	} else {
+		b = falseB
+	}
+	_, _ = w.Write(b)
+}
+
+// rangeRecord is a record returned from a range walk. These are returned as a list since the order matters.
+type rangeRecord struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
 func setupApiV1(apiV1 *mux.Router) {
 	// Handle key fetching, insertion, and deletion.
 	apiV1.HandleFunc("/record/{key}", func(w http.ResponseWriter, r *http.Request) {
@@ -81,7 +181,7 @@ func setupApiV1(apiV1 *mux.Router) {
 		vars := mux.Vars(r)
 		key := s2b(vars["key"])
 		if r.Method == "GET" {
-			value, deallocator := db.Get(key)
+			value, version, deallocator := db.GetVersioned(key)
 			defer func() { go deallocator() }()
 			if value == nil {
 				throwException(
@@ -89,6 +189,7 @@ func setupApiV1(apiV1 *mux.Router) {
 					"The key was not found in the database.",
 					w)
 			} else {
+				w.Header().Set("ETag", makeETag(version))
 				w.WriteHeader(http.StatusOK)
 				_, _ = w.Write(value)
 			}
@@ -97,33 +198,165 @@ func setupApiV1(apiV1 *mux.Router) {
 
 		if r.Method == "PUT" {
 			defer r.Body.Close()
+			expiresAt, ret := getExpiry(w, r)
+			if ret {
+				return
+			}
 			body, err := io.ReadAll(r.Body)
 			if err != nil {
 				return
 			}
 
-			res := db.Set(key, body)
-			w.WriteHeader(http.StatusOK)
-			var b []byte
-			if res {
-				b = trueB
-			} else {
-				b = falseB
+			condition, version, ok := getSetCondition(r)
+			if !ok {
+				throwException(
+					"InvalidToken",
+					"The fencing token must be a 64-bit unsigned integer.",
+					w)
+				return
+			}
+			var res bool
+			switch {
+			case condition != radix.SetAlways:
+				// Only a write which needed the key to exist is known to have overwritten something. Fenced writes
+				// return if they were written instead, since that is what the token decides.
+				version, err = db.SetIf(key, body, expiresAt, condition, nil, version)
+				res = condition == radix.SetIfExists || condition == radix.SetIfVersion || condition == radix.SetIfFence
+			case expiresAt.IsZero():
+				res, err = db.Set(key, body)
+			default:
+				res, err = db.SetWithExpiry(key, body, expiresAt)
+			}
+			if err != nil {
+				throwException(
+					"OutOfMemory",
+					outOfMemoryMessage,
+					w)
+				return
+			}
+			if condition != radix.SetAlways {
+				if version == 0 {
+					throwExceptionWithStatus(
+						http.StatusPreconditionFailed,
+						"PreconditionFailed",
+						"The record did not meet the condition.",
+						w)
+					return
+				}
+				w.Header().Set("ETag", makeETag(version))
 			}
-			_, _ = w.Write(b)
+			writeBool(w, res)
 			return
 		}
 
-		res := db.DeleteKey(key)
+		writeBool(w, db.DeleteKey(key))
+	}).Methods("GET", "PUT", "DELETE")
+
+	// Handle getting how long a key has left in milliseconds. This is -1 if the key does not expire.
+	apiV1.HandleFunc("/record/{key}/ttl", func(w http.ResponseWriter, r *http.Request) {
+		db, ret := getDb(w, r)
+		if ret {
+			return
+		}
+
+		expiresAt, ok := db.ExpiresAt(s2b(mux.Vars(r)["key"]))
+		if !ok {
+			throwException(
+				"NotFound",
+				"The key was not found in the database.",
+				w)
+			return
+		}
+		ttl := int64(-1)
+		if !expiresAt.IsZero() {
+			if ttl = time.Until(expiresAt).Milliseconds(); ttl < 0 {
+				ttl = 0
+			}
+		}
 		w.WriteHeader(http.StatusOK)
-		var b []byte
-		if res {
-			b = trueB
+		_, _ = w.Write([]byte(strconv.FormatInt(ttl, 10)))
+	}).Methods("GET")
+
+	// Handle making a key never expire.
+	apiV1.HandleFunc("/record/{key}/persist", func(w http.ResponseWriter, r *http.Request) {
+		db, ret := getDb(w, r)
+		if ret {
+			return
+		}
+
+		writeBool(w, db.Persist(s2b(mux.Vars(r)["key"])))
+	}).Methods("POST")
+
+	// Handle setting when a key expires with the X-TTL or Expires header.
+	apiV1.HandleFunc("/record/{key}/expire", func(w http.ResponseWriter, r *http.Request) {
+		db, ret := getDb(w, r)
+		if ret {
+			return
+		}
+
+		expiresAt, ret := getExpiry(w, r)
+		if ret {
+			return
+		}
+		if expiresAt.IsZero() {
+			throwException(
+				"InvalidExpiry",
+				"The X-TTL or Expires header must be set.",
+				w)
+			return
+		}
+		writeBool(w, db.ExpireAt(s2b(mux.Vars(r)["key"]), expiresAt))
+	}).Methods("POST")
+
+	// Handle atomically incrementing a key by the "by" query parameter, which defaults to 1. If the "float" query
+	// parameter is true, the key is incremented as a float. The new value is returned.
+	apiV1.HandleFunc("/record/{key}/incr", func(w http.ResponseWriter, r *http.Request) {
+		db, ret := getDb(w, r)
+		if ret {
+			return
+		}
+
+		key := s2b(mux.Vars(r)["key"])
+		query := r.URL.Query()
+		by := query.Get("by")
+		if by == "" {
+			by = "1"
+		}
+		var res string
+		if query.Get("float") == "true" {
+			delta, err := strconv.ParseFloat(by, 64)
+			if err != nil || math.IsInf(delta, 0) || math.IsNaN(delta) {
+				throwException(
+					"InvalidDelta",
+					"The amount to increment by must be a finite number.",
+					w)
+				return
+			}
+			f, err := db.IncrementFloat(key, delta)
+			if err != nil {
+				throwException(incrementException(err), err.Error(), w)
+				return
+			}
+			res = strconv.FormatFloat(f, 'g', -1, 64)
 		} else {
-			b = falseB
+			delta, err := strconv.ParseInt(by, 10, 64)
+			if err != nil {
+				throwException(
+					"InvalidDelta",
+					"The amount to increment by must be a 64-bit integer.",
+					w)
+				return
+			}
+			n, err := db.Increment(key, delta)
+			if err != nil {
+				throwException(incrementException(err), err.Error(), w)
+				return
+			}
+			res = strconv.FormatInt(n, 10)
 		}
-		_, _ = w.Write(b)
-	}).Methods("GET", "PUT", "DELETE")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(res))
+	}).Methods("POST")
 
 	// Handle prefix walking and deletion.
 	apiV1.HandleFunc("/prefix/{prefix}", func(w http.ResponseWriter, r *http.Request) {
@@ -143,10 +376,47 @@ func setupApiV1(apiV1 *mux.Router) {
 
 		m := map[string]string{}
 		freer := &radix.PendingFreer{}
-		db.WalkPrefix(prefix, func(key, value []byte) bool {
-			m[string(key)] = string(value)
-			return true
-		}, freer)
+		query := r.URL.Query()
+		if query.Has("limit") || query.Has("cursor") {
+			// Get a page of the prefix. The cursor for the next page is returned in the X-Cursor header.
+			limit, err := strconv.Atoi(query.Get("limit"))
+			if err != nil && query.Has("limit") {
+				throwException(
+					"InvalidLimit",
+					"The limit must be a number.",
+					w)
+				return
+			}
+			var cursor []byte
+			if query.Has("cursor") {
+				if cursor, err = base64.RawURLEncoding.DecodeString(query.Get("cursor")); err != nil {
+					throwException(
+						"InvalidCursor",
+						"The cursor is invalid.",
+						w)
+					return
+				}
+			}
+			records, next, err := db.walkPrefixPage(prefix, cursor, limit, freer)
+			if err != nil {
+				throwException(
+					"InvalidCursor",
+					err.Error(),
+					w)
+				return
+			}
+			for _, r := range records {
+				m[string(r.key)] = string(r.value)
+			}
+			if next != nil {
+				w.Header().Set("X-Cursor", base64.RawURLEncoding.EncodeToString(next))
+			}
+		} else {
+			db.WalkPrefix(prefix, func(key, value []byte) bool {
+				m[string(key)] = string(value)
+				return true
+			}, freer)
+		}
 		go freer.FreeAll()
 
 		w.Header().Set("Content-Type", "application/json")
@@ -154,6 +424,310 @@ func setupApiV1(apiV1 *mux.Router) {
 		_ = json.NewEncoder(w).Encode(m)
 	}).Methods("GET", "DELETE")
 
+	// Handle walking a range of keys. The end is exclusive and can be left out to walk to the end of the tree. This is
+	// walked a page at a time, and the cursor for the next page is returned in the X-Cursor header.
+	apiV1.HandleFunc("/range", func(w http.ResponseWriter, r *http.Request) {
+		db, ret := getDb(w, r)
+		if ret {
+			return
+		}
+
+		query := r.URL.Query()
+		reverse := query.Get("reverse") == "true"
+		limit, err := strconv.Atoi(query.Get("limit"))
+		if err != nil && query.Has("limit") {
+			throwException(
+				"InvalidLimit",
+				"The limit must be a number.",
+				w)
+			return
+		}
+		var cursor []byte
+		if query.Has("cursor") {
+			if cursor, err = base64.RawURLEncoding.DecodeString(query.Get("cursor")); err != nil {
+				throwException(
+					"InvalidCursor",
+					"The cursor is invalid.",
+					w)
+				return
+			}
+		}
+		freer := &radix.PendingFreer{}
+		records, next, err := db.walkRangePage(
+			s2b(query.Get("start")), s2b(query.Get("end")), reverse, cursor, limit, freer)
+		if err != nil {
+			throwException(
+				"InvalidCursor",
+				err.Error(),
+				w)
+			return
+		}
+		res := make([]rangeRecord, len(records))
+		for i, r := range records {
+			res[i] = rangeRecord{Key: string(r.key), Value: string(r.value)}
+		}
+		go freer.FreeAll()
+		if next != nil {
+			w.Header().Set("X-Cursor", base64.RawURLEncoding.EncodeToString(next))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(res)
+	}).Methods("GET")
+
+	// Handle taking, inspecting and releasing locks. Locks need a lease in milliseconds since there is no connection
+	// to release them when the client goes away. Taking a lock waits in line for up to the "timeout" query parameter
+	// in milliseconds, which defaults to 0 and waits forever if it is below 0. It returns the fencing token, which is
+	// then used to release it. Getting a lock returns if it is held, how many holds there are and how many connections
+	// are waiting for it.
+	lockHandler := func(kind byte) func(w http.ResponseWriter, r *http.Request) {
+		return func(w http.ResponseWriter, r *http.Request) {
+			locks, ret := getLocks(w, r)
+			if ret {
+				return
+			}
+
+			key := lockKey(kind, s2b(mux.Vars(r)["name"]))
+			switch r.Method {
+			case "GET":
+				holds, waiters := locks.queue(key)
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusOK)
+				_ = json.NewEncoder(w).Encode(map[string]any{"held": holds != 0, "holds": holds, "waiters": waiters})
+				return
+			case "POST":
+				query := r.URL.Query()
+				lease, err := strconv.ParseUint(query.Get("lease"), 10, 64)
+				if err != nil || lease == 0 {
+					throwException(
+						"InvalidLease",
+						"The lease must be a number of milliseconds above 0.",
+						w)
+					return
+				}
+				var timeout int64
+				if s := query.Get("timeout"); s != "" {
+					if timeout, err = strconv.ParseInt(s, 10, 64); err != nil {
+						throwException(
+							"InvalidTimeout",
+							"The timeout must be a number of milliseconds.",
+							w)
+						return
+					}
+				}
+
+				// Get how the lock is held.
+				shared := false
+				limit := 0
+				switch kind {
+				case lockKindRW:
+					switch query.Get("mode") {
+					case "shared":
+						shared = true
+					case "", "exclusive":
+					default:
+						throwException(
+							"InvalidMode",
+							"The mode must be shared or exclusive.",
+							w)
+						return
+					}
+				case lockKindSemaphore:
+					l, err := strconv.ParseUint(query.Get("limit"), 10, 32)
+					if err != nil || l == 0 {
+						throwException(
+							"InvalidLimit",
+							"The limit must be a 32-bit unsigned integer above 0.",
+							w)
+						return
+					}
+					shared = true
+					limit = int(l)
+				}
+
+				// The client can name itself so it shows as the holder in the lock list.
+				owner := &lockOwner{addr: r.RemoteAddr}
+				if name := r.Header.Get("X-Client-Name"); name != "" {
+					owner.name.Store(name)
+				}
+				token, err := locks.lock(
+					key, owner, millis(lease), lockTimeout(timeout), shared, limit, r.Context().Done())
+				if err != nil {
+					throwExceptionWithStatus(http.StatusConflict, "LimitMismatch", err.Error(), w)
+					return
+				}
+				if token == 0 {
+					throwExceptionWithStatus(
+						http.StatusConflict,
+						"LockHeld",
+						"The lock is held by another connection.",
+						w)
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+				_, _ = w.Write([]byte(strconv.FormatUint(token, 10)))
+				return
+			}
+
+			token, err := strconv.ParseUint(r.URL.Query().Get("token"), 10, 64)
+			if err != nil {
+				throwException(
+					"InvalidToken",
+					"The fencing token must be a 64-bit unsigned integer.",
+					w)
+				return
+			}
+			switch locks.unlockToken(key, token) {
+			case nil:
+				w.WriteHeader(http.StatusNoContent)
+			case errNotLockOwner:
+				throwExceptionWithStatus(http.StatusConflict, "NotLockOwner", errNotLockOwner.Error(), w)
+			default:
+				throwException("UnlockError", errNotLocked.Error(), w)
+			}
+		}
+	}
+	apiV1.HandleFunc("/lock/{name}", lockHandler(lockKindMutex)).Methods("GET", "POST", "DELETE")
+
+	// Handle read-write locks. The "mode" query parameter is shared or exclusive when taking one, and defaults to
+	// exclusive.
+	apiV1.HandleFunc("/rwlock/{name}", lockHandler(lockKindRW)).Methods("GET", "POST", "DELETE")
+
+	// Handle semaphores. The "limit" query parameter is the most holds there can be at once when acquiring one, and
+	// must match the limit of anything else holding or waiting for it.
+	apiV1.HandleFunc("/semaphore/{name}", lockHandler(lockKindSemaphore)).Methods("GET", "POST", "DELETE")
+
+	// Handle listing every lock along with who holds it. This is used to find what holds a lock when something is
+	// stuck.
+	apiV1.HandleFunc("/locks", func(w http.ResponseWriter, r *http.Request) {
+		locks, ret := getLocks(w, r)
+		if ret {
+			return
+		}
+
+		type holder struct {
+			Addr       string    `json:"addr"`
+			ClientName string    `json:"client_name"`
+			Acquired   time.Time `json:"acquired"`
+			HeldMs     int64     `json:"held_ms"`
+			Token      uint64    `json:"token"`
+			Shared     bool      `json:"shared"`
+		}
+		type lock struct {
+			Kind    string   `json:"kind"`
+			Name    string   `json:"name"`
+			Holders []holder `json:"holders"`
+			Waiters int      `json:"waiters"`
+		}
+		list := locks.list()
+		res := make([]lock, len(list))
+		now := time.Now()
+		for i, l := range list {
+			res[i] = lock{Kind: lockKinds[l.kind], Name: string(l.name), Holders: []holder{}, Waiters: l.waiters}
+			for _, h := range l.holders {
+				res[i].Holders = append(res[i].Holders, holder{
+					Addr:       h.addr,
+					ClientName: h.clientName,
+					Acquired:   h.acquired,
+					HeldMs:     now.Sub(h.acquired).Milliseconds(),
+					Token:      h.token,
+					Shared:     h.shared,
+				})
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(res)
+	}).Methods("GET")
+
+	// Handle force releasing a lock. Every hold on the lock is released, whoever has it, and the number released is
+	// returned. The kind is mutex, rwlock or semaphore. This needs the admin password in the X-Admin-Password header,
+	// and is logged along with who asked for it.
+	apiV1.HandleFunc("/locks/{kind}/{name}", func(w http.ResponseWriter, r *http.Request) {
+		locks, ret := getLocks(w, r)
+		if ret {
+			return
+		}
+
+		vars := mux.Vars(r)
+		kind := -1
+		for i, v := range lockKinds {
+			if v == vars["kind"] {
+				kind = i
+			}
+		}
+		if kind == -1 {
+			throwException(
+				"InvalidKind",
+				"The kind must be mutex, rwlock or semaphore.",
+				w)
+			return
+		}
+		name := s2b(vars["name"])
+		owner := &lockOwner{addr: r.RemoteAddr}
+		if clientName := r.Header.Get("X-Client-Name"); clientName != "" {
+			owner.name.Store(clientName)
+		}
+		if !forceReleaseAllowed([]byte(r.Header.Get("X-Admin-Password"))) {
+			logForceRelease(owner, byte(kind), name, 0, false)
+			throwExceptionWithStatus(
+				http.StatusForbidden,
+				"InvalidCredentials",
+				"The admin password is invalid or force release is turned off.",
+				w)
+			return
+		}
+		released := locks.forceRelease(lockKey(byte(kind), name))
+		logForceRelease(owner, byte(kind), name, released, true)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(map[string]any{"released": released})
+	}).Methods("DELETE")
+
+	// Handle listing every connection which can subscribe to events along with its subscriptions, how many events are
+	// waiting to be written to it and how many were dropped because its queue was full.
+	apiV1.HandleFunc("/subscribers", func(w http.ResponseWriter, r *http.Request) {
+		dbIndex, ret := getDbIndex(w, r)
+		if ret {
+			return
+		}
+
+		type subscriber struct {
+			Addr     string   `json:"addr"`
+			Channels []string `json:"channels"`
+			Patterns []string `json:"patterns"`
+			Keyspace []string `json:"keyspace"`
+			Queued   int      `json:"queued"`
+			Dropped  uint64   `json:"dropped"`
+		}
+		list := eventDispatchers[dbIndex].list()
+		res := make([]subscriber, len(list))
+		for i, s := range list {
+			res[i] = subscriber{
+				Addr:     s.addr,
+				Channels: s.channels,
+				Patterns: s.patterns,
+				Keyspace: s.keyspace,
+				Queued:   s.queued,
+				Dropped:  s.dropped,
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(res)
+	}).Methods("GET")
+
+	// Handle pings. This is mainly used by clients to check the credentials and database.
+	apiV1.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {
+		if _, ret := getDb(w, r); ret {
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods("GET")
+
 	// Deletes the tree.
 	apiV1.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		db, ret := getDb(w, r)
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Defines the kinds of lock. Each kind has its own names, so a mutex and a semaphore can have the same name.
+const (
+	lockKindMutex byte = iota
+	lockKindRW
+	lockKindSemaphore
+)
+
+// lockKinds is the name of each kind of lock. This is used in the HTTP API and logs.
+var lockKinds = []string{lockKindMutex: "mutex", lockKindRW: "rwlock", lockKindSemaphore: "semaphore"}
+
+// lockKey is used to get the key for a lock in a lockTable.
+func lockKey(kind byte, name []byte) string {
+	return string(kind) + string(name)
+}
+
+// lockOwner is a connection which can hold locks. Each connection has its own.
+type lockOwner struct {
+	// Defines the remote address of the connection.
+	addr string
+
+	// Defines the name the client gave the connection. This is a string, and is not set if it did not give one.
+	name atomic.Value
+}
+
+// clientName is used to get the name the client gave the connection, or a blank string if it did not give one.
+func (o *lockOwner) clientName() string {
+	s, _ := o.name.Load().(string)
+	return s
+}
+
+// lockHold is a hold on a lock.
+type lockHold struct {
+	owner *lockOwner
+
+	// Defines the fencing token of the hold.
+	token uint64
+
+	// Defines when the hold was given out.
+	acquired time.Time
+
+	// Defines if the hold is shared. Holds on mutexes are never shared, and holds on semaphores always are.
+	shared bool
+
+	// Defines the timer which releases the hold when the lease expires. This is nil if there is no lease.
+	lease *time.Timer
+}
+
+// lockWaiter is a connection waiting for a lock.
+type lockWaiter struct {
+	key    string
+	owner  *lockOwner
+	lease  time.Duration
+	shared bool
+
+	// Gets the fencing token when the lock is given to the waiter, or 0 if it was removed from the queue.
+	granted chan uint64
+}
+
+// namedLock is a lock in a lockTable.
+type namedLock struct {
+	// Defines the current holds on the lock.
+	holds []*lockHold
+
+	// Defines the most shared holds there can be at once. This is 0 if there is no limit.
+	limit int
+
+	// Defines the connections waiting for the lock, in the order they asked for it.
+	waiters []*lockWaiter
+}
+
+// free is used to check if nothing holds or waits for the lock.
+func (l *namedLock) free() bool {
+	return len(l.holds) == 0 && len(l.waiters) == 0
+}
+
+// grantable is used to check if a hold can be given out now.
+func (l *namedLock) grantable(shared bool) bool {
+	if !shared || len(l.holds) == 0 {
+		return len(l.holds) == 0
+	}
+	if !l.holds[0].shared {
+		// This is held exclusively.
+		return false
+	}
+	return l.limit == 0 || len(l.holds) < l.limit
+}
+
+// lockTable is used to manage the named locks for a database. Locks are made when they are first used and removed
+// when nothing holds or waits for them. Every lock can have exclusive holds and shared holds. Mutexes are only held
+// exclusively, read-write locks are held either way, and semaphores are only held shared up to their limit.
+type lockTable struct {
+	mu    sync.Mutex
+	locks map[string]*namedLock
+
+	// Defines the last fencing token given out. Every lock in the table shares this, so tokens keep increasing for a
+	// name even after its lock is removed from the table.
+	lastToken uint64
+}
+
+var (
+	errNotLocked     = errors.New("Mutex was already unlocked.")
+	errNotLockOwner  = errors.New("The mutex is held by another connection.")
+	errLimitMismatch = errors.New("The semaphore is in use with a different limit.")
+)
+
+// hold is used to add a hold to a lock, and start the lease if there is one. Returns the fencing token for it. The
+// table must be locked.
+func (t *lockTable) hold(key string, l *namedLock, owner *lockOwner, lease time.Duration, shared bool) uint64 {
+	if t.lastToken == 0 {
+		// Base the first token on the time so tokens are not reused after a restart.
+		t.lastToken = uint64(time.Now().UnixMilli()) << 16
+	}
+	t.lastToken++
+	h := &lockHold{owner: owner, token: t.lastToken, acquired: time.Now(), shared: shared}
+	if lease > 0 {
+		h.lease = time.AfterFunc(lease, func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.release(key, l, h)
+		})
+	}
+	l.holds = append(l.holds, h)
+	return h.token
+}
+
+// release is used to remove a hold from a lock and give it to any waiters which can now have it. Returns false if the
+// hold is not on the lock. The table must be locked.
+func (t *lockTable) release(key string, l *namedLock, h *lockHold) bool {
+	i := 0
+	for i < len(l.holds) && l.holds[i] != h {
+		i++
+	}
+	if i == len(l.holds) {
+		return false
+	}
+	if h.lease != nil {
+		h.lease.Stop()
+	}
+	l.holds = append(l.holds[:i], l.holds[i+1:]...)
+	t.grant(key, l)
+	return true
+}
+
+// grant is used to give the lock to the waiters at the front of the queue for as long as it can be given out. If
+// nothing holds or waits for it after, it is removed from the table. The table must be locked.
+func (t *lockTable) grant(key string, l *namedLock) {
+	for len(l.waiters) != 0 && l.grantable(l.waiters[0].shared) {
+		w := l.waiters[0]
+		l.waiters[0] = nil
+		l.waiters = l.waiters[1:]
+		w.granted <- t.hold(key, l, w.owner, w.lease, w.shared)
+	}
+	if l.free() {
+		delete(t.locks, key)
+	}
+}
+
+// enqueue is used to ask for a hold on the lock with the key specified. If it can be given out and nothing is waiting
+// for it, it is given to the waiter straight away. Otherwise, the waiter is put at the back of the queue. This does
+// not block, so it can be called from the loop reading from a connection and the wait done elsewhere. The limit is
+// the most shared holds there can be at once (0 for none), and returns errLimitMismatch if the lock is in use with a
+// different limit.
+func (t *lockTable) enqueue(
+	key string, owner *lockOwner, lease time.Duration, shared bool, limit int,
+) (*lockWaiter, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	l, ok := t.locks[key]
+	if !ok {
+		if t.locks == nil {
+			t.locks = map[string]*namedLock{}
+		}
+		l = &namedLock{limit: limit}
+		t.locks[key] = l
+	} else if l.limit != limit {
+		return nil, errLimitMismatch
+	}
+	w := &lockWaiter{key: key, owner: owner, lease: lease, shared: shared, granted: make(chan uint64, 1)}
+	if len(l.waiters) == 0 && l.grantable(shared) {
+		w.granted <- t.hold(key, l, owner, lease, shared)
+	} else {
+		l.waiters = append(l.waiters, w)
+	}
+	return w, nil
+}
+
+// dequeue is used to remove a waiter from the queue for its lock. Returns false if it is not in the queue. The table
+// must be locked.
+func (t *lockTable) dequeue(w *lockWaiter) bool {
+	l, ok := t.locks[w.key]
+	if !ok {
+		return false
+	}
+	for i, v := range l.waiters {
+		if v == w {
+			l.waiters = append(l.waiters[:i], l.waiters[i+1:]...)
+
+			// Shared waiters behind this one might be able to go now.
+			t.grant(w.key, l)
+			return true
+		}
+	}
+	return false
+}
+
+// wait is used to wait for a queued waiter to get its lock. If the timeout is below 0, it waits until it gets the lock
+// or is cancelled. Returns the fencing token, or 0 if it timed out or was cancelled.
+func (t *lockTable) wait(w *lockWaiter, timeout time.Duration, cancel <-chan struct{}) uint64 {
+	var timer <-chan time.Time
+	if timeout >= 0 {
+		tm := time.NewTimer(timeout)
+		defer tm.Stop()
+		timer = tm.C
+	}
+	select {
+	case token := <-w.granted:
+		return token
+	case <-timer:
+	case <-cancel:
+	}
+
+	// Give up on the lock, unless it was given to us in the meantime.
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.dequeue(w) {
+		return 0
+	}
+	return <-w.granted
+}
+
+// lock is used to get a hold on the lock with the key specified, waiting up to the timeout for it. If the timeout is
+// below 0, it waits until it can. If the lease is above 0, the hold is released when it expires. Returns the fencing
+// token, or 0 if it timed out or was cancelled.
+func (t *lockTable) lock(
+	key string, owner *lockOwner, lease, timeout time.Duration, shared bool, limit int, cancel <-chan struct{},
+) (uint64, error) {
+	w, err := t.enqueue(key, owner, lease, shared, limit)
+	if err != nil {
+		return 0, err
+	}
+	return t.wait(w, timeout, cancel), nil
+}
+
+// queue is used to get how many holds there are on the lock with the key specified and how many connections are
+// waiting for it.
+func (t *lockTable) queue(key string) (holds, waiters int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	l, ok := t.locks[key]
+	if !ok {
+		return 0, 0
+	}
+	return len(l.holds), len(l.waiters)
+}
+
+// unlock is used to release the oldest hold the owner has on the lock with the key specified. Returns errNotLocked if
+// it is not held, or errNotLockOwner if only other connections hold it.
+func (t *lockTable) unlock(key string, owner *lockOwner) error {
+	return t.unlockWhere(key, func(h *lockHold) bool { return h.owner == owner })
+}
+
+// unlockToken is used to release the hold with the fencing token specified on the lock with the key specified. This is
+// used where there is no connection to own the lock. Returns errNotLocked if it is not held, or errNotLockOwner if it
+// is only held with other tokens.
+func (t *lockTable) unlockToken(key string, token uint64) error {
+	return t.unlockWhere(key, func(h *lockHold) bool { return h.token == token })
+}
+
+// unlockWhere is used to release the oldest hold matching the function on the lock with the key specified.
+func (t *lockTable) unlockWhere(key string, match func(*lockHold) bool) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	l, ok := t.locks[key]
+	if !ok || len(l.holds) == 0 {
+		return errNotLocked
+	}
+	for _, h := range l.holds {
+		if match(h) {
+			t.release(key, l, h)
+			return nil
+		}
+	}
+	return errNotLockOwner
+}
+
+// releaseAll is used to release every hold the owner has and remove it from every queue. This is called when a
+// connection closes.
+func (t *lockTable) releaseAll(owner *lockOwner) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key, l := range t.locks {
+		// Remove the waiters first so the lock is not given back to the owner.
+		waiters := l.waiters[:0]
+		for _, w := range l.waiters {
+			if w.owner == owner {
+				w.granted <- 0
+			} else {
+				waiters = append(waiters, w)
+			}
+		}
+		l.waiters = waiters
+
+		// Release the holds. Releasing can give out holds to other connections, so go through a copy.
+		holds := append([]*lockHold(nil), l.holds...)
+		for _, h := range holds {
+			if h.owner == owner {
+				t.release(key, l, h)
+			}
+		}
+		t.grant(key, l)
+	}
+}
+
+// lockHolderInfo is a hold on a lock returned from a lockTable list.
+type lockHolderInfo struct {
+	addr       string
+	clientName string
+	acquired   time.Time
+	token      uint64
+	shared     bool
+}
+
+// lockInfo is a lock returned from a lockTable list.
+type lockInfo struct {
+	kind    byte
+	name    []byte
+	holders []lockHolderInfo
+	waiters int
+}
+
+// list is used to get every lock in the table along with who holds it, in order of kind and name.
+func (t *lockTable) list() []lockInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	locks := make([]lockInfo, 0, len(t.locks))
+	for key, l := range t.locks {
+		info := lockInfo{kind: key[0], name: []byte(key[1:]), waiters: len(l.waiters)}
+		for _, h := range l.holds {
+			info.holders = append(info.holders, lockHolderInfo{
+				addr:       h.owner.addr,
+				clientName: h.owner.clientName(),
+				acquired:   h.acquired,
+				token:      h.token,
+				shared:     h.shared,
+			})
+		}
+		locks = append(locks, info)
+	}
+	sort.Slice(locks, func(i, j int) bool {
+		if locks[i].kind != locks[j].kind {
+			return locks[i].kind < locks[j].kind
+		}
+		return string(locks[i].name) < string(locks[j].name)
+	})
+	return locks
+}
+
+// forceRelease is used to release every hold on the lock with the key specified, whoever has it. The lock is then
+// given to any waiters. This is used by operators to free a lock which is stuck. Returns the number of holds released.
+func (t *lockTable) forceRelease(key string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	l, ok := t.locks[key]
+	if !ok {
+		return 0
+	}
+
+	// Releasing can give out holds to waiters, so go through a copy.
+	holds := append([]*lockHold(nil), l.holds...)
+	for _, h := range holds {
+		t.release(key, l, h)
+	}
+	return len(holds)
+}
+
+// forceReleaseAllowed is used to check the admin password given to force release a lock. Force release takes locks
+// from whoever holds them, so it is turned off unless an admin password is set.
+func forceReleaseAllowed(attempt []byte) bool {
+	return len(adminPassword) != 0 && subtle.ConstantTimeCompare(attempt, adminPassword) == 1
+}
+
+// logForceRelease is used to log a force release, so that operators can see who took a lock from its holders. If it
+// was not allowed, it is logged as a warning.
+func logForceRelease(by *lockOwner, kind byte, name []byte, released int, allowed bool) {
+	who := by.addr
+	if clientName := by.clientName(); clientName != "" {
+		who += " (" + strconv.Quote(clientName) + ")"
+	}
+	what := lockKinds[kind] + " " + strconv.Quote(string(name))
+	if allowed {
+		fmt.Println("[LOG]", who, "force released", released, "holds on", what)
+	} else {
+		fmt.Println("[WARN]", who, "tried to force release", what, "without the admin password")
+	}
+}
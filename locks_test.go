@@ -0,0 +1,400 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// mutexKey is used to get the key of the mutex with the name specified.
+func mutexKey(name string) string {
+	return lockKey(lockKindMutex, []byte(name))
+}
+
+// mustLock is used to lock a mutex in the table, failing the test if it errors. Returns the fencing token, or 0 if it
+// timed out or was cancelled.
+func mustLock(
+	t *testing.T, table *lockTable, key string, owner *lockOwner, lease, timeout time.Duration, cancel <-chan struct{},
+) uint64 {
+	token, err := table.lock(key, owner, lease, timeout, false, 0, cancel)
+	if err != nil {
+		t.Error(err)
+	}
+	return token
+}
+
+func TestLockTable(t *testing.T) {
+	var table lockTable
+	owner := &lockOwner{}
+	a, b := mutexKey("a"), mutexKey("b")
+
+	// Locks are independent of each other.
+	mustLock(t, &table, a, owner, 0, -1, nil)
+	if mustLock(t, &table, a, owner, 0, 0, nil) != 0 {
+		t.Fatal("a held lock was locked again")
+	}
+	if mustLock(t, &table, b, owner, 0, 0, nil) == 0 {
+		t.Fatal("a free lock could not be locked")
+	}
+	if table.unlock(b, owner) != nil || table.unlock(b, owner) != errNotLocked {
+		t.Fatal("unlocking should only work whilst the lock is held")
+	}
+
+	// A waiter gets the lock once it is unlocked.
+	locked := make(chan struct{})
+	go func() {
+		mustLock(t, &table, a, owner, 0, -1, nil)
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Fatal("the lock was given to a waiter whilst it was held")
+	case <-time.After(20 * time.Millisecond):
+	}
+	if err := table.unlock(a, owner); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("the waiter did not get the lock")
+	}
+	if err := table.unlock(a, owner); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing references the locks now, so they are removed.
+	if len(table.locks) != 0 {
+		t.Errorf("got %d locks in the table, want none", len(table.locks))
+	}
+	if err := table.unlock(mutexKey("missing"), owner); err != errNotLocked {
+		t.Errorf("got %v unlocking a lock which was never made, want %v", err, errNotLocked)
+	}
+}
+
+func TestLockOwnership(t *testing.T) {
+	var table lockTable
+	first, second := &lockOwner{}, &lockOwner{}
+	mustLock(t, &table, mutexKey("a"), first, 0, -1, nil)
+	mustLock(t, &table, mutexKey("b"), first, 0, -1, nil)
+	mustLock(t, &table, mutexKey("c"), second, 0, -1, nil)
+
+	if err := table.unlock(mutexKey("a"), second); err != errNotLockOwner {
+		t.Fatalf("got %v unlocking another connection's lock, want %v", err, errNotLockOwner)
+	}
+
+	// Closing the first connection releases its locks only.
+	table.releaseAll(first)
+	for _, name := range []string{"a", "b"} {
+		if mustLock(t, &table, mutexKey(name), second, 0, 0, nil) == 0 {
+			t.Errorf("lock %q was not released with its owner", name)
+		}
+	}
+	if mustLock(t, &table, mutexKey("c"), first, 0, 0, nil) != 0 {
+		t.Error("a lock held by another connection was released")
+	}
+}
+
+func TestLockLease(t *testing.T) {
+	var table lockTable
+	first, second := &lockOwner{}, &lockOwner{}
+	name := mutexKey("mutex")
+
+	// The lease expires and the waiter gets the lock.
+	mustLock(t, &table, name, first, 20*time.Millisecond, -1, nil)
+	start := time.Now()
+	mustLock(t, &table, name, second, 0, -1, nil)
+	if waited := time.Since(start); waited < 10*time.Millisecond {
+		t.Errorf("the lock was taken after %s, before the lease expired", waited)
+	}
+	if err := table.unlock(name, first); err != errNotLockOwner {
+		t.Fatalf("got %v unlocking after the lease expired, want %v", err, errNotLockOwner)
+	}
+	if err := table.unlock(name, second); err != nil {
+		t.Fatal(err)
+	}
+
+	// A lease from an earlier hold does not release a later one.
+	mustLock(t, &table, name, first, 20*time.Millisecond, -1, nil)
+	if err := table.unlock(name, first); err != nil {
+		t.Fatal(err)
+	}
+	mustLock(t, &table, name, second, 0, -1, nil)
+	time.Sleep(50 * time.Millisecond)
+	if mustLock(t, &table, name, first, 0, 0, nil) != 0 {
+		t.Fatal("an old lease released the lock")
+	}
+	if err := table.unlock(name, second); err != nil {
+		t.Fatal(err)
+	}
+	if len(table.locks) != 0 {
+		t.Errorf("got %d locks in the table, want none", len(table.locks))
+	}
+}
+
+func TestLockTokens(t *testing.T) {
+	var table lockTable
+	owner := &lockOwner{}
+	name := mutexKey("mutex")
+
+	// Tokens keep increasing, even after the lock is removed from the table.
+	first := mustLock(t, &table, name, owner, 0, -1, nil)
+	if err := table.unlock(name, owner); err != nil {
+		t.Fatal(err)
+	}
+	second := mustLock(t, &table, name, owner, 0, 0, nil)
+	if first == 0 || second <= first {
+		t.Fatalf("got token %d after %d, want a larger one", second, first)
+	}
+
+	// Unlocking by token only works for the current holder.
+	if err := table.unlockToken(name, first); err != errNotLockOwner {
+		t.Errorf("got %v unlocking with an old token, want %v", err, errNotLockOwner)
+	}
+	if err := table.unlockToken(name, second); err != nil {
+		t.Fatal(err)
+	}
+	if err := table.unlockToken(name, second); err != errNotLocked {
+		t.Errorf("got %v unlocking with a released token, want %v", err, errNotLocked)
+	}
+}
+
+// grantedNow is used to get the fencing token a waiter was given without waiting, or 0 if it has not got the lock.
+func grantedNow(w *lockWaiter) uint64 {
+	select {
+	case token := <-w.granted:
+		return token
+	default:
+		return 0
+	}
+}
+
+func TestLockFIFO(t *testing.T) {
+	var table lockTable
+	name := mutexKey("mutex")
+	owners := make([]*lockOwner, 4)
+	waiters := make([]*lockWaiter, len(owners))
+	for i := range owners {
+		owners[i] = &lockOwner{}
+		w, err := table.enqueue(name, owners[i], 0, false, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		waiters[i] = w
+	}
+	if holds, queued := table.queue(name); holds != 1 || queued != 3 {
+		t.Fatalf("got %d holds and %d waiters, want 1 and 3", holds, queued)
+	}
+
+	// Each unlock gives the lock to the next waiter in the order they asked for it.
+	var lastToken uint64
+	for i, w := range waiters {
+		token := grantedNow(w)
+		if token == 0 {
+			t.Fatalf("waiter %d did not get the lock after the ones before it unlocked", i)
+		}
+		if token <= lastToken {
+			t.Fatalf("waiter %d got token %d after token %d", i, token, lastToken)
+		}
+		lastToken = token
+		for _, later := range waiters[i+1:] {
+			if grantedNow(later) != 0 {
+				t.Fatalf("a waiter behind waiter %d got the lock whilst it was held", i)
+			}
+		}
+		if err := table.unlock(name, owners[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(table.locks) != 0 {
+		t.Errorf("got %d locks in the table, want none", len(table.locks))
+	}
+}
+
+func TestLockTimeout(t *testing.T) {
+	var table lockTable
+	holder, timedOut, cancelled, last := &lockOwner{}, &lockOwner{}, &lockOwner{}, &lockOwner{}
+	name := mutexKey("mutex")
+	mustLock(t, &table, name, holder, 0, -1, nil)
+
+	// Waiters which time out or are cancelled leave the queue without getting the lock.
+	start := time.Now()
+	if token := mustLock(t, &table, name, timedOut, 0, 20*time.Millisecond, nil); token != 0 {
+		t.Fatalf("got token %d whilst the lock was held, want 0", token)
+	}
+	if waited := time.Since(start); waited < 20*time.Millisecond {
+		t.Errorf("gave up after %s, before the timeout", waited)
+	}
+	cancel := make(chan struct{})
+	close(cancel)
+	if token := mustLock(t, &table, name, cancelled, 0, -1, cancel); token != 0 {
+		t.Fatalf("got token %d for a cancelled wait, want 0", token)
+	}
+	if _, queued := table.queue(name); queued != 0 {
+		t.Fatalf("got %d waiters, want the ones which gave up removed", queued)
+	}
+
+	// A waiter without a timeout still gets the lock once it is unlocked.
+	w, err := table.enqueue(name, last, 0, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := table.unlock(name, holder); err != nil {
+		t.Fatal(err)
+	}
+	if table.wait(w, -1, nil) == 0 {
+		t.Fatal("the waiter did not get the lock")
+	}
+	if err := table.unlock(name, last); err != nil {
+		t.Fatal(err)
+	}
+	if len(table.locks) != 0 {
+		t.Errorf("got %d locks in the table, want none", len(table.locks))
+	}
+}
+
+func TestLockSharedHolds(t *testing.T) {
+	tests := []struct {
+		name   string
+		kind   byte
+		shared []bool
+		limit  int
+
+		// Defines the waiters given the lock after each round of releasing every hold from the last round.
+		want [][]int
+	}{
+		{
+			name:   "readers share",
+			kind:   lockKindRW,
+			shared: []bool{true, true, true},
+			want:   [][]int{{0, 1, 2}},
+		},
+		{
+			name:   "writer waits for readers",
+			kind:   lockKindRW,
+			shared: []bool{true, true, false, true, true},
+			want:   [][]int{{0, 1}, {2}, {3, 4}},
+		},
+		{
+			name:   "readers wait behind a writer",
+			kind:   lockKindRW,
+			shared: []bool{false, true, false, true},
+			want:   [][]int{{0}, {1}, {2}, {3}},
+		},
+		{
+			name:   "semaphore",
+			kind:   lockKindSemaphore,
+			shared: []bool{true, true, true, true, true},
+			limit:  2,
+			want:   [][]int{{0, 1}, {2, 3}, {4}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var table lockTable
+			key := lockKey(tt.kind, []byte("lock"))
+			owners := make([]*lockOwner, len(tt.shared))
+			waiters := make([]*lockWaiter, len(tt.shared))
+			for i, shared := range tt.shared {
+				owners[i] = &lockOwner{}
+				w, err := table.enqueue(key, owners[i], 0, shared, tt.limit)
+				if err != nil {
+					t.Fatal(err)
+				}
+				waiters[i] = w
+			}
+
+			var got [][]int
+			for {
+				// Collect the waiters which have the lock now.
+				var round []int
+				for i, w := range waiters {
+					if w != nil && grantedNow(w) != 0 {
+						round = append(round, i)
+						waiters[i] = nil
+					}
+				}
+				if len(round) == 0 {
+					break
+				}
+				got = append(got, round)
+				for _, i := range round {
+					if err := table.unlock(key, owners[i]); err != nil {
+						t.Fatalf("waiter %d could not unlock: %v", i, err)
+					}
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			if len(table.locks) != 0 {
+				t.Fatal("the lock was not removed from the table")
+			}
+		})
+	}
+}
+
+func TestLockLimitMismatch(t *testing.T) {
+	var table lockTable
+	key := lockKey(lockKindSemaphore, []byte("sem"))
+	if _, err := table.enqueue(key, &lockOwner{}, 0, true, 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := table.enqueue(key, &lockOwner{}, 0, true, 3); err != errLimitMismatch {
+		t.Fatalf("got %v, want %v", err, errLimitMismatch)
+	}
+}
+
+func TestForceRelease(t *testing.T) {
+	var table lockTable
+	key := lockKey(lockKindSemaphore, []byte("sem"))
+	first, second := &lockOwner{addr: "first"}, &lockOwner{addr: "second"}
+	second.name.Store("worker")
+	for _, owner := range []*lockOwner{first, second} {
+		if _, err := table.enqueue(key, owner, 0, true, 2); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waiter, err := table.enqueue(key, &lockOwner{addr: "waiter"}, 0, true, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The list shows who holds the lock.
+	locks := table.list()
+	if len(locks) != 1 || len(locks[0].holders) != 2 || locks[0].waiters != 1 {
+		t.Fatalf("got %+v, want one lock with 2 holders and 1 waiter", locks)
+	}
+	if h := locks[0].holders[1]; h.addr != "second" || h.clientName != "worker" {
+		t.Errorf("got holder %q named %q, want second named worker", h.addr, h.clientName)
+	}
+
+	// Every hold is released and the waiter gets the lock.
+	if released := table.forceRelease(key); released != 2 {
+		t.Fatalf("got %d holds released, want 2", released)
+	}
+	if grantedNow(waiter) == 0 {
+		t.Fatal("the waiter did not get the lock")
+	}
+	if err := table.unlock(key, first); err != errNotLockOwner {
+		t.Errorf("got %v unlocking a force released hold, want %v", err, errNotLockOwner)
+	}
+}
+
+func TestForceReleaseAllowed(t *testing.T) {
+	defer func(old []byte) { adminPassword = old }(adminPassword)
+
+	// Force release is turned off without an admin password.
+	adminPassword = nil
+	if forceReleaseAllowed(nil) || forceReleaseAllowed([]byte("")) {
+		t.Error("force release was allowed without an admin password set")
+	}
+
+	adminPassword = []byte("secret")
+	if forceReleaseAllowed([]byte("wrong")) {
+		t.Error("force release was allowed with the wrong password")
+	}
+	if !forceReleaseAllowed([]byte("secret")) {
+		t.Error("force release was not allowed with the admin password")
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"net"
@@ -8,47 +9,74 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
-	"sync"
 	"time"
 
 	"github.com/webscalesoftwareltd/hypercache/radix"
 )
 
-func setupTree(path, name string, sleepTime time.Duration) radix.RadixTree {
-	//if path == "" {
-	return radix.NewRadixTree()
-	//}
-	//
-	////rbf := radix.NewRBF(path)
-	//var tree radix.RadixTree
-	////ret := rbf.Load()
-	//if ret == nil {
-	//	fmt.Println("[WARN]", name, "could not be loaded from disk")
-	//	tree = radix.NewRadixTree()
-	//} else {
-	//	fmt.Println("[LOG]", name, "loaded from disk")
-	//	tree = *ret
-	//}
-	//
-	//go func() {
-	//	for {
-	//		time.Sleep(sleepTime)
-	//		if rbf.Write(tree) {
-	//			fmt.Println("[LOG]", name, "written to disk")
-	//		} else {
-	//			_, _ = fmt.Fprintln(os.Stderr, "[ERROR]", name, "could not be written to disk")
-	//		}
-	//	}
-	//}()
-	//
-	//return tree
+func setupTree(path, walPath string, dbIndex uint16, sleepTime time.Duration, fsync walFsyncPolicy) *database {
+	name := "DB " + strconv.Itoa(int(dbIndex))
+	if path == "" {
+		return &database{RadixTree: radix.NewRadixTree()}
+	}
+
+	rbf := radix.NewRBF(path, dbIndex)
+	var tree radix.RadixTree
+	ret := rbf.Load()
+	if ret == nil {
+		// There is nothing to warn about if the database was never written to disk.
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			fmt.Println("[WARN]", name, "could not be loaded from disk")
+		}
+		tree = radix.NewRadixTree()
+	} else {
+		tree = *ret
+		metadata := rbf.Metadata()
+		if metadata == nil || metadata.Version == 1 {
+			fmt.Println("[LOG]", name, "loaded from disk")
+		} else {
+			fmt.Println("[LOG]", name, "loaded", metadata.Entries, "entries from disk saved at",
+				metadata.CreatedAt.Format(time.RFC3339))
+			if metadata.DBIndex != dbIndex {
+				fmt.Println("[WARN]", name, "was loaded from a file saved by DB", metadata.DBIndex)
+			}
+		}
+	}
+
+	// Replay any writes made since the last snapshot.
+	wal, err := openWriteAheadLog(walPath, name, fsync)
+	if err != nil {
+		panic(err)
+	}
+	count, err := wal.replay(tree)
+	if err != nil {
+		panic(err)
+	}
+	if count != 0 {
+		fmt.Println("[LOG]", name, "replayed", count, "writes from the write-ahead log")
+	}
+
+	go func() {
+		for {
+			time.Sleep(sleepTime)
+			if wal.snapshot(tree, rbf.WriteSnapshot) {
+				fmt.Println("[LOG]", name, "written to disk")
+			} else {
+				_, _ = fmt.Fprintln(os.Stderr, "[ERROR]", name, "could not be written to disk")
+			}
+		}
+	}()
+
+	return &database{RadixTree: tree, wal: wal}
 }
 
 var (
-	trees            []radix.RadixTree
-	mutexes          []sync.Mutex
+	trees            []*database
+	lockTables       []lockTable
 	eventDispatchers []eventDispatcher
 	password         []byte
+	adminPassword    []byte
+	idleTimeout      time.Duration
 )
 
 func main() {
@@ -56,7 +84,16 @@ func main() {
 	writeDurationPtr := flag.Duration("write-duration", time.Minute*5, "the amount of time between saves - minimum 10 seconds")
 	dataPathPtr := flag.String("data-path", "./data", "defines the path where data is stored")
 	savesPtr := flag.Bool("saves", true, "defines if the database should be read/saved from disk")
+	walFsyncPtr := flag.String("wal-fsync", "everysec", "defines when the write-ahead log is synced to disk - always, everysec or never")
+	maxMemoryPtr := flag.String("max-memory", "0", "the maximum memory every database can use together, such as 512mb - 0 for no limit")
+	dbMaxMemoryPtr := flag.String("db-max-memory", "0", "the maximum memory each database can use - a size for every database, or index=size pairs separated by commas")
+	evictionPolicyPtr := flag.String("eviction-policy", "noeviction", "what a database does when it reaches its memory limit - noeviction, allkeys-lru, allkeys-lfu or volatile-ttl, or index=policy pairs separated by commas")
+	eventQueueSizePtr := flag.Uint("event-queue-size", 1024, "the most events which can wait to be written to each connection")
+	eventOverflowPtr := flag.String("event-overflow", "drop-oldest", "what happens when a connection's event queue is full - drop-oldest, drop-newest or disconnect")
+	idleTimeoutPtr := flag.Duration("idle-timeout", 0, "how long a HNP connection can go without sending a packet before it is closed - 0 for no limit")
+	keepAlivePtr := flag.Duration("tcp-keepalive", time.Second*15, "the period between TCP keep-alive probes on HNP connections, which find dead connections and release their locks - 0 to turn them off")
 	passwordPtr := flag.String("password", "", "defines the database password")
+	adminPasswordPtr := flag.String("admin-password", "", "defines the password needed to force release locks - force release is turned off if this is empty")
 	hnpBindPtr := flag.String("hnp-bind", "127.0.0.1:6060", "defines the bind for the HyperCache Networking Protocol")
 	httpBindPtr := flag.String("http-bind", "127.0.0.1:6061", "defines the bind for the HTTP implementation")
 	flag.Parse()
@@ -68,6 +105,8 @@ func main() {
 	writeDuration := *writeDurationPtr
 	if writeDuration == 0 {
 		writeDuration = time.Minute * 5
+	} else if writeDuration < time.Second*10 {
+		writeDuration = time.Second * 10
 	}
 	dataPath := *dataPathPtr
 	saves := *savesPtr
@@ -75,26 +114,78 @@ func main() {
 		dataPath = ""
 	}
 	password = []byte(*passwordPtr)
-
-	trees = make([]radix.RadixTree, dbCount)
-	mutexes = make([]sync.Mutex, dbCount)
-	eventDispatchers = make([]eventDispatcher, dbCount)
-	err := os.MkdirAll(dataPath, 0o777)
+	adminPassword = []byte(*adminPasswordPtr)
+	idleTimeout = *idleTimeoutPtr
+	keepAlive := *keepAlivePtr
+	if keepAlive <= 0 {
+		// A negative period turns keep-alives off.
+		keepAlive = -1
+	}
+	walFsync, err := parseWalFsyncPolicy(*walFsyncPtr)
+	if err != nil {
+		panic(err)
+	}
+	maxMemory, err = parseMemorySize(*maxMemoryPtr)
 	if err != nil {
 		panic(err)
 	}
-	p, err := filepath.Abs(dataPath)
+	dbMaxMemories, err := parsePerDatabase(*dbMaxMemoryPtr, dbCount)
 	if err != nil {
 		panic(err)
 	}
+	evictionPolicies, err := parsePerDatabase(*evictionPolicyPtr, dbCount)
+	if err != nil {
+		panic(err)
+	}
+
+	eventQueueSize := int(*eventQueueSizePtr)
+	if eventQueueSize == 0 {
+		eventQueueSize = 1024
+	}
+	eventOverflow, err := parseEventOverflowPolicy(*eventOverflowPtr)
+	if err != nil {
+		panic(err)
+	}
+
+	trees = make([]*database, dbCount)
+	lockTables = make([]lockTable, dbCount)
+	eventDispatchers = make([]eventDispatcher, dbCount)
+	for i := range eventDispatchers {
+		eventDispatchers[i].queueSize = eventQueueSize
+		eventDispatchers[i].overflow = eventOverflow
+	}
+	if dataPath != "" {
+		err = os.MkdirAll(dataPath, 0o777)
+		if err != nil {
+			panic(err)
+		}
+		dataPath, err = filepath.Abs(dataPath)
+		if err != nil {
+			panic(err)
+		}
+	}
 	for i := range trees {
-		fp := filepath.Join(p, strconv.Itoa(i)+".rbf")
-		trees[i] = setupTree(fp, "DB "+strconv.Itoa(i), writeDuration)
+		fp, walFp := "", ""
+		if dataPath != "" {
+			fp = filepath.Join(dataPath, strconv.Itoa(i)+".rbf")
+			walFp = filepath.Join(dataPath, strconv.Itoa(i)+".wal")
+		}
+		db := setupTree(fp, walFp, uint16(i), writeDuration, walFsync)
+		if db.maxMemory, err = parseMemorySize(dbMaxMemories[i]); err != nil {
+			panic(err)
+		}
+		if db.eviction, err = parseEvictionPolicy(evictionPolicies[i]); err != nil {
+			panic(err)
+		}
+		db.events = &eventDispatchers[i]
+		trees[i] = db
+		go db.sweepExpired()
 	}
 
 	go func() {
 		fmt.Println("[LOG] HNP handler going to serve on", *hnpBindPtr)
-		ln, err := net.Listen("tcp", *hnpBindPtr)
+		lc := net.ListenConfig{KeepAlive: keepAlive}
+		ln, err := lc.Listen(context.Background(), "tcp", *hnpBindPtr)
 		if err != nil {
 			panic(err)
 		}
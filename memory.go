@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/webscalesoftwareltd/hypercache/radix"
+)
+
+// evictionPolicy defines what a database does when a write would take it over its memory limit.
+type evictionPolicy struct {
+	// evicts defines if keys are evicted. If not, the write fails.
+	evicts bool
+
+	// policy defines how keys are picked to be evicted.
+	policy radix.EvictionPolicy
+}
+
+func parseEvictionPolicy(s string) (evictionPolicy, error) {
+	switch s {
+	case "noeviction":
+		return evictionPolicy{}, nil
+	case "allkeys-lru":
+		return evictionPolicy{evicts: true, policy: radix.EvictAllKeysLRU}, nil
+	case "allkeys-lfu":
+		return evictionPolicy{evicts: true, policy: radix.EvictAllKeysLFU}, nil
+	case "volatile-ttl":
+		return evictionPolicy{evicts: true, policy: radix.EvictVolatileTTL}, nil
+	default:
+		return evictionPolicy{}, errors.New("unknown eviction policy: " + s)
+	}
+}
+
+// Defines the units which can be used for memory sizes.
+var memoryUnits = []struct {
+	suffix     string
+	multiplier uint64
+}{
+	{"kb", 1 << 10},
+	{"mb", 1 << 20},
+	{"gb", 1 << 30},
+	{"tb", 1 << 40},
+	{"b", 1},
+}
+
+// parseMemorySize is used to parse a number of bytes with an optional unit (b, kb, mb, gb or tb). Zero means
+// there is no limit.
+func parseMemorySize(s string) (uint64, error) {
+	lower := strings.ToLower(s)
+	multiplier := uint64(1)
+	for _, unit := range memoryUnits {
+		if strings.HasSuffix(lower, unit.suffix) {
+			lower = lower[:len(lower)-len(unit.suffix)]
+			multiplier = unit.multiplier
+			break
+		}
+	}
+	n, err := strconv.ParseUint(lower, 10, 64)
+	if err != nil {
+		return 0, errors.New("invalid memory size: " + s)
+	}
+	return n * multiplier, nil
+}
+
+// parsePerDatabase is used to parse a flag which holds a value for each database. This is a comma separated
+// list of values in the format index=value. A value without an index is used for every database not given one.
+func parsePerDatabase(s string, dbCount uint) ([]string, error) {
+	var fallback string
+	values := make([]string, dbCount)
+	set := make([]bool, dbCount)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		eq := strings.IndexByte(part, '=')
+		if eq == -1 {
+			fallback = part
+			continue
+		}
+		i, err := strconv.ParseUint(part[:eq], 10, 64)
+		if err != nil || i >= uint64(dbCount) {
+			return nil, errors.New("invalid database index: " + part[:eq])
+		}
+		values[i] = part[eq+1:]
+		set[i] = true
+	}
+	for i := range values {
+		if !set[i] {
+			values[i] = fallback
+		}
+	}
+	return values, nil
+}
+
+// Defines the maximum number of bytes every database can use together. Zero means there is no limit.
+var maxMemory uint64
+
+const outOfMemoryMessage = "The database does not have enough memory for this write."
+
+var errOutOfMemory = errors.New(outOfMemoryMessage)
+
+// totalMemoryUsage is used to get the number of bytes used by every database.
+func totalMemoryUsage() uint64 {
+	var total uint64
+	for _, db := range trees {
+		total += db.MemoryUsage()
+	}
+	return total
+}
+
+// evictOne is used to evict a key picked by the eviction policy. Returns false if nothing can be evicted.
+func (d *database) evictOne() bool {
+	if !d.eviction.evicts {
+		return false
+	}
+	key := d.PickEviction(d.eviction.policy)
+	if key == nil {
+		return false
+	}
+	d.deleteKey(key, keyspaceOpEvict)
+	return true
+}
+
+// Defines the lock held by writes to any database from when they reserve memory until they are applied, if every
+// database has a limit together.
+var globalMemoryMu sync.Mutex
+
+// limited is used to check if writes to this database have a memory limit.
+func (d *database) limited() bool {
+	return maxMemory != 0 || d.maxMemory != 0
+}
+
+// lockMemory is used to lock the memory writes are reserved against until the returned function is called. Writes
+// hold this from when they reserve memory until they are applied, so two writes cannot both be given the same room.
+// If there is no limit, nothing is locked.
+func (d *database) lockMemory() (unlock func()) {
+	switch {
+	case maxMemory != 0:
+		globalMemoryMu.Lock()
+		return globalMemoryMu.Unlock
+	case d.maxMemory != 0:
+		d.memoryMu.Lock()
+		return d.memoryMu.Unlock
+	default:
+		return func() {}
+	}
+}
+
+// growth is used to get how many bytes setting a key to a value of the length specified adds. If the key exists, this
+// is only how much longer the value is. If there is no limit, this is 0 since it would not be used.
+func (d *database) growth(key []byte, valueLen int) uint64 {
+	if !d.limited() {
+		return 0
+	}
+	current, deallocator := d.Get(key)
+	defer deallocator()
+	if current == nil {
+		return radix.EntrySize(len(key), valueLen)
+	}
+	if valueLen <= len(current) {
+		return 0
+	}
+	return uint64(valueLen - len(current))
+}
+
+// reserve is used to make room for a write of the number of bytes specified, evicting keys if the policy allows.
+// Keys are evicted from this database first, and then from the others if every database is over the global limit.
+// The memory must be locked with lockMemory until the write is applied. Returns false if there is not enough room.
+func (d *database) reserve(n uint64) bool {
+	if n == 0 {
+		return true
+	}
+	for d.maxMemory != 0 && d.MemoryUsage()+n > d.maxMemory {
+		if !d.evictOne() {
+			return false
+		}
+	}
+	for maxMemory != 0 && totalMemoryUsage()+n > maxMemory {
+		if d.evictOne() {
+			continue
+		}
+		evicted := false
+		for _, other := range trees {
+			if other != d && other.evictOne() {
+				evicted = true
+				break
+			}
+		}
+		if !evicted {
+			return false
+		}
+	}
+	return true
+}
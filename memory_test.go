@@ -0,0 +1,128 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/webscalesoftwareltd/hypercache/radix"
+)
+
+func TestParseMemorySize(t *testing.T) {
+	sizes := map[string]uint64{"0": 0, "512": 512, "10b": 10, "2KB": 2 << 10, "512mb": 512 << 20, "1gb": 1 << 30}
+	for s, want := range sizes {
+		if got, err := parseMemorySize(s); err != nil || got != want {
+			t.Errorf("%q: got %d (%v), want %d", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "mb", "-1", "1.5gb", "ten"} {
+		if _, err := parseMemorySize(s); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+}
+
+func TestSampledEvictionOrder(t *testing.T) {
+	// Keys are picked from a random sample, so the key which should go first is only expected to be picked most of
+	// the time. With two keys, the other key is only picked if every sample misses it.
+	policies := map[string]radix.EvictionPolicy{"lru": radix.EvictAllKeysLRU, "lfu": radix.EvictAllKeysLFU}
+	for name, policy := range policies {
+		t.Run(name, func(t *testing.T) {
+			tree := radix.NewRadixTree()
+			defer tree.FreeTree()
+			tree.Set([]byte("cold"), []byte("1"))
+			time.Sleep(5 * time.Millisecond)
+			tree.Set([]byte("hot"), []byte("2"))
+			for i := 0; i < 10; i++ {
+				_, free := tree.Get([]byte("hot"))
+				free()
+			}
+
+			cold := 0
+			for i := 0; i < 200; i++ {
+				if string(tree.PickEviction(policy)) == "cold" {
+					cold++
+				}
+			}
+			if cold < 150 {
+				t.Errorf("the cold key was picked %d times out of 200", cold)
+			}
+
+			// Expired keys are picked over any live key whenever they are in the sample.
+			tree.SetWithExpiry([]byte("expired"), []byte("3"), time.Now().Add(-time.Second))
+			expired := 0
+			for i := 0; i < 200; i++ {
+				if string(tree.PickEviction(policy)) == "expired" {
+					expired++
+				}
+			}
+			if expired < 100 {
+				t.Errorf("the expired key was picked %d times out of 200", expired)
+			}
+		})
+	}
+}
+
+func TestReserve(t *testing.T) {
+	soon, later := time.Now().Add(time.Hour), time.Now().Add(2*time.Hour)
+	newDatabase := func(policy string) *database {
+		eviction, err := parseEvictionPolicy(policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := &database{RadixTree: radix.NewRadixTree(), eviction: eviction}
+		t.Cleanup(d.RadixTree.FreeTree)
+		_, _ = d.SetWithExpiry([]byte("a"), []byte("1"), later)
+		_, _ = d.SetWithExpiry([]byte("b"), []byte("2"), soon)
+		_, _ = d.Set([]byte("c"), []byte("3"))
+		d.maxMemory = d.MemoryUsage()
+		return d
+	}
+	get := func(d *database, key string) string {
+		value, free := d.Get([]byte(key))
+		defer free()
+		return string(value)
+	}
+
+	t.Run("noeviction", func(t *testing.T) {
+		d := newDatabase("noeviction")
+		if _, err := d.Set([]byte("d"), []byte("4")); err != errOutOfMemory {
+			t.Fatalf("got %v for a write over the limit, want errOutOfMemory", err)
+		}
+		if get(d, "d") != "" {
+			t.Error("the write was applied")
+		}
+		if _, err := d.SetWithExpiry([]byte("e"), []byte("5"), later); err != errOutOfMemory {
+			t.Fatalf("got %v for an expiring write over the limit, want errOutOfMemory", err)
+		}
+
+		// Writes which do not grow a key still fit.
+		if _, err := d.Set([]byte("a"), []byte("x")); err != nil {
+			t.Fatalf("got %v for an overwrite of the same size", err)
+		}
+		if _, err := d.Set([]byte("a"), []byte("xy")); err != errOutOfMemory {
+			t.Fatalf("got %v for an overwrite which grows the key, want errOutOfMemory", err)
+		}
+		if get(d, "a") != "x" || get(d, "b") != "2" || get(d, "c") != "3" {
+			t.Error("a key was evicted")
+		}
+	})
+
+	t.Run("volatile-ttl", func(t *testing.T) {
+		// The keys which expire soonest go first, and keys which never expire are never evicted.
+		d := newDatabase("volatile-ttl")
+		for _, want := range []struct{ key, evicted string }{{"d", "b"}, {"e", "a"}} {
+			if _, err := d.Set([]byte(want.key), []byte("4")); err != nil {
+				t.Fatalf("set %q: %v", want.key, err)
+			}
+			if get(d, want.evicted) != "" {
+				t.Errorf("setting %q did not evict %q", want.key, want.evicted)
+			}
+		}
+		if _, err := d.Set([]byte("f"), []byte("5")); err != errOutOfMemory {
+			t.Fatalf("got %v with no keys left which expire, want errOutOfMemory", err)
+		}
+		if get(d, "c") != "3" || get(d, "d") != "4" || get(d, "e") != "4" {
+			t.Error("a key which never expires was evicted")
+		}
+	})
+}
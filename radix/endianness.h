@@ -4,19 +4,24 @@ extern "C" {
 
 #ifndef HYPERCACHE_ENDIANNESS_H
 #define HYPERCACHE_ENDIANNESS_H
+#include <stdint.h>
+#include <stdlib.h>
+#include <string.h>
 
 // TODO: Big endian support.
 
 #if __BYTE_ORDER__ == __ORDER_LITTLE_ENDIAN__
-    uint8_t* le_uint64_encode(uint64_t val) {
+    static inline uint8_t* le_uint64_encode(uint64_t val) {
         auto ptr = (uint64_t*)&val;
         auto a = malloc(sizeof(uint64_t));
         memcpy(a, ptr, sizeof(uint64_t));
         return (uint8_t*)a;
     }
 
-    uint64_t le_uint64_decode(const uint8_t* ptr) {
-        return *(uint64_t*)ptr;
+    static inline uint64_t le_uint64_decode(const uint8_t* ptr) {
+        uint64_t val;
+        memcpy(&val, ptr, sizeof(uint64_t));
+        return val;
     }
 #endif
 
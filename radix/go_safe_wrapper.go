@@ -2,8 +2,10 @@ package radix
 
 import (
 	"C"
+	"errors"
 	"reflect"
 	"runtime"
+	"time"
 	"unsafe"
 )
 
@@ -58,6 +60,33 @@ func (r RadixTree) Get(key []byte) (value []byte, deallocator func()) {
 		}
 }
 
+type radixTreeVersionedValueGo struct {
+	value   byteSlice
+	version uint64
+}
+
+// GetVersioned is used to get a value along with its version. The version changes every time the key is set.
+func (r RadixTree) GetVersioned(key []byte) (value []byte, version uint64, deallocator func()) {
+	defer runtime.KeepAlive(key)
+	keepAlive, keyC := shortTermByteSlice(key)
+	defer runtime.KeepAlive(keepAlive)
+
+	possibleValue := r.cObj.Get_versioned(keyC)
+	if possibleValue == nil || possibleValue.Swigcptr() == 0 {
+		return nil, 0, func() {}
+	}
+
+	versioned := *(*radixTreeVersionedValueGo)(unsafe.Pointer(possibleValue.Swigcptr()))
+	return *(*[]byte)(unsafe.Pointer(&reflect.SliceHeader{
+			Data: versioned.value.value,
+			Len:  int(versioned.value.length),
+			Cap:  int(versioned.value.length),
+		})), versioned.version, func() {
+			Swig_free(possibleValue.Swigcptr())
+			Swig_free(versioned.value.value)
+		}
+}
+
 type RadixTreeWalkValueGo struct {
 	key   byteSlice
 	value byteSlice
@@ -93,6 +122,8 @@ func (p *PendingFreer) FreeAll() {
 	}
 }
 
+// WalkPrefix is used to walk every key starting with the prefix in byte order. The walk stops if the handler
+// returns false.
 func (r RadixTree) WalkPrefix(prefix []byte, hn func(key, value []byte) bool, destructor WalkerDestructor) {
 	keepAlive, cVal := shortTermByteSlice(prefix)
 	walker := r.cObj.Walk_prefix(cVal)
@@ -101,8 +132,31 @@ func (r RadixTree) WalkPrefix(prefix []byte, hn func(key, value []byte) bool, de
 	runtime.KeepAlive(keepAlive)
 	runtime.KeepAlive(prefix)
 
-	// Defer the destruction of the walker.
+	walk(walker, hn, destructor)
+}
+
+// WalkRange is used to walk every key from start (inclusive) to end (exclusive) in byte order, or in descending
+// byte order if reverse is true. An empty end means there is no end. The walk stops if the handler returns false.
+func (r RadixTree) WalkRange(
+	start, end []byte, reverse bool, hn func(key, value []byte) bool, destructor WalkerDestructor,
+) {
+	startKeepAlive, startC := shortTermByteSlice(start)
+	endKeepAlive, endC := shortTermByteSlice(end)
+	walker := r.cObj.Walk_range(startC, endC, reverse)
+
+	// The walker copies the keys, so they only need to be kept alive to here.
+	runtime.KeepAlive(startKeepAlive)
+	runtime.KeepAlive(start)
+	runtime.KeepAlive(endKeepAlive)
+	runtime.KeepAlive(end)
+
+	walk(walker, hn, destructor)
+}
+
+func walk(walker RadixTreeBranchWalker, hn func(key, value []byte) bool, destructor WalkerDestructor) {
+	// Defer the destruction of the walker. Closing it unlocks the tree if the walk is stopped early.
 	defer Swig_free(walker.Swigcptr())
+	defer walker.Close()
 
 	for {
 		// Get the next value.
@@ -146,6 +200,19 @@ func (r RadixTree) WalkPrefix(prefix []byte, hn func(key, value []byte) bool, de
 }
 
 func (r RadixTree) Set(key, value []byte) bool {
+	return r.set(key, value, 0)
+}
+
+// SetWithExpiry is used to set a key which expires at the time specified. A zero time means the key never expires.
+// Returns true if it overwrote something.
+func (r RadixTree) SetWithExpiry(key, value []byte, expiresAt time.Time) bool {
+	if expiresAt.IsZero() {
+		return r.set(key, value, 0)
+	}
+	return r.set(key, value, expiresAt.UnixMilli())
+}
+
+func (r RadixTree) set(key, value []byte, expiresAt int64) bool {
 	defer runtime.KeepAlive(key)
 	keepAlive, keyC := shortTermByteSlice(key)
 	defer runtime.KeepAlive(keepAlive)
@@ -158,7 +225,204 @@ func (r RadixTree) Set(key, value []byte) bool {
 	return Set_with_stack_value(
 		r.cObj, keyC,
 		SwigcptrUint8_t(unsafe.Pointer(ptr)),
-		int64(len(value)))
+		int64(len(value)), expiresAt)
+}
+
+// SetCondition defines the condition a key must meet to be set by SetIf.
+type SetCondition int
+
+const (
+	// SetAlways sets the key whatever it is.
+	SetAlways SetCondition = RADIX_SET_ALWAYS
+
+	// SetIfAbsent sets the key if it does not exist.
+	SetIfAbsent SetCondition = RADIX_SET_IF_ABSENT
+
+	// SetIfExists sets the key if it exists.
+	SetIfExists SetCondition = RADIX_SET_IF_EXISTS
+
+	// SetIfValue sets the key if its value is the expected value.
+	SetIfValue SetCondition = RADIX_SET_IF_VALUE
+
+	// SetIfVersion sets the key if its version is the expected version.
+	SetIfVersion SetCondition = RADIX_SET_IF_VERSION
+
+	// SetIfFence sets the key if the expected version, which is a fencing token, is at least the highest token the
+	// key was set with. The tokens are kept even after the key is deleted, and are saved with the tree.
+	SetIfFence SetCondition = RADIX_SET_IF_FENCE
+)
+
+// SetIf is used to atomically set a key if it meets the condition. The expected value is used by SetIfValue and the
+// expected version is used by SetIfVersion and SetIfFence. A zero expiry time means the key never expires. Returns the
+// version of the new value, or 0 if the condition was not met.
+func (r RadixTree) SetIf(
+	key, value []byte, expiresAt time.Time, condition SetCondition,
+	expectedValue []byte, expectedVersion uint64,
+) uint64 {
+	defer runtime.KeepAlive(key)
+	keepAlive, keyC := shortTermByteSlice(key)
+	defer runtime.KeepAlive(keepAlive)
+
+	defer runtime.KeepAlive(expectedValue)
+	expectedKeepAlive, expectedC := shortTermByteSlice(expectedValue)
+	defer runtime.KeepAlive(expectedKeepAlive)
+
+	defer runtime.KeepAlive(value)
+	var ptr *byte
+	if len(value) != 0 {
+		ptr = &value[0]
+	}
+	var expiresAtMs int64
+	if !expiresAt.IsZero() {
+		expiresAtMs = expiresAt.UnixMilli()
+	}
+	return Set_if_with_stack_value(
+		r.cObj, keyC,
+		SwigcptrUint8_t(unsafe.Pointer(ptr)),
+		int64(len(value)), expiresAtMs,
+		int(condition), expectedC, expectedVersion)
+}
+
+var (
+	// ErrNotANumber is returned when a value being incremented is not a number.
+	ErrNotANumber = errors.New("The value is not a number.")
+
+	// ErrNumberOverflow is returned when an increment would overflow.
+	ErrNumberOverflow = errors.New("The result of the increment is out of range.")
+)
+
+type radixTreeIncrementResultGo struct {
+	value     byteSlice
+	expiresAt int64
+	status    int32
+}
+
+// Converts an increment result to Go and frees it.
+func incrementResult(possibleResult RadixTreeIncrementResult) (value []byte, expiresAt time.Time, err error) {
+	result := *(*radixTreeIncrementResultGo)(unsafe.Pointer(possibleResult.Swigcptr()))
+	Swig_free(possibleResult.Swigcptr())
+	switch result.status {
+	case RADIX_INCREMENT_NOT_A_NUMBER:
+		return nil, time.Time{}, ErrNotANumber
+	case RADIX_INCREMENT_OVERFLOW:
+		return nil, time.Time{}, ErrNumberOverflow
+	}
+
+	value = make([]byte, result.value.length)
+	copy(value, *(*[]byte)(unsafe.Pointer(&reflect.SliceHeader{
+		Data: result.value.value,
+		Len:  int(result.value.length),
+		Cap:  int(result.value.length),
+	})))
+	Swig_free(result.value.value)
+	if result.expiresAt != 0 {
+		expiresAt = time.UnixMilli(result.expiresAt)
+	}
+	return value, expiresAt, nil
+}
+
+// Increment is used to atomically add to a keys value as a 64-bit integer. Keys which do not exist count as 0.
+// Returns the new value as it is stored along with when the key expires, which the increment does not change.
+func (r RadixTree) Increment(key []byte, delta int64) (value []byte, expiresAt time.Time, err error) {
+	defer runtime.KeepAlive(key)
+	keepAlive, cVal := shortTermByteSlice(key)
+	defer runtime.KeepAlive(keepAlive)
+
+	return incrementResult(r.cObj.Increment(cVal, delta))
+}
+
+// IncrementFloat is used to atomically add to a keys value as a float. Keys which do not exist count as 0.
+// Returns the new value as it is stored along with when the key expires, which the increment does not change.
+func (r RadixTree) IncrementFloat(key []byte, delta float64) (value []byte, expiresAt time.Time, err error) {
+	defer runtime.KeepAlive(key)
+	keepAlive, cVal := shortTermByteSlice(key)
+	defer runtime.KeepAlive(keepAlive)
+
+	return incrementResult(r.cObj.Increment_float(cVal, delta))
+}
+
+// ExpiresAt is used to get when a key expires. The time is zero if the key never expires, and ok is false if
+// the key does not exist.
+func (r RadixTree) ExpiresAt(key []byte) (expiresAt time.Time, ok bool) {
+	defer runtime.KeepAlive(key)
+	keepAlive, cVal := shortTermByteSlice(key)
+	defer runtime.KeepAlive(keepAlive)
+
+	ms := r.cObj.Get_expiry(cVal)
+	if ms == -1 {
+		return time.Time{}, false
+	}
+	if ms == 0 {
+		return time.Time{}, true
+	}
+	return time.UnixMilli(ms), true
+}
+
+// ExpireAt is used to set when a key expires. A zero time makes the key never expire. Returns true if the key exists.
+func (r RadixTree) ExpireAt(key []byte, expiresAt time.Time) bool {
+	defer runtime.KeepAlive(key)
+	keepAlive, cVal := shortTermByteSlice(key)
+	defer runtime.KeepAlive(keepAlive)
+
+	var ms int64
+	if !expiresAt.IsZero() {
+		ms = expiresAt.UnixMilli()
+	}
+	return r.cObj.Expire_at(cVal, ms)
+}
+
+// Persist is used to make a key never expire. Returns true if the key exists.
+func (r RadixTree) Persist(key []byte) bool {
+	return r.ExpireAt(key, time.Time{})
+}
+
+// SweepExpired is used to remove up to max keys which have expired. Returns the number of keys removed.
+func (r RadixTree) SweepExpired(max int) int {
+	return int(r.cObj.Sweep_expired(int64(max)))
+}
+
+// EvictionPolicy defines how a key is picked to be evicted from a tree which is using too much memory.
+type EvictionPolicy int
+
+const (
+	// EvictAllKeysLRU picks the key which was used least recently out of a sample of keys.
+	EvictAllKeysLRU EvictionPolicy = RADIX_EVICT_ALLKEYS_LRU
+
+	// EvictAllKeysLFU picks the key which was used least frequently out of a sample of keys.
+	EvictAllKeysLFU EvictionPolicy = RADIX_EVICT_ALLKEYS_LFU
+
+	// EvictVolatileTTL picks the key which expires soonest. Keys which never expire are not picked.
+	EvictVolatileTTL EvictionPolicy = RADIX_EVICT_VOLATILE_TTL
+)
+
+// EntrySize is used to get the number of bytes a key and its value use in a tree.
+func EntrySize(keyLen, valueLen int) uint64 {
+	return uint64(Radix_entry_size(int64(keyLen), int64(valueLen)))
+}
+
+// MemoryUsage is used to get the number of bytes used by the keys and values in the tree, along with their nodes.
+func (r RadixTree) MemoryUsage() uint64 {
+	return uint64(r.cObj.Memory_usage())
+}
+
+// PickEviction is used to pick a key to evict with the policy specified. The key is not removed from the tree.
+// Returns nil if there is nothing to evict.
+func (r RadixTree) PickEviction(policy EvictionPolicy) []byte {
+	possibleKey := r.cObj.Pick_eviction(int(policy))
+	if possibleKey == nil || possibleKey.Swigcptr() == 0 {
+		return nil
+	}
+
+	byteSlice := *(*byteSlice)(unsafe.Pointer(possibleKey.Swigcptr()))
+	key := make([]byte, byteSlice.length)
+	copy(key, *(*[]byte)(unsafe.Pointer(&reflect.SliceHeader{
+		Data: byteSlice.value,
+		Len:  int(byteSlice.length),
+		Cap:  int(byteSlice.length),
+	})))
+	Swig_free(possibleKey.Swigcptr())
+	Swig_free(byteSlice.value)
+	return key
 }
 
 func (r RadixTree) DeleteKey(key []byte) bool {
@@ -180,3 +444,119 @@ func (r RadixTree) DeletePrefix(prefix []byte) uint64 {
 func (r RadixTree) FreeTree() {
 	r.cObj.Free_tree()
 }
+
+// Snapshot is a frozen point in time view of a tree. The tree can still be written to whilst a snapshot
+// exists, but only one snapshot of a tree can exist at a time, so Release must be called when it is done with.
+type Snapshot struct {
+	tree RadixTree
+	node RadixTreeNode
+}
+
+// Snapshot is used to take a snapshot of the tree. If a snapshot of the tree already exists, this blocks
+// until it is released.
+func (r RadixTree) Snapshot() Snapshot {
+	return Snapshot{tree: r, node: r.cObj.Freeze()}
+}
+
+// Release is used to release the snapshot and free anything which was only being kept for it.
+func (s Snapshot) Release() {
+	s.tree.cObj.Unfreeze()
+}
+
+// Transaction is a list of operations which are run atomically by Exec. The keys and values are copied when they
+// are added. Free must be called when it is done with.
+type Transaction struct {
+	cObj RadixTreeTransaction
+}
+
+// NewTransaction is used to make an empty transaction.
+func NewTransaction() Transaction {
+	return Transaction{cObj: NewRadixTreeTransaction()}
+}
+
+// Watch is used to make the transaction only run if the key still has the version specified. A version of 0 means
+// the key must not exist.
+func (t Transaction) Watch(key []byte, version uint64) {
+	defer runtime.KeepAlive(key)
+	keepAlive, cVal := shortTermByteSlice(key)
+	defer runtime.KeepAlive(keepAlive)
+
+	t.cObj.Watch(cVal, version)
+}
+
+// Get is used to add getting a key to the transaction.
+func (t Transaction) Get(key []byte) {
+	defer runtime.KeepAlive(key)
+	keepAlive, cVal := shortTermByteSlice(key)
+	defer runtime.KeepAlive(keepAlive)
+
+	t.cObj.Get(cVal)
+}
+
+// Set is used to add setting a key to the transaction. A zero time means the key never expires.
+func (t Transaction) Set(key, value []byte, expiresAt time.Time) {
+	defer runtime.KeepAlive(key)
+	keepAlive, keyC := shortTermByteSlice(key)
+	defer runtime.KeepAlive(keepAlive)
+
+	defer runtime.KeepAlive(value)
+	valueKeepAlive, valueC := shortTermByteSlice(value)
+	defer runtime.KeepAlive(valueKeepAlive)
+
+	var ms int64
+	if !expiresAt.IsZero() {
+		ms = expiresAt.UnixMilli()
+	}
+	t.cObj.Set(keyC, valueC, ms)
+}
+
+// DeleteKey is used to add deleting a key to the transaction.
+func (t Transaction) DeleteKey(key []byte) {
+	defer runtime.KeepAlive(key)
+	keepAlive, cVal := shortTermByteSlice(key)
+	defer runtime.KeepAlive(keepAlive)
+
+	t.cObj.Delete_key(cVal)
+}
+
+// DeletePrefix is used to add deleting everything starting with the prefix to the transaction.
+func (t Transaction) DeletePrefix(prefix []byte) {
+	defer runtime.KeepAlive(prefix)
+	keepAlive, cVal := shortTermByteSlice(prefix)
+	defer runtime.KeepAlive(keepAlive)
+
+	t.cObj.Delete_prefix(cVal)
+}
+
+// Result is used to get the result of an operation once the transaction has run. This is 1 if a set overwrote
+// something or a delete deleted something (0 if not), or the number of nodes a prefix delete removed.
+func (t Transaction) Result(index int) uint64 {
+	return uint64(t.cObj.Result(int64(index)))
+}
+
+// Value is used to get the value a get found once the transaction has run, or nil if the key was not found. The
+// value is only valid until the transaction is freed.
+func (t Transaction) Value(index int) []byte {
+	possibleValue := t.cObj.Result_value(int64(index))
+	if possibleValue == nil || possibleValue.Swigcptr() == 0 {
+		return nil
+	}
+
+	byteSlice := *(*byteSlice)(unsafe.Pointer(possibleValue.Swigcptr()))
+	return *(*[]byte)(unsafe.Pointer(&reflect.SliceHeader{
+		Data: byteSlice.value,
+		Len:  int(byteSlice.length),
+		Cap:  int(byteSlice.length),
+	}))
+}
+
+// Free is used to free the transaction.
+func (t Transaction) Free() {
+	DeleteRadixTreeTransaction(t.cObj)
+}
+
+// Exec is used to run the operations in the transaction atomically, in the order they were added. Returns false
+// without running anything if a watched key does not have the version it was watched with.
+func (r RadixTree) Exec(t Transaction) bool {
+	return r.cObj.Exec(t.cObj)
+}
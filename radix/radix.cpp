@@ -5,12 +5,50 @@
 #include <cinttypes>
 #include <deque>
 #include <utility>
-#include <fstream>
+#include <cstring>
+#include <algorithm>
+#include <chrono>
+#include <cerrno>
+#include <climits>
+#include <cmath>
+#include <cstdio>
+#include <random>
 #include "byteslice.h"
-#include "endianness.h"
+
+// Gets the current time in milliseconds since the Unix epoch.
+long long radix_now_ms() {
+    return std::chrono::duration_cast<std::chrono::milliseconds>(
+        std::chrono::system_clock::now().time_since_epoch()).count();
+}
+
+// Checks if the contents of a node have expired.
+static inline bool content_expired(RadixTreeNode* node, long long now) {
+    return node->expires_at != 0 && node->expires_at <= now;
+}
+
+// Gets the number of bytes a key and its value use in the tree. This includes the node they are in.
+size_t radix_entry_size(size_t key_len, size_t value_len) {
+    return sizeof(RadixTreeNode) + sizeof(ByteSlice) + key_len + value_len;
+}
+
+// Marks the contents of a node as used. This is safe to call whilst the tree is read locked.
+static inline void touch_node(RadixTreeNode* node, long long now) {
+    __atomic_store_n(&node->accessed_at, now, __ATOMIC_RELAXED);
+    if (__atomic_load_n(&node->access_count, __ATOMIC_RELAXED) != UINT_MAX) {
+        __atomic_fetch_add(&node->access_count, 1, __ATOMIC_RELAXED);
+    }
+}
+
+// Gets the number of bytes used by a branch. The key length is the length of the key before the branch.
+static size_t branch_memory(RadixTreeNode* branch, size_t key_len) {
+    key_len += branch->key.length;
+    size_t total = branch->content ? radix_entry_size(key_len, branch->content->length) : 0;
+    for (size_t i = 0; i < branch->children_len; i++) total += branch_memory(branch->children[i], key_len);
+    return total;
+}
 
 // Frees a nodes children. The amount of children killed will be the result.
-inline size_t free_node_children(RadixTreeNode** nodes, size_t nodes_len) {
+size_t free_node_children(RadixTreeNode** nodes, size_t nodes_len) {
     // Defines the number of killed children.
     size_t killed_children{};
 
@@ -75,6 +113,23 @@ inline size_t free_node_children(RadixTreeNode** nodes, size_t nodes_len) {
     return killed_children;
 }
 
+// Counts the nodes and all of their children.
+size_t count_node_children(RadixTreeNode** nodes, size_t nodes_len) {
+    size_t count{};
+    auto stack = std::deque<std::pair<RadixTreeNode**, size_t>>();
+    stack.emplace_back(nodes, nodes_len);
+    while (!stack.empty()) {
+        auto next = stack.back();
+        stack.pop_back();
+        count += next.second;
+        for (size_t i = 0; i < next.second; i++) {
+            auto child = next.first[i];
+            if (child->children_len != 0) stack.emplace_back(child->children, child->children_len);
+        }
+    }
+    return count;
+}
+
 // Merges a child radix branch into a parent.
 inline void merge_radix_branches(RadixTreeNode* parent, RadixTreeNode* child) {
     // Concat the key and GC both the key of the other child and last parent.
@@ -92,168 +147,301 @@ inline void merge_radix_branches(RadixTreeNode* parent, RadixTreeNode* child) {
     parent->children = child->children;
     parent->children_len = child->children_len;
     parent->content = child->content;
+    parent->expires_at = child->expires_at;
+    parent->accessed_at = child->accessed_at;
+    parent->access_count = child->access_count;
+    parent->version = child->version;
 
     // Copy over the key.
     parent->key.length = key_len;
     parent->key.value = concat;
 }
 
-RadixTreeBranchWalker::RadixTreeBranchWalker(RadixTreeNode* node, ByteSlice full_key, size_t key_chunk, std::shared_mutex* lock) {
+RadixTreeBranchWalker::RadixTreeBranchWalker(RadixTreeNode* node, ByteSlice node_key, ByteSlice start, ByteSlice end, bool reverse, std::shared_mutex* lock, long long now) {
+    // Set the walk options.
+    this->reverse = reverse;
+    this->lock = lock;
+    this->now = now;
+
     // Handle a null node.
     if (!node) {
         unlocked = true;
         return;
     }
+    unlocked = false;
 
-    // Insert the lock.
-    this->lock = lock;
+    // Copy the keys and start at the node.
+    this->start.assign((const char*)start.value, start.length);
+    this->end.assign((const char*)end.value, end.length);
+    key.assign((const char*)node_key.value, node_key.length);
+    push_frame(node);
+}
 
-    // Create a chunk of the key.
-    auto* a = (uint8_t*)malloc(key_chunk);
-    if (key_chunk > full_key.length) {
-        // Copy all the parts involved.
-        memcpy(a, full_key.value, full_key.length);
-        auto remainder_len = key_chunk - full_key.length;
-        memcpy(&a[full_key.length], &node->key.value[remainder_len], remainder_len);
-    } else {
-        // Copy the key.
-        memcpy(a, full_key.value, key_chunk);
-    }
-    ByteSlice s{};
-    s.value = a;
-    s.length = key_chunk;
+void RadixTreeBranchWalker::push_frame(RadixTreeNode* node) {
+    frames.push_back(Frame{node, key.size(), reverse ? node->children_len : 0, false});
+}
+
+// Checks if every key in the branch for the current key is outside of the range.
+bool RadixTreeBranchWalker::branch_out_of_range() {
+    // Everything in the branch starts with the key, so the branch is below the start if the key is
+    // below it and is not a prefix of it.
+    if (key < start && start.compare(0, key.size(), key) != 0) return true;
 
-    // Add the child.
-    add_node_child(node, s);
+    // Everything in the branch is at least the key, so the branch is above the range if the key is.
+    return !end.empty() && key >= end;
 }
 
 // Walk through the radix tree. A null pointer means you have reached the end.
 RadixTreeWalkValue* RadixTreeBranchWalker::next() {
-    for (;;) {
-        // If the nodes count is 0, unlock the radix tree and return null.
-        if (nodes.empty()) {
-            if (!unlocked) {
-                lock->unlock_shared();
-                unlocked = true;
-            }
-            return nullptr;
-        }
-
-        // Get the last child.
-        RadixTreeNode* last_child = nodes.back();
-
-        // If the childs value isn't read, we will do that.
-        if (!childs_value_read) {
-            // We're about to read it, we don't want to worry about this child again.
-            childs_value_read = true;
-
-            // Check if there is content.
-            if (last_child->content) {
-                // There is! Return this now.
-                auto key = get_current_key();
-                auto value = copy_byte_slice_stack(*last_child->content);
+    while (!frames.empty()) {
+        // Get the node we are on and trim the key back to it.
+        auto& frame = frames.back();
+        auto current_node = frame.node;
+        key.resize(frame.key_len);
+
+        // Going forwards, the content comes before the children. Going backwards, it comes after them.
+        bool children_left = reverse ? frame.child != 0 : frame.child != current_node->children_len;
+        if (!frame.content_read && (!reverse || !children_left)) {
+            // We're about to read it, we don't want to worry about this content again.
+            frame.content_read = true;
+            if (!current_node->content || content_expired(current_node, now)) continue;
+
+            // Everything after this is in order, so we are done if this is past the range.
+            if (reverse ? key < start : !end.empty() && key >= end) break;
+
+            // Return the content if it is in the range.
+            if (key >= start && (end.empty() || key < end)) {
+                touch_node(current_node, now);
                 auto v = (RadixTreeWalkValue*)malloc(sizeof(RadixTreeWalkValue));
-                v->key = key;
-                v->value = value;
+                v->key.length = key.size();
+                v->key.value = (uint8_t*)malloc(key.size());
+                memcpy(v->key.value, key.data(), key.size());
+                v->value = copy_byte_slice_stack(*current_node->content);
                 return v;
             }
+            continue;
         }
 
-        // Get the child index.
-        auto child_index = child_indexes.back();
-
-        // If the child index is equal to the child count, we're done with this node.
-        if (child_index == last_child->children_len) {
-            remove_node_child();
+        // If there are no children left, we're done with this node.
+        if (!children_left) {
+            frames.pop_back();
             continue;
         }
 
-        // Get the nodes child.
-        add_node_child(last_child->children[child_index], last_child->key);
-        childs_value_read = false;
+        // Go down the next child if anything in it is in the range.
+        auto child = current_node->children[reverse ? --frame.child : frame.child++];
+        key.append((const char*)child->key.value, child->key.length);
+        if (!branch_out_of_range()) push_frame(child);
     }
-}
 
-void RadixTreeBranchWalker::add_node_child(RadixTreeNode* node, ByteSlice key_chunk) {
-    nodes.push_back(node);
-    key_chunks.push_back(key_chunk);
-    child_indexes.push_back(0);
+    // We are done, so unlock the tree.
+    close();
+    return nullptr;
 }
 
-void RadixTreeBranchWalker::remove_node_child() {
-    nodes.pop_back();
-    key_chunks.pop_back();
-    child_indexes.pop_back();
-    if (!child_indexes.empty()) {
-        // Since we are done with this child, we want to add 1 to the parent.
-        auto back = child_indexes.back();
-        back++;
-        child_indexes.pop_back();
-        child_indexes.push_back(back);
+// Stops the walk. This unlocks the radix tree and frees everything the walker is using.
+void RadixTreeBranchWalker::close() {
+    if (!unlocked) {
+        lock->unlock_shared();
+        unlocked = true;
     }
+    std::vector<Frame>().swap(frames);
+    std::string().swap(key);
+    std::string().swap(start);
+    std::string().swap(end);
 }
 
-ByteSlice RadixTreeBranchWalker::get_current_key() {
-    size_t len{};
-    auto iter = nodes.begin();
-    for (;;) {
-        // If iter is false, break.
-        if (!*iter) break;
+// Gets the first version for a tree. This is based on the time so versions are not reused after a restart.
+static unsigned long long first_version() {
+    return (unsigned long long)radix_now_ms() << 16;
+}
+
+RadixTreeRoot::RadixTreeRoot() {
+    node = (RadixTreeNode*)calloc(1, sizeof(RadixTreeNode));
+    last_version = first_version();
+}
+
+RadixTreeRoot::RadixTreeRoot(RadixTreeNode** nodes, size_t nodes_len) {
+    last_version = first_version();
+    node = (RadixTreeNode*)calloc(1, sizeof(RadixTreeNode));
+    node->children = nodes;
+    node->children_len = nodes_len;
+}
 
-        // Get the key length.
-        len += (*iter)->key.length;
+// Checks if a node is shared with a snapshot. Frozen nodes must be thawed before they are modified.
+bool RadixTreeRoot::un_thread_safe_is_frozen(RadixTreeNode* n) {
+    return frozen && n->generation <= frozen_generation;
+}
 
-        // Get the next value.
-        iter++;
+// Gets a node which is safe to modify. If the node is frozen, a copy is returned and the original is kept
+// until the snapshot is released. The caller is responsible for replacing the node with the copy.
+RadixTreeNode* RadixTreeRoot::un_thread_safe_thaw(RadixTreeNode* n) {
+    if (!un_thread_safe_is_frozen(n)) return n;
+
+    // Copy the node and everything it owns. The children themselves are still shared.
+    auto cpy = (RadixTreeNode*)malloc(sizeof(RadixTreeNode));
+    memcpy(cpy, n, sizeof(RadixTreeNode));
+    cpy->generation = generation;
+    cpy->key = copy_byte_slice_stack(n->key);
+    cpy->content = copy_byte_slice_heap(n->content);
+    if (n->children_len != 0) {
+        cpy->children = (RadixTreeNode**)malloc(sizeof(RadixTreeNode*) * n->children_len); // NOLINT
+        memcpy(cpy->children, n->children, sizeof(RadixTreeNode*) * n->children_len);
     }
-    auto* data = (uint8_t*)malloc(len);
-    size_t done{};
-    iter = nodes.begin();
-    for (;;) {
-        // If iter is false, break.
-        if (!*iter) break;
 
-        // Get the key.
-        auto key = (*iter)->key;
+    // Retire the original and return the copy.
+    retired_nodes.push_back(n);
+    return cpy;
+}
+
+// Thaws every node which a mutation of this key could modify. This is the path to the key, along with
+// the child which partially matches the end of the key (since it may be split or cut).
+void RadixTreeRoot::un_thread_safe_thaw_path(ByteSlice key) {
+    node = un_thread_safe_thaw(node);
+    auto current_node = node;
+    size_t key_index = 0;
+    while (key_index < key.length) {
+        // Find the child which starts with the next byte of the key. There can only be one of these.
+        RadixTreeNode* next{};
+        for (size_t i = 0; i < current_node->children_len; i++) {
+            auto child = current_node->children[i];
+            if (child->key.value[0] != key.value[key_index]) continue;
+
+            // Thaw the child and check if we should go down it.
+            child = un_thread_safe_thaw(child);
+            current_node->children[i] = child;
+            auto remainder_len = key.length - key_index;
+            if (remainder_len > child->key.length &&
+                memcmp(&key.value[key_index], child->key.value, child->key.length) == 0) next = child;
+            break;
+        }
+        if (!next) return;
 
-        // Copy the memory.
-        memcpy(&data[done], key.value, key.length);
+        // Go down the child.
+        key_index += next->key.length;
+        current_node = next;
+    }
+}
 
-        // Add to done.
-        done += key.length;
+// Removes the child at the index from the parent. If this leaves the parent as a router with only one child,
+// the child is merged into the parent. The parent must be thawed.
+void RadixTreeRoot::un_thread_safe_remove_child(RadixTreeNode* parent, size_t index) {
+    // Remove the child from the children array whilst keeping the order.
+    parent->children_len--;
+    if (parent->children_len == 0) {
+        free(parent->children);
+        parent->children = nullptr;
+    } else {
+        memmove(&parent->children[index], &parent->children[index + 1],
+            sizeof(RadixTreeNode*) * (parent->children_len - index)); // NOLINT
+    }
 
-        // Get the next value.
-        iter++;
+    // Check if there's just one other child in the parent and no content. If so, merge them.
+    if (parent->children_len == 1 && !parent->content && parent != node) {
+        auto other_child = un_thread_safe_thaw(parent->children[0]);
+        merge_radix_branches(parent, other_child);
+        free(other_child);
     }
-    ByteSlice s{};
-    s.length = len;
-    s.value = data;
-    return s;
 }
 
-RadixTreeRoot::RadixTreeRoot() {
-    node = (RadixTreeNode*)calloc(1, sizeof(RadixTreeNode));
+// Frees a branch which has been cut from the tree. Returns the number of nodes in the branch.
+static size_t free_branch(RadixTreeNode* branch) {
+    auto children = branch->children;
+    auto children_len = branch->children_len;
+    free(branch->key.value);
+    if (branch->content) {
+        free(branch->content->value);
+        free(branch->content);
+    }
+    free(branch);
+    return 1 + free_node_children(children, children_len);
 }
 
-RadixTreeRoot::RadixTreeRoot(RadixTreeNode** nodes, size_t nodes_len) {
-    node = (RadixTreeNode*)calloc(1, sizeof(RadixTreeNode));
-    node->children = nodes;
-    node->children_len = nodes_len;
+// Keeps a branch which has been cut from the tree until the snapshot is released if there is one, since the branch
+// may be shared with it. Returns false if there is no snapshot, in which case the branch should be freed once the
+// tree is unlocked. Otherwise, the number of nodes in the branch is set.
+bool RadixTreeRoot::un_thread_safe_retire_branch(RadixTreeNode* branch, size_t& count) {
+    if (!frozen) return false;
+
+    // Count the nodes whilst we still hold the lock, since the branch is freed when the snapshot is released.
+    count = 1 + count_node_children(branch->children, branch->children_len);
+    retired_branches.push_back(branch);
+    return true;
+}
+
+// Frees a branch which has been cut from the tree and then unlocks the tree. Returns the number of nodes in the branch.
+size_t RadixTreeRoot::un_thread_safe_free_branch_and_unlock(RadixTreeNode* branch) {
+    size_t count;
+    if (un_thread_safe_retire_branch(branch, count)) {
+        lock.unlock();
+        return count;
+    }
+
+    // We can free this outside the lock since nothing else can reach it.
+    lock.unlock();
+    return free_branch(branch);
 }
 
 void RadixTreeRoot::free_tree() {
     lock.lock();
-    auto children = node->children;
-    auto children_len = node->children_len;
-    auto content = node->content;
-    if (content) {
-        free(content->value);
-        free(content);
-    }
-    free(node);
+    auto old_node = node;
     node = (RadixTreeNode*)calloc(1, sizeof(RadixTreeNode));
+    node->generation = generation;
+    expiries.clear();
+    fences.clear();
+    memory = 0;
+    un_thread_safe_free_branch_and_unlock(old_node);
+}
+
+// Freezes the tree for a snapshot and returns the base node of it. Until unfreeze is called, nothing reachable
+// from the returned node will be modified or freed, but writes to the tree carry on as normal by copying any
+// node they need to modify. If the tree is already frozen, this blocks until it is unfrozen.
+RadixTreeNode* RadixTreeRoot::freeze() {
+    lock.lock();
+    while (frozen) unfrozen.wait(lock);
+    frozen = true;
+    frozen_generation = generation;
+    generation++;
+    frozen_fences = fences;
+    auto frozen_node = node;
+    lock.unlock();
+    return frozen_node;
+}
+
+// Releases the snapshot and frees everything that was only being kept for it.
+void RadixTreeRoot::unfreeze() {
+    // Take everything which was retired and unfreeze the tree.
+    lock.lock();
+    frozen = false;
+    frozen_fences.clear();
+    auto nodes = std::move(retired_nodes);
+    retired_nodes.clear();
+    auto branches = std::move(retired_branches);
+    retired_branches.clear();
     lock.unlock();
-    free_node_children(children, children_len);
+    unfrozen.notify_one();
+
+    // Free the nodes which were replaced by copies. Their children are owned by the copies.
+    for (auto retired : nodes) {
+        free(retired->key.value);
+        if (retired->content) {
+            free(retired->content->value);
+            free(retired->content);
+        }
+        free(retired->children);
+        free(retired);
+    }
+
+    // Free the branches which were cut from the tree.
+    for (auto branch : branches) {
+        free_node_children(branch->children, branch->children_len);
+        free(branch->key.value);
+        if (branch->content) {
+            free(branch->content->value);
+            free(branch->content);
+        }
+        free(branch);
+    }
 }
 
 ByteSlice* RadixTreeRoot::get(ByteSlice key) {
@@ -267,26 +455,70 @@ ByteSlice* RadixTreeRoot::get(ByteSlice key) {
         lock.unlock_shared();
         return nullptr;
     }
+    auto now = radix_now_ms();
+    if (content_expired(result.node, now)) {
+        // This has expired and is just waiting to be swept.
+        lock.unlock_shared();
+        return nullptr;
+    }
 
     // Copy the value and return.
+    touch_node(result.node, now);
     auto* cpy = copy_byte_slice_heap(result.node->content);
     lock.unlock_shared();
     return cpy;
 }
 
-// Walk items starting with a prefix.
+// Gets a copy of a keys value along with its version. Returns a null pointer if the key does not exist.
+RadixTreeVersionedValue* RadixTreeRoot::get_versioned(ByteSlice key) {
+    lock.lock_shared();
+    auto result = un_thread_safe_get_node(key, false);
+    auto now = radix_now_ms();
+    if (result.key_index != key.length || !result.node->content || content_expired(result.node, now)) {
+        lock.unlock_shared();
+        return nullptr;
+    }
+    touch_node(result.node, now);
+    auto v = (RadixTreeVersionedValue*)malloc(sizeof(RadixTreeVersionedValue));
+    v->value = copy_byte_slice_stack(*result.node->content);
+    v->version = result.node->version;
+    lock.unlock_shared();
+    return v;
+}
+
+// Walk items starting with a prefix in byte order.
 RadixTreeBranchWalker RadixTreeRoot::walk_prefix(ByteSlice key) {
     // Acquire the shared mutex lock. This is unlocked by the walker.
     lock.lock_shared();
 
     // Get the node.
+    ByteSlice empty{};
     auto result = un_thread_safe_get_node(key, true);
     if (key.length > result.key_index) {
         // Null node.
         lock.unlock_shared();
-        return RadixTreeBranchWalker(nullptr, key, 0, nullptr);
+        return RadixTreeBranchWalker(nullptr, empty, empty, empty, false, nullptr, 0);
+    }
+
+    // The node key may go past the prefix, so get the whole key of the node.
+    std::string node_key;
+    if (result.node != node) {
+        node_key.assign((const char*)key.value, result.key_index - result.node->key.length);
+        node_key.append((const char*)result.node->key.value, result.node->key.length);
     }
-    return RadixTreeBranchWalker(result.node, key, result.key_index, &lock);
+    ByteSlice node_key_slice{};
+    node_key_slice.value = (uint8_t*)node_key.data();
+    node_key_slice.length = node_key.size();
+    return RadixTreeBranchWalker(result.node, node_key_slice, empty, empty, false, &lock, radix_now_ms());
+}
+
+// Walk items from the start key (inclusive) to the end key (exclusive) in byte order, or descending byte order
+// if reverse is true. An empty end key means there is no end.
+RadixTreeBranchWalker RadixTreeRoot::walk_range(ByteSlice start, ByteSlice end, bool reverse) {
+    // Acquire the shared mutex lock. This is unlocked by the walker.
+    lock.lock_shared();
+    ByteSlice empty{};
+    return RadixTreeBranchWalker(node, empty, start, end, reverse, &lock, radix_now_ms());
 }
 
 // Split a node at index. The remainder after the index will become its own child,
@@ -306,6 +538,9 @@ RadixTreeNode* split_node(size_t split_index, RadixTreeNode* node, RadixTreeNode
     auto key_remainder = (uint8_t*)malloc(remainder_len);
     memcpy(key_remainder, &init_node_key.value[split_index], remainder_len);
 
+    // Free the old key since it has been copied into both.
+    free(init_node_key.value);
+
     // Create a new child for the current contents of the node.
     auto new_child = (RadixTreeNode*)malloc(sizeof(RadixTreeNode));
     memcpy(new_child, node, sizeof(RadixTreeNode));
@@ -316,16 +551,22 @@ RadixTreeNode* split_node(size_t split_index, RadixTreeNode* node, RadixTreeNode
 
     // Null the content of the node since this basically just works as a router now.
     node->content = nullptr;
+    node->expires_at = 0;
 
     // Allocate for a place for the 1 or 2 children.
     auto children_len = other_child ? 2 : 1;
     auto children = (RadixTreeNode**)malloc(children_len * sizeof(RadixTreeNode*)); // NOLINT
 
-    // Add the node split as a child.
+    // Add the node split as a child. If there's another child, we'll add it, keeping the children in byte order.
     *children = new_child;
-
-    // If there's another child, we'll add it.
-    if (other_child) children[1] = other_child;
+    if (other_child) {
+        if (other_child->key.value[0] < new_child->key.value[0]) {
+            children[0] = other_child;
+            children[1] = new_child;
+        } else {
+            children[1] = other_child;
+        }
+    }
 
     // Set the nodes children.
     node->children = children;
@@ -339,22 +580,109 @@ RadixTreeNode* split_node(size_t split_index, RadixTreeNode* node, RadixTreeNode
     return new_child;
 }
 
-// Sets a keys value in the tree. Returns true if it overwrote something.
-// The value will not be copied, but the key will. Free your key, do NOT free your value!
-bool RadixTreeRoot::set(ByteSlice key, ByteSlice value) {
+// Sorts the children of a node into byte order. Siblings never start with the same byte, so this only
+// needs to compare the first byte of each key.
+void sort_node_children(RadixTreeNode* node) {
+    std::sort(node->children, node->children + node->children_len, [](RadixTreeNode* a, RadixTreeNode* b) {
+        return a->key.value[0] < b->key.value[0];
+    });
+}
+
+// Sets a keys value in the tree. If expires_at is not zero, the key expires at that time in milliseconds since the
+// Unix epoch. Returns true if it overwrote something. The value will not be copied, but the key will. Free your key,
+// do NOT free your value!
+bool RadixTreeRoot::set(ByteSlice key, ByteSlice value, long long expires_at) {
+    // Acquire the write lock.
+    lock.lock();
+
+    // If there is a snapshot, make sure we are not going to modify anything in it.
+    if (frozen) un_thread_safe_thaw_path(key);
+
+    // Set the key and unlock.
+    auto overwrote = un_thread_safe_set(key, value, expires_at);
+    lock.unlock();
+    return overwrote;
+}
+
+// Sets a keys value if the condition is met. The expected value is used by RADIX_SET_IF_VALUE and the expected
+// version is used by RADIX_SET_IF_VERSION. Keys which have expired do not exist. Returns the version of the new
+// value, or 0 if the condition was not met. Either way, the value is owned by the tree, so do NOT free your value!
+unsigned long long RadixTreeRoot::set_if(
+    ByteSlice key, ByteSlice value, long long expires_at, int condition,
+    ByteSlice expected_value, unsigned long long expected_version
+) {
     // Acquire the write lock.
     lock.lock();
 
+    // Get the current content.
+    auto result = un_thread_safe_get_node(key, false);
+    RadixTreeNode* current{};
+    if (result.key_index == key.length && result.node->content && !content_expired(result.node, radix_now_ms())) {
+        current = result.node;
+    }
+
+    // Check the condition.
+    bool ok;
+    switch (condition) {
+    case RADIX_SET_IF_ABSENT:
+        ok = !current;
+        break;
+    case RADIX_SET_IF_EXISTS:
+        ok = current;
+        break;
+    case RADIX_SET_IF_VALUE:
+        ok = current && current->content->length == expected_value.length &&
+            memcmp(current->content->value, expected_value.value, expected_value.length) == 0;
+        break;
+    case RADIX_SET_IF_VERSION:
+        ok = current && current->version == expected_version;
+        break;
+    case RADIX_SET_IF_FENCE: {
+        // The expected version is the fencing token. It must be at least the highest token the key was set with.
+        auto& fence = fences[std::string((const char*)key.value, key.length)];
+        ok = expected_version >= fence;
+        if (ok) fence = expected_version;
+        break;
+    }
+    default:
+        ok = true;
+    }
+    if (!ok) {
+        lock.unlock();
+        free(value.value);
+        return 0;
+    }
+
+    // Set the key and get its version.
+    if (frozen) un_thread_safe_thaw_path(key);
+    un_thread_safe_set(key, value, expires_at);
+    auto version = last_version;
+    lock.unlock();
+    return version;
+}
+
+// Sets a keys value in the tree. Returns true if it overwrote something. The path to the key must be thawed.
+bool RadixTreeRoot::un_thread_safe_set(ByteSlice key, ByteSlice value, long long expires_at) {
     // Get as close to the node as possible.
     auto result = un_thread_safe_get_node(key, false);
     if (result.key_index == key.length) {
-        // It is a strict match. Is this an overwrite?
+        // It is a strict match. Update when it expires.
+        un_thread_safe_index_expiry(key, result.node->expires_at, expires_at);
+        auto old_expires_at = result.node->expires_at;
+        result.node->expires_at = expires_at;
+
+        // Is this an overwrite?
+        auto now = radix_now_ms();
         if (result.node->content) {
-            // Overwrite the contents.
+            // Free the old contents and overwrite them. If they had expired, they don't count.
+            memory += value.length;
+            memory -= result.node->content->length;
+            free(result.node->content->value);
             result.node->content->length = value.length;
             result.node->content->value = value.value;
-            lock.unlock();
-            return true;
+            touch_node(result.node, now);
+            result.node->version = ++last_version;
+            return old_expires_at == 0 || old_expires_at > now;
         }
 
         // Set the contents. This is duplicated from below since if we did it any earlier it'd leak on overwrite.
@@ -362,9 +690,12 @@ bool RadixTreeRoot::set(ByteSlice key, ByteSlice value) {
         value_heap->value = value.value;
         value_heap->length = value.length;
         result.node->content = value_heap;
+        result.node->accessed_at = now;
+        result.node->access_count = 1;
+        result.node->version = ++last_version;
+        memory += radix_entry_size(key.length, value.length);
 
         // Return false since this had no contents, making it just a router at the time.
-        lock.unlock();
         return false;
     }
 
@@ -373,6 +704,14 @@ bool RadixTreeRoot::set(ByteSlice key, ByteSlice value) {
     value_heap->value = value.value;
     value_heap->length = value.length;
 
+    // Get the length of the key which is not in the tree yet.
+    auto remainder_len = key.length - result.key_index;
+
+    // This key is new, so index when it expires and count its memory.
+    un_thread_safe_index_expiry(key, 0, expires_at);
+    memory += radix_entry_size(key.length, value.length);
+    auto now = radix_now_ms();
+
     // Find if there is any keys we can break down.
     for (size_t i = 0; i < result.node->children_len; i++) {
         // Get the child.
@@ -399,38 +738,48 @@ bool RadixTreeRoot::set(ByteSlice key, ByteSlice value) {
         if (common != 0) {
             // Defines the other child. If the bit in common isn't the key, we'll store our content here.
             RadixTreeNode* other_child{};
-            if (common != key.length) {
+            if (common != remainder_len) {
                 // The key isn't the bit in common, this means there'll be a new child for the contents.
                 // Allocate the child here.
-                other_child = (RadixTreeNode*)malloc(sizeof(RadixTreeNode));
-                other_child->children_len = 0;
+                other_child = (RadixTreeNode*)calloc(1, sizeof(RadixTreeNode));
+                other_child->generation = generation;
                 auto other_child_key = ByteSlice{};
-                other_child_key.length = key.length - common;
+                other_child_key.length = remainder_len - common;
                 other_child_key.value = (uint8_t*)malloc(other_child_key.length);
-                memcpy(other_child_key.value, &key.value[common], other_child_key.length);
+                memcpy(other_child_key.value, &key.value[y], other_child_key.length);
                 other_child->key = other_child_key;
                 other_child->content = value_heap;
+                other_child->expires_at = expires_at;
+                other_child->accessed_at = now;
+                other_child->access_count = 1;
+                other_child->version = ++last_version;
             }
 
             // Split the node.
             split_node(common, child, other_child);
-            if (common == key.length) {
+            if (common == remainder_len) {
                 // Since it is common, we want to set the content here.
                 child->content = value_heap;
+                child->expires_at = expires_at;
+                child->accessed_at = now;
+                child->access_count = 1;
+                child->version = ++last_version;
             }
 
-            // Unlock the mutex.
-            lock.unlock();
-
             // Return false since we did not overwrite anything.
             return false;
         }
     }
 
-    // We were not able to optimise any further. Just add to where we are.
+    // We were not able to optimise any further. Just add to where we are, keeping the children in byte order.
     auto** children = (RadixTreeNode**)malloc(sizeof(RadixTreeNode*) * (result.node->children_len + 1)); // NOLINT
-    for (int i = 0; i < result.node->children_len; i++) children[i] = result.node->children[i];
-    auto branch_entry = &children[result.node->children_len];
+    size_t insert_at = 0;
+    auto first_byte = key.value[result.key_index];
+    while (insert_at < result.node->children_len &&
+        result.node->children[insert_at]->key.value[0] < first_byte) insert_at++;
+    for (size_t i = 0; i < insert_at; i++) children[i] = result.node->children[i];
+    for (size_t i = insert_at; i < result.node->children_len; i++) children[i + 1] = result.node->children[i];
+    auto branch_entry = &children[insert_at];
     if (result.node->children_len != 0) {
         // This is definitely memory allocated, we will free it.
         free(result.node->children);
@@ -439,113 +788,106 @@ bool RadixTreeRoot::set(ByteSlice key, ByteSlice value) {
     result.node->children = children;
 
     // Create the remainder key.
-    auto remainder_len = key.length - result.key_index;
     auto* remainder_chunk = (uint8_t*)malloc(remainder_len);
     memcpy(remainder_chunk, &key.value[result.key_index], remainder_len);
 
     // Create the child.
     auto* child = (RadixTreeNode*)calloc(1, sizeof(RadixTreeNode));
+    child->generation = generation;
     ByteSlice key_chunk{};
     key_chunk.length = remainder_len;
     key_chunk.value = remainder_chunk;
     child->key = key_chunk;
     child->content = value_heap;
+    child->expires_at = expires_at;
+    child->accessed_at = now;
+    child->access_count = 1;
+    child->version = ++last_version;
     *branch_entry = child;
 
-    // Unlock and return false.
-    lock.unlock();
+    // Return false since we did not overwrite anything.
     return false;
 }
 
-// Removes items from the tree by prefix.
+// Removes items from the tree by prefix. Returns the number of nodes removed.
 size_t RadixTreeRoot::delete_prefix(ByteSlice key) {
     // Write lock the mutex.
     lock.lock();
 
-    // If the keys length is zero, handle removing content from the base node.
-    if (key.length == 0) {
-        auto children = node->children;
-        auto children_len = node->children_len;
-        node->children_len = 0;
+    // If there is a snapshot, make sure we are not going to modify anything in it.
+    if (frozen) un_thread_safe_thaw_path(key);
+
+    // Cut the branch and free it.
+    bool holder;
+    auto branch = un_thread_safe_cut_prefix(key, holder);
+    if (!branch) {
         lock.unlock();
-        return free_node_children(children, children_len);
+        return 0;
+    }
+    return un_thread_safe_free_branch_and_unlock(branch) - (holder ? 1 : 0);
+}
+
+// Cuts the branch with everything starting with the prefix out of the tree. Returns a null pointer if nothing starts
+// with it. If the prefix is empty, everything is moved to a holder node and holder is set, since the holder node is
+// not part of the tree and should not be counted as removed. The path to the prefix must be thawed.
+RadixTreeNode* RadixTreeRoot::un_thread_safe_cut_prefix(ByteSlice key, bool& holder) {
+    // If the keys length is zero, handle removing everything from the base node.
+    holder = key.length == 0;
+    if (holder) {
+        auto holder_node = (RadixTreeNode*)calloc(1, sizeof(RadixTreeNode));
+        holder_node->children = node->children;
+        holder_node->children_len = node->children_len;
+        holder_node->content = node->content;
+        node->children = nullptr;
+        node->children_len = 0;
+        node->content = nullptr;
+        node->expires_at = 0;
+        expiries.clear();
+        fences.clear();
+        memory = 0;
+        return holder_node;
     }
 
     // Defines the current key index.
     size_t key_index = 0;
 
-    // Defines the child.
-    RadixTreeNode* child;
-
     // Defines the current node.
     RadixTreeNode* current_node = node;
 
     // Loop through the tree children.
     for (;;) {
-        // Go through the nodes.
-        bool outer_continue = false;
-        for (size_t i = 0; i < current_node->children_len; i++) {
-            // Get the child.
-            child = current_node->children[i];
-
-            // Check if the key is a chunk of ours.
-            if (key.length >= key_index + child->key.length) {
-                // Ok, it isn't too long. We can check without accidentally crashing or leaking memory.
-
-                // Check if the key chunk is there.
-                if (memcmp(&key.value[key_index], child->key.value, child->key.length) == 0) {
-                    // Add to the key index.
-                    key_index += child->key.length;
-
-                    // Check if this is the key.
-                    if (key_index == key.length) {
-                        // We matched!
-                        un_thread_safe_cut_branch(node, current_node, child);
-                        lock.unlock();
-                        auto children = child->children;
-                        auto children_len = child->children_len;
-                        free(child);
-                        return 1 + free_node_children(children, children_len);
-                    } else {
-                        // Go back to the start.
-                        current_node = child;
-                        outer_continue = true;
-                        break;
-                    }
-                }
-            } else if (key_index + child->key.length > key.length) {
-                // Check if it starts with anything from the start of key index.
-                auto child_key = child->key;
-                uintptr_t x = 0;
-                auto y = key_index;
-                for (; y < key.length; y++) {
-                    if (x == child_key.length) {
-                        // We don't want a buffer overflow.
-                        break;
-                    }
-                    if (key.value[y] != child_key.value[x]) {
-                        // We are done here with possible node.
-                        break;
-                    }
-                    x++;
-                }
-                if (y == key.length) {
-                    // This is it. We have exhausted the key.
-                    // Cut the branch.
-                    un_thread_safe_cut_branch(node, current_node, child);
-                    lock.unlock();
-                    auto children = child->children;
-                    auto children_len = child->children_len;
-                    free(child);
-                    return 1 + free_node_children(children, children_len);
-                }
+        // Find the child which starts with the next byte of the key.
+        size_t i = 0;
+        for (; i < current_node->children_len; i++) {
+            if (current_node->children[i]->key.value[0] == key.value[key_index]) break;
+        }
+        if (i == current_node->children_len) {
+            // We didn't match.
+            return nullptr;
+        }
+        auto child = current_node->children[i];
+
+        // Check if the rest of the key ends within this child.
+        auto remainder_len = key.length - key_index;
+        if (child->key.length >= remainder_len) {
+            if (memcmp(&key.value[key_index], child->key.value, remainder_len) != 0) {
+                // The child goes somewhere else.
+                return nullptr;
             }
+
+            // This is it. We have exhausted the key, so cut the branch.
+            un_thread_safe_unindex_prefix(key);
+            memory -= branch_memory(child, key_index);
+            un_thread_safe_remove_child(current_node, i);
+            return child;
         }
-        if (outer_continue) continue;
 
-        // We didn't match.
-        lock.unlock();
-        return 0;
+        // Check if the key chunk is there and go down it if so.
+        if (memcmp(&key.value[key_index], child->key.value, child->key.length) != 0) {
+            return nullptr;
+        }
+        key_index += child->key.length;
+        current_node = child;
     }
 }
 
@@ -554,112 +896,527 @@ bool RadixTreeRoot::delete_key(ByteSlice key) {
     // Write lock the mutex.
     lock.lock();
 
-    // If the keys length is zero, handle removing content from the base node.
-    if (key.length == 0) {
-        bool exists = node->content;
-        if (exists) {
-            free(node->content->value);
-            free(node->content);
-            node->content = nullptr;
-        }
-        lock.unlock();
-        return exists;
-    }
+    // If there is a snapshot, make sure we are not going to modify anything in it.
+    if (frozen) un_thread_safe_thaw_path(key);
 
-    // Defines the current key index.
-    size_t key_index = 0;
+    // Delete the key and unlock.
+    auto deleted = un_thread_safe_delete_key(key);
+    lock.unlock();
+    return deleted;
+}
 
-    // Defines the child.
-    RadixTreeNode* child;
+// Removes an item from the tree. Returns true if an item is deleted. The path to the key must be thawed.
+bool RadixTreeRoot::un_thread_safe_delete_key(ByteSlice key) {
+    // Find the node. Make sure this isn't just a router.
+    RadixTreeNode* parent;
+    size_t index;
+    auto found = un_thread_safe_find(key, &parent, &index);
+    if (!found || !found->content) return false;
+
+    // Cut the branch. If the content had expired, it is still removed but doesn't count.
+    bool exists = !content_expired(found, radix_now_ms());
+    memory -= radix_entry_size(key.length, found->content->length);
+    un_thread_safe_index_expiry(key, found->expires_at, 0);
+    fences.erase(std::string((const char*)key.value, key.length));
+    un_thread_safe_cut_branch(parent, index);
+    return exists;
+}
 
-    // Defines the current node.
+// Finds the node which is an exact match for the key, along with its parent and its index in the parent.
+// The parent is null for the base node. Returns a null pointer if there is no node for the key.
+RadixTreeNode* RadixTreeRoot::un_thread_safe_find(ByteSlice key, RadixTreeNode** parent, size_t* index) {
+    *parent = nullptr;
+    *index = 0;
+    size_t key_index = 0;
     RadixTreeNode* current_node = node;
-
-    // Loop through the tree children.
-    for (;;) {
-        // Go through the nodes.
-        bool outer_continue = false;
+    while (key_index < key.length) {
+        // Find the child which is a chunk of the key.
+        RadixTreeNode* next{};
         for (size_t i = 0; i < current_node->children_len; i++) {
-            // Get the child.
-            child = current_node->children[i];
-
-            // Check if the key is a chunk of ours.
-            if (key.length >= key_index + child->key.length) {
-                // Ok, it isn't too long. We can check without accidentally crashing or leaking memory.
-
-                // Check if the key chunk is there.
-                if (memcmp(&key.value[key_index], child->key.value, child->key.length) == 0) {
-                    // Add to the key index.
-                    key_index += child->key.length;
-
-                    // Check if this is the key.
-                    if (key_index == key.length) {
-                        // We matched!
-                        un_thread_safe_cut_branch(node, current_node, child);
-                        lock.unlock();
-                        return true;
-                    } else {
-                        // Go back to the start.
-                        current_node = child;
-                        outer_continue = true;
-                        break;
-                    }
-                }
+            auto child = current_node->children[i];
+            if (key.length - key_index >= child->key.length &&
+                memcmp(&key.value[key_index], child->key.value, child->key.length) == 0) {
+                *parent = current_node;
+                *index = i;
+                next = child;
+                break;
             }
         }
-        if (outer_continue) continue;
+        if (!next) return nullptr;
 
-        // We didn't match.
-        lock.unlock();
-        return false;
+        // Go down the child.
+        key_index += next->key.length;
+        current_node = next;
     }
+    return current_node;
 }
 
-// Cuts a branch from the tree.
-void un_thread_safe_cut_branch(RadixTreeNode* root, RadixTreeNode* parent, RadixTreeNode* branch) {
+// Removes the content of a node and then cleans up the branch. If the parent is null, this is the base node.
+// The parent and the node must be thawed.
+void RadixTreeRoot::un_thread_safe_cut_branch(RadixTreeNode* parent, size_t index) {
     // Free our current node.
+    auto branch = parent ? parent->children[index] : node;
     if (branch->content) {
         // We are nuking this branches content.
         free(branch->content->value);
         free(branch->content);
         branch->content = nullptr;
+        branch->expires_at = 0;
     }
 
+    // The base node always stays where it is.
+    if (!parent) return;
+
     // If the child length is 0, this node is definitely unused.
     if (branch->children_len == 0) {
-        // This is a dead branch. Free it.
+        // This is a dead branch. Remove it from the parent and free it.
+        un_thread_safe_remove_child(parent, index);
         free(branch->key.value);
         free(branch);
+        return;
+    }
+
+    // If there is only one child, this is now a router which can be merged with it.
+    if (branch->children_len == 1) {
+        auto child = un_thread_safe_thaw(branch->children[0]);
+        merge_radix_branches(branch, child);
+        free(child);
+    }
+}
+
+// Updates the expiry index for a key which had its expiry changed.
+void RadixTreeRoot::un_thread_safe_index_expiry(ByteSlice key, long long old_expires_at, long long new_expires_at) {
+    if (old_expires_at == new_expires_at) return;
+    if (old_expires_at != 0) {
+        auto range = expiries.equal_range(old_expires_at);
+        for (auto it = range.first; it != range.second; it++) {
+            if (it->second.size() == key.length && memcmp(it->second.data(), key.value, key.length) == 0) {
+                expiries.erase(it);
+                break;
+            }
+        }
+    }
+    if (new_expires_at != 0) expiries.emplace(new_expires_at, std::string((const char*)key.value, key.length));
+}
+
+// Removes every key starting with the prefix from the expiry index and the fencing tokens. This is used when a branch
+// is cut from the tree.
+void RadixTreeRoot::un_thread_safe_unindex_prefix(ByteSlice prefix) {
+    for (auto it = expiries.begin(); it != expiries.end();) {
+        if (it->second.size() >= prefix.length && memcmp(it->second.data(), prefix.value, prefix.length) == 0) {
+            it = expiries.erase(it);
+        } else {
+            it++;
+        }
+    }
+
+    // The fencing tokens are in key order, so the keys with the prefix are together.
+    auto it = fences.lower_bound(std::string((const char*)prefix.value, prefix.length));
+    while (it != fences.end() && it->first.size() >= prefix.length &&
+        memcmp(it->first.data(), prefix.value, prefix.length) == 0) {
+        it = fences.erase(it);
+    }
+}
+
+// Adds a key which must still have the version specified when the transaction is run. A version of 0 means the key
+// must not exist.
+void RadixTreeTransaction::watch(ByteSlice key, unsigned long long version) {
+    watches.push_back(Watch{std::string((const char*)key.value, key.length), version});
+}
+
+// Adds getting a key.
+void RadixTreeTransaction::get(ByteSlice key) {
+    Operation operation{};
+    operation.kind = GET;
+    operation.key.assign((const char*)key.value, key.length);
+    operations.push_back(std::move(operation));
+}
+
+// Adds setting a key. If expires_at is not zero, the key expires at that time in milliseconds since the Unix epoch.
+void RadixTreeTransaction::set(ByteSlice key, ByteSlice value, long long expires_at) {
+    Operation operation{};
+    operation.kind = SET;
+    operation.key.assign((const char*)key.value, key.length);
+    operation.value.assign((const char*)value.value, value.length);
+    operation.expires_at = expires_at;
+    operations.push_back(std::move(operation));
+}
+
+// Adds deleting a key.
+void RadixTreeTransaction::delete_key(ByteSlice key) {
+    Operation operation{};
+    operation.kind = DELETE_KEY;
+    operation.key.assign((const char*)key.value, key.length);
+    operations.push_back(std::move(operation));
+}
+
+// Adds deleting everything starting with a prefix.
+void RadixTreeTransaction::delete_prefix(ByteSlice key) {
+    Operation operation{};
+    operation.kind = DELETE_PREFIX;
+    operation.key.assign((const char*)key.value, key.length);
+    operations.push_back(std::move(operation));
+}
 
-        // Check if there's just one other child in the parent and no content. If so, concat the child and return.
-        if (parent->children_len == 2 && !parent->content && parent != root) {
-            // Get the other child.
-            auto other_child = *parent->children == branch ? parent->children[1] : *parent->children;
+// Gets the result of an operation. This is 1 if a set overwrote something or a delete deleted something (0 if not),
+// or the number of nodes a prefix delete removed.
+size_t RadixTreeTransaction::result(size_t index) {
+    return operations[index].result;
+}
 
-            // Merge the 2 branches.
-            merge_radix_branches(parent, other_child);
+// Gets the value a get found. Returns a null pointer if the key was not found. The value belongs to the transaction.
+ByteSlice* RadixTreeTransaction::result_value(size_t index) {
+    auto& operation = operations[index];
+    return operation.found ? &operation.found_value : nullptr;
+}
 
-            // Free the other child.
-            free(other_child);
+// Runs the operations in a transaction atomically, in the order they were added. If any watched key does not have
+// the version it was watched with, nothing is run and false is returned.
+bool RadixTreeRoot::exec(RadixTreeTransaction* transaction) {
+    // Acquire the write lock.
+    lock.lock();
 
-            // We have dealt with this and can return now.
-            return;
+    // Check the watched keys. Keys which have expired do not exist.
+    auto now = radix_now_ms();
+    for (auto& watch : transaction->watches) {
+        ByteSlice key{(uint8_t*)watch.key.data(), watch.key.size()};
+        auto result = un_thread_safe_get_node(key, false);
+        unsigned long long version = 0;
+        if (result.key_index == key.length && result.node->content && !content_expired(result.node, now)) {
+            version = result.node->version;
         }
+        if (version != watch.version) {
+            lock.unlock();
+            return false;
+        }
+    }
 
-        // Reallocate the children array.
-        parent->children_len--;
-        auto nodes = (RadixTreeNode**)malloc(sizeof(RadixTreeNode*) * parent->children_len); // NOLINT
-        size_t x = 0;
-        for (auto i = 0; i < parent->children_len + 1; i++) {
-            auto child_node = parent->children[i];
-            if (child_node != branch) {
-                nodes[x] = child_node;
-                x++;
+    // Run each operation.
+    bool cut_branches = false;
+    for (auto& operation : transaction->operations) {
+        ByteSlice key{(uint8_t*)operation.key.data(), operation.key.size()};
+        if (operation.kind == RadixTreeTransaction::GET) {
+            // Copy the value if the key exists.
+            auto result = un_thread_safe_get_node(key, false);
+            operation.found = result.key_index == key.length && result.node->content &&
+                !content_expired(result.node, now);
+            if (operation.found) {
+                touch_node(result.node, now);
+                operation.value.assign((const char*)result.node->content->value, result.node->content->length);
+                operation.found_value.value = (uint8_t*)operation.value.data();
+                operation.found_value.length = operation.value.size();
+            }
+            continue;
+        }
+
+        // Everything else is a write, so make sure we are not going to modify anything in a snapshot.
+        if (frozen) un_thread_safe_thaw_path(key);
+        switch (operation.kind) {
+        case RadixTreeTransaction::SET: {
+            // The tree owns the value, so copy it to the heap.
+            ByteSlice value{(uint8_t*)malloc(operation.value.size()), operation.value.size()};
+            memcpy(value.value, operation.value.data(), value.length);
+            operation.result = un_thread_safe_set(key, value, operation.expires_at);
+            break;
+        }
+        case RadixTreeTransaction::DELETE_KEY:
+            operation.result = un_thread_safe_delete_key(key);
+            break;
+        default: {
+            // Cut the branch. It is freed once we unlock unless there is a snapshot.
+            auto branch = un_thread_safe_cut_prefix(key, operation.cut_holder);
+            if (!branch) break;
+            size_t count;
+            if (un_thread_safe_retire_branch(branch, count)) {
+                operation.result = count - (operation.cut_holder ? 1 : 0);
+            } else {
+                operation.cut = branch;
+                cut_branches = true;
             }
         }
-        free(parent->children);
-        parent->children = nodes;
+        }
+    }
+    lock.unlock();
+
+    // Free any branches which were cut now that nothing else can reach them.
+    if (cut_branches) {
+        for (auto& operation : transaction->operations) {
+            if (!operation.cut) continue;
+            operation.result = free_branch(operation.cut) - (operation.cut_holder ? 1 : 0);
+            operation.cut = nullptr;
+        }
     }
+    return true;
+}
+
+// Parses a value as a 64-bit integer. Returns false if it is not one.
+static bool parse_integer(const char* value, size_t len, long long& out) {
+    // Make sure it is just digits with an optional minus sign.
+    size_t i = len != 0 && value[0] == '-' ? 1 : 0;
+    if (i == len || len > 20) return false;
+    for (size_t j = i; j < len; j++) {
+        if (value[j] < '0' || value[j] > '9') return false;
+    }
+
+    // Parse it, making sure it fits.
+    std::string str(value, len);
+    errno = 0;
+    out = strtoll(str.c_str(), nullptr, 10);
+    return errno != ERANGE;
+}
+
+// Parses a value as a finite float. Returns false if it is not one.
+static bool parse_float(const char* value, size_t len, double& out) {
+    // Make sure there is nothing like whitespace, infinity or NaN in it.
+    if (len == 0 || len > 64) return false;
+    for (size_t i = 0; i < len; i++) {
+        auto c = value[i];
+        if ((c < '0' || c > '9') && c != '-' && c != '+' && c != '.' && c != 'e' && c != 'E') return false;
+    }
+
+    // Parse it, making sure all of it was used.
+    std::string str(value, len);
+    char* end;
+    errno = 0;
+    out = strtod(str.c_str(), &end);
+    return errno != ERANGE && end == str.c_str() + len && std::isfinite(out);
+}
+
+// Formats a float so it parses back to the same float. 15 digits are tried first so that something like 0.1 is not
+// written as 0.10000000000000001.
+static std::string format_float(double value) {
+    char buf[32];
+    snprintf(buf, sizeof(buf), "%.15g", value);
+    if (strtod(buf, nullptr) == value) return buf;
+    snprintf(buf, sizeof(buf), "%.17g", value);
+    return buf;
+}
+
+// Atomically adds to a keys value as a 64-bit integer. Keys which do not exist count as 0, and keep when they
+// expire otherwise. Returns a result which must be freed along with its value.
+RadixTreeIncrementResult* RadixTreeRoot::increment(ByteSlice key, long long delta) {
+    return increment_with(key, [delta](const char* current, size_t current_len, std::string& next) {
+        long long n;
+        if (!parse_integer(current, current_len, n)) return RADIX_INCREMENT_NOT_A_NUMBER;
+        if (__builtin_add_overflow(n, delta, &n)) return RADIX_INCREMENT_OVERFLOW;
+        next = std::to_string(n);
+        return RADIX_INCREMENT_OK;
+    });
+}
+
+// Atomically adds to a keys value as a float. Keys which do not exist count as 0, and keep when they expire
+// otherwise. Returns a result which must be freed along with its value.
+RadixTreeIncrementResult* RadixTreeRoot::increment_float(ByteSlice key, double delta) {
+    return increment_with(key, [delta](const char* current, size_t current_len, std::string& next) {
+        double n;
+        if (!parse_float(current, current_len, n)) return RADIX_INCREMENT_NOT_A_NUMBER;
+        n += delta;
+        if (!std::isfinite(n)) return RADIX_INCREMENT_OVERFLOW;
+        next = format_float(n);
+        return RADIX_INCREMENT_OK;
+    });
+}
+
+// Sets a keys value to the result of adding to its current value whilst the tree is write locked.
+RadixTreeIncrementResult* RadixTreeRoot::increment_with(
+    ByteSlice key, const std::function<int(const char* current, size_t current_len, std::string& next)>& add
+) {
+    // Acquire the write lock.
+    lock.lock();
+
+    // Get the current content. If the key does not exist, it counts as 0.
+    auto result = un_thread_safe_get_node(key, false);
+    RadixTreeNode* current{};
+    if (result.key_index == key.length && result.node->content && !content_expired(result.node, radix_now_ms())) {
+        current = result.node;
+    }
+    auto res = (RadixTreeIncrementResult*)calloc(1, sizeof(RadixTreeIncrementResult));
+    std::string next;
+    if (current) {
+        res->status = add((const char*)current->content->value, current->content->length, next);
+        res->expires_at = current->expires_at;
+    } else {
+        res->status = add("0", 1, next);
+    }
+    if (res->status != RADIX_INCREMENT_OK) {
+        lock.unlock();
+        return res;
+    }
+
+    // Set the new value and return a copy of it.
+    ByteSlice value{};
+    value.length = next.size();
+    value.value = (uint8_t*)malloc(value.length);
+    memcpy(value.value, next.data(), value.length);
+    if (frozen) un_thread_safe_thaw_path(key);
+    un_thread_safe_set(key, value, res->expires_at);
+    res->value = copy_byte_slice_stack(value);
+    lock.unlock();
+    return res;
+}
+
+// Gets when a key expires in milliseconds since the Unix epoch. Returns 0 if the key never expires, and -1 if
+// the key does not exist.
+long long RadixTreeRoot::get_expiry(ByteSlice key) {
+    lock.lock_shared();
+    auto result = un_thread_safe_get_node(key, false);
+    long long expiry = -1;
+    if (result.key_index == key.length && result.node->content && !content_expired(result.node, radix_now_ms())) {
+        expiry = result.node->expires_at;
+    }
+    lock.unlock_shared();
+    return expiry;
+}
+
+// Sets when a key expires in milliseconds since the Unix epoch. Zero makes the key never expire. Returns true if
+// the key exists.
+bool RadixTreeRoot::expire_at(ByteSlice key, long long expires_at) {
+    lock.lock();
+    if (frozen) un_thread_safe_thaw_path(key);
+    RadixTreeNode* parent;
+    size_t index;
+    auto found = un_thread_safe_find(key, &parent, &index);
+    if (!found || !found->content || content_expired(found, radix_now_ms())) {
+        lock.unlock();
+        return false;
+    }
+    un_thread_safe_index_expiry(key, found->expires_at, expires_at);
+    found->expires_at = expires_at;
+    lock.unlock();
+    return true;
+}
+
+// Removes up to max keys which have expired. Returns the number of keys removed.
+size_t RadixTreeRoot::sweep_expired(size_t max) {
+    lock.lock();
+    auto now = radix_now_ms();
+    size_t removed = 0;
+    while (removed < max && !expiries.empty()) {
+        // Get the key which expires first and check if it has expired.
+        auto first = expiries.begin();
+        if (first->first > now) break;
+        auto expires_at = first->first;
+        auto key_str = std::move(first->second);
+        expiries.erase(first);
+
+        // Remove the key if it still expires at this time.
+        ByteSlice key{};
+        key.value = (uint8_t*)key_str.data();
+        key.length = key_str.size();
+        if (frozen) un_thread_safe_thaw_path(key);
+        RadixTreeNode* parent;
+        size_t index;
+        auto found = un_thread_safe_find(key, &parent, &index);
+        if (found && found->content && found->expires_at == expires_at) {
+            memory -= radix_entry_size(key.length, found->content->length);
+            fences.erase(key_str);
+            un_thread_safe_cut_branch(parent, index);
+            removed++;
+        }
+    }
+    lock.unlock();
+    return removed;
+}
+
+// Rebuilds the expiry index and the memory count from the nodes in the tree. This is used after a tree is loaded.
+void RadixTreeRoot::rebuild_indexes() {
+    lock.lock();
+    expiries.clear();
+    memory = branch_memory(node, 0);
+    struct _key_node {
+        RadixTreeNode* node;
+        std::string key;
+    };
+    auto stack = std::deque<_key_node>();
+    stack.push_back(_key_node{node, std::string()});
+    while (!stack.empty()) {
+        auto next = std::move(stack.back());
+        stack.pop_back();
+        if (next.node->content) next.node->version = ++last_version;
+        if (next.node->content && next.node->expires_at != 0) expiries.emplace(next.node->expires_at, next.key);
+        for (size_t i = 0; i < next.node->children_len; i++) {
+            auto child = next.node->children[i];
+            stack.push_back(_key_node{child, next.key + std::string((const char*)child->key.value, child->key.length)});
+        }
+    }
+    lock.unlock();
+}
+
+// Gets the number of bytes used by the keys and values in the tree, along with their nodes.
+size_t RadixTreeRoot::memory_usage() {
+    return memory;
+}
+
+// Picks a key to evict with the policy specified. The key is copied, and a null pointer is returned if
+// there is nothing to evict. The key is not removed, so the caller should delete it.
+ByteSlice* RadixTreeRoot::pick_eviction(int policy) {
+    lock.lock_shared();
+    auto now = radix_now_ms();
+    std::string key;
+    bool found{};
+    if (policy == RADIX_EVICT_VOLATILE_TTL) {
+        // Get the key which expires soonest. The index may have keys which were since removed, so skip those.
+        for (auto& entry : expiries) {
+            auto result = un_thread_safe_get_node(ByteSlice{(uint8_t*)entry.second.data(), entry.second.size()}, false);
+            if (result.key_index == entry.second.size() && result.node->content &&
+                result.node->expires_at == entry.first) {
+                key = entry.second;
+                found = true;
+                break;
+            }
+        }
+    } else {
+        found = un_thread_safe_sample(policy, now, key);
+    }
+    lock.unlock_shared();
+    if (!found) return nullptr;
+
+    // Copy the key to the heap.
+    auto slice = (ByteSlice*)malloc(sizeof(ByteSlice));
+    slice->length = key.size();
+    slice->value = (uint8_t*)malloc(key.size());
+    memcpy(slice->value, key.data(), key.size());
+    return slice;
+}
+
+// Samples random keys from the tree and writes the one which should be evicted first to key. Expired keys are
+// always evicted first. Returns false if the tree is empty.
+bool RadixTreeRoot::un_thread_safe_sample(int policy, long long now, std::string& key) {
+    thread_local std::minstd_rand random(std::random_device{}());
+    bool found{};
+    long long best_score{};
+    for (int i = 0; i < RADIX_EVICTION_SAMPLES; i++) {
+        // Go down random children until we decide to stop at some content.
+        std::string path;
+        auto current_node = node;
+        for (;;) {
+            auto options = current_node->children_len + (current_node->content ? 1 : 0);
+            if (options == 0) return found;
+            auto pick = random() % options;
+            if (pick == current_node->children_len) break;
+            current_node = current_node->children[pick];
+            path.append((const char*)current_node->key.value, current_node->key.length);
+        }
+
+        // Get the score of the key. Lower scores are evicted first.
+        long long score;
+        if (content_expired(current_node, now)) {
+            score = LLONG_MIN;
+        } else if (policy == RADIX_EVICT_ALLKEYS_LFU) {
+            // The count is halved for every minute the key has not been used.
+            auto idle_minutes = (now - __atomic_load_n(&current_node->accessed_at, __ATOMIC_RELAXED)) / 60000;
+            auto count = __atomic_load_n(&current_node->access_count, __ATOMIC_RELAXED);
+            score = idle_minutes >= 32 ? 0 : count >> idle_minutes;
+        } else {
+            score = __atomic_load_n(&current_node->accessed_at, __ATOMIC_RELAXED);
+        }
+        if (!found || score < best_score) {
+            found = true;
+            best_score = score;
+            key = std::move(path);
+        }
+    }
+    return found;
 }
 
 // Gets a node from the tree.
@@ -747,12 +1504,24 @@ RadixTreeNodeResult RadixTreeRoot::un_thread_safe_get_node(ByteSlice key, bool a
     return result;
 }
 
-bool set_with_stack_value(RadixTreeRoot* tree, ByteSlice key, uint8_t* value_start, size_t value_len) {
+bool set_with_stack_value(RadixTreeRoot* tree, ByteSlice key, uint8_t* value_start, size_t value_len, long long expires_at) {
+    uint8_t* value_cpy = (uint8_t*)malloc(value_len);
+    memcpy(value_cpy, value_start, value_len);
+    auto value = ByteSlice{};
+    value.value = value_cpy;
+    value.length = value_len;
+    return tree->set(key, value, expires_at);
+}
+
+unsigned long long set_if_with_stack_value(
+    RadixTreeRoot* tree, ByteSlice key, uint8_t* value_start, size_t value_len, long long expires_at,
+    int condition, ByteSlice expected_value, unsigned long long expected_version
+) {
     uint8_t* value_cpy = (uint8_t*)malloc(value_len);
     memcpy(value_cpy, value_start, value_len);
     auto value = ByteSlice{};
     value.value = value_cpy;
     value.length = value_len;
-    return tree->set(key, value);
+    return tree->set_if(key, value, expires_at, condition, expected_value, expected_version);
 }
 #endif // _RADIX_CPP
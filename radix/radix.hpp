@@ -1,10 +1,37 @@
 #ifndef RADIX_H
 #define RADIX_H
 #include <shared_mutex>
+#include <atomic>
+#include <condition_variable>
 #include <cinttypes>
 #include <deque>
+#include <functional>
+#include <map>
+#include <string>
+#include <vector>
 #include "byteslice.h"
 
+// Defines the policies used to pick which key is evicted when a tree is using too much memory.
+#define RADIX_EVICT_ALLKEYS_LRU 0
+#define RADIX_EVICT_ALLKEYS_LFU 1
+#define RADIX_EVICT_VOLATILE_TTL 2
+
+// Defines the conditions a key can be set with.
+#define RADIX_SET_ALWAYS 0
+#define RADIX_SET_IF_ABSENT 1
+#define RADIX_SET_IF_EXISTS 2
+#define RADIX_SET_IF_VALUE 3
+#define RADIX_SET_IF_VERSION 4
+#define RADIX_SET_IF_FENCE 5
+
+// Defines the statuses of an increment.
+#define RADIX_INCREMENT_OK 0
+#define RADIX_INCREMENT_NOT_A_NUMBER 1
+#define RADIX_INCREMENT_OVERFLOW 2
+
+// Defines how many keys are sampled to pick one for LRU and LFU eviction.
+#define RADIX_EVICTION_SAMPLES 5
+
 // Defines a node of the radix tree.
 struct RadixTreeNode {
     // Defines the length of children.
@@ -18,6 +45,21 @@ struct RadixTreeNode {
 
     // Defines the contents of this node.
     ByteSlice* content;
+
+    // Defines when the contents expire in milliseconds since the Unix epoch. Zero means they never expire.
+    long long expires_at;
+
+    // Defines when the contents were last used in milliseconds since the Unix epoch, and roughly how many times
+    // they have been used. These are used to pick which keys to evict.
+    long long accessed_at;
+    unsigned int access_count;
+
+    // Defines the version of the contents. This changes every time the contents are set.
+    unsigned long long version;
+
+    // Defines the generation of the tree this node was created in. Nodes from before a snapshot
+    // are frozen until the snapshot is released.
+    size_t generation;
 };
 
 // Defines a node result.
@@ -29,6 +71,27 @@ struct RadixTreeNodeResult {
     RadixTreeNode* node;
 };
 
+// Defines a value along with its version.
+struct RadixTreeVersionedValue {
+    // Defines the value.
+    ByteSlice value;
+
+    // Defines the version.
+    unsigned long long version;
+};
+
+// Defines the result of an increment.
+struct RadixTreeIncrementResult {
+    // Defines a copy of the new value. This is empty if the increment failed.
+    ByteSlice value;
+
+    // Defines when the key expires. Increments do not change this.
+    long long expires_at;
+
+    // Defines the status of the increment.
+    int status;
+};
+
 // Defines a walking value result.
 struct RadixTreeWalkValue {
     // Defines the key.
@@ -40,26 +103,88 @@ struct RadixTreeWalkValue {
 
 class RadixTreeBranchWalker {
     public:
-        RadixTreeBranchWalker(RadixTreeNode* node, ByteSlice full_key, size_t key_chunk, std::shared_mutex* lock);
+        RadixTreeBranchWalker(RadixTreeNode* node, ByteSlice node_key, ByteSlice start, ByteSlice end, bool reverse, std::shared_mutex* lock, long long now);
         RadixTreeWalkValue* next();
+        void close();
     private:
-        void add_node_child(RadixTreeNode* node, ByteSlice key_chunk);
-        void remove_node_child();
-        ByteSlice get_current_key();
+        // Defines a node being walked. The key length is the length of the key up to the end of this node.
+        struct Frame {
+            RadixTreeNode* node;
+            size_t key_len;
+            size_t child;
+            bool content_read;
+        };
+        void push_frame(RadixTreeNode* node);
+        bool branch_out_of_range();
+
+        // Defines the nodes being walked in order of parents first.
+        std::vector<Frame> frames;
+
+        // Defines the key of the node being walked.
+        std::string key;
 
-        // Defines if the childs value has been read.
-        bool childs_value_read{};
+        // Defines the range of keys to walk. An empty end means there is no end.
+        std::string start;
+        std::string end;
+
+        // Defines if the keys are walked in descending order.
+        bool reverse;
 
         // Defines if the radix tree was unlocked.
         bool unlocked;
 
-        // Defines the nodes in order of parents first.
-        std::deque<RadixTreeNode*> nodes;
-        std::deque<ByteSlice> key_chunks;
-        std::deque<uintptr_t> child_indexes;
-
         // Defines the radix trees mutex.
         std::shared_mutex* lock;
+
+        // Defines the time the walk started. Anything which expired before this is skipped.
+        long long now;
+};
+
+// Defines a list of operations which are run atomically by RadixTreeRoot::exec. The keys and values are copied, and
+// the results can be read once it has run.
+class RadixTreeTransaction {
+    public:
+        void watch(ByteSlice key, unsigned long long version);
+        void get(ByteSlice key);
+        void set(ByteSlice key, ByteSlice value, long long expires_at);
+        void delete_key(ByteSlice key);
+        void delete_prefix(ByteSlice key);
+        size_t result(size_t index);
+        ByteSlice* result_value(size_t index);
+#ifndef SWIG
+        // Defines the kinds of operation.
+        enum Kind { GET, SET, DELETE_KEY, DELETE_PREFIX };
+
+        // Defines a key which must still have the version specified for the transaction to run. A version of 0
+        // means the key must not exist.
+        struct Watch {
+            std::string key;
+            unsigned long long version;
+        };
+
+        // Defines an operation along with its result.
+        struct Operation {
+            Kind kind;
+            std::string key;
+            std::string value;
+            long long expires_at;
+
+            // Defines if a get found the key, and the value it found.
+            bool found;
+            ByteSlice found_value;
+
+            // Defines if a set overwrote something or a delete deleted something, or the number of nodes a prefix
+            // delete removed.
+            size_t result;
+
+            // Defines a branch cut by a prefix delete which is freed once the tree is unlocked.
+            RadixTreeNode* cut;
+            bool cut_holder;
+        };
+
+        std::vector<Watch> watches;
+        std::vector<Operation> operations;
+#endif
 };
 
 class RadixTreeRoot {
@@ -67,25 +192,92 @@ class RadixTreeRoot {
         RadixTreeRoot();
         RadixTreeRoot(RadixTreeNode** nodes, size_t nodes_len);
         ByteSlice* get(ByteSlice key);
+        RadixTreeVersionedValue* get_versioned(ByteSlice key);
         RadixTreeBranchWalker walk_prefix(ByteSlice key);
-        bool set(ByteSlice key, ByteSlice value);
+        RadixTreeBranchWalker walk_range(ByteSlice start, ByteSlice end, bool reverse);
+        bool set(ByteSlice key, ByteSlice value, long long expires_at);
+        unsigned long long set_if(ByteSlice key, ByteSlice value, long long expires_at, int condition, ByteSlice expected_value, unsigned long long expected_version);
+        bool exec(RadixTreeTransaction* transaction);
+        RadixTreeIncrementResult* increment(ByteSlice key, long long delta);
+        RadixTreeIncrementResult* increment_float(ByteSlice key, double delta);
+        long long get_expiry(ByteSlice key);
+        bool expire_at(ByteSlice key, long long expires_at);
+        size_t sweep_expired(size_t max);
+        size_t memory_usage();
+        ByteSlice* pick_eviction(int policy);
         bool delete_key(ByteSlice key);
         size_t delete_prefix(ByteSlice key);
         void free_tree();
+        RadixTreeNode* freeze();
+        void unfreeze();
         RadixTreeNode* node;
 #ifndef SWIG
         mutable std::shared_mutex lock;
+        void rebuild_indexes();
+        friend bool rbf_write(RadixTreeRoot* tree, RadixTreeNode* node, const char* path, unsigned short db_index);
+        friend RadixTreeRoot* rbf_load(const char* path);
 #endif
     private:
 #ifdef SWIG
         mutable std::shared_mutex lock;
+#else
+        // Defines the generation new nodes are created in.
+        size_t generation{};
+
+        // Defines if there is a snapshot, and the last generation which is part of it.
+        bool frozen{};
+        size_t frozen_generation{};
+
+        // Notified when the snapshot is released.
+        std::condition_variable_any unfrozen;
+
+        // Defines the keys which expire, ordered by when they expire.
+        std::multimap<long long, std::string> expiries;
+
+        // Defines the version of the last set.
+        unsigned long long last_version;
+
+        // Defines the highest fencing token each key was set with. A key's token is removed along with the key, so
+        // this does not grow past the keys in the tree.
+        std::map<std::string, unsigned long long> fences;
+
+        // Defines the fencing tokens as they were when the tree was frozen. These are saved along with the snapshot.
+        std::map<std::string, unsigned long long> frozen_fences;
+
+        // Defines the number of bytes used by the keys and values in the tree, along with their nodes.
+        std::atomic<size_t> memory{};
+
+        // Defines nodes which were copied or cut from the tree whilst they were frozen.
+        std::deque<RadixTreeNode*> retired_nodes;
+        std::deque<RadixTreeNode*> retired_branches;
+
+        bool un_thread_safe_is_frozen(RadixTreeNode* n);
+        RadixTreeNode* un_thread_safe_thaw(RadixTreeNode* n);
+        void un_thread_safe_thaw_path(ByteSlice key);
+        bool un_thread_safe_set(ByteSlice key, ByteSlice value, long long expires_at);
+        RadixTreeNode* un_thread_safe_find(ByteSlice key, RadixTreeNode** parent, size_t* index);
+        void un_thread_safe_index_expiry(ByteSlice key, long long old_expires_at, long long new_expires_at);
+        void un_thread_safe_unindex_prefix(ByteSlice prefix);
+        void un_thread_safe_remove_child(RadixTreeNode* parent, size_t index);
+        void un_thread_safe_cut_branch(RadixTreeNode* parent, size_t index);
+        bool un_thread_safe_delete_key(ByteSlice key);
+        RadixTreeNode* un_thread_safe_cut_prefix(ByteSlice key, bool& holder);
+        bool un_thread_safe_retire_branch(RadixTreeNode* branch, size_t& count);
+        size_t un_thread_safe_free_branch_and_unlock(RadixTreeNode* branch);
+        bool un_thread_safe_sample(int policy, long long now, std::string& key);
+        RadixTreeIncrementResult* increment_with(
+            ByteSlice key, const std::function<int(const char* current, size_t current_len, std::string& next)>& add);
 #endif
         RadixTreeNodeResult un_thread_safe_get_node(ByteSlice key, bool allow_node_prefix);
 };
 
-inline size_t free_node_children(RadixTreeNode** nodes, size_t nodes_len);
+size_t free_node_children(RadixTreeNode** nodes, size_t nodes_len);
+size_t count_node_children(RadixTreeNode** nodes, size_t nodes_len);
 inline void merge_radix_branches(RadixTreeNode* parent, RadixTreeNode* child);
-void un_thread_safe_cut_branch(RadixTreeNode* root, RadixTreeNode* parent, RadixTreeNode* branch);
 RadixTreeNode* split_node(size_t split_index, RadixTreeNode* node, RadixTreeNode* other_child);
-bool set_with_stack_value(RadixTreeRoot* tree, ByteSlice key, uint8_t* value_start, size_t value_len);
+void sort_node_children(RadixTreeNode* node);
+long long radix_now_ms();
+size_t radix_entry_size(size_t key_len, size_t value_len);
+bool set_with_stack_value(RadixTreeRoot* tree, ByteSlice key, uint8_t* value_start, size_t value_len, long long expires_at);
+unsigned long long set_if_with_stack_value(RadixTreeRoot* tree, ByteSlice key, uint8_t* value_start, size_t value_len, long long expires_at, int condition, ByteSlice expected_value, unsigned long long expected_version);
 #endif
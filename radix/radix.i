@@ -2,6 +2,8 @@
 
 %{
     #include "radix.hpp"
+    #include "rbf.hpp"
 %}
 
 %include "radix.hpp"
+%include "rbf.hpp"
@@ -0,0 +1,393 @@
+package radix
+
+import (
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSnapshotIsolation(t *testing.T) {
+	tree := NewRadixTree()
+	defer tree.FreeTree()
+	for _, k := range []string{"a", "ab", "abc", "user:1", "user:2"} {
+		tree.Set([]byte(k), []byte("before"))
+	}
+	before := map[string]string{"a": "before", "ab": "before", "abc": "before", "user:1": "before", "user:2": "before"}
+	after := map[string]string{"a": "after", "abc": "before", "abd": "new"}
+
+	// Write to the tree whilst the snapshot is held. None of this should be visible in the snapshot.
+	s := tree.Snapshot()
+	tree.Set([]byte("a"), []byte("after"))
+	tree.Set([]byte("abd"), []byte("new"))
+	tree.DeleteKey([]byte("ab"))
+	tree.DeletePrefix([]byte("user:"))
+
+	rbf := NewRBF(filepath.Join(t.TempDir(), "db.rbf"), 0)
+	ok := rbf.WriteSnapshot(s)
+	s.Release()
+	if !ok {
+		t.Fatal("write failed")
+	}
+	loaded := rbf.Load()
+	if loaded == nil {
+		t.Fatal("load failed")
+	}
+	defer loaded.FreeTree()
+
+	keys := []string{"a", "ab", "abc", "abd", "user:1", "user:2"}
+	for name, c := range map[string]struct {
+		tree RadixTree
+		want map[string]string
+	}{
+		"snapshot": {*loaded, before},
+		"tree":     {tree, after},
+	} {
+		for _, k := range keys {
+			value, free := c.tree.Get([]byte(k))
+			if want, ok := c.want[k]; value == nil && ok || string(value) != want {
+				t.Errorf("%s: key %q: got %q, want %q", name, k, value, want)
+			}
+			free()
+		}
+	}
+
+	// Once released, the tree can be snapshotted again and the new snapshot has the writes.
+	if !rbf.Write(tree) {
+		t.Fatal("write after release failed")
+	}
+	if metadata := rbf.Metadata(); metadata == nil || metadata.Entries != uint64(len(after)) {
+		t.Errorf("got metadata %+v, want %d entries", metadata, len(after))
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	tree := NewRadixTree()
+	defer tree.FreeTree()
+	past := time.Now().Add(-time.Second)
+	later := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	tree.Set([]byte("live"), []byte("1"))
+	tree.SetWithExpiry([]byte("later"), []byte("2"), later)
+	tree.SetWithExpiry([]byte("gone:1"), []byte("3"), past)
+	tree.SetWithExpiry([]byte("gone:2"), []byte("4"), past)
+	tree.SetWithExpiry([]byte("soon"), []byte("5"), time.Now().Add(50*time.Millisecond))
+
+	// Expired keys are invisible straight away, even though they have not been swept yet.
+	get := func(key string) string {
+		value, free := tree.Get([]byte(key))
+		defer free()
+		return string(value)
+	}
+	if v := get("gone:1"); v != "" {
+		t.Errorf("got %q for an expired key", v)
+	}
+	if _, ok := tree.ExpiresAt([]byte("gone:1")); ok {
+		t.Error("an expired key exists")
+	}
+	if tree.ExpireAt([]byte("gone:1"), later) {
+		t.Error("an expired key had its expiry changed")
+	}
+	if tree.DeleteKey([]byte("gone:1")) {
+		t.Error("deleting an expired key reported it existed")
+	}
+	if tree.Set([]byte("gone:2"), []byte("6")) {
+		t.Error("setting an expired key reported an overwrite")
+	}
+	if at, ok := tree.ExpiresAt([]byte("later")); !ok || !at.Equal(later) {
+		t.Errorf("got expiry %v (%v), want %v", at, ok, later)
+	}
+	if v := get("soon"); v != "5" {
+		t.Errorf("got %q before the key expired, want %q", v, "5")
+	}
+
+	// gone:1 was already removed and gone:2 no longer expires, so nothing is swept until soon expires.
+	if n := tree.SweepExpired(10); n != 0 {
+		t.Errorf("swept %d keys, want 0", n)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if v := get("soon"); v != "" {
+		t.Errorf("got %q after the key expired", v)
+	}
+	if n := tree.SweepExpired(10); n != 1 {
+		t.Errorf("swept %d keys, want 1", n)
+	}
+	for k, want := range map[string]string{"live": "1", "later": "2", "gone:2": "6"} {
+		if v := get(k); v != want {
+			t.Errorf("key %q: got %q after sweeping, want %q", k, v, want)
+		}
+	}
+
+	// Sweeps are done in batches of the size given.
+	for i := 0; i < 5; i++ {
+		tree.SetWithExpiry([]byte("batch:"+strconv.Itoa(i)), []byte("x"), past)
+	}
+	if n := tree.SweepExpired(3); n != 3 {
+		t.Errorf("swept %d keys in the first batch, want 3", n)
+	}
+	if n := tree.SweepExpired(3); n != 2 {
+		t.Errorf("swept %d keys in the second batch, want 2", n)
+	}
+
+	// Persisting a key stops it expiring.
+	if !tree.Persist([]byte("later")) {
+		t.Error("persist did not find the key")
+	}
+	if at, ok := tree.ExpiresAt([]byte("later")); !ok || !at.IsZero() {
+		t.Errorf("got expiry %v (%v) after persisting, want none", at, ok)
+	}
+}
+
+func TestSetIf(t *testing.T) {
+	tests := []struct {
+		name            string
+		existing        *string
+		condition       SetCondition
+		expectedValue   string
+		expectedVersion func(current uint64) uint64
+		wantSet         bool
+	}{
+		{name: "always on absent key", condition: SetAlways, wantSet: true},
+		{name: "always on existing key", existing: strPtr("old"), condition: SetAlways, wantSet: true},
+		{name: "if absent on absent key", condition: SetIfAbsent, wantSet: true},
+		{name: "if absent on existing key", existing: strPtr("old"), condition: SetIfAbsent},
+		{name: "if exists on absent key", condition: SetIfExists},
+		{name: "if exists on existing key", existing: strPtr("old"), condition: SetIfExists, wantSet: true},
+		{
+			name: "if value matches", existing: strPtr("old"), condition: SetIfValue,
+			expectedValue: "old", wantSet: true,
+		},
+		{name: "if value differs", existing: strPtr("old"), condition: SetIfValue, expectedValue: "other"},
+		{name: "if value on absent key", condition: SetIfValue, expectedValue: "old"},
+		{
+			name: "if version matches", existing: strPtr("old"), condition: SetIfVersion,
+			expectedVersion: func(current uint64) uint64 { return current }, wantSet: true,
+		},
+		{
+			name: "if version differs", existing: strPtr("old"), condition: SetIfVersion,
+			expectedVersion: func(current uint64) uint64 { return current + 1 },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tree := NewRadixTree()
+			defer tree.FreeTree()
+			key := []byte("key")
+			var current uint64
+			if tt.existing != nil {
+				current = tree.SetIf(key, []byte(*tt.existing), time.Time{}, SetAlways, nil, 0)
+			}
+			var expectedVersion uint64
+			if tt.expectedVersion != nil {
+				expectedVersion = tt.expectedVersion(current)
+			}
+
+			version := tree.SetIf(
+				key, []byte("new"), time.Time{}, tt.condition, []byte(tt.expectedValue), expectedVersion)
+			if (version != 0) != tt.wantSet {
+				t.Fatalf("got version %d, want set %v", version, tt.wantSet)
+			}
+			value, deallocator := tree.Get(key)
+			defer deallocator()
+			switch {
+			case tt.wantSet && string(value) != "new":
+				t.Fatalf("got %q, want %q", value, "new")
+			case !tt.wantSet && tt.existing == nil && value != nil:
+				t.Fatalf("got %q, want no value", value)
+			case !tt.wantSet && tt.existing != nil && string(value) != *tt.existing:
+				t.Fatalf("got %q, want %q", value, *tt.existing)
+			}
+			if tt.wantSet && version <= current {
+				t.Fatalf("got version %d, want above %d", version, current)
+			}
+		})
+	}
+}
+
+func strPtr(s string) *string {
+	return &s
+}
+
+func TestSetIfFence(t *testing.T) {
+	tree := NewRadixTree()
+	defer tree.FreeTree()
+	set := func(key string, token uint64) bool {
+		return tree.SetIf([]byte(key), []byte("value"), time.Time{}, SetIfFence, nil, token) != 0
+	}
+
+	// The token has to be at least the highest one the key was set with.
+	if !set("key", 5) || !set("key", 5) {
+		t.Fatal("the current token was rejected")
+	}
+	if set("key", 4) {
+		t.Fatal("a stale token was accepted")
+	}
+	if !set("key", 7) || set("key", 6) {
+		t.Fatal("the fence was not raised by a newer token")
+	}
+
+	// Removing the key removes its fence, however it is removed. Other keys keep theirs.
+	removals := []struct {
+		name       string
+		remove     func()
+		keepsOther bool
+	}{
+		{name: "delete", remove: func() { tree.DeleteKey([]byte("key")) }, keepsOther: true},
+		{name: "prefix delete", remove: func() { tree.DeletePrefix([]byte("k")) }, keepsOther: true},
+		{name: "free", remove: tree.FreeTree},
+	}
+	for _, r := range removals {
+		if !set("key", 10) || !set("other", 10) {
+			t.Fatalf("%s: the fenced sets failed", r.name)
+		}
+		r.remove()
+		if !set("key", 1) {
+			t.Errorf("%s: the fence outlived the key", r.name)
+		}
+		if kept := !set("other", 9); kept != r.keepsOther {
+			t.Errorf("%s: got the other fence kept %v, want %v", r.name, kept, r.keepsOther)
+		}
+		tree.FreeTree()
+	}
+}
+
+func TestSweptKeysLoseFences(t *testing.T) {
+	tree := NewRadixTree()
+	defer tree.FreeTree()
+	expiresAt := time.Now().Add(20 * time.Millisecond)
+	if tree.SetIf([]byte("key"), []byte("value"), expiresAt, SetIfFence, nil, 10) == 0 {
+		t.Fatal("the fenced set failed")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if removed := tree.SweepExpired(10); removed != 1 {
+		t.Fatalf("got %d keys swept, want 1", removed)
+	}
+	if tree.SetIf([]byte("key"), []byte("value"), time.Time{}, SetIfFence, nil, 1) == 0 {
+		t.Error("the fence outlived the swept key")
+	}
+}
+
+func TestIncrement(t *testing.T) {
+	tests := []struct {
+		name    string
+		current *string
+		delta   int64
+		float   float64
+		isFloat bool
+		want    string
+		wantErr error
+	}{
+		{name: "missing key counts as 0", delta: 5, want: "5"},
+		{name: "below 0", current: strPtr("10"), delta: -15, want: "-5"},
+		{name: "up to the maximum", current: strPtr("9223372036854775806"), delta: 1, want: "9223372036854775807"},
+		{name: "overflow", current: strPtr("9223372036854775807"), delta: 1, wantErr: ErrNumberOverflow},
+		{name: "underflow", current: strPtr("-9223372036854775808"), delta: -1, wantErr: ErrNumberOverflow},
+		{name: "text", current: strPtr("abc"), delta: 1, wantErr: ErrNotANumber},
+		{name: "float as integer", current: strPtr("1.5"), delta: 1, wantErr: ErrNotANumber},
+		{name: "whitespace", current: strPtr(" 1"), delta: 1, wantErr: ErrNotANumber},
+		{name: "empty value", current: strPtr(""), delta: 1, wantErr: ErrNotANumber},
+		{name: "integer out of range", current: strPtr("99999999999999999999"), delta: 1, wantErr: ErrNotANumber},
+		{name: "float on missing key", isFloat: true, float: 1.5, want: "1.5"},
+		{name: "float on integer", current: strPtr("1"), isFloat: true, float: 0.25, want: "1.25"},
+		{name: "float keeps precision", current: strPtr("0.1"), isFloat: true, float: 0.2, want: "0.30000000000000004"},
+		{name: "float overflow", current: strPtr("1e308"), isFloat: true, float: 1e308, wantErr: ErrNumberOverflow},
+		{name: "float text", current: strPtr("abc"), isFloat: true, float: 1, wantErr: ErrNotANumber},
+		{name: "float infinity", current: strPtr("inf"), isFloat: true, float: 1, wantErr: ErrNotANumber},
+		{name: "float nan", current: strPtr("nan"), isFloat: true, float: 1, wantErr: ErrNotANumber},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tree := NewRadixTree()
+			defer tree.FreeTree()
+			key := []byte("n")
+			if tt.current != nil {
+				tree.Set(key, []byte(*tt.current))
+			}
+
+			var value []byte
+			var err error
+			if tt.isFloat {
+				value, _, err = tree.IncrementFloat(key, tt.float)
+			} else {
+				value, _, err = tree.Increment(key, tt.delta)
+			}
+			if err != tt.wantErr {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+
+			// A failed increment leaves the value alone.
+			want := tt.want
+			if err != nil && tt.current != nil {
+				want = *tt.current
+			}
+			if err == nil && string(value) != want {
+				t.Errorf("got %q returned, want %q", value, want)
+			}
+			stored, free := tree.Get(key)
+			defer free()
+			if string(stored) != want {
+				t.Errorf("got %q stored, want %q", stored, want)
+			}
+		})
+	}
+}
+
+func TestIncrementKeepsExpiry(t *testing.T) {
+	tree := NewRadixTree()
+	defer tree.FreeTree()
+	expiresAt := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	tree.SetWithExpiry([]byte("n"), []byte("1"), expiresAt)
+	if _, at, err := tree.Increment([]byte("n"), 1); err != nil || !at.Equal(expiresAt) {
+		t.Fatalf("got expiry %v (%v), want %v", at, err, expiresAt)
+	}
+	if at, ok := tree.ExpiresAt([]byte("n")); !ok || !at.Equal(expiresAt) {
+		t.Fatalf("got stored expiry %v (%v), want %v", at, ok, expiresAt)
+	}
+
+	// An expired key counts as 0 and the new value does not expire.
+	tree.SetWithExpiry([]byte("gone"), []byte("10"), time.Now().Add(-time.Second))
+	if value, at, err := tree.Increment([]byte("gone"), 1); err != nil || string(value) != "1" || !at.IsZero() {
+		t.Fatalf("got %q expiring at %v (%v), want \"1\" which never expires", value, at, err)
+	}
+}
+
+func TestWalkRange(t *testing.T) {
+	tree := NewRadixTree()
+	defer tree.FreeTree()
+	for _, k := range []string{"", "a", "ab", "abc", "b", "ba", "c", "\xff"} {
+		tree.Set([]byte(k), []byte("v"+k))
+	}
+	tests := []struct {
+		name       string
+		start, end string
+		reverse    bool
+		stopAfter  int
+		want       []string
+	}{
+		{name: "everything", want: []string{"", "a", "ab", "abc", "b", "ba", "c", "\xff"}},
+		{name: "everything reversed", reverse: true, want: []string{"\xff", "c", "ba", "b", "abc", "ab", "a", ""}},
+		{name: "from start", start: "ab", want: []string{"ab", "abc", "b", "ba", "c", "\xff"}},
+		{name: "to end", end: "b", want: []string{"", "a", "ab", "abc"}},
+		{name: "between", start: "a\x00", end: "ba", want: []string{"ab", "abc", "b"}},
+		{name: "between reversed", start: "a\x00", end: "ba", reverse: true, want: []string{"b", "abc", "ab"}},
+		{name: "missing bounds", start: "aa", end: "bb", want: []string{"ab", "abc", "b", "ba"}},
+		{name: "empty range", start: "b", end: "b"},
+		{name: "stopped early", start: "a", stopAfter: 2, want: []string{"a", "ab"}},
+		{name: "stopped early reversed", reverse: true, stopAfter: 3, want: []string{"\xff", "c", "ba"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			tree.WalkRange([]byte(tt.start), []byte(tt.end), tt.reverse, func(key, value []byte) bool {
+				if string(value) != "v"+string(key) {
+					t.Errorf("key %q: got value %q", key, value)
+				}
+				got = append(got, string(key))
+				return tt.stopAfter == 0 || len(got) < tt.stopAfter
+			}, ImmediateFreer{})
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,523 @@
+#ifndef _RBF_CPP
+#define _RBF_CPP
+#include "rbf.hpp"
+#include <cinttypes>
+#include <cstring>
+#include <cstdio>
+#include <chrono>
+#include <map>
+#include <string>
+#include <fcntl.h>
+#include <unistd.h>
+#include "byteslice.h"
+#include "endianness.h"
+
+// Defines the headers at the start of RBF files.
+static const char rbf1_header[4] = {'R', 'B', 'F', '1'};
+static const char rbf2_header[4] = {'R', 'B', 'F', '2'};
+
+// Defines the RBF2 format version written to the header. Version 3 added the fencing tokens after the base node.
+static const uint16_t rbf2_version = 3;
+static const uint16_t rbf2_fences_version = 3;
+
+// Defines the length of the RBF2 header. This is the magic, version, database index, creation time,
+// entry count and the checksum of all of these.
+static const size_t rbf2_header_len = 4 + 2 + 2 + 8 + 8 + 4;
+
+// Defines the size of the blocks RBF2 data is written in.
+static const size_t rbf2_block_size = 64 * 1024;
+
+// Defines the flags before the content of a RBF2 node.
+static const uint8_t rbf2_flag_has_content = 1;
+static const uint8_t rbf2_flag_expires = 2;
+
+// Computes the CRC32C (Castagnoli) checksum of the data, continuing from the CRC specified.
+static uint32_t crc32c(uint32_t crc, const uint8_t* data, size_t len) {
+    static uint32_t table[256];
+    static bool table_made = [] {
+        for (uint32_t i = 0; i < 256; i++) {
+            uint32_t c = i;
+            for (int j = 0; j < 8; j++) c = c & 1 ? (c >> 1) ^ 0x82F63B78 : c >> 1;
+            table[i] = c;
+        }
+        return true;
+    }();
+    (void)table_made;
+
+    crc = ~crc;
+    for (size_t i = 0; i < len; i++) crc = table[(crc ^ data[i]) & 0xFF] ^ (crc >> 8);
+    return ~crc;
+}
+
+static inline void le_uint16_put(uint8_t* dest, uint16_t val) {
+    dest[0] = val & 0xFF;
+    dest[1] = val >> 8;
+}
+
+static inline void le_uint32_put(uint8_t* dest, uint32_t val) {
+    for (int i = 0; i < 4; i++) dest[i] = (val >> (i * 8)) & 0xFF;
+}
+
+static inline void le_uint64_put(uint8_t* dest, uint64_t val) {
+    auto encoded = le_uint64_encode(val);
+    memcpy(dest, encoded, sizeof(uint64_t));
+    free(encoded);
+}
+
+static inline uint16_t le_uint16_get(const uint8_t* ptr) {
+    return ptr[0] | (ptr[1] << 8);
+}
+
+static inline uint32_t le_uint32_get(const uint8_t* ptr) {
+    uint32_t val{};
+    for (int i = 0; i < 4; i++) val |= (uint32_t)ptr[i] << (i * 8);
+    return val;
+}
+
+// Defines the state used when writing a RBF2 file. Data is buffered into a block, and each
+// block is written with its length and checksum.
+struct _rbf_writer {
+    FILE* file;
+    uint8_t* block;
+    size_t block_len;
+    uint64_t body_len;
+    uint64_t entries;
+    bool ok;
+};
+
+// Writes the buffered block to the file.
+static void rbf_flush_block(_rbf_writer& writer) {
+    if (writer.block_len == 0) return;
+    uint8_t len[4], crc[4];
+    le_uint32_put(len, writer.block_len);
+    le_uint32_put(crc, crc32c(0, writer.block, writer.block_len));
+    writer.ok = writer.ok &&
+        fwrite(len, 1, 4, writer.file) == 4 &&
+        fwrite(writer.block, 1, writer.block_len, writer.file) == writer.block_len &&
+        fwrite(crc, 1, 4, writer.file) == 4;
+    writer.body_len += writer.block_len;
+    writer.block_len = 0;
+}
+
+// Writes data into the current block, flushing it whenever it fills up.
+static void rbf_write_bytes(_rbf_writer& writer, const void* data, size_t len) {
+    auto ptr = (const uint8_t*)data;
+    while (len != 0) {
+        auto chunk = rbf2_block_size - writer.block_len;
+        if (chunk > len) chunk = len;
+        memcpy(&writer.block[writer.block_len], ptr, chunk);
+        writer.block_len += chunk;
+        ptr += chunk;
+        len -= chunk;
+        if (writer.block_len == rbf2_block_size) rbf_flush_block(writer);
+    }
+}
+
+// Writes a uint64 in little endian.
+static void rbf_write_uint64(_rbf_writer& writer, uint64_t val) {
+    uint8_t buf[sizeof(uint64_t)];
+    le_uint64_put(buf, val);
+    rbf_write_bytes(writer, buf, sizeof(uint64_t));
+}
+
+static void rbf_write_children(_rbf_writer& writer, RadixTreeNode* node);
+
+// Writes a node and all of its children.
+static void rbf_write_node(_rbf_writer& writer, RadixTreeNode* node) {
+    // Write the key.
+    rbf_write_uint64(writer, node->key.length);
+    rbf_write_bytes(writer, node->key.value, node->key.length);
+
+    // Write the flags and then the content if there is any.
+    auto content = node->content;
+    uint8_t flags = content ? rbf2_flag_has_content : 0;
+    if (content && node->expires_at != 0) flags |= rbf2_flag_expires;
+    rbf_write_bytes(writer, &flags, 1);
+    if (content) {
+        rbf_write_uint64(writer, content->length);
+        rbf_write_bytes(writer, content->value, content->length);
+        if (flags & rbf2_flag_expires) rbf_write_uint64(writer, (uint64_t)node->expires_at);
+        writer.entries++;
+    }
+
+    // Write the children.
+    rbf_write_children(writer, node);
+}
+
+// Writes the children of a node.
+static void rbf_write_children(_rbf_writer& writer, RadixTreeNode* node) {
+    rbf_write_uint64(writer, node->children_len);
+    for (size_t i = 0; i < node->children_len; i++) rbf_write_node(writer, node->children[i]);
+}
+
+// Writes the fencing tokens in byte order of their keys.
+static void rbf_write_fences(_rbf_writer& writer, const std::map<std::string, unsigned long long>& fences) {
+    rbf_write_uint64(writer, fences.size());
+    for (auto& fence : fences) {
+        rbf_write_uint64(writer, fence.first.size());
+        rbf_write_bytes(writer, fence.first.data(), fence.first.size());
+        rbf_write_uint64(writer, fence.second);
+    }
+}
+
+// Builds the RBF2 header.
+static void rbf2_make_header(uint8_t* header, unsigned short db_index, long long created_at, uint64_t entries) {
+    memcpy(header, rbf2_header, sizeof(rbf2_header));
+    le_uint16_put(&header[4], rbf2_version);
+    le_uint16_put(&header[6], db_index);
+    le_uint64_put(&header[8], (uint64_t)created_at);
+    le_uint64_put(&header[16], entries);
+    le_uint32_put(&header[24], crc32c(0, header, 24));
+}
+
+// Syncs the directory containing the path so that a rename is durable.
+static void rbf_sync_parent(const std::string& path) {
+    auto slash = path.find_last_of('/');
+    auto dir = slash == std::string::npos ? std::string(".") : path.substr(0, slash == 0 ? 1 : slash);
+    int fd = open(dir.c_str(), O_RDONLY);
+    if (fd == -1) return;
+    fsync(fd);
+    close(fd);
+}
+
+bool rbf_write(RadixTreeRoot* tree, RadixTreeNode* node, const char* path, unsigned short db_index) {
+    // Open a temporary file next to the destination. We only replace the destination once this is fully on disk.
+    auto tmp_path = std::string(path) + ".tmp";
+    auto file = fopen(tmp_path.c_str(), "wb");
+    if (!file) return false;
+
+    // Write a placeholder header. This is rewritten once we know the entry count.
+    auto created_at = std::chrono::duration_cast<std::chrono::milliseconds>(
+        std::chrono::system_clock::now().time_since_epoch()).count();
+    uint8_t header[rbf2_header_len];
+    rbf2_make_header(header, db_index, created_at, 0);
+    _rbf_writer writer{};
+    writer.file = file;
+    writer.ok = fwrite(header, 1, rbf2_header_len, file) == rbf2_header_len;
+    writer.block = (uint8_t*)malloc(rbf2_block_size);
+
+    // Write the base node and the fencing tokens. These are frozen, so we do not need to lock the tree.
+    rbf_write_node(writer, node);
+    rbf_write_fences(writer, tree->frozen_fences);
+    rbf_flush_block(writer);
+    free(writer.block);
+
+    // Write the end block and the length trailer.
+    uint8_t trailer[4 + sizeof(uint64_t)]{};
+    le_uint64_put(&trailer[4], writer.body_len);
+    writer.ok = writer.ok && fwrite(trailer, 1, sizeof(trailer), file) == sizeof(trailer);
+
+    // Rewrite the header with the entry count.
+    rbf2_make_header(header, db_index, created_at, writer.entries);
+    writer.ok = writer.ok &&
+        fseek(file, 0, SEEK_SET) == 0 &&
+        fwrite(header, 1, rbf2_header_len, file) == rbf2_header_len;
+
+    // Flush and sync the file to disk.
+    writer.ok = writer.ok && fflush(file) == 0 && fsync(fileno(file)) == 0;
+    writer.ok = fclose(file) == 0 && writer.ok;
+    if (!writer.ok) {
+        remove(tmp_path.c_str());
+        return false;
+    }
+
+    // Atomically replace the destination.
+    if (rename(tmp_path.c_str(), path) != 0) {
+        remove(tmp_path.c_str());
+        return false;
+    }
+    rbf_sync_parent(path);
+    return true;
+}
+
+// Defines the state used when reading a file. In RBF2 files, data is read from a verified block at a time.
+struct _rbf_reader {
+    FILE* file;
+    uint64_t remaining;
+    int version;
+    uint16_t format_version;
+    uint8_t* block;
+    size_t block_len;
+    size_t block_pos;
+    uint64_t body_len;
+};
+
+// Reads directly from the file. Returns false if the file is too short.
+static bool rbf_read_file(_rbf_reader& reader, void* dest, uint64_t len) {
+    if (len > reader.remaining) return false;
+    if (len == 0) return true;
+    if (fread(dest, 1, len, reader.file) != len) return false;
+    reader.remaining -= len;
+    return true;
+}
+
+// Loads the next RBF2 block and checks its checksum. Returns false if there is not another valid block.
+static bool rbf_next_block(_rbf_reader& reader) {
+    uint8_t len_buf[4];
+    if (!rbf_read_file(reader, len_buf, 4)) return false;
+    auto len = le_uint32_get(len_buf);
+    if (len == 0 || len > reader.remaining) return false;
+    auto block = (uint8_t*)realloc(reader.block, len);
+    if (!block) return false;
+    reader.block = block;
+    uint8_t crc_buf[4];
+    if (!rbf_read_file(reader, block, len) || !rbf_read_file(reader, crc_buf, 4)) return false;
+    if (crc32c(0, block, len) != le_uint32_get(crc_buf)) return false;
+    reader.block_len = len;
+    reader.block_pos = 0;
+    reader.body_len += len;
+    return true;
+}
+
+// Gets the maximum number of bytes which could be left to read.
+static uint64_t rbf_available(_rbf_reader& reader) {
+    return reader.remaining + (reader.block_len - reader.block_pos);
+}
+
+// Reads the number of bytes specified. Returns false if the file is too short or corrupt.
+static bool rbf_read(_rbf_reader& reader, void* dest, uint64_t len) {
+    if (reader.version == 1) return rbf_read_file(reader, dest, len);
+
+    auto ptr = (uint8_t*)dest;
+    while (len != 0) {
+        if (reader.block_pos == reader.block_len && !rbf_next_block(reader)) return false;
+        uint64_t chunk = reader.block_len - reader.block_pos;
+        if (chunk > len) chunk = len;
+        memcpy(ptr, &reader.block[reader.block_pos], chunk);
+        reader.block_pos += chunk;
+        ptr += chunk;
+        len -= chunk;
+    }
+    return true;
+}
+
+// Reads a little endian uint64.
+static bool rbf_read_uint64(_rbf_reader& reader, uint64_t* val) {
+    uint8_t buf[sizeof(uint64_t)];
+    if (!rbf_read(reader, buf, sizeof(uint64_t))) return false;
+    *val = le_uint64_decode(buf);
+    return true;
+}
+
+// Reads a length and then allocates and reads that many bytes.
+static bool rbf_read_chunk(_rbf_reader& reader, ByteSlice* slice) {
+    uint64_t len;
+    if (!rbf_read_uint64(reader, &len)) return false;
+    if (len > rbf_available(reader)) return false;
+    slice->length = len;
+    slice->value = (uint8_t*)malloc(len);
+    if (rbf_read(reader, slice->value, len)) return true;
+    free(slice->value);
+    slice->value = nullptr;
+    return false;
+}
+
+static bool rbf_read_children(_rbf_reader& reader, RadixTreeNode* node);
+
+// Frees a node which has not been attached to a tree yet.
+static void rbf_free_node(RadixTreeNode* node) {
+    free_node_children(node->children, node->children_len);
+    free(node->key.value);
+    if (node->content) {
+        free(node->content->value);
+        free(node->content);
+    }
+    free(node);
+}
+
+// Reads the content of a RBF1 node. A zero length is followed by a byte saying if the content is null.
+static bool rbf1_read_content(_rbf_reader& reader, RadixTreeNode* node) {
+    ByteSlice content{};
+    if (!rbf_read_chunk(reader, &content)) return false;
+    if (content.length == 0) {
+        uint8_t null_byte;
+        if (!rbf_read(reader, &null_byte, 1)) {
+            free(content.value);
+            return false;
+        }
+        if (null_byte == 1) {
+            free(content.value);
+            return true;
+        }
+    }
+    node->content = (ByteSlice*)malloc(sizeof(ByteSlice));
+    *node->content = content;
+    return true;
+}
+
+// Reads the content of a RBF2 node. This starts with flags defining what follows.
+static bool rbf2_read_content(_rbf_reader& reader, RadixTreeNode* node) {
+    uint8_t flags;
+    if (!rbf_read(reader, &flags, 1)) return false;
+    if (flags & rbf2_flag_has_content) {
+        ByteSlice content{};
+        if (!rbf_read_chunk(reader, &content)) return false;
+        node->content = (ByteSlice*)malloc(sizeof(ByteSlice));
+        *node->content = content;
+        if (flags & rbf2_flag_expires) {
+            uint64_t expires_at;
+            if (!rbf_read_uint64(reader, &expires_at)) return false;
+            node->expires_at = (long long)expires_at;
+        }
+    }
+    return true;
+}
+
+// Reads a node and its children. Returns a null pointer if the node is malformed.
+static RadixTreeNode* rbf_read_node(_rbf_reader& reader) {
+    // Create the node and read the key.
+    auto node = (RadixTreeNode*)calloc(1, sizeof(RadixTreeNode));
+    if (!rbf_read_chunk(reader, &node->key)) {
+        free(node);
+        return nullptr;
+    }
+
+    // Read the content and then the children.
+    bool ok = reader.version == 1 ? rbf1_read_content(reader, node) : rbf2_read_content(reader, node);
+    if (!ok || !rbf_read_children(reader, node)) {
+        rbf_free_node(node);
+        return nullptr;
+    }
+    return node;
+}
+
+// Reads the children into the node specified. On failure, any children which were read are attached to the node.
+static bool rbf_read_children(_rbf_reader& reader, RadixTreeNode* node) {
+    // Get the number of children. Each child is at least 17 bytes, so use that to check the length is sane.
+    uint64_t children_len;
+    if (!rbf_read_uint64(reader, &children_len)) return false;
+    if (children_len == 0) return true;
+    if (children_len > rbf_available(reader) / 17) return false;
+
+    // Read each child.
+    node->children = (RadixTreeNode**)malloc(sizeof(RadixTreeNode*) * children_len); // NOLINT
+    for (uint64_t i = 0; i < children_len; i++) {
+        auto child = rbf_read_node(reader);
+        if (!child) {
+            if (i == 0) {
+                free(node->children);
+                node->children = nullptr;
+            }
+            return false;
+        }
+        node->children[i] = child;
+        node->children_len++;
+        if (child->key.length == 0) return false;
+    }
+
+    // Files written before children were kept in byte order may have them in any order.
+    sort_node_children(node);
+    return true;
+}
+
+// Opens the file and reads the header. On success, the reader is ready to read the base nodes children.
+static bool rbf_open(_rbf_reader& reader, const char* path, RBFHeader* metadata) {
+    reader.file = fopen(path, "rb");
+    if (!reader.file) return false;
+    if (fseek(reader.file, 0, SEEK_END) != 0) return false;
+    auto size = ftell(reader.file);
+    if (size < 0 || fseek(reader.file, 0, SEEK_SET) != 0) return false;
+    reader.remaining = (uint64_t)size;
+
+    // Check the magic.
+    uint8_t header[rbf2_header_len];
+    if (!rbf_read_file(reader, header, 4)) return false;
+    if (memcmp(header, rbf1_header, 4) == 0) {
+        // RBF1 files are just the data with no metadata.
+        reader.version = 1;
+        if (metadata) *metadata = RBFHeader{1, 0, 0, 0};
+        return true;
+    }
+    if (memcmp(header, rbf2_header, 4) != 0) return false;
+
+    // Read and verify the rest of the RBF2 header.
+    if (!rbf_read_file(reader, &header[4], rbf2_header_len - 4)) return false;
+    if (crc32c(0, header, 24) != le_uint32_get(&header[24])) return false;
+    reader.version = 2;
+    reader.format_version = le_uint16_get(&header[4]);
+    if (metadata) {
+        metadata->version = le_uint16_get(&header[4]);
+        metadata->db_index = le_uint16_get(&header[6]);
+        metadata->created_at = (long long)le_uint64_decode(&header[8]);
+        metadata->entries = le_uint64_decode(&header[16]);
+    }
+    return true;
+}
+
+// Reads the fencing tokens which follow the base node. Each one is at least 16 bytes, so use that to check the length
+// is sane.
+static bool rbf_read_fences(_rbf_reader& reader, std::map<std::string, unsigned long long>& fences) {
+    uint64_t count;
+    if (!rbf_read_uint64(reader, &count)) return false;
+    if (count > rbf_available(reader) / 16) return false;
+    for (uint64_t i = 0; i < count; i++) {
+        ByteSlice key{};
+        uint64_t token;
+        if (!rbf_read_chunk(reader, &key)) return false;
+        auto key_str = std::string((const char*)key.value, key.length);
+        free(key.value);
+        if (!rbf_read_uint64(reader, &token)) return false;
+        fences[key_str] = token;
+    }
+    return true;
+}
+
+// Checks that the RBF2 body ended cleanly with the end block and a matching length trailer.
+static bool rbf2_check_trailer(_rbf_reader& reader) {
+    if (reader.block_pos != reader.block_len) return false;
+    uint8_t trailer[4 + sizeof(uint64_t)];
+    if (!rbf_read_file(reader, trailer, sizeof(trailer))) return false;
+    return le_uint32_get(trailer) == 0 && le_uint64_decode(&trailer[4]) == reader.body_len;
+}
+
+RadixTreeRoot* rbf_load(const char* path) {
+    // Open the file and read the header.
+    _rbf_reader reader{};
+    if (!rbf_open(reader, path, nullptr)) {
+        if (reader.file) fclose(reader.file);
+        return nullptr;
+    }
+
+    // Read the base node. In RBF1 files, this is just the children of it. Newer RBF2 files follow it with the
+    // fencing tokens.
+    RadixTreeNode* base;
+    std::map<std::string, unsigned long long> fences;
+    bool ok;
+    if (reader.version == 1) {
+        base = (RadixTreeNode*)calloc(1, sizeof(RadixTreeNode));
+        ok = rbf_read_children(reader, base);
+    } else {
+        base = rbf_read_node(reader);
+        ok = base && base->key.length == 0 &&
+            (reader.format_version < rbf2_fences_version || rbf_read_fences(reader, fences)) &&
+            rbf2_check_trailer(reader);
+    }
+    ok = ok && reader.remaining == 0;
+    free(reader.block);
+    fclose(reader.file);
+    if (!ok) {
+        if (base) rbf_free_node(base);
+        return nullptr;
+    }
+
+    // Create the tree around the base node.
+    auto tree = new RadixTreeRoot();
+    free(tree->node);
+    tree->node = base;
+    tree->fences = std::move(fences);
+    tree->rebuild_indexes();
+    return tree;
+}
+
+RBFHeader* rbf_read_metadata(const char* path) {
+    _rbf_reader reader{};
+    auto metadata = (RBFHeader*)malloc(sizeof(RBFHeader));
+    bool ok = rbf_open(reader, path, metadata);
+    if (reader.file) fclose(reader.file);
+    if (!ok) {
+        free(metadata);
+        return nullptr;
+    }
+    return metadata;
+}
+#endif // _RBF_CPP
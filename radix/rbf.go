@@ -0,0 +1,78 @@
+package radix
+
+import (
+	"time"
+	"unsafe"
+)
+
+// RBF is used to read and write radix trees to a file in the Radix Binary Format.
+type RBF struct {
+	path    string
+	dbIndex uint16
+}
+
+// NewRBF is used to create a RBF handler for the path specified. The database index is stored in the
+// metadata of files which are written.
+func NewRBF(path string, dbIndex uint16) RBF {
+	return RBF{path: path, dbIndex: dbIndex}
+}
+
+// Load is used to load the tree from disk. If the tree could not be loaded, nil is returned.
+func (r RBF) Load() *RadixTree {
+	cObj := Rbf_load(r.path)
+	if cObj == nil || cObj.Swigcptr() == 0 {
+		return nil
+	}
+	return &RadixTree{cObj: cObj}
+}
+
+// Write is used to write the tree to disk. Returns true if the write was successful.
+func (r RBF) Write(tree RadixTree) bool {
+	s := tree.Snapshot()
+	defer s.Release()
+	return r.WriteSnapshot(s)
+}
+
+// WriteSnapshot is used to write a snapshot of a tree to disk. Returns true if the write was successful.
+func (r RBF) WriteSnapshot(s Snapshot) bool {
+	return Rbf_write(s.tree.cObj, s.node, r.path, r.dbIndex)
+}
+
+type rbfMetadataGo struct {
+	version   uint16
+	dbIndex   uint16
+	createdAt int64
+	entries   uint64
+}
+
+// RBFMetadata is the metadata stored in the header of a RBF file.
+type RBFMetadata struct {
+	// Version is the format version of the file. RBF1 files have no other metadata.
+	Version uint16
+
+	// DBIndex is the index of the database which was saved.
+	DBIndex uint16
+
+	// CreatedAt is when the file was written.
+	CreatedAt time.Time
+
+	// Entries is the number of entries in the file.
+	Entries uint64
+}
+
+// Metadata is used to read the metadata from the file on disk. If the header could not be read, nil is returned.
+func (r RBF) Metadata() *RBFMetadata {
+	ptr := Rbf_read_metadata(r.path)
+	if ptr == nil || ptr.Swigcptr() == 0 {
+		return nil
+	}
+	defer Swig_free(ptr.Swigcptr())
+
+	goVal := *(*rbfMetadataGo)(unsafe.Pointer(ptr.Swigcptr()))
+	return &RBFMetadata{
+		Version:   goVal.version,
+		DBIndex:   goVal.dbIndex,
+		CreatedAt: time.UnixMilli(goVal.createdAt),
+		Entries:   goVal.entries,
+	}
+}
@@ -0,0 +1,30 @@
+#ifndef RBF_H
+#define RBF_H
+#include "radix.hpp"
+
+// Defines the metadata stored in the header of a RBF file.
+struct RBFHeader {
+    // Defines the format version. RBF1 files have no other metadata.
+    unsigned short version;
+
+    // Defines the index of the database which was saved.
+    unsigned short db_index;
+
+    // Defines when the file was created in milliseconds since the Unix epoch.
+    long long created_at;
+
+    // Defines the number of entries in the file.
+    size_t entries;
+};
+
+// Writes the frozen base node of a tree to the path specified in the Radix Binary Format, along with the fencing tokens
+// from when the tree was frozen. The file is written to a temporary path and synced before it replaces the original,
+// so a failed write never corrupts it. Returns true if the write was successful.
+bool rbf_write(RadixTreeRoot* tree, RadixTreeNode* node, const char* path, unsigned short db_index);
+
+// Loads a tree from the Radix Binary Format file at the path specified. Returns a null pointer on failure.
+RadixTreeRoot* rbf_load(const char* path);
+
+// Reads the metadata from the header of the file at the path specified. Returns a null pointer on failure.
+RBFHeader* rbf_read_metadata(const char* path);
+#endif
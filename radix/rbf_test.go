@@ -0,0 +1,202 @@
+package radix
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestRBFRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		values map[string]string
+		fences map[string]uint64
+	}{
+		{name: "empty"},
+		{name: "single key", values: map[string]string{"hello": "world"}},
+		{
+			name: "shared prefixes",
+			values: map[string]string{
+				"a":      "1",
+				"ab":     "2",
+				"abc":    "3",
+				"abd":    "4",
+				"b":      "5",
+				"\x00\n": "binary",
+			},
+		},
+		{
+			name:   "fences",
+			values: map[string]string{"fenced": "1", "other": "2"},
+			fences: map[string]uint64{"fenced": 10},
+		},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Insert in a fixed order so every run builds the same tree.
+			keys := make([]string, 0, len(tt.values))
+			for k := range tt.values {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			tree := NewRadixTree()
+			defer tree.FreeTree()
+			for _, k := range keys {
+				tree.Set([]byte(k), []byte(tt.values[k]))
+			}
+			for k, token := range tt.fences {
+				if tree.SetIf([]byte(k), []byte(tt.values[k]), time.Time{}, SetIfFence, nil, token) == 0 {
+					t.Fatalf("fenced set of %q failed", k)
+				}
+			}
+
+			rbf := NewRBF(filepath.Join(t.TempDir(), "db.rbf"), uint16(i))
+			if !rbf.Write(tree) {
+				t.Fatal("write failed")
+			}
+			loaded := rbf.Load()
+			if loaded == nil {
+				t.Fatal("load failed")
+			}
+			defer loaded.FreeTree()
+
+			for _, k := range keys {
+				value, free := loaded.Get([]byte(k))
+				if string(value) != tt.values[k] {
+					t.Errorf("key %q: got %q, want %q", k, value, tt.values[k])
+				}
+				free()
+			}
+			value, free := loaded.Get([]byte("missing"))
+			defer free()
+			if value != nil {
+				t.Errorf("got %q for a key which was never set", value)
+			}
+			for k, token := range tt.fences {
+				if loaded.SetIf([]byte(k), []byte("stale"), time.Time{}, SetIfFence, nil, token-1) != 0 {
+					t.Errorf("key %q: a stale token was accepted after loading", k)
+				}
+			}
+
+			metadata := rbf.Metadata()
+			if metadata == nil {
+				t.Fatal("metadata could not be read")
+			}
+			if metadata.Version != 3 || metadata.DBIndex != uint16(i) || metadata.Entries != uint64(len(keys)) {
+				t.Errorf("got metadata %+v, want version 3, index %d and %d entries", *metadata, i, len(keys))
+			}
+		})
+	}
+}
+
+func TestRBFLoadMissingFile(t *testing.T) {
+	if loaded := NewRBF(filepath.Join(t.TempDir(), "missing.rbf"), 0).Load(); loaded != nil {
+		loaded.FreeTree()
+		t.Fatal("a file which does not exist was loaded")
+	}
+}
+
+// rbf1Node is a node to be written to a RBF1 file.
+type rbf1Node struct {
+	key      string
+	content  *string
+	children []rbf1Node
+}
+
+// appendRBF1Children is used to write children in the RBF1 format.
+func appendRBF1Children(b []byte, children []rbf1Node) []byte {
+	b = binary.LittleEndian.AppendUint64(b, uint64(len(children)))
+	for _, n := range children {
+		b = binary.LittleEndian.AppendUint64(b, uint64(len(n.key)))
+		b = append(b, n.key...)
+		switch {
+		case n.content == nil:
+			b = binary.LittleEndian.AppendUint64(b, 0)
+			b = append(b, 1)
+		case *n.content == "":
+			b = binary.LittleEndian.AppendUint64(b, 0)
+			b = append(b, 0)
+		default:
+			b = binary.LittleEndian.AppendUint64(b, uint64(len(*n.content)))
+			b = append(b, *n.content...)
+		}
+		b = appendRBF1Children(b, n.children)
+	}
+	return b
+}
+
+func TestRBF1Compatibility(t *testing.T) {
+	one, two, three, empty := "1", "2", "3", ""
+	path := filepath.Join(t.TempDir(), "db.rbf")
+	b := appendRBF1Children([]byte("RBF1"), []rbf1Node{
+		{key: "a", content: &one, children: []rbf1Node{
+			{key: "bc", content: &two},
+		}},
+		{key: "x", children: []rbf1Node{
+			{key: "y", content: &three},
+			{key: "z", content: &empty},
+		}},
+	})
+	if err := os.WriteFile(path, b, 0o666); err != nil {
+		t.Fatal(err)
+	}
+
+	rbf := NewRBF(path, 0)
+	loaded := rbf.Load()
+	if loaded == nil {
+		t.Fatal("load failed")
+	}
+	defer loaded.FreeTree()
+	for k, want := range map[string]*string{"a": &one, "abc": &two, "x": nil, "xy": &three, "xz": &empty} {
+		value, free := loaded.Get([]byte(k))
+		switch {
+		case want == nil && value != nil:
+			t.Errorf("key %q: got %q for a node without content", k, value)
+		case want != nil && (value == nil || string(value) != *want):
+			t.Errorf("key %q: got %q, want %q", k, value, *want)
+		}
+		free()
+	}
+	if metadata := rbf.Metadata(); metadata == nil || metadata.Version != 1 {
+		t.Errorf("got metadata %+v, want version 1", metadata)
+	}
+}
+
+func TestRBFRejectsDamagedFiles(t *testing.T) {
+	tree := NewRadixTree()
+	defer tree.FreeTree()
+	tree.Set([]byte("hello"), []byte("world"))
+	tree.Set([]byte("help"), []byte("me"))
+	dir := t.TempDir()
+	good := filepath.Join(dir, "good.rbf")
+	if !NewRBF(good, 0).Write(tree) {
+		t.Fatal("write failed")
+	}
+	b, err := os.ReadFile(good)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := "value"
+	rbf1 := appendRBF1Children([]byte("RBF1"), []rbf1Node{{key: "key", content: &value}})
+
+	for name, damaged := range map[string][]byte{
+		"empty file":          nil,
+		"bad magic":           append([]byte("RBF9"), b[4:]...),
+		"bad header checksum": append(append(append([]byte(nil), b[:10]...), ^b[10]), b[11:]...),
+		"bad block checksum":  append(append(append([]byte(nil), b[:len(b)-20]...), ^b[len(b)-20]), b[len(b)-19:]...),
+		"truncated":           b[:len(b)-5],
+		"truncated RBF1":      rbf1[:20],
+	} {
+		path := filepath.Join(dir, "damaged.rbf")
+		if err = os.WriteFile(path, damaged, 0o666); err != nil {
+			t.Fatal(err)
+		}
+		if loaded := NewRBF(path, 0).Load(); loaded != nil {
+			loaded.FreeTree()
+			t.Errorf("%s: damaged file was loaded", name)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/jakemakesstuff/packetmaker"
+	"github.com/webscalesoftwareltd/hypercache/radix"
+)
+
+// Defines the kinds of operation in a transaction.
+const (
+	txOpGet byte = iota
+	txOpSet
+	txOpDeleteKey
+	txOpDeletePrefix
+)
+
+// watchedKey is a key which must still have the version specified for a transaction to run. A version of 0 means
+// the key must not exist.
+type watchedKey struct {
+	key     []byte
+	version uint64
+}
+
+// transactionOp is an operation in a transaction.
+type transactionOp struct {
+	kind      byte
+	key       []byte
+	value     []byte
+	expiresAt time.Time
+}
+
+// transactionResult is the result of an operation in a transaction.
+type transactionResult struct {
+	// value is the value a get found, or nil if the key was not found.
+	value []byte
+
+	// n is 1 if a set overwrote something or a delete deleted something (0 if not), or the number of nodes a prefix
+	// delete removed.
+	n uint64
+}
+
+// Exec is used to run the operations atomically, in order. If a watched key does not have the version it was watched
+// with, nothing is run and executed is false. Returns errOutOfMemory if there is not enough memory for the sets.
+func (d *database) Exec(
+	watches []watchedKey, ops []transactionOp,
+) (results []transactionResult, executed bool, err error) {
+	// Build the transaction along with the log entries for the writes in it.
+	tx := radix.NewTransaction()
+	defer tx.Free()
+	for _, w := range watches {
+		tx.Watch(w.key, w.version)
+	}
+	unlock := d.lockMemory()
+	defer unlock()
+	var entries []byte
+	var size uint64
+	for _, op := range ops {
+		switch op.kind {
+		case txOpGet:
+			tx.Get(op.key)
+		case txOpSet:
+			tx.Set(op.key, op.value, op.expiresAt)
+			size += d.growth(op.key, len(op.value))
+			if op.expiresAt.IsZero() {
+				entries = append(entries, walSetEntry(op.key, op.value)...)
+			} else {
+				entries = append(entries, walSetExpiringEntry(op.key, op.value, op.expiresAt)...)
+			}
+		case txOpDeleteKey:
+			tx.DeleteKey(op.key)
+			entries = append(entries, walKeyEntry(walOpDeleteKey, op.key)...)
+		case txOpDeletePrefix:
+			tx.DeletePrefix(op.key)
+			entries = append(entries, walKeyEntry(walOpDeletePrefix, op.key)...)
+		}
+	}
+	if !d.reserve(size) {
+		return nil, false, errOutOfMemory
+	}
+
+	// Run the transaction. The entries are written to the log in one write.
+	d.wal.apply(entries, func() bool {
+		executed = d.RadixTree.Exec(tx)
+		if executed {
+			d.notifyTransaction(tx, ops)
+		}
+		return executed && len(entries) != 0
+	})
+	if !executed {
+		return nil, false, nil
+	}
+
+	// Get the results. Values only live as long as the transaction, so copy them.
+	results = make([]transactionResult, len(ops))
+	for i, op := range ops {
+		if op.kind == txOpGet {
+			if value := tx.Value(i); value != nil {
+				results[i].value = append([]byte{}, value...)
+			}
+		} else {
+			results[i].n = tx.Result(i)
+		}
+	}
+	return results, true, nil
+}
+
+// notifyTransaction is used to send the keyspace notifications for the writes in a transaction which ran.
+func (d *database) notifyTransaction(tx radix.Transaction, ops []transactionOp) {
+	for i, op := range ops {
+		switch op.kind {
+		case txOpSet:
+			d.events.notifyKeyspace(keyspaceOpSet, op.key, 0, op.value)
+		case txOpDeleteKey:
+			if tx.Result(i) != 0 {
+				d.events.notifyKeyspace(keyspaceOpDelete, op.key, 0, nil)
+			}
+		case txOpDeletePrefix:
+			if removed := tx.Result(i); removed != 0 {
+				d.events.notifyKeyspace(keyspaceOpDeletePrefix, op.key, removed, nil)
+			}
+		}
+	}
+}
+
+var errShortTransaction = errors.New("Packet too short for the transaction.")
+
+// parseTransaction is used to parse a transaction packet. This is the number of watched keys followed by each one
+// ([u32 key length][key][u64 version]), and then the number of operations followed by each one ([u8 kind]
+// [u32 key length][key], with [u64 TTL in milliseconds, 0 for none][u32 value length][value] after the key for sets).
+func parseTransaction(packet []byte) (watches []watchedKey, ops []transactionOp, err error) {
+	// readBytes is used to read length prefixed bytes from the packet.
+	readBytes := func() ([]byte, bool) {
+		if len(packet) < 4 {
+			return nil, false
+		}
+		keyLen := int(binary.LittleEndian.Uint32(packet))
+		packet = packet[4:]
+		if len(packet) < keyLen {
+			return nil, false
+		}
+		key := packet[:keyLen]
+		packet = packet[keyLen:]
+		return key, true
+	}
+
+	// Read the watched keys.
+	if len(packet) < 4 {
+		return nil, nil, errShortTransaction
+	}
+	watchCount := int(binary.LittleEndian.Uint32(packet))
+	packet = packet[4:]
+	for i := 0; i < watchCount; i++ {
+		key, ok := readBytes()
+		if !ok || len(packet) < 8 {
+			return nil, nil, errShortTransaction
+		}
+		watches = append(watches, watchedKey{key: key, version: binary.LittleEndian.Uint64(packet)})
+		packet = packet[8:]
+	}
+
+	// Read the operations.
+	if len(packet) < 4 {
+		return nil, nil, errShortTransaction
+	}
+	opCount := int(binary.LittleEndian.Uint32(packet))
+	packet = packet[4:]
+	for i := 0; i < opCount; i++ {
+		if len(packet) < 1 {
+			return nil, nil, errShortTransaction
+		}
+		op := transactionOp{kind: packet[0]}
+		packet = packet[1:]
+		if op.kind > txOpDeletePrefix {
+			return nil, nil, errors.New("Unknown transaction operation.")
+		}
+		var ok bool
+		if op.key, ok = readBytes(); !ok {
+			return nil, nil, errShortTransaction
+		}
+		if op.kind == txOpSet {
+			if len(packet) < 8 {
+				return nil, nil, errShortTransaction
+			}
+			op.expiresAt = expiryFromTTL(binary.LittleEndian.Uint64(packet))
+			packet = packet[8:]
+			if op.value, ok = readBytes(); !ok {
+				return nil, nil, errShortTransaction
+			}
+		}
+		ops = append(ops, op)
+	}
+	return watches, ops, nil
+}
+
+// makeTransactionResult is used to make the result of a transaction. This is a byte which is 1 if it was executed,
+// followed by the result of each operation. Gets are [u8 found] followed by [u32 value length][value] if found,
+// and everything else is a u64.
+func makeTransactionResult(ops []transactionOp, results []transactionResult, executed bool) []byte {
+	p := packetmaker.New()
+	if !executed {
+		return p.Byte(0).Make()
+	}
+	p.Byte(1)
+	for i, op := range ops {
+		if op.kind != txOpGet {
+			p.Uint64(results[i].n, true)
+		} else if results[i].value == nil {
+			p.Byte(0)
+		} else {
+			p.Byte(1).Uint32(uint32(len(results[i].value)), true).Bytes(results[i].value)
+		}
+	}
+	return p.Make()
+}
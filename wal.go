@@ -0,0 +1,372 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jakemakesstuff/packetmaker"
+	"github.com/webscalesoftwareltd/hypercache/radix"
+)
+
+// Defines the operations that can be stored in the write-ahead log.
+const (
+	walOpSet          byte = 1
+	walOpDeleteKey    byte = 2
+	walOpDeletePrefix byte = 3
+	walOpFreeTree     byte = 4
+	walOpSetExpiring  byte = 5
+	walOpExpireAt     byte = 6
+	walOpSetFenced    byte = 7
+)
+
+// walFsyncPolicy defines when the write-ahead log is synced to disk.
+type walFsyncPolicy int
+
+const (
+	// walFsyncAlways syncs the log after every mutation.
+	walFsyncAlways walFsyncPolicy = iota
+
+	// walFsyncEverySecond syncs the log once a second if it has been written to.
+	walFsyncEverySecond
+
+	// walFsyncNever leaves syncing the log up to the operating system.
+	walFsyncNever
+)
+
+func parseWalFsyncPolicy(s string) (walFsyncPolicy, error) {
+	switch s {
+	case "always":
+		return walFsyncAlways, nil
+	case "everysec":
+		return walFsyncEverySecond, nil
+	case "never":
+		return walFsyncNever, nil
+	default:
+		return 0, errors.New("unknown fsync policy: " + s)
+	}
+}
+
+// writeAheadLog is an append-only log of the mutations made to a database since its last snapshot.
+// A nil log does nothing and just runs the mutations it is given.
+type writeAheadLog struct {
+	mu     sync.Mutex
+	name   string
+	f      *os.File
+	policy walFsyncPolicy
+	dirty  bool
+}
+
+// openWriteAheadLog is used to open (or create) the log at the path specified.
+func openWriteAheadLog(path, name string, policy walFsyncPolicy) (*writeAheadLog, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o666)
+	if err != nil {
+		return nil, err
+	}
+	l := &writeAheadLog{name: name, f: f, policy: policy}
+	if policy == walFsyncEverySecond {
+		go l.syncLoop()
+	}
+	return l, nil
+}
+
+func (l *writeAheadLog) syncLoop() {
+	for {
+		time.Sleep(time.Second)
+		l.mu.Lock()
+		if l.dirty {
+			if err := l.f.Sync(); err != nil {
+				_, _ = fmt.Fprintln(os.Stderr, "[ERROR]", l.name, "write-ahead log could not be synced:", err)
+			}
+			l.dirty = false
+		}
+		l.mu.Unlock()
+	}
+}
+
+// apply is used to run the mutation and then write the entry to the log if the mutation returns true, so
+// mutations which change nothing (such as deleting a key which does not exist) are not logged.
+func (l *writeAheadLog) apply(entry []byte, mutation func() bool) {
+	l.applyResult(func() []byte {
+		if mutation() {
+			return entry
+		}
+		return nil
+	})
+}
+
+// applyResult is used to run the mutation and then write the entry it returns to the log. This is used for mutations
+// which are logged by their result (such as increments being logged as sets). A nil entry is not logged. The log is
+// locked throughout, so the order of the entries always matches the order the mutations were made in.
+func (l *writeAheadLog) applyResult(mutation func() []byte) {
+	if l == nil {
+		mutation()
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entry := mutation()
+	if entry == nil {
+		return
+	}
+	_, err := l.f.Write(entry)
+	if err == nil && l.policy == walFsyncAlways {
+		err = l.f.Sync()
+	}
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, "[ERROR]", l.name, "could not be written to the write-ahead log:", err)
+	}
+	l.dirty = true
+}
+
+// snapshot is used to take a snapshot of the tree and write it with the function specified. Writes are only paused
+// whilst the snapshot is taken, so the log position matches it. If the write is successful, the log is compacted
+// down to the entries written since the snapshot was taken.
+func (l *writeAheadLog) snapshot(tree radix.RadixTree, write func(radix.Snapshot) bool) bool {
+	if l == nil {
+		s := tree.Snapshot()
+		defer s.Release()
+		return write(s)
+	}
+
+	// Take the snapshot and get the log position it matches.
+	l.mu.Lock()
+	s := tree.Snapshot()
+	offset, err := l.f.Seek(0, io.SeekCurrent)
+	l.mu.Unlock()
+	if err != nil {
+		s.Release()
+		return false
+	}
+
+	// Write the snapshot.
+	ok := write(s)
+	s.Release()
+	if ok {
+		if err = l.compact(offset); err != nil {
+			_, _ = fmt.Fprintln(os.Stderr, "[ERROR]", l.name, "write-ahead log could not be compacted:", err)
+		}
+	}
+	return ok
+}
+
+// compact is used to remove everything before the offset from the log. The remainder is written to a new file
+// which replaces the log, so a crash during compaction leaves the old log in place.
+func (l *writeAheadLog) compact(offset int64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Read everything written since the offset.
+	end, err := l.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	remainder := make([]byte, end-offset)
+	if _, err = l.f.ReadAt(remainder, offset); err != nil {
+		return err
+	}
+
+	// Write the remainder to a new file and swap it in.
+	path := l.f.Name()
+	f, err := os.OpenFile(path+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o666)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(remainder); err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		_ = f.Close()
+		_ = os.Remove(path + ".tmp")
+		return err
+	}
+	_ = l.f.Close()
+	l.f = f
+	l.dirty = false
+	return nil
+}
+
+// replay is used to apply every entry in the log to the tree. A partially written entry at the end of the log
+// (for example, from a crash mid-write) is discarded. Returns the number of entries replayed.
+func (l *writeAheadLog) replay(tree radix.RadixTree) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, err := io.ReadAll(l.f)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	offset := 0
+	for offset < len(b) {
+		n := replayWalEntry(tree, b[offset:])
+		if n == 0 {
+			break
+		}
+		offset += n
+		count++
+	}
+
+	// Cut off anything we could not read so new entries are not appended after it.
+	if offset != len(b) {
+		if err = l.f.Truncate(int64(offset)); err != nil {
+			return count, err
+		}
+	}
+	_, err = l.f.Seek(int64(offset), io.SeekStart)
+	return count, err
+}
+
+// Reads a length prefixed chunk from the entry. Returns nil if the entry is too short.
+func readWalChunk(b []byte) (chunk, remainder []byte) {
+	if len(b) < 4 {
+		return nil, nil
+	}
+	chunkLen := binary.LittleEndian.Uint32(b)
+	b = b[4:]
+	if uint32(len(b)) < chunkLen {
+		return nil, nil
+	}
+	return b[:chunkLen], b[chunkLen:]
+}
+
+// Applies the first entry in b to the tree. Returns the length of the entry, or 0 if it is incomplete or invalid.
+func replayWalEntry(tree radix.RadixTree, b []byte) int {
+	switch b[0] {
+	case walOpSet:
+		key, rest := readWalChunk(b[1:])
+		if key == nil {
+			return 0
+		}
+		value, rest := readWalChunk(rest)
+		if value == nil {
+			return 0
+		}
+		tree.Set(key, value)
+		return len(b) - len(rest)
+	case walOpDeleteKey:
+		key, rest := readWalChunk(b[1:])
+		if key == nil {
+			return 0
+		}
+		tree.DeleteKey(key)
+		return len(b) - len(rest)
+	case walOpDeletePrefix:
+		prefix, rest := readWalChunk(b[1:])
+		if prefix == nil {
+			return 0
+		}
+		tree.DeletePrefix(prefix)
+		return len(b) - len(rest)
+	case walOpFreeTree:
+		tree.FreeTree()
+		return 1
+	case walOpSetExpiring:
+		key, rest := readWalChunk(b[1:])
+		if key == nil {
+			return 0
+		}
+		value, rest := readWalChunk(rest)
+		if value == nil || len(rest) < 8 {
+			return 0
+		}
+		tree.SetWithExpiry(key, value, walTime(rest))
+		return len(b) - len(rest) + 8
+	case walOpExpireAt:
+		key, rest := readWalChunk(b[1:])
+		if key == nil || len(rest) < 8 {
+			return 0
+		}
+		tree.ExpireAt(key, walTime(rest))
+		return len(b) - len(rest) + 8
+	case walOpSetFenced:
+		// Replaying this with the token raises the fence again, so stale tokens are still rejected after a restart.
+		key, rest := readWalChunk(b[1:])
+		if key == nil {
+			return 0
+		}
+		value, rest := readWalChunk(rest)
+		if value == nil || len(rest) < 16 {
+			return 0
+		}
+		tree.SetIf(key, value, walTime(rest), radix.SetIfFence, nil, binary.LittleEndian.Uint64(rest[8:]))
+		return len(b) - len(rest) + 16
+	default:
+		return 0
+	}
+}
+
+func walSetEntry(key, value []byte) []byte {
+	return packetmaker.New().
+		Byte(walOpSet).
+		Uint32(uint32(len(key)), true).
+		Bytes(key).
+		Uint32(uint32(len(value)), true).
+		Bytes(value).
+		Make()
+}
+
+// Reads a timestamp from the entry. Zero means no time.
+func walTime(b []byte) time.Time {
+	ms := int64(binary.LittleEndian.Uint64(b))
+	if ms == 0 {
+		return time.Time{}
+	}
+	return time.UnixMilli(ms)
+}
+
+// Gets the timestamp which is stored in the log for the time.
+func walTimestamp(t time.Time) uint64 {
+	if t.IsZero() {
+		return 0
+	}
+	return uint64(t.UnixMilli())
+}
+
+func walSetExpiringEntry(key, value []byte, expiresAt time.Time) []byte {
+	return packetmaker.New().
+		Byte(walOpSetExpiring).
+		Uint32(uint32(len(key)), true).
+		Bytes(key).
+		Uint32(uint32(len(value)), true).
+		Bytes(value).
+		Uint64(walTimestamp(expiresAt), true).
+		Make()
+}
+
+func walSetFencedEntry(key, value []byte, expiresAt time.Time, token uint64) []byte {
+	return packetmaker.New().
+		Byte(walOpSetFenced).
+		Uint32(uint32(len(key)), true).
+		Bytes(key).
+		Uint32(uint32(len(value)), true).
+		Bytes(value).
+		Uint64(walTimestamp(expiresAt), true).
+		Uint64(token, true).
+		Make()
+}
+
+func walExpireAtEntry(key []byte, expiresAt time.Time) []byte {
+	return packetmaker.New().
+		Byte(walOpExpireAt).
+		Uint32(uint32(len(key)), true).
+		Bytes(key).
+		Uint64(walTimestamp(expiresAt), true).
+		Make()
+}
+
+func walKeyEntry(op byte, key []byte) []byte {
+	return packetmaker.New().
+		Byte(op).
+		Uint32(uint32(len(key)), true).
+		Bytes(key).
+		Make()
+}
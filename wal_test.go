@@ -0,0 +1,322 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/webscalesoftwareltd/hypercache/radix"
+)
+
+// lookup is used to get the values of the keys specified which are in the tree.
+func lookup(tree radix.RadixTree, keys ...string) map[string]string {
+	m := map[string]string{}
+	for _, k := range keys {
+		value, free := tree.Get([]byte(k))
+		if value != nil {
+			m[k] = string(value)
+		}
+		free()
+	}
+	return m
+}
+
+// replayLog is used to replay the log at the path specified into a new tree.
+func replayLog(t *testing.T, path string) (radix.RadixTree, int) {
+	t.Helper()
+	wal, err := openWriteAheadLog(path, "test", walFsyncNever)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.f.Close()
+	tree := radix.NewRadixTree()
+	t.Cleanup(tree.FreeTree)
+	count, err := wal.replay(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree, count
+}
+
+func TestWalReplay(t *testing.T) {
+	expiresAt := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	tests := []struct {
+		name        string
+		mutate      func(d *database)
+		keys        []string
+		wantEntries int
+		want        map[string]string
+		check       func(t *testing.T, tree radix.RadixTree)
+	}{
+		{
+			name: "sets and deletes",
+			mutate: func(d *database) {
+				d.Set([]byte("a"), []byte("1"))
+				d.Set([]byte("b"), []byte("2"))
+				d.Set([]byte("a"), []byte("3"))
+				d.DeleteKey([]byte("b"))
+
+				// Deleting a key which does not exist changes nothing, so it is not logged.
+				d.DeleteKey([]byte("missing"))
+			},
+			keys:        []string{"a", "b", "missing"},
+			wantEntries: 4,
+			want:        map[string]string{"a": "3"},
+		},
+		{
+			name: "prefix deletes",
+			mutate: func(d *database) {
+				d.Set([]byte("user:1"), []byte("a"))
+				d.Set([]byte("user:2"), []byte("b"))
+				d.Set([]byte("post:1"), []byte("c"))
+				d.DeletePrefix([]byte("user:"))
+			},
+			keys:        []string{"user:1", "user:2", "post:1"},
+			wantEntries: 4,
+			want:        map[string]string{"post:1": "c"},
+		},
+		{
+			name: "frees",
+			mutate: func(d *database) {
+				d.Set([]byte("gone"), []byte("a"))
+				d.FreeTree()
+				d.Set([]byte("after"), []byte("b"))
+			},
+			keys:        []string{"gone", "after"},
+			wantEntries: 3,
+			want:        map[string]string{"after": "b"},
+		},
+		{
+			name: "expiry",
+			mutate: func(d *database) {
+				d.SetWithExpiry([]byte("expiring"), []byte("1"), expiresAt)
+				d.Set([]byte("later"), []byte("2"))
+				d.ExpireAt([]byte("later"), expiresAt)
+				d.SetWithExpiry([]byte("persisted"), []byte("3"), expiresAt)
+				d.Persist([]byte("persisted"))
+				d.ExpireAt([]byte("missing"), expiresAt)
+			},
+			keys:        []string{"expiring", "later", "persisted", "missing"},
+			wantEntries: 5,
+			want:        map[string]string{"expiring": "1", "later": "2", "persisted": "3"},
+			check: func(t *testing.T, tree radix.RadixTree) {
+				for _, k := range []string{"expiring", "later"} {
+					if at, ok := tree.ExpiresAt([]byte(k)); !ok || !at.Equal(expiresAt) {
+						t.Errorf("key %q: got expiry %v (%v), want %v", k, at, ok, expiresAt)
+					}
+				}
+				if at, ok := tree.ExpiresAt([]byte("persisted")); !ok || !at.IsZero() {
+					t.Errorf("persisted key: got expiry %v (%v), want none", at, ok)
+				}
+			},
+		},
+		{
+			name: "conditional sets which fail are not logged",
+			mutate: func(d *database) {
+				_, _ = d.SetIf([]byte("a"), []byte("1"), time.Time{}, radix.SetIfAbsent, nil, 0)
+				_, _ = d.SetIf([]byte("a"), []byte("2"), time.Time{}, radix.SetIfAbsent, nil, 0)
+				_, _ = d.SetIf([]byte("a"), []byte("3"), time.Time{}, radix.SetIfValue, []byte("1"), 0)
+				_, _ = d.SetIf([]byte("b"), []byte("4"), time.Time{}, radix.SetIfExists, nil, 0)
+			},
+			keys:        []string{"a", "b"},
+			wantEntries: 2,
+			want:        map[string]string{"a": "3"},
+		},
+		{
+			name: "increments are logged as sets",
+			mutate: func(d *database) {
+				_, _ = d.Increment([]byte("n"), 5)
+				_, _ = d.Increment([]byte("n"), -2)
+				_, _ = d.IncrementFloat([]byte("f"), 1.5)
+				_, _ = d.Set([]byte("text"), []byte("abc"))
+				_, _ = d.Increment([]byte("text"), 1)
+			},
+			keys:        []string{"n", "f", "text"},
+			wantEntries: 4,
+			want:        map[string]string{"n": "3", "f": "1.5", "text": "abc"},
+		},
+		{
+			name: "fenced sets raise the fence again",
+			mutate: func(d *database) {
+				_, _ = d.SetIf([]byte("fenced"), []byte("1"), time.Time{}, radix.SetIfFence, nil, 10)
+				_, _ = d.SetIf([]byte("fenced"), []byte("2"), time.Time{}, radix.SetIfFence, nil, 9)
+				_, _ = d.SetIf([]byte("reset"), []byte("3"), time.Time{}, radix.SetIfFence, nil, 10)
+				d.DeleteKey([]byte("reset"))
+			},
+			keys:        []string{"fenced", "reset"},
+			wantEntries: 3,
+			want:        map[string]string{"fenced": "1"},
+			check: func(t *testing.T, tree radix.RadixTree) {
+				if tree.SetIf([]byte("fenced"), []byte("4"), time.Time{}, radix.SetIfFence, nil, 9) != 0 {
+					t.Error("a stale token was accepted after replay")
+				}
+				if tree.SetIf([]byte("reset"), []byte("5"), time.Time{}, radix.SetIfFence, nil, 1) == 0 {
+					t.Error("the fence of a deleted key was replayed")
+				}
+			},
+		},
+		{
+			name: "transactions",
+			mutate: func(d *database) {
+				_, _ = d.Set([]byte("old:1"), []byte("x"))
+				_, _, _ = d.Exec(nil, []transactionOp{
+					{kind: txOpGet, key: []byte("old:1")},
+					{kind: txOpSet, key: []byte("a"), value: []byte("1")},
+					{kind: txOpSet, key: []byte("b"), value: []byte("2"), expiresAt: expiresAt},
+					{kind: txOpDeleteKey, key: []byte("a")},
+					{kind: txOpDeletePrefix, key: []byte("old:")},
+				})
+
+				// Transactions which do not run, or only read, are not logged.
+				_, _, _ = d.Exec([]watchedKey{{key: []byte("b")}}, []transactionOp{
+					{kind: txOpSet, key: []byte("skipped"), value: []byte("3")},
+				})
+				_, _, _ = d.Exec(nil, []transactionOp{{kind: txOpGet, key: []byte("b")}})
+			},
+			keys:        []string{"old:1", "a", "b", "skipped"},
+			wantEntries: 5,
+			want:        map[string]string{"b": "2"},
+			check: func(t *testing.T, tree radix.RadixTree) {
+				if at, ok := tree.ExpiresAt([]byte("b")); !ok || !at.Equal(expiresAt) {
+					t.Errorf("got expiry %v (%v), want %v", at, ok, expiresAt)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "db.wal")
+			wal, err := openWriteAheadLog(path, "test", walFsyncNever)
+			if err != nil {
+				t.Fatal(err)
+			}
+			d := &database{RadixTree: radix.NewRadixTree(), wal: wal}
+			tt.mutate(d)
+			_ = wal.f.Close()
+			got := lookup(d.RadixTree, tt.keys...)
+			d.RadixTree.FreeTree()
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %q before replay, want %q", got, tt.want)
+			}
+
+			tree, count := replayLog(t, path)
+			if count != tt.wantEntries {
+				t.Errorf("replayed %d entries, want %d", count, tt.wantEntries)
+			}
+			if got = lookup(tree, tt.keys...); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q after replay, want %q", got, tt.want)
+			}
+			if tt.check != nil {
+				tt.check(t, tree)
+			}
+		})
+	}
+}
+
+func TestWalPartialTail(t *testing.T) {
+	full := append(walSetEntry([]byte("a"), []byte("1")), walSetEntry([]byte("b"), []byte("2"))...)
+	full = append(full, walKeyEntry(walOpDeletePrefix, []byte("z"))...)
+	entry := walSetEntry([]byte("key"), []byte("value"))
+	for name, tail := range map[string][]byte{
+		"unknown op":       {0xff, 1, 2, 3},
+		"op only":          {walOpSet},
+		"short key length": entry[:3],
+		"short key":        entry[:7],
+		"short value":      entry[:14],
+		"short expiry":     walSetExpiringEntry([]byte("k"), []byte("v"), time.Now())[:15],
+		"short prefix":     walKeyEntry(walOpDeletePrefix, []byte("prefix"))[:6],
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "db.wal")
+			if err := os.WriteFile(path, append(append([]byte(nil), full...), tail...), 0o666); err != nil {
+				t.Fatal(err)
+			}
+
+			// The whole entries are replayed and the tail is cut off.
+			if _, count := replayLog(t, path); count != 3 {
+				t.Fatalf("replayed %d entries, want 3", count)
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Size() != int64(len(full)) {
+				t.Fatalf("log is %d bytes after replay, want %d", info.Size(), len(full))
+			}
+
+			// New entries go after the last whole entry, so they are replayed next time.
+			wal, err := openWriteAheadLog(path, "test", walFsyncNever)
+			if err != nil {
+				t.Fatal(err)
+			}
+			d := &database{RadixTree: radix.NewRadixTree(), wal: wal}
+			if _, err = wal.replay(d.RadixTree); err != nil {
+				t.Fatal(err)
+			}
+			d.Set([]byte("c"), []byte("3"))
+			_ = wal.f.Close()
+			d.RadixTree.FreeTree()
+			tree, count := replayLog(t, path)
+			if count != 4 {
+				t.Fatalf("replayed %d entries after a write, want 4", count)
+			}
+			want := map[string]string{"a": "1", "b": "2", "c": "3"}
+			if got := lookup(tree, "a", "b", "c"); !reflect.DeepEqual(got, want) {
+				t.Fatalf("got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestWalSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "db.wal")
+	wal, err := openWriteAheadLog(path, "test", walFsyncNever)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &database{RadixTree: radix.NewRadixTree(), wal: wal}
+	defer d.RadixTree.FreeTree()
+	d.Set([]byte("a"), []byte("1"))
+	d.Set([]byte("b"), []byte("2"))
+
+	// A failed write leaves the log alone.
+	if wal.snapshot(d.RadixTree, func(radix.Snapshot) bool { return false }) {
+		t.Fatal("failed write was reported as successful")
+	}
+	if _, count := replayLog(t, path); count != 2 {
+		t.Fatalf("replayed %d entries after a failed write, want 2", count)
+	}
+
+	// Writes made whilst the snapshot is being written stay in the log, since they are not in the snapshot.
+	rbf := radix.NewRBF(filepath.Join(dir, "db.rbf"), 0)
+	ok := wal.snapshot(d.RadixTree, func(s radix.Snapshot) bool {
+		d.Set([]byte("c"), []byte("3"))
+		return rbf.WriteSnapshot(s)
+	})
+	if !ok {
+		t.Fatal("write failed")
+	}
+	d.Set([]byte("d"), []byte("4"))
+	_ = wal.f.Close()
+
+	loaded := rbf.Load()
+	if loaded == nil {
+		t.Fatal("load failed")
+	}
+	defer loaded.FreeTree()
+	want := map[string]string{"a": "1", "b": "2"}
+	if got := lookup(*loaded, "a", "b", "c", "d"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q in the snapshot, want %q", got, want)
+	}
+	tree, count := replayLog(t, path)
+	if count != 2 {
+		t.Errorf("replayed %d entries after compaction, want 2", count)
+	}
+	want = map[string]string{"c": "3", "d": "4"}
+	if got := lookup(tree, "a", "b", "c", "d"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q from the log, want %q", got, want)
+	}
+}